@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// accessLog writes one line per request in the Apache combined format, with
+// the duration and cache status appended. nil when --access-log is unset.
+var accessLog *accessLogger
+
+type accessLogger struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// openAccessLog opens path for appending; "-" is standard output.
+func openAccessLog(path string) (*accessLogger, error) {
+	if path == "-" {
+		return &accessLogger{out: os.Stdout}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &accessLogger{out: f}, nil
+}
+
+// write logs e as, e.g.:
+//
+//	10.0.0.1 - - [02/May/2024:10:15:04 +0000] "GET /a?b=1 HTTP/1.1" 200 512 "-" "curl/8.5.0" 0.004 HIT
+func (l *accessLogger) write(e *requestLogEvent) {
+	if l == nil {
+		return
+	}
+	size := "-"
+	if e.Bytes > 0 {
+		size = fmt.Sprint(e.Bytes)
+	}
+	line := fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s \"%s\" \"%s\" %.3f %s\n",
+		e.ClientIP, orDash(clfEscape(e.user)), e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		clfEscape(e.Method), clfEscape(e.requestURI), clfEscape(e.proto), e.Status, size,
+		orDash(clfEscape(e.referer)), orDash(clfEscape(e.userAgent)), e.DurationMs/1000, orDash(e.Cache))
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.out, line)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// clfEscape escapes quotes, backslashes and control characters the way
+// Apache does, so every field stays on its line and inside its quotes.
+func clfEscape(s string) string {
+	if !strings.ContainsFunc(s, func(r rune) bool { return r < 0x20 || r == 0x7f || r == '"' || r == '\\' }) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// letsEncryptDirectory is the default ACME directory.
+const letsEncryptDirectory = "https://acme-v02.api.letsencrypt.org/directory"
+
+const (
+	// acmeRenewBefore is how long before expiry the certificate is renewed.
+	acmeRenewBefore = 30 * 24 * time.Hour
+	// acmeRetry is how long to wait after a failed issuance.
+	acmeRetry = time.Hour
+	// acmeTimeout bounds a whole issuance, polling included.
+	acmeTimeout = 5 * time.Minute
+	// acmeALPNProto is negotiated by TLS-ALPN-01 validation connections.
+	acmeALPNProto = "acme-tls/1"
+)
+
+// idPeACMEIdentifier is the certificate extension carrying a TLS-ALPN-01
+// key authorization digest (RFC 8737).
+var idPeACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// acmeManager obtains and renews the listener certificate from an ACME
+// server (RFC 8555), answering HTTP-01 challenges on a plain HTTP port or,
+// without one, TLS-ALPN-01 challenges on the TLS listener itself. The
+// account key and the certificate are kept in dir so restarts don't issue
+// new ones.
+type acmeManager struct {
+	domains   []string
+	email     string
+	directory string
+	dir       string
+	http01    bool // answer HTTP-01 rather than TLS-ALPN-01 challenges
+
+	client *http.Client
+	cert   atomic.Pointer[tls.Certificate]
+
+	// Pending challenges: HTTP-01 key authorizations by token, TLS-ALPN-01
+	// certificates by domain.
+	mu        sync.Mutex
+	httpToken map[string]string
+	alpnCerts map[string]*tls.Certificate
+}
+
+func newACMEManager(domains []string, email, directory, dir string, http01 bool) (*acmeManager, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	m := &acmeManager{
+		domains:   domains,
+		email:     email,
+		directory: directory,
+		dir:       dir,
+		http01:    http01,
+		client:    &http.Client{Timeout: 30 * time.Second},
+		httpToken: map[string]string{},
+		alpnCerts: map[string]*tls.Certificate{},
+	}
+	if cert, err := loadKeyPair(m.certPath(), m.certPath()); err == nil && m.covers(cert.Leaf) {
+		m.cert.Store(&cert)
+		log.Printf("[ACME] Loaded certificate for %v from %s, valid until %s", cert.Leaf.DNSNames, m.certPath(), cert.Leaf.NotAfter.Format("2006-01-02"))
+	}
+	return m, nil
+}
+
+func (m *acmeManager) certPath() string { return filepath.Join(m.dir, "certificate.pem") }
+func (m *acmeManager) keyPath() string  { return filepath.Join(m.dir, "account.key") }
+
+// covers reports whether leaf names every configured domain.
+func (m *acmeManager) covers(leaf *x509.Certificate) bool {
+	if leaf == nil {
+		return false
+	}
+	for _, d := range m.domains {
+		if !slices.Contains(leaf.DNSNames, d) {
+			return false
+		}
+	}
+	return true
+}
+
+// tlsConfig returns the listener configuration, which also answers
+// TLS-ALPN-01 validation handshakes.
+func (m *acmeManager) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: m.getCertificate,
+		NextProtos:     []string{"h2", "http/1.1", acmeALPNProto},
+	}
+}
+
+func (m *acmeManager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if slices.Contains(hello.SupportedProtos, acmeALPNProto) {
+		m.mu.Lock()
+		cert := m.alpnCerts[hello.ServerName]
+		m.mu.Unlock()
+		if cert == nil {
+			return nil, fmt.Errorf("no pending TLS-ALPN-01 challenge for %q", hello.ServerName)
+		}
+		return cert, nil
+	}
+	cert := m.cert.Load()
+	if cert == nil {
+		return nil, errors.New("no certificate obtained yet")
+	}
+	return cert, nil
+}
+
+// httpHandler answers HTTP-01 challenges and redirects every other request
+// to HTTPS on tlsPort.
+func (m *acmeManager) httpHandler(tlsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token, ok := strings.CutPrefix(r.URL.Path, "/.well-known/acme-challenge/"); ok {
+			m.mu.Lock()
+			keyAuth, found := m.httpToken[token]
+			m.mu.Unlock()
+			if !found {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, keyAuth)
+			return
+		}
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if tlsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(tlsPort))
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// run obtains a certificate when there is none or it is due for renewal,
+// checking twice a day.
+func (m *acmeManager) run() {
+	for {
+		next := 12 * time.Hour
+		if cert := m.cert.Load(); cert == nil || time.Until(cert.Leaf.NotAfter) < acmeRenewBefore {
+			if err := m.obtain(); err != nil {
+				logf("error", "[ACME] Could not obtain a certificate for %v, retrying in %s: %v", m.domains, acmeRetry, err)
+				next = acmeRetry
+			}
+		}
+		time.Sleep(next)
+	}
+}
+
+// obtain runs one issuance: account, order, challenges, finalization and
+// download.
+func (m *acmeManager) obtain() error {
+	log.Printf("[ACME] Requesting a certificate for %v from %s", m.domains, m.directory)
+	deadline := time.Now().Add(acmeTimeout)
+	s, err := m.newSession()
+	if err != nil {
+		return err
+	}
+
+	identifiers := make([]map[string]string, len(m.domains))
+	for i, d := range m.domains {
+		identifiers[i] = map[string]string{"type": "dns", "value": d}
+	}
+	var order acmeOrder
+	resp, err := s.post(s.dir.NewOrder, map[string]any{"identifiers": identifiers}, &order)
+	if err != nil {
+		return fmt.Errorf("new order: %w", err)
+	}
+	orderURL := resp.Header.Get("Location")
+
+	for _, authzURL := range order.Authorizations {
+		if err := m.authorize(s, authzURL, deadline); err != nil {
+			return err
+		}
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: m.domains[0]},
+		DNSNames: m.domains,
+	}, certKey)
+	if err != nil {
+		return err
+	}
+	if _, err := s.post(order.Finalize, map[string]string{"csr": b64(csr)}, &order); err != nil {
+		return fmt.Errorf("finalize: %w", err)
+	}
+	for order.Status != "valid" {
+		if order.Status == "invalid" || time.Now().After(deadline) {
+			return fmt.Errorf("order is %s", order.Status)
+		}
+		time.Sleep(time.Second)
+		if _, err := s.post(orderURL, nil, &order); err != nil {
+			return fmt.Errorf("poll order: %w", err)
+		}
+	}
+
+	resp, err = s.post(order.Certificate, nil, nil)
+	if err != nil {
+		return fmt.Errorf("download certificate: %w", err)
+	}
+	chain, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(certKey)
+	if err != nil {
+		return err
+	}
+	data := append(chain, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})...)
+	cert, err := tls.X509KeyPair(data, data)
+	if err == nil {
+		err = parseLeaf(&cert)
+	}
+	if err != nil {
+		return fmt.Errorf("issued certificate: %w", err)
+	}
+	if err := writeFileAtomic(m.certPath(), func(f *os.File) error {
+		_, err := f.Write(data)
+		return err
+	}); err != nil {
+		logf("error", "[ACME] Could not save the certificate to %s: %v", m.certPath(), err)
+	}
+	m.cert.Store(&cert)
+	log.Printf("[ACME] Obtained certificate for %v, valid until %s", cert.Leaf.DNSNames, cert.Leaf.NotAfter.Format("2006-01-02"))
+	return nil
+}
+
+// authorize completes one authorization with the configured challenge type.
+func (m *acmeManager) authorize(s *acmeSession, authzURL string, deadline time.Time) error {
+	var authz acmeAuthorization
+	if _, err := s.post(authzURL, nil, &authz); err != nil {
+		return fmt.Errorf("authorization: %w", err)
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+	want := "tls-alpn-01"
+	if m.http01 {
+		want = "http-01"
+	}
+	i := slices.IndexFunc(authz.Challenges, func(c acmeChallenge) bool { return c.Type == want })
+	if i < 0 {
+		return fmt.Errorf("%s: no %s challenge offered", authz.Identifier.Value, want)
+	}
+	ch := authz.Challenges[i]
+	keyAuth := ch.Token + "." + s.thumbprint
+	domain := authz.Identifier.Value
+
+	m.mu.Lock()
+	if m.http01 {
+		m.httpToken[ch.Token] = keyAuth
+	} else {
+		cert, err := alpnChallengeCert(domain, keyAuth)
+		if err != nil {
+			m.mu.Unlock()
+			return err
+		}
+		m.alpnCerts[domain] = cert
+	}
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.httpToken, ch.Token)
+		delete(m.alpnCerts, domain)
+		m.mu.Unlock()
+	}()
+
+	resp, err := s.post(ch.URL, struct{}{}, nil)
+	if err != nil {
+		return fmt.Errorf("%s: accept challenge: %w", domain, err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	for authz.Status != "valid" {
+		if authz.Status == "invalid" {
+			for _, c := range authz.Challenges {
+				if c.Error != nil {
+					return fmt.Errorf("%s: %s challenge failed: %v", domain, c.Type, c.Error)
+				}
+			}
+			return fmt.Errorf("%s: authorization is invalid", domain)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s: authorization still %s", domain, authz.Status)
+		}
+		time.Sleep(time.Second)
+		if _, err := s.post(authzURL, nil, &authz); err != nil {
+			return fmt.Errorf("%s: poll authorization: %w", domain, err)
+		}
+	}
+	log.Printf("[ACME] Validated %s with %s", domain, want)
+	return nil
+}
+
+// alpnChallengeCert builds the self-signed certificate a TLS-ALPN-01
+// validation expects for domain.
+func alpnChallengeCert(domain, keyAuth string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(keyAuth))
+	ext, err := asn1.Marshal(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:    big.NewInt(1),
+		Subject:         pkix.Name{CommonName: domain},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(24 * time.Hour),
+		DNSNames:        []string{domain},
+		ExtraExtensions: []pkix.Extension{{Id: idPeACMEIdentifier, Critical: true, Value: ext}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// accountKey loads the account key from dir, creating it on first use.
+func (m *acmeManager) accountKey() (*ecdsa.PrivateKey, error) {
+	if data, err := os.ReadFile(m.keyPath()); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no PEM key", m.keyPath())
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(m.keyPath(), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// acmeDirectory lists the server's endpoints.
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+type acmeOrder struct {
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+}
+
+type acmeAuthorization struct {
+	Status     string                 `json:"status"`
+	Identifier struct{ Value string } `json:"identifier"`
+	Challenges []acmeChallenge        `json:"challenges"`
+}
+
+type acmeChallenge struct {
+	Type  string       `json:"type"`
+	URL   string       `json:"url"`
+	Token string       `json:"token"`
+	Error *acmeProblem `json:"error"`
+}
+
+// acmeProblem is an RFC 7807 error document.
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+}
+
+func (p *acmeProblem) Error() string { return p.Detail + " (" + p.Type + ")" }
+
+// acmeSession signs requests with the account key, tracking the replay
+// nonce the server hands out with every response.
+type acmeSession struct {
+	m          *acmeManager
+	dir        acmeDirectory
+	key        *ecdsa.PrivateKey
+	jwk        map[string]string
+	thumbprint string
+	kid        string // account URL, once registered
+	nonce      string
+}
+
+// newSession fetches the directory and registers the account, which finds
+// the existing one when the key is already known to the server.
+func (m *acmeManager) newSession() (*acmeSession, error) {
+	key, err := m.accountKey()
+	if err != nil {
+		return nil, fmt.Errorf("account key: %w", err)
+	}
+	s := &acmeSession{m: m, key: key}
+	s.jwk = map[string]string{
+		"crv": "P-256",
+		"kty": "EC",
+		"x":   b64(key.X.FillBytes(make([]byte, 32))),
+		"y":   b64(key.Y.FillBytes(make([]byte, 32))),
+	}
+	// json.Marshal sorts map keys, which is the order the thumbprint needs
+	jwk, _ := json.Marshal(s.jwk)
+	sum := sha256.Sum256(jwk)
+	s.thumbprint = b64(sum[:])
+
+	resp, err := m.client.Get(m.directory)
+	if err != nil {
+		return nil, fmt.Errorf("directory: %w", err)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&s.dir)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("directory: %w", err)
+	}
+
+	account := map[string]any{"termsOfServiceAgreed": true}
+	if m.email != "" {
+		account["contact"] = []string{"mailto:" + m.email}
+	}
+	resp, err = s.post(s.dir.NewAccount, account, nil)
+	if err != nil {
+		return nil, fmt.Errorf("account: %w", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	s.kid = resp.Header.Get("Location")
+	return s, nil
+}
+
+// post sends a JWS-signed request and decodes the JSON answer into out. A nil
+// payload makes a POST-as-GET. The response is returned with its body
+// unread when out is nil.
+func (s *acmeSession) post(url string, payload any, out any) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := s.postOnce(url, payload)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode >= 400 {
+			prob := &acmeProblem{}
+			json.NewDecoder(resp.Body).Decode(prob)
+			resp.Body.Close()
+			if prob.Type == "urn:ietf:params:acme:error:badNonce" && attempt < 3 {
+				continue
+			}
+			if prob.Detail == "" {
+				prob.Detail = resp.Status
+			}
+			return nil, prob
+		}
+		if out != nil {
+			err = json.NewDecoder(resp.Body).Decode(out)
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+}
+
+func (s *acmeSession) postOnce(url string, payload any) (*http.Response, error) {
+	if s.nonce == "" {
+		resp, err := s.m.client.Head(s.dir.NewNonce)
+		if err != nil {
+			return nil, fmt.Errorf("nonce: %w", err)
+		}
+		resp.Body.Close()
+		s.nonce = resp.Header.Get("Replay-Nonce")
+	}
+	protected := map[string]any{"alg": "ES256", "nonce": s.nonce, "url": url}
+	if s.kid != "" {
+		protected["kid"] = s.kid
+	} else {
+		protected["jwk"] = s.jwk
+	}
+	header, _ := json.Marshal(protected)
+	var body []byte
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+	signingInput := b64(header) + "." + b64(body)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, sig, err := ecdsa.Sign(rand.Reader, s.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	signature := append(r.FillBytes(make([]byte, 32)), sig.FillBytes(make([]byte, 32))...)
+	jws, _ := json.Marshal(map[string]string{"protected": b64(header), "payload": b64(body), "signature": b64(signature)})
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(jws))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/jose+json")
+	resp, err := s.m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	s.nonce = resp.Header.Get("Replay-Nonce")
+	return resp, nil
+}
+
+func b64(data []byte) string { return base64.RawURLEncoding.EncodeToString(data) }
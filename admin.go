@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// adminToken protects the /__admin/ endpoints, which are disabled when it is
+// empty. Clients authenticate with "Authorization: Bearer <token>".
+var adminToken string
+
+// cacheDiffPath is where the entry diff is served besides /__admin/diff.
+const cacheDiffPath = "/__cache/diff"
+
+// withAdminAPI serves the admin endpoints under /__admin/, and cacheDiffPath,
+// and passes every other request to the proxy handler.
+func withAdminAPI(proxyHandler http.Handler) http.Handler {
+	admin := requireAdminToken(newAdminMux(proxyHandler))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/__admin/") && r.URL.Path != cacheDiffPath {
+			proxyHandler.ServeHTTP(w, r)
+			return
+		}
+		admin.ServeHTTP(w, r)
+	})
+}
+
+// serveAdminPort serves the admin API alone on its own management listener.
+// Without --admin-token it is served unauthenticated, for ports that are only
+// reachable from the operators' network.
+func serveAdminPort(port int, proxyHandler http.Handler) {
+	var admin http.Handler = newAdminMux(proxyHandler)
+	if adminToken != "" {
+		admin = requireAdminToken(admin)
+	} else {
+		logf("warn", "[Admin] Serving the admin API on :%d without authentication", port)
+	}
+	log.Printf("[Admin] Management listener on :%d", port)
+	fatalf("%v", http.ListenAndServe(fmt.Sprintf(":%d", port), withHealthEndpoints(admin)))
+}
+
+func newAdminMux(proxyHandler http.Handler) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /__admin/publish", publishHandler(proxyHandler))
+	mux.HandleFunc("POST /__admin/warm", warmHandler(proxyHandler))
+	mux.HandleFunc("POST /__admin/refresh", refreshHandler(proxyHandler))
+	mux.HandleFunc("POST /__admin/purge", purgeHandler(proxyHandler))
+	mux.HandleFunc("GET /__admin/entry", entryHandler)
+	mux.HandleFunc("GET /__admin/diff", diffHandler)
+	mux.HandleFunc("GET "+cacheDiffPath, diffHandler)
+	mux.HandleFunc("GET /__admin/versions", versionsHandler)
+	mux.HandleFunc("POST /__admin/versions/rollback", rollbackHandler)
+	mux.HandleFunc("GET /__admin/generation", generationHandler)
+	mux.HandleFunc("POST /__admin/generation", generationHandler)
+	mux.HandleFunc("GET /__admin/namespaces", namespacesHandler)
+	mux.HandleFunc("GET /__admin/pools", poolsHandler)
+	mux.HandleFunc("GET /__admin/store", storeHandler)
+	mux.HandleFunc("GET /__admin/peer", peerEntryHandler)
+	mux.HandleFunc("GET /__admin/keys", keysHandler)
+	mux.HandleFunc("GET /__admin/dump", dumpHandler)
+	mux.HandleFunc("GET /__admin/shadow", shadowHandler)
+	mux.HandleFunc("GET /__admin/synthetic", syntheticHandler)
+	mux.HandleFunc("GET /__admin/stats/sizes", sizeStatsHandler)
+	mux.HandleFunc("GET /__admin/logs", recentLogsHandler)
+	mux.HandleFunc("GET /__admin/logs/stream", logStreamHandler)
+	mux.HandleFunc("GET /__admin/samples", samplesHandler)
+	mux.HandleFunc("DELETE /__admin/samples", samplesHandler)
+	mux.HandleFunc("POST /__admin/namespaces/{name}/clear", namespaceClearHandler)
+	mux.HandleFunc("GET /__admin/stats", statsHandler)
+	mux.HandleFunc("GET /__admin/config", configHandler)
+	mux.HandleFunc("POST /__admin/reload", reloadHandler)
+	mux.HandleFunc("GET /__admin/features", featuresHandler)
+	mux.HandleFunc("GET /__admin/metrics", metricsHandler)
+	// Only reachable on the management port, where nothing is proxied
+	mux.HandleFunc("GET /metrics", metricsHandler)
+	return mux
+}
+
+func requireAdminToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			logf("warn", "[Admin] Rejected unauthenticated request %s %s", r.Method, r.URL.Path)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// startedAt is reported as the uptime in GET /__admin/stats.
+var startedAt = time.Now()
+
+// statsHandler summarizes the cache: store statistics, evictions and the
+// current generation.
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	cacheMutex.Lock()
+	evictions := entryEvictions
+	cacheMutex.Unlock()
+	stores := storeStats()
+	stats := map[string]any{
+		"uptime_seconds": int64(time.Since(startedAt).Seconds()),
+		"generation":     cacheGeneration.Load(),
+		"evictions":      evictions,
+		"stores":         stores,
+	}
+	if len(tenants) > 0 {
+		stats["tenants"] = tenantStats()
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// configHandler returns the effective value of every flag. Secrets are
+// redacted.
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	config := map[string]string{}
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if value != "" && isSecretFlag(f.Name) {
+			value = "REDACTED"
+		}
+		if f.Name == "origin-header" {
+			value = redactOriginHeaders(*f.Value.(*stringList))
+		}
+		config[f.Name] = value
+	})
+	writeJSON(w, http.StatusOK, config)
+}
+
+func isSecretFlag(name string) bool {
+	for _, s := range []string{"token", "password", "secret"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactOriginHeaders hides the values of --origin-header entries, which
+// often carry internal tokens. References to the environment are shown.
+func redactOriginHeaders(specs stringList) string {
+	redacted := make(stringList, len(specs))
+	for i, spec := range specs {
+		host, header, _ := strings.Cut(spec, "=")
+		name, value, _ := strings.Cut(header, ":")
+		if !strings.HasPrefix(strings.TrimSpace(value), "$") {
+			value = "REDACTED"
+		}
+		redacted[i] = host + "=" + name + ":" + value
+	}
+	return redacted.String()
+}
+
+// entryInfo describes a cached entry without its body.
+type entryInfo struct {
+	Key     string      `json:"key"`
+	Status  int         `json:"status"`
+	Size    int64       `json:"size"`
+	Stored  time.Time   `json:"stored"`
+	Backend string      `json:"backend"`
+	Headers http.Header `json:"headers,omitempty"`
+}
+
+func newEntryInfo(key string, c *CachedResponse) entryInfo {
+	return entryInfo{Key: key, Status: c.StatusCode, Size: c.size(), Stored: c.Timestamp, Backend: c.Backend}
+}
+
+// entryHandler shows the metadata of the entry named by the key query parameter.
+func entryHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	c, found := lookupEntry(key)
+	if !found {
+		http.Error(w, "no such entry", http.StatusNotFound)
+		return
+	}
+	info := newEntryInfo(key, c)
+	info.Headers = c.Headers
+	writeJSON(w, http.StatusOK, info)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logf("warn", "[Admin] Failed to write response: %v", err)
+	}
+}
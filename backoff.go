@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxRetryAfter caps how long a backend is paused for, whatever it asks for.
+const maxRetryAfter = time.Hour
+
+// paused reports whether the backend asked to be left alone with Retry-After.
+// Only clients' own requests reach a paused backend; refreshes, prefetches,
+// shadow revalidation and connection prewarming wait for the window to pass.
+func (b *backend) paused() bool {
+	return time.Now().UnixNano() < b.pausedUntil.Load()
+}
+
+// parseRetryAfter accepts delay-seconds or an HTTP-date.
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return t.Sub(now), true
+	}
+	return 0, false
+}
+
+// noteRetryAfter pauses b when it sheds load with 429 or 503 and Retry-After.
+func noteRetryAfter(b *backend, resp *http.Response) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return
+	}
+	now := time.Now()
+	d, ok := parseRetryAfter(resp.Header.Get("Retry-After"), now)
+	if !ok || d <= 0 {
+		return
+	}
+	d = min(d, maxRetryAfter)
+	until := now.Add(d).UnixNano()
+	if prev := b.pausedUntil.Load(); until > prev && b.pausedUntil.CompareAndSwap(prev, until) {
+		logf("warn", "[Backoff] %s answered %d, pausing background traffic for %s", b.url, resp.StatusCode, d)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// bypassHeader and bypassToken let operators force a request past the cache:
+// a request carrying the header with the secret token is fetched from the
+// origin and refreshes the stored entry. Disabled while the token is empty.
+var (
+	bypassHeader = "X-Bypass-Cache"
+	bypassToken  string
+)
+
+// checkBypass strips the bypass header, so the token never reaches the
+// origin, and reports whether it carried the right token.
+func checkBypass(r *http.Request) bool {
+	if bypassToken == "" {
+		return false
+	}
+	v := r.Header.Get(bypassHeader)
+	if v == "" {
+		return false
+	}
+	r.Header.Del(bypassHeader)
+	if subtle.ConstantTimeCompare([]byte(v), []byte(bypassToken)) != 1 {
+		logf("warn", "[Bypass] Ignoring %s with a wrong token from %s", bypassHeader, clientIP(r))
+		return false
+	}
+	return true
+}
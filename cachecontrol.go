@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheControl holds parsed Cache-Control directives, keyed by lower-cased
+// name. Directives without an argument map to "".
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, line := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(line, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				cc[name] = strings.Trim(strings.TrimSpace(value), `"`)
+			}
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+// seconds returns a delta-seconds directive such as max-age. Malformed values
+// count as zero, which errs on the side of not serving stale content.
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	v, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, true
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// freshnessLifetime returns how long a response may be served from a shared
+// cache (RFC 9111 §4.2.1), minus the Age it already had when it arrived. ok is
+// false when the origin gave no explicit lifetime.
+func freshnessLifetime(h http.Header) (lifetime time.Duration, ok bool) {
+	cc := parseCacheControl(h)
+	if lifetime, ok = cc.seconds("s-maxage"); !ok {
+		lifetime, ok = cc.seconds("max-age")
+	}
+	if !ok && h.Get("Expires") != "" {
+		ok = true
+		// An invalid Expires date means already expired
+		if expires, err := http.ParseTime(h.Get("Expires")); err == nil {
+			date, err := http.ParseTime(h.Get("Date"))
+			if err != nil {
+				date = time.Now()
+			}
+			lifetime = expires.Sub(date)
+		}
+	}
+	if !ok {
+		return 0, false
+	}
+	if age, err := strconv.ParseInt(h.Get("Age"), 10, 64); err == nil && age > 0 {
+		lifetime -= time.Duration(age) * time.Second
+	}
+	return max(lifetime, 0), true
+}
+
+// responseStorable applies the origin's Cache-Control response directives,
+// returning the reason when the response must not be stored. A no-cache
+// response is stored only with a validator, since every reuse has to be
+// confirmed by the origin (see revalidateOnReuse).
+func responseStorable(resp *http.Response) (bool, string) {
+	cc := parseCacheControl(resp.Header)
+	switch {
+	case cc.has("no-store"):
+		return false, "no-store"
+	case cc.has("private"):
+		return false, "private response in a shared cache"
+	case cc.has("no-cache") && resp.Header.Get("ETag") == "" && resp.Header.Get("Last-Modified") == "":
+		return false, "no-cache without a validator can never be reused"
+	case cc.has("no-cache"):
+		return true, ""
+	}
+	if lifetime, ok := freshnessLifetime(resp.Header); ok && lifetime <= 0 {
+		return false, "already stale"
+	}
+	return true, ""
+}
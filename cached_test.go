@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestBodyAllowed(t *testing.T) {
+	tests := []struct {
+		status int
+		want   bool
+	}{
+		{100, false},
+		{103, false},
+		{200, true},
+		{203, true},
+		{204, false},
+		{206, true},
+		{301, true},
+		{304, false},
+		{404, true},
+		{503, true},
+	}
+	for _, tt := range tests {
+		if got := bodyAllowed(tt.status); got != tt.want {
+			t.Errorf("bodyAllowed(%d) = %v, want %v", tt.status, got, tt.want)
+		}
+	}
+}
+
+// TestWriteCached replays stored entries over a real server and checks the
+// status, Content-Length and body each combination of method, status and
+// body reaches the client with.
+func TestWriteCached(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		key         string
+		status      int
+		body        string
+		stored      http.Header // on top of an ETag
+		ifNoneMatch string
+
+		wantStatus int
+		wantLength string // "" means no Content-Length header
+		wantBody   string
+	}{
+		{"GET 200", "GET", "GET:/x?", 200, "hello", nil, "", 200, "5", "hello"},
+		{"GET 200 zero-length", "GET", "GET:/x?", 200, "", nil, "", 200, "0", ""},
+		{"GET 200 with stale stored length", "GET", "GET:/x?", 200, "hello", http.Header{"Content-Length": {"99"}}, "", 200, "5", "hello"},
+		{"HEAD 200 from a GET entry", "HEAD", "GET:/x?", 200, "hello", nil, "", 200, "5", ""},
+		{"HEAD 200 from a zero-length GET entry", "HEAD", "GET:/x?", 200, "", nil, "", 200, "0", ""},
+		{"HEAD 200 from a HEAD entry", "HEAD", "HEAD:/x?", 200, "", http.Header{"Content-Length": {"1234"}}, "", 200, "1234", ""},
+		{"GET 204", "GET", "GET:/x?", 204, "", http.Header{"Content-Length": {"0"}}, "", 204, "", ""},
+		{"HEAD 204", "HEAD", "GET:/x?", 204, "", nil, "", 204, "", ""},
+		{"GET 304", "GET", "GET:/x?", 304, "", http.Header{"Content-Length": {"5"}}, "", 304, "", ""},
+		{"HEAD 304", "HEAD", "GET:/x?", 304, "", nil, "", 304, "", ""},
+		{"GET 200 revalidated by the client", "GET", "GET:/x?", 200, "hello", http.Header{"Content-Length": {"5"}}, `"v1"`, 304, "", ""},
+		{"HEAD 200 revalidated by the client", "HEAD", "GET:/x?", 200, "hello", nil, `W/"v1"`, 304, "", ""},
+		{"GET 200 with another ETag", "GET", "GET:/x?", 200, "hello", nil, `"v2"`, 200, "5", "hello"},
+		{"GET 404", "GET", "GET:/x?", 404, "gone", nil, "", 404, "4", "gone"},
+		{"GET 404 ignores If-None-Match", "GET", "GET:/x?", 404, "gone", nil, `"v1"`, 404, "4", "gone"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := &CachedResponse{
+				Response:   []byte(tt.body),
+				StatusCode: tt.status,
+				Headers:    http.Header{"Etag": {`"v1"`}, "Connection": {"close"}},
+			}
+			for k, vv := range tt.stored {
+				entry.Headers[k] = vv
+			}
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				writeCached(w, r, tt.key, entry, "HIT")
+			}))
+			defer srv.Close()
+
+			req, _ := http.NewRequest(tt.method, srv.URL+"/x", nil)
+			if tt.ifNoneMatch != "" {
+				req.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			length, sent := resp.Header["Content-Length"]
+			switch {
+			case tt.wantLength == "" && sent:
+				t.Errorf("Content-Length = %q, want none", length)
+			case tt.wantLength != "" && (!sent || length[0] != tt.wantLength):
+				t.Errorf("Content-Length = %q, want %q", length, tt.wantLength)
+			}
+			if string(body) != tt.wantBody {
+				t.Errorf("body = %q, want %q", body, tt.wantBody)
+			}
+			if got := resp.Header.Get("X-Cache"); got != "HIT" {
+				t.Errorf("X-Cache = %q, want HIT", got)
+			}
+			if tt.wantStatus == http.StatusOK && tt.method == http.MethodGet {
+				if n, _ := strconv.Atoi(length[0]); n != len(body) {
+					t.Errorf("Content-Length %d describes %d body bytes", n, len(body))
+				}
+			}
+		})
+	}
+}
+
+// With the default --origin-compression, a client that doesn't accept gzip
+// gets the proxy's own gzip decoded as a plain 200 it can revalidate, on the
+// miss and on the hit.
+func TestGzipDecodedForPlainClient(t *testing.T) {
+	originCompression = true
+	defer func() { originCompression = false }()
+	srv := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			t.Errorf("origin asked for %q, want gzip", r.Header.Get("Accept-Encoding"))
+		}
+		var body bytes.Buffer
+		zw := gzip.NewWriter(&body)
+		io.WriteString(zw, "hello")
+		zw.Close()
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(body.Bytes())
+	}))
+	for _, want := range []string{"MISS", "HIT"} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/x", nil)
+		req.Header.Set("Accept-Encoding", "identity")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "hello" || resp.Header.Get("Content-Encoding") != "" {
+			t.Errorf("%s: got %d %q with Content-Encoding %q, want 200 \"hello\" decoded", want, resp.StatusCode, body, resp.Header.Get("Content-Encoding"))
+		}
+		if got := resp.Header.Get("ETag"); got != `W/"v1"` {
+			t.Errorf("%s: ETag = %q, want W/\"v1\"", want, got)
+		}
+		if got := resp.Header.Get("X-Cache"); got != want {
+			t.Errorf("X-Cache = %q, want %s", got, want)
+		}
+	}
+}
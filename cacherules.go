@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// cacheRule overrides the caching policy of a route.
+type cacheRule struct {
+	pattern pathPattern
+	ttl     time.Duration // lifetime when the origin gives none; 0 keeps --cache-ttl
+	noCache bool          // bypass the cache entirely
+}
+
+var cacheRules []cacheRule
+
+// parseCacheRule parses a route pattern followed by options, e.g.
+// "/static/* ttl=24h" or "/admin/* no-cache".
+func parseCacheRule(spec string) (cacheRule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) < 2 {
+		return cacheRule{}, fmt.Errorf("invalid cache rule %q (want PATTERN ttl=DURATION or PATTERN no-cache)", spec)
+	}
+	p, err := parsePathPattern(fields[0])
+	if err != nil {
+		return cacheRule{}, err
+	}
+	rule := cacheRule{pattern: p}
+	for _, opt := range fields[1:] {
+		switch name, value, _ := strings.Cut(opt, "="); name {
+		case "ttl":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return cacheRule{}, fmt.Errorf("cache rule %q: invalid ttl %q", spec, value)
+			}
+			rule.ttl = d
+		case "no-cache":
+			rule.noCache = true
+		default:
+			return cacheRule{}, fmt.Errorf("cache rule %q: unknown option %q", spec, opt)
+		}
+	}
+	if rule.noCache && rule.ttl > 0 {
+		return cacheRule{}, fmt.Errorf("cache rule %q: ttl has no effect with no-cache", spec)
+	}
+	return rule, nil
+}
+
+// cacheRuleFor returns the first rule matching urlPath.
+func cacheRuleFor(urlPath string) (cacheRule, bool) {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	for _, rule := range cacheRules {
+		if rule.pattern.match(urlPath) {
+			return rule, true
+		}
+	}
+	return cacheRule{}, false
+}
+
+// routeCacheable reports whether requests for urlPath may be served from and
+// stored in the cache.
+func routeCacheable(urlPath string) bool {
+	rule, _ := cacheRuleFor(urlPath)
+	return !rule.noCache
+}
+
+// storedLifetime returns the freshness lifetime to store an entry with: the
+// ttl of a matching --ttl-schedule, else the origin's, else the ttl of its
+// route's rule, else 0 for --cache-ttl.
+func storedLifetime(key string, h http.Header) time.Duration {
+	if ttl, ok := scheduledTTLFor(cacheKeyPath(key), time.Now()); ok {
+		return ttl
+	}
+	if lifetime, ok := freshnessLifetime(h); ok {
+		return lifetime
+	}
+	rule, _ := cacheRuleFor(cacheKeyPath(key))
+	return rule.ttl
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// originCompression makes cacheable requests ask the origin for gzip whatever
+// the client sent, so entries are fetched and stored compressed. Clients that
+// don't accept gzip get the body decoded on the way out.
+var originCompression bool
+
+// negotiateOriginEncoding replaces the client's Accept-Encoding with gzip for
+// the cache lookup and the origin request, keeping the client's value in the
+// request context. Range requests keep theirs, since the ranges index into
+// whichever representation the client negotiated.
+func negotiateOriginEncoding(r *http.Request) *http.Request {
+	if !originCompression || r.Header.Get("Range") != "" {
+		return r
+	}
+	r = r.WithContext(context.WithValue(r.Context(), clientEncodingKey, r.Header.Get("Accept-Encoding")))
+	r.Header.Set("Accept-Encoding", "gzip")
+	return r
+}
+
+// clientAcceptsGzip reports whether the client's Accept-Encoding allows gzip.
+// A missing header is taken to mean identity only, as most clients that send
+// none cannot decode anything else.
+func clientAcceptsGzip(r *http.Request) bool {
+	accept, ok := r.Context().Value(clientEncodingKey).(string)
+	if !ok {
+		accept = r.Header.Get("Accept-Encoding")
+	}
+	gzipQ, starQ := -1.0, -1.0
+	for _, part := range strings.Split(accept, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(coding)) {
+		case "gzip", "x-gzip":
+			gzipQ = q
+		case "*":
+			starQ = q
+		}
+	}
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return starQ > 0
+}
+
+func isGzipEncoded(h http.Header) bool {
+	enc := strings.ToLower(strings.TrimSpace(h.Get("Content-Encoding")))
+	return enc == "gzip" || enc == "x-gzip"
+}
+
+func gunzip(body []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// decodeForClient returns the body to send for a stored or fetched
+// response, decoding gzip for clients that can't accept it. Undoing a coding
+// the proxy asked for itself is not a transformation: the decoded response
+// only drops Content-Encoding, and its ETag becomes weak, since it still
+// names the same content but no longer the same bytes. Responses the proxy
+// compressed for itself advertise Vary: Accept-Encoding so downstream caches
+// keep both forms apart. Bodies the origin marked no-transform are always
+// sent in their stored coding.
+func decodeForClient(r *http.Request, h http.Header, body []byte) ([]byte, error) {
+	if !originCompression || !isGzipEncoded(h) || !mayTransform(h) {
+		return body, nil
+	}
+	addVary(h, "Accept-Encoding")
+	if clientAcceptsGzip(r) {
+		return body, nil
+	}
+	decoded, err := gunzip(body)
+	if err != nil {
+		return nil, err
+	}
+	h.Del("Content-Encoding")
+	h.Del("Content-MD5")
+	if etag := h.Get("ETag"); etag != "" {
+		h.Set("ETag", weakETag(etag))
+	}
+	return decoded, nil
+}
+
+// addVary adds name to the Vary header unless it is already listed.
+func addVary(h http.Header, name string) {
+	names, star := parseVary(h)
+	if star {
+		return
+	}
+	for _, n := range names {
+		if n == http.CanonicalHeaderKey(name) {
+			return
+		}
+	}
+	h.Add("Vary", name)
+}
+
+// decodeOriginResponse decodes a response on its way from the origin to a
+// client that can't accept its gzip encoding, after it has been stored.
+func decodeOriginResponse(resp *http.Response) {
+	if !originCompression || !isGzipEncoded(resp.Header) || !mayTransform(resp.Header) {
+		return
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return
+	}
+	if decoded, err := decodeForClient(resp.Request, resp.Header, body); err != nil {
+		logf("warn", "[Compression] Could not decode response for %s, sending it as is: %v", resp.Request.URL.String(), err)
+	} else {
+		body = decoded
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+// identityBody returns a body without its content coding, for features that
+// inspect payloads. ok is false for codings the proxy cannot decode.
+func identityBody(h http.Header, body []byte) ([]byte, bool) {
+	switch {
+	case isGzipEncoded(h):
+		decoded, err := gunzip(body)
+		return decoded, err == nil
+	case h.Get("Content-Encoding") == "", strings.EqualFold(h.Get("Content-Encoding"), "identity"):
+		return body, true
+	}
+	return nil, false
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// configOption is one setting of a configuration file: a flag name with the
+// values to set it to, in order (several for repeatable flags).
+type configOption struct {
+	name   string
+	values []string
+	line   int
+}
+
+// loadConfigFile sets the flags named in a YAML or TOML file, except those
+// given on the command line, which take precedence. Keys are flag names,
+// with _ accepted for -; lists set repeatable flags once per item. It returns
+// the options read, keyed by flag name.
+func loadConfigFile(fs *flag.FlagSet, path string) (map[string][]string, error) {
+	opts, err := readConfigFile(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	explicit := explicitFlags(fs)
+	values := map[string][]string{}
+	for _, opt := range opts {
+		values[opt.name] = append(values[opt.name], opt.values...)
+		if explicit[opt.name] {
+			continue
+		}
+		for _, v := range opt.values {
+			if err := fs.Set(opt.name, v); err != nil {
+				return nil, fmt.Errorf("%s: line %d: invalid %s: %v", path, opt.line, opt.name, err)
+			}
+		}
+	}
+	return values, nil
+}
+
+// readConfigFile parses a YAML or TOML file into options named after the
+// flags of fs.
+func readConfigFile(fs *flag.FlagSet, path string) ([]configOption, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var opts []configOption
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		opts, err = parseYAMLConfig(string(data))
+	case ".toml":
+		opts, err = parseTOMLConfig(string(data))
+	default:
+		return nil, fmt.Errorf("%s: unknown format %q (want .yaml, .yml or .toml)", path, ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i, opt := range opts {
+		name := strings.ReplaceAll(opt.name, "_", "-")
+		if name == "config" || fs.Lookup(name) == nil {
+			return nil, fmt.Errorf("%s: line %d: unknown option %q", path, opt.line, opt.name)
+		}
+		opts[i].name = name
+	}
+	return opts, nil
+}
+
+// explicitFlags returns the names of the flags given on the command line.
+func explicitFlags(fs *flag.FlagSet) map[string]bool {
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	return explicit
+}
+
+// parseYAMLConfig reads the flat subset of YAML a flag set maps to: top-level
+// "key: value" pairs, where a value is a scalar, an inline [a, b] list or a
+// block list of "- item" lines.
+func parseYAMLConfig(data string) ([]configOption, error) {
+	var opts []configOption
+	var list *configOption // the key whose block list is being read
+	for i, raw := range strings.Split(data, "\n") {
+		n := i + 1
+		line := strings.TrimRight(stripComment(raw), " \t\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' || trimmed[0] == '-' {
+			item, ok := strings.CutPrefix(trimmed, "-")
+			if !ok || list == nil {
+				return nil, fmt.Errorf("line %d: nested mappings are not supported; keys must be top-level flag names", n)
+			}
+			v, err := parseConfigScalar(strings.TrimSpace(item))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			list.values = append(list.values, v)
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("line %d: want \"key: value\"", n)
+		}
+		opt := configOption{name: strings.TrimSpace(key), line: n}
+		value = strings.TrimSpace(value)
+		list = nil
+		if value == "" {
+			opts = append(opts, opt)
+			list = &opts[len(opts)-1]
+			continue
+		}
+		values, err := parseConfigValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		opt.values = values
+		opts = append(opts, opt)
+	}
+	for _, opt := range opts {
+		if len(opt.values) == 0 {
+			return nil, fmt.Errorf("line %d: %s has no value", opt.line, opt.name)
+		}
+	}
+	return opts, nil
+}
+
+// parseTOMLConfig reads the flat subset of TOML a flag set maps to:
+// "key = value" pairs outside any table, where a value is a string, number,
+// boolean or array, which may span lines.
+func parseTOMLConfig(data string) ([]configOption, error) {
+	var opts []configOption
+	lines := strings.Split(data, "\n")
+	for i := 0; i < len(lines); i++ {
+		n := i + 1
+		line := strings.TrimSpace(stripComment(lines[i]))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			return nil, fmt.Errorf("line %d: tables are not supported; keys must be top-level flag names", n)
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("line %d: want \"key = value\"", n)
+		}
+		value = strings.TrimSpace(value)
+		// Arrays may continue over the following lines
+		for strings.HasPrefix(value, "[") && !strings.HasSuffix(value, "]") && i+1 < len(lines) {
+			i++
+			value += " " + strings.TrimSpace(stripComment(lines[i]))
+		}
+		values, err := parseConfigValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		opts = append(opts, configOption{name: strings.Trim(strings.TrimSpace(key), `"`), values: values, line: n})
+	}
+	return opts, nil
+}
+
+// parseConfigValue parses a scalar or an inline [a, b] list.
+func parseConfigValue(v string) ([]string, error) {
+	inner, ok := strings.CutPrefix(v, "[")
+	if !ok {
+		s, err := parseConfigScalar(v)
+		return []string{s}, err
+	}
+	inner, ok = strings.CutSuffix(inner, "]")
+	if !ok {
+		return nil, fmt.Errorf("unterminated list %q", v)
+	}
+	var values []string
+	for _, item := range splitConfigList(inner) {
+		if item = strings.TrimSpace(item); item == "" {
+			continue // trailing comma
+		}
+		s, err := parseConfigScalar(item)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, s)
+	}
+	return values, nil
+}
+
+// parseConfigScalar unquotes "double" and 'single' quoted strings; anything
+// else is taken literally, e.g. 8080, 5m or true.
+func parseConfigScalar(v string) (string, error) {
+	switch {
+	case len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"':
+		s, err := strconv.Unquote(v)
+		if err != nil {
+			return "", fmt.Errorf("invalid string %s", v)
+		}
+		return s, nil
+	case len(v) >= 2 && v[0] == '\'' && v[len(v)-1] == '\'':
+		return strings.ReplaceAll(v[1:len(v)-1], "''", "'"), nil
+	case strings.HasPrefix(v, "[") || strings.HasPrefix(v, "{"):
+		return "", fmt.Errorf("nested value %s is not supported", v)
+	}
+	return v, nil
+}
+
+// splitConfigList splits on the commas outside quotes.
+func splitConfigList(s string) []string {
+	var items []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' || c == '\'' && quote == '\'' && strings.HasPrefix(s[i+1:], "'") {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && opensQuote(s, i):
+			quote = c
+		case c == ',':
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, s[start:])
+}
+
+// opensQuote reports whether the quote at s[i] starts a quoted string: it has
+// to begin a key, value or list item, so apostrophes within unquoted text
+// such as "don't" are taken literally.
+func opensQuote(s string, i int) bool {
+	prev := strings.TrimRight(s[:i], " \t")
+	return prev == "" || strings.ContainsRune(":=[,-", rune(prev[len(prev)-1]))
+}
+
+// stripComment drops a # comment that is outside quotes and starts the line
+// or follows whitespace, so values such as URLs with fragments survive.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' || c == '\'' && quote == '\'' && strings.HasPrefix(line[i+1:], "'") {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && opensQuote(line, i):
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStripComment(t *testing.T) {
+	tests := []struct {
+		line, want string
+	}{
+		{"port = 8080 # the default", "port = 8080 "},
+		{"# a comment", ""},
+		{"origin = http://site.internal/#top", "origin = http://site.internal/#top"},
+		{`origin-header = "X-Note: # not a comment"`, `origin-header = "X-Note: # not a comment"`},
+		{"origin-header = X-Note: don't", "origin-header = X-Note: don't"},
+		{"origin-header = X-Note: don't # it's not sent upstream", "origin-header = X-Note: don't "},
+		{"port = 8080 # don't change", "port = 8080 "},
+		{"origin-header: 'X-Note: it''s # literal'  # note", "origin-header: 'X-Note: it''s # literal'  "},
+		{"- 'b # c' # d", "- 'b # c' "},
+	}
+	for _, tt := range tests {
+		if got := stripComment(tt.line); got != tt.want {
+			t.Errorf("stripComment(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestParseConfigApostrophes(t *testing.T) {
+	toml := "origin-header = X-Note: don't # it's sent as is\n" +
+		"method-policy = [TRACE=deny, OPTIONS=pass] # won't change\n"
+	yaml := "origin-header: X-Note: don't # it's sent as is\n" +
+		"method-policy: [TRACE=deny, OPTIONS=pass] # won't change\n"
+	want := []configOption{
+		{name: "origin-header", values: []string{"X-Note: don't"}, line: 1},
+		{name: "method-policy", values: []string{"TRACE=deny", "OPTIONS=pass"}, line: 2},
+	}
+	for name, parse := range map[string]func(string) ([]configOption, error){"toml": parseTOMLConfig, "yaml": parseYAMLConfig} {
+		data := toml
+		if name == "yaml" {
+			data = yaml
+		}
+		got, err := parse(data)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", name, got, want)
+		}
+	}
+}
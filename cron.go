@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed standard five-field cron expression
+// (minute hour day-of-month month day-of-week).
+type cronSchedule struct {
+	minute, hour, dom, month, dow [64]bool
+	// domAny and dowAny record a "*" day field; when both day fields are
+	// restricted, cron matches either of them.
+	domAny, dowAny bool
+}
+
+var cronFieldBounds = [5]struct{ min, max int }{
+	{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6},
+}
+
+func parseCronSchedule(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields", expr)
+	}
+	s := &cronSchedule{domAny: fields[2] == "*", dowAny: fields[4] == "*"}
+	targets := []*[64]bool{&s.minute, &s.hour, &s.dom, &s.month, &s.dow}
+	for i, field := range fields {
+		field = replaceCronNames(strings.ToLower(field), cronFieldNames[i])
+		if err := parseCronField(field, cronFieldBounds[i].min, cronFieldBounds[i].max, targets[i]); err != nil {
+			return nil, fmt.Errorf("cron expression %q: %w", expr, err)
+		}
+	}
+	// Sunday may be written as 7
+	if s.dow[7] {
+		s.dow[0] = true
+	}
+	return s, nil
+}
+
+// cronFieldNames lists the names accepted in the month and day-of-week fields.
+var cronFieldNames = [5][]string{
+	3: {"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"},
+	4: {"sun", "mon", "tue", "wed", "thu", "fri", "sat"},
+}
+
+func replaceCronNames(field string, names []string) string {
+	for i, name := range names {
+		if name != "" {
+			field = strings.ReplaceAll(field, name, strconv.Itoa(i))
+		}
+	}
+	return field
+}
+
+// parseCronField handles lists, ranges and steps: "*", "*/15", "1-5", "0,30".
+func parseCronField(field string, min, max int, set *[64]bool) error {
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid step in %q", part)
+			}
+			step = n
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			first, last, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(first); err != nil {
+				return fmt.Errorf("invalid value in %q", part)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(last); err != nil {
+					return fmt.Errorf("invalid range in %q", part)
+				}
+			} else if hasStep {
+				hi = max
+			}
+		}
+		// Allow 7 for Sunday in the day-of-week field
+		limit := max
+		if max == 6 {
+			limit = 7
+		}
+		if lo < min || hi > limit || lo > hi {
+			return fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return nil
+}
+
+// matches reports whether the schedule fires in the minute containing t.
+func (s *cronSchedule) matches(t time.Time) bool {
+	if !s.minute[t.Minute()] || !s.hour[t.Hour()] || !s.month[int(t.Month())] {
+		return false
+	}
+	domMatch, dowMatch := s.dom[t.Day()], s.dow[int(t.Weekday())]
+	switch {
+	case s.domAny && s.dowAny:
+		return true
+	case s.domAny:
+		return dowMatch
+	case s.dowAny:
+		return domMatch
+	}
+	return domMatch || dowMatch
+}
+
+// scheduledPurge purges entries matching pattern whenever its schedule fires.
+type scheduledPurge struct {
+	schedule *cronSchedule
+	spec     string
+	pattern  pathPattern
+}
+
+// parseScheduledPurge parses "MIN HOUR DOM MON DOW PATTERN", for example
+// "0 3 * * * /news/*" to purge /news daily at 03:00.
+func parseScheduledPurge(spec string) (*scheduledPurge, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("invalid purge schedule %q (want a cron expression followed by a route pattern)", spec)
+	}
+	schedule, err := parseCronSchedule(strings.Join(fields[:5], " "))
+	if err != nil {
+		return nil, err
+	}
+	pattern, err := parsePathPattern(fields[5])
+	if err != nil {
+		return nil, err
+	}
+	return &scheduledPurge{schedule: schedule, spec: spec, pattern: pattern}, nil
+}
+
+// runPurgeScheduler evaluates the schedules at the start of every minute.
+func runPurgeScheduler(purges []*scheduledPurge) {
+	for {
+		now := time.Now()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		time.Sleep(next.Sub(now))
+
+		for _, p := range purges {
+			if p.schedule.matches(next) {
+				n := purgeMatching(p.pattern)
+				log.Printf("[Scheduler] Purge '%s' removed %d entries", p.spec, n)
+			}
+		}
+	}
+}
+
+// scheduledTTL overrides the lifetime of entries stored for a route while
+// its schedule matches, e.g. to shorten it during business hours.
+type scheduledTTL struct {
+	schedule *cronSchedule
+	pattern  pathPattern
+	ttl      time.Duration
+}
+
+var scheduledTTLs []*scheduledTTL
+
+// parseScheduledTTL parses "MIN HOUR DOM MON DOW PATTERN ttl=DURATION", for
+// example "* 9-17 * * mon-fri /live/* ttl=10s".
+func parseScheduledTTL(spec string) (*scheduledTTL, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 7 {
+		return nil, fmt.Errorf("invalid TTL schedule %q (want a cron expression, a route pattern and ttl=DURATION)", spec)
+	}
+	schedule, err := parseCronSchedule(strings.Join(fields[:5], " "))
+	if err != nil {
+		return nil, err
+	}
+	pattern, err := parsePathPattern(fields[5])
+	if err != nil {
+		return nil, err
+	}
+	value, ok := strings.CutPrefix(fields[6], "ttl=")
+	ttl, err := time.ParseDuration(value)
+	if !ok || err != nil || ttl <= 0 {
+		return nil, fmt.Errorf("TTL schedule %q: invalid ttl %q", spec, fields[6])
+	}
+	return &scheduledTTL{schedule: schedule, pattern: pattern, ttl: ttl}, nil
+}
+
+// scheduledTTLFor returns the ttl of the first schedule that matches at t
+// for urlPath.
+func scheduledTTLFor(urlPath string, t time.Time) (time.Duration, bool) {
+	for _, s := range scheduledTTLs {
+		if s.schedule.matches(t) && s.pattern.match(urlPath) {
+			return s.ttl, true
+		}
+	}
+	return 0, false
+}
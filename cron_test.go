@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestStoredLifetimeSchedule(t *testing.T) {
+	s, err := parseScheduledTTL("* 9-17 * * mon-fri /live/* ttl=10s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduledTTLs = []*scheduledTTL{s}
+	defer func() { scheduledTTLs = nil }()
+
+	monday := time.Date(2026, time.October, 12, 0, 0, 0, 0, time.Local)
+	h := http.Header{"Cache-Control": {"max-age=3600"}}
+	tests := []struct {
+		path string
+		at   time.Time
+		want time.Duration
+		ok   bool
+	}{
+		{"/live/score", monday.Add(10 * time.Hour), 10 * time.Second, true},
+		{"/live/score", monday.Add(17*time.Hour + 59*time.Minute), 10 * time.Second, true},
+		{"/live/score", monday.Add(18 * time.Hour), 0, false},
+		{"/live/score", monday.Add(-14 * time.Hour), 0, false}, // Sunday
+		{"/news/today", monday.Add(10 * time.Hour), 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := scheduledTTLFor(tt.path, tt.at)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("scheduledTTLFor(%q, %s) = %v, %v, want %v, %v", tt.path, tt.at.Format(time.DateTime), got, ok, tt.want, tt.ok)
+		}
+	}
+	if got := storedLifetime("GET:/news/today?", h); got != time.Hour {
+		t.Errorf("storedLifetime off schedule = %v, want the origin's hour", got)
+	}
+
+	for _, spec := range []string{
+		"* 9-17 * * mon-fri /live/*",
+		"* 9-17 * * mon-fri /live/* 10s",
+		"* 9-17 * * mon-fri /live/* ttl=0s",
+		"* 25 * * * /live/* ttl=10s",
+	} {
+		if _, err := parseScheduledTTL(spec); err == nil {
+			t.Errorf("parseScheduledTTL(%q) accepted", spec)
+		}
+	}
+}
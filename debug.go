@@ -0,0 +1,11 @@
+package main
+
+import "net/http"
+
+// debugHeaders exposes cache internals to clients for troubleshooting.
+var debugHeaders bool
+
+func setDebugHeaders(h http.Header, cacheKey, backend string) {
+	h.Set("X-Cache-Key", cacheKey)
+	h.Set("X-Cache-Backend", backend)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dedupRule enables duplicate suppression for non-GET requests on a route.
+type dedupRule struct {
+	pattern pathPattern
+	window  time.Duration
+}
+
+var dedupRules []dedupRule
+
+// parseDedupRule parses PATTERN=WINDOW, e.g. "/api/orders/*=2s".
+func parseDedupRule(spec string) (dedupRule, error) {
+	pattern, window, ok := strings.Cut(spec, "=")
+	if !ok {
+		return dedupRule{}, fmt.Errorf("invalid dedup route %q (want PATTERN=WINDOW)", spec)
+	}
+	p, err := parsePathPattern(pattern)
+	if err != nil {
+		return dedupRule{}, err
+	}
+	d, err := time.ParseDuration(window)
+	if err != nil || d <= 0 {
+		return dedupRule{}, fmt.Errorf("invalid window %q for dedup route %q", window, pattern)
+	}
+	return dedupRule{pattern: p, window: d}, nil
+}
+
+// dedupWindow returns how long identical copies of r are suppressed, or 0
+// when its route has no rule.
+func dedupWindow(r *http.Request) time.Duration {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return 0
+	}
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	for _, rule := range dedupRules {
+		if rule.pattern.match(r.URL.Path) {
+			return rule.window
+		}
+	}
+	return 0
+}
+
+// dedupExchanges holds the requests seen within their window, keyed by
+// method, URL, caller and body digest. They share idempotentExchange with the
+// Idempotency-Key layer.
+var dedupExchanges = struct {
+	sync.Mutex
+	m map[string]*idempotentExchange
+}{m: map[string]*idempotentExchange{}}
+
+// handleDeduplicated sends only the first of identical concurrent requests to
+// the origin; copies arriving while it is in flight, or within window of it
+// starting, get its response. Failed and oversized exchanges are not shared,
+// so waiting copies then go to the origin themselves.
+func handleDeduplicated(w http.ResponseWriter, r *http.Request, window time.Duration, next http.HandlerFunc) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxIdempotentBody+1))
+	if err != nil || len(body) > maxIdempotentBody {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		next(w, r)
+		return
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	sum := sha256.Sum256(body)
+	scope := idempotencyScope(r, hex.EncodeToString(sum[:]))
+
+	dedupExchanges.Lock()
+	ex, ok := dedupExchanges.m[scope]
+	if ok && time.Now().After(ex.expires) {
+		delete(dedupExchanges.m, scope)
+		ok = false
+	}
+	if !ok {
+		ex = &idempotentExchange{done: make(chan struct{}), expires: time.Now().Add(window)}
+		dedupExchanges.m[scope] = ex
+	}
+	dedupExchanges.Unlock()
+
+	if ok {
+		select {
+		case <-ex.done:
+		case <-r.Context().Done():
+			return
+		}
+		if ex.status != 0 {
+			log.Printf("[Dedup] Answering duplicate %s %s with the response of the first request", r.Method, r.URL.String())
+			for k, vv := range ex.header {
+				w.Header()[k] = vv
+			}
+			w.Header().Set("X-Cache", "REPLAY")
+			w.WriteHeader(ex.status)
+			w.Write(ex.body)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next(w, r)
+		return
+	}
+
+	rec := &captureWriter{ResponseWriter: w, body: &limitedBuffer{max: maxIdempotentBody + 1}}
+	next(rec, r)
+
+	dedupExchanges.Lock()
+	if rec.status == 0 || rec.status >= 500 || len(rec.body.buf) > maxIdempotentBody {
+		delete(dedupExchanges.m, scope)
+	} else {
+		ex.status, ex.body = rec.status, rec.body.buf
+		ex.header = w.Header().Clone()
+		ex.header.Del("X-Cache")
+	}
+	close(ex.done)
+	dedupExchanges.Unlock()
+}
+
+// sweepDedup drops exchanges whose window has passed.
+func sweepDedup() {
+	for range time.Tick(time.Minute) {
+		now := time.Now()
+		dedupExchanges.Lock()
+		for k, ex := range dedupExchanges.m {
+			if now.After(ex.expires) && isClosed(ex.done) {
+				delete(dedupExchanges.m, k)
+			}
+		}
+		dedupExchanges.Unlock()
+	}
+}
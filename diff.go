@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// diffClient fetches live origin responses for the diff endpoint.
+var diffClient *http.Client
+
+// diffIgnoredHeaders change on every response or hop and would drown out the
+// differences that matter.
+var diffIgnoredHeaders = []string{"Date", "Age", "Via", "Connection", "Keep-Alive", "Transfer-Encoding"}
+
+type headerChange struct {
+	Cached string `json:"cached"`
+	Origin string `json:"origin"`
+}
+
+type entryDiff struct {
+	Key       string  `json:"key"`
+	Backend   string  `json:"backend"`
+	AgeSecs   float64 `json:"age_seconds"`
+	Identical bool    `json:"identical"`
+	// Variant is set for keys with a variant suffix (ranges, Vary, Accept),
+	// for which the origin is asked without the client's headers.
+	Variant bool `json:"variant,omitempty"`
+	Status  struct {
+		Cached int `json:"cached"`
+		Origin int `json:"origin"`
+	} `json:"status"`
+	Headers struct {
+		Added   map[string]string       `json:"added,omitempty"`
+		Removed map[string]string       `json:"removed,omitempty"`
+		Changed map[string]headerChange `json:"changed,omitempty"`
+	} `json:"headers"`
+	Body struct {
+		CachedSize   int    `json:"cached_size"`
+		OriginSize   int    `json:"origin_size"`
+		SizeDelta    int    `json:"size_delta"`
+		CachedSHA256 string `json:"cached_sha256"`
+		OriginSHA256 string `json:"origin_sha256"`
+		Changed      bool   `json:"changed"`
+	} `json:"body"`
+}
+
+// diffEntry compares a stored entry with the origin's current response.
+func diffEntry(key string, c *CachedResponse, resp *http.Response, body []byte) entryDiff {
+	var d entryDiff
+	d.Key, d.Backend, d.AgeSecs = key, c.Backend, time.Since(c.Timestamp).Seconds()
+	d.Variant = strings.Contains(key, "#")
+	d.Status.Cached, d.Status.Origin = c.StatusCode, resp.StatusCode
+
+	d.Headers.Added, d.Headers.Removed, d.Headers.Changed = map[string]string{}, map[string]string{}, map[string]headerChange{}
+	for name := range c.Headers {
+		if slices.Contains(diffIgnoredHeaders, name) {
+			continue
+		}
+		cached, origin := strings.Join(c.Headers[name], ", "), strings.Join(resp.Header[name], ", ")
+		switch {
+		case len(resp.Header[name]) == 0:
+			d.Headers.Removed[name] = cached
+		case cached != origin:
+			d.Headers.Changed[name] = headerChange{Cached: cached, Origin: origin}
+		}
+	}
+	for name, vv := range resp.Header {
+		if _, ok := c.Headers[name]; !ok && !slices.Contains(diffIgnoredHeaders, name) {
+			d.Headers.Added[name] = strings.Join(vv, ", ")
+		}
+	}
+
+	cachedSum, originSum := sha256.Sum256(c.Response), sha256.Sum256(body)
+	d.Body.CachedSize, d.Body.OriginSize = len(c.Response), len(body)
+	d.Body.SizeDelta = len(body) - len(c.Response)
+	d.Body.CachedSHA256, d.Body.OriginSHA256 = hex.EncodeToString(cachedSum[:]), hex.EncodeToString(originSum[:])
+	d.Body.Changed = cachedSum != originSum
+
+	d.Identical = d.Status.Cached == d.Status.Origin && !d.Body.Changed &&
+		len(d.Headers.Added) == 0 && len(d.Headers.Removed) == 0 && len(d.Headers.Changed) == 0
+	return d
+}
+
+// diffHandler fetches the live origin response for the entry named by the key
+// query parameter and reports how it differs from the cached copy.
+func diffHandler(w http.ResponseWriter, r *http.Request) {
+	if readOnly {
+		http.Error(w, "read-only replicas do not contact the origin", http.StatusConflict)
+		return
+	}
+	key := r.URL.Query().Get("key")
+	c, found := lookupEntry(key)
+	if !found {
+		http.Error(w, "no such entry", http.StatusNotFound)
+		return
+	}
+	resp, body, err := fetchStoredRepresentation(diffClient, key, c)
+	if err != nil {
+		http.Error(w, "origin request failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, http.StatusOK, diffEntry(key, c, resp, body))
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// diskCache mirrors the in-memory cache to a directory so it survives
+// restarts: every stored entry is written to its own file, removed entries
+// are deleted, and the index is rebuilt from the files on startup. Files are
+// spread over two levels of subdirectories named after their key's hash, so
+// no directory grows past a few thousand files. Writes go through a single
+// goroutine, off the request path.
+type diskCache struct {
+	dir string
+
+	// Pending writes, latest per key. Queueing never waits on the disk: it
+	// happens with cacheMutex held, which cache hits need too. The queue is
+	// unbounded, as a dropped delete would bring an entry back on restart;
+	// it holds at most one write per cached key.
+	writes *writeQueue[diskOp]
+
+	// Size of each key's file, and their total. Writes are counted when
+	// queued, at the entry's size, and corrected once the file is written;
+	// deletes are counted at once.
+	mu        sync.Mutex
+	sizes     map[string]int64
+	bytes     atomic.Int64
+	evictions atomic.Int64
+
+	// durable makes every write fsync its file, once shutting down.
+	durable atomic.Bool
+}
+
+type diskOp struct {
+	key   string
+	entry *CachedResponse // nil deletes the file
+}
+
+// diskEntry is the on-disk form of an entry.
+type diskEntry struct {
+	Key   string
+	Entry *CachedResponse
+}
+
+// diskState persists the generations, so entries invalidated before a
+// restart stay invalid after it.
+type diskState struct {
+	Generation uint64            `json:"generation"`
+	Namespaces map[string]uint64 `json:"namespaces"`
+}
+
+const diskEntryExt = ".entry"
+
+var disk *diskCache
+
+func openDiskCache(dir string) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	d := &diskCache{dir: dir, sizes: map[string]int64{}}
+	if err := d.loadState(); err != nil {
+		return nil, err
+	}
+	d.writes = newWriteQueue(0, func(batch []diskOp) {
+		for _, op := range batch {
+			d.apply(op)
+		}
+	})
+	return d, nil
+}
+
+// path places key's file under two levels of 256 shards picked by the first
+// bytes of its hash, e.g. ab/cd/abcd....entry.
+func (d *diskCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:16])
+	return filepath.Join(d.dir, name[0:2], name[2:4], name+diskEntryExt)
+}
+
+func (d *diskCache) store(key string, c *CachedResponse) {
+	d.account(key, c.size())
+	d.queue(diskOp{key: key, entry: c})
+}
+
+func (d *diskCache) remove(key string) {
+	d.account(key, 0)
+	d.queue(diskOp{key: key})
+}
+
+// account records that key's file takes n bytes, 0 once it is gone.
+func (d *diskCache) account(key string, n int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.bytes.Add(n - d.sizes[key])
+	if n == 0 {
+		delete(d.sizes, key)
+	} else {
+		d.sizes[key] = n
+	}
+}
+
+// usage returns the bytes taken by the entry files.
+func (d *diskCache) usage() int64 { return d.bytes.Load() }
+
+// queue schedules op, replacing any pending write of the same key.
+func (d *diskCache) queue(op diskOp) { d.writes.add(op.key, op) }
+
+func (d *diskCache) apply(op diskOp) {
+	if op.entry == nil {
+		d.account(op.key, 0)
+		if err := os.Remove(d.path(op.key)); err != nil && !os.IsNotExist(err) {
+			logf("error", "[Disk] Failed to delete cacheKey '%s': %v", op.key, err)
+		}
+		return
+	}
+	path := d.path(op.key)
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err == nil {
+		err = writeFileAtomic(path, func(f *os.File) error {
+			if err := gob.NewEncoder(f).Encode(diskEntry{Key: op.key, Entry: op.entry}); err != nil || !d.durable.Load() {
+				return err
+			}
+			return f.Sync()
+		})
+	}
+	if err != nil {
+		logf("error", "[Disk] Failed to write cacheKey '%s': %v", op.key, err)
+		return
+	}
+	if info, err := os.Stat(path); err == nil {
+		d.account(op.key, info.Size())
+	}
+}
+
+// flush writes the pending entries and deletes to disk, syncing each file,
+// and saves the generations. Call it on shutdown, once requests are drained.
+func (d *diskCache) flush() {
+	start := time.Now()
+	pending := d.writes.depth()
+	d.durable.Store(true)
+	d.writes.flush()
+	d.saveState()
+	log.Printf("[Disk] Flushed %d pending writes to %s in %s", pending, d.dir, time.Since(start).Round(time.Millisecond))
+}
+
+// clearDiskCache deletes the entry files and saved generations in dir, for
+// --clear-cache, and returns how many entries it deleted. Other files in dir
+// are left alone.
+func clearDiskCache(dir string) (int, error) {
+	removed := 0
+	var dirs []string
+	err := filepath.WalkDir(dir, func(path string, file fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if file.IsDir() {
+			if path != dir {
+				dirs = append(dirs, path)
+			}
+			return nil
+		}
+		name := file.Name()
+		isEntry := strings.HasSuffix(name, diskEntryExt)
+		if !isEntry && !strings.HasPrefix(name, ".tmp-") {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		if isEntry {
+			removed++
+		}
+		return nil
+	})
+	if err != nil {
+		return removed, err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i]) // only empties
+	}
+	if err := os.Remove(filepath.Join(dir, "state.json")); err != nil && !os.IsNotExist(err) {
+		return removed, err
+	}
+	return removed, nil
+}
+
+// writeFileAtomic writes through a temporary file renamed into place, so a
+// crash never leaves a truncated file behind.
+func writeFileAtomic(path string, write func(*os.File) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (d *diskCache) statePath() string { return filepath.Join(d.dir, "state.json") }
+
+func (d *diskCache) loadState() error {
+	data, err := os.ReadFile(d.statePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var st diskState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return fmt.Errorf("%s: %w", d.statePath(), err)
+	}
+	cacheGeneration.Store(st.Generation)
+	for _, ns := range namespaces {
+		ns.generation.Store(st.Namespaces[ns.name])
+	}
+	return nil
+}
+
+// saveState records the current generations; call it after bumping one.
+func (d *diskCache) saveState() {
+	st := diskState{Generation: cacheGeneration.Load(), Namespaces: map[string]uint64{}}
+	for _, ns := range namespaces {
+		st.Namespaces[ns.name] = ns.generation.Load()
+	}
+	if err := writeFileAtomic(d.statePath(), func(f *os.File) error {
+		return json.NewEncoder(f).Encode(st)
+	}); err != nil {
+		logf("error", "[Disk] Failed to save cache state: %v", err)
+	}
+}
+
+// load rebuilds the in-memory index from the entry files, deleting the ones
+// that were invalidated, have expired or cannot be read. Files outside their
+// shard, such as those written before sharding, are moved into it. Where two
+// files hold the same key, the older entry is deleted. Leftover temporary
+// files, stray files in the shard directories and shard directories left
+// empty go too, and the space all of this frees is reported.
+func (d *diskCache) load() {
+	start := time.Now()
+	dropped, duplicates := 0, 0
+	var reclaimed int64
+	discard := func(path string) {
+		if info, err := os.Stat(path); err == nil {
+			reclaimed += info.Size()
+		}
+		os.Remove(path)
+	}
+	entries := map[string]*CachedResponse{}
+	files := map[string]string{} // key -> file its entry was read from
+	var dirs []string            // parents first
+	err := filepath.WalkDir(d.dir, func(path string, file fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if file.IsDir() {
+			if path != d.dir {
+				dirs = append(dirs, path)
+			}
+			return nil
+		}
+		name := file.Name()
+		if strings.HasPrefix(name, ".tmp-") {
+			discard(path) // left over from a crash
+			return nil
+		}
+		if !strings.HasSuffix(name, diskEntryExt) {
+			if filepath.Dir(path) != d.dir {
+				discard(path)
+			}
+			return nil
+		}
+		var e diskEntry
+		f, err := os.Open(path)
+		if err == nil {
+			err = gob.NewDecoder(f).Decode(&e)
+			f.Close()
+		}
+		if err != nil || e.Entry == nil || !e.Entry.live() || e.Entry.expired() {
+			discard(path)
+			dropped++
+			return nil
+		}
+		if prev, ok := entries[e.Key]; ok {
+			duplicates++
+			if !e.Entry.Timestamp.After(prev.Timestamp) {
+				discard(path)
+				return nil
+			}
+			discard(files[e.Key])
+		}
+		entries[e.Key], files[e.Key] = e.Entry, path
+		return nil
+	})
+	if err != nil {
+		logf("error", "[Disk] Failed to read %s: %v", d.dir, err)
+	}
+	moved := 0
+	for key, c := range entries {
+		if info, err := os.Stat(files[key]); err == nil {
+			d.account(key, info.Size())
+		}
+		cacheMutex.Lock()
+		addEntryLocked(key, c)
+		cacheMutex.Unlock()
+		from, to := files[key], d.path(key)
+		if from == to {
+			continue
+		}
+		if err := d.move(from, to); err != nil {
+			logf("error", "[Disk] Failed to move %s into its shard: %v", from, err)
+			continue
+		}
+		moved++
+	}
+	if moved > 0 {
+		log.Printf("[Disk] Moved %d entries into their shard directories", moved)
+	}
+	// Children come after their parents in the walk, so going backwards
+	// empties a shard before its parent is tried. Removing a directory that
+	// still has files fails and leaves it be.
+	emptied := 0
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if os.Remove(dirs[i]) == nil {
+			emptied++
+		}
+	}
+	log.Printf("[Disk] Loaded %d entries from %s in %s (%d dropped, %d duplicates, %d empty directories removed, %.1f MB reclaimed)",
+		len(entries), d.dir, time.Since(start).Round(time.Millisecond), dropped, duplicates, emptied, float64(reclaimed)/(1<<20))
+}
+
+func (d *diskCache) move(from, to string) error {
+	if err := os.MkdirAll(filepath.Dir(to), 0o755); err != nil {
+		return err
+	}
+	return os.Rename(from, to)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// diskQuota keeps the entry files of --cache-dir within a size limit. Above
+// the high watermark it evicts the least recently used entries, from memory
+// and disk alike, until usage is back to the low watermark. It runs in the
+// background, so stores never wait for it.
+type diskQuota struct {
+	limit int64
+	high  float64
+	low   float64
+}
+
+func (q *diskQuota) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		q.check()
+	}
+}
+
+func (q *diskQuota) check() {
+	used := disk.usage()
+	highMark := int64(float64(q.limit) * q.high)
+	lowMark := int64(float64(q.limit) * q.low)
+	if used < highMark {
+		return
+	}
+
+	logf("warn", "[Disk] Usage %d bytes above high watermark %d (limit %d), evicting least recently used entries", used, highMark, q.limit)
+	evicted := 0
+	cacheMutex.Lock()
+	// Evicting deletes the entry's file, which is counted at once.
+	for disk.usage() > lowMark {
+		key, ok := entryRecency.victim()
+		if !ok {
+			break
+		}
+		evictEntryLocked(key)
+		evicted++
+	}
+	cacheMutex.Unlock()
+	disk.evictions.Add(int64(evicted))
+	log.Printf("[Disk] Evicted %d entries (%d bytes) to reach the low watermark %d", evicted, used-disk.usage(), lowMark)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// doctorReport collects the findings of "caching-proxy doctor" for one path.
+type doctorReport struct {
+	path     string
+	findings []string
+	advice   []string
+}
+
+func (d *doctorReport) note(format string, args ...any) {
+	d.findings = append(d.findings, fmt.Sprintf(format, args...))
+}
+func (d *doctorReport) advise(format string, args ...any) {
+	d.advice = append(d.advice, fmt.Sprintf(format, args...))
+}
+
+// runDoctorCommand implements "caching-proxy doctor": it probes an origin and
+// recommends proxy settings for it.
+func runDoctorCommand(args []string) {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	origin := fs.String("origin", "", "Origin URL to probe")
+	samples := fs.Int("samples", 3, "Number of requests used to measure latency")
+	var paths stringList
+	fs.Var(&paths, "path", "Path to probe (repeatable, default /)")
+	caFile := fs.String("origin-ca", "", "PEM bundle of CA certificates trusted for an https origin, on top of the system roots")
+	fs.Parse(args)
+
+	if *origin == "" {
+		log.Fatal("--origin URL is required")
+	}
+	if len(paths) == 0 {
+		paths = stringList{"/"}
+	}
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		// Report redirects instead of following them
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	if *caFile != "" {
+		pool, err := loadCertPool(*caFile)
+		if err != nil {
+			log.Fatalf("Invalid --origin-ca: %v", err)
+		}
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = &tls.Config{RootCAs: pool}
+		client.Transport = t
+	}
+
+	failed := false
+	for _, p := range paths {
+		target := strings.TrimSuffix(*origin, "/") + p
+		d, err := diagnose(client, target, max(*samples, 1))
+		if err != nil {
+			fmt.Printf("%s\n  error: %v\n\n", target, err)
+			failed = true
+			continue
+		}
+		fmt.Println(target)
+		for _, f := range d.findings {
+			fmt.Printf("  - %s\n", f)
+		}
+		if len(d.advice) > 0 {
+			fmt.Println("  Recommendations:")
+			for _, a := range d.advice {
+				fmt.Printf("  * %s\n", a)
+			}
+		}
+		fmt.Println()
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// doctorGet issues a GET with the given headers and returns the response with
+// its body drained, and how long it took.
+func doctorGet(client *http.Client, target string, header http.Header) (*http.Response, []byte, time.Duration, error) {
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return resp, body, time.Since(start), err
+}
+
+func diagnose(client *http.Client, target string, samples int) (*doctorReport, error) {
+	d := &doctorReport{path: target}
+
+	// Latency
+	var latencies []time.Duration
+	var resp *http.Response
+	var body []byte
+	for range samples {
+		r, b, took, err := doctorGet(client, target, http.Header{"Accept-Encoding": {"identity"}})
+		if err != nil {
+			return nil, err
+		}
+		resp, body = r, b
+		latencies = append(latencies, took)
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	median := latencies[len(latencies)/2]
+	d.note("status %d, %d bytes, median latency %s over %d requests", resp.StatusCode, len(body), median.Round(100*time.Microsecond), samples)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		d.advise("Only 2xx responses are cached; this path answered %d", resp.StatusCode)
+	}
+	if median > 500*time.Millisecond {
+		d.advise("The origin is slow: warm the cache with --warm-url and consider --prefetch-preload")
+	}
+
+	// Caching headers
+	cc := resp.Header.Get("Cache-Control")
+	lifetime, explicit := freshnessLifetime(resp.Header)
+	switch {
+	case cc == "" && resp.Header.Get("Expires") == "":
+		d.note("no Cache-Control or Expires header")
+		d.advise("Set --cache-ttl so entries are refreshed periodically, or have the origin send Cache-Control: max-age")
+	case explicit:
+		d.note("Cache-Control %q: fresh for %s", cc, lifetime)
+	default:
+		d.note("Cache-Control %q", cc)
+	}
+	if ok, reason := responseStorable(resp); !ok {
+		d.note("responses are not stored: %s", reason)
+		d.advise("Change the origin's Cache-Control for this route if it should be cached")
+	}
+	if resp.Header.Get("Set-Cookie") != "" {
+		d.note("response sets cookies")
+		d.advise("Cached responses replay Set-Cookie to every client; keep personalized routes out of the cache")
+	}
+
+	// Vary
+	if vary, star := parseVary(resp.Header); star {
+		d.note("Vary: *")
+		d.advise("Vary: * prevents caching entirely")
+	} else if len(vary) > 0 {
+		d.note("Vary: %s", strings.Join(vary, ", "))
+		for _, h := range vary {
+			switch h {
+			case "User-Agent", "Cookie":
+				d.advise("Vary: %s splits the cache into almost one entry per client", h)
+			case "Accept":
+				d.advise("Consider --accept-variants to bucket Accept values instead of keying on the raw header")
+			}
+		}
+	}
+
+	// Compression
+	cr, cbody, _, err := doctorGet(client, target, http.Header{"Accept-Encoding": {"gzip, br"}})
+	if err != nil {
+		return nil, err
+	}
+	if enc := cr.Header.Get("Content-Encoding"); enc != "" {
+		d.note("compression: %s (%d bytes instead of %d)", enc, len(cbody), len(body))
+		if !strings.Contains(cr.Header.Get("Vary"), "Accept-Encoding") {
+			d.advise("The origin compresses without Vary: Accept-Encoding; clients lacking %s may get compressed hits", enc)
+		}
+	} else if ct := resp.Header.Get("Content-Type"); len(body) > 1024 && compressibleType(ct) {
+		d.note("no compression for %s", ct)
+		d.advise("Enable gzip or br at the origin to cut the size of cached text responses")
+	}
+
+	// Validators
+	etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	switch {
+	case etag != "":
+		vr, _, _, err := doctorGet(client, target, http.Header{"If-None-Match": {etag}})
+		if err != nil {
+			return nil, err
+		}
+		d.note("ETag %s; conditional request answered %d", etag, vr.StatusCode)
+		if vr.StatusCode != http.StatusNotModified {
+			d.advise("The origin ignores If-None-Match, so revalidations transfer the full body")
+		}
+	case lastModified != "":
+		d.note("Last-Modified %s, no ETag", lastModified)
+	default:
+		d.note("no validators")
+		d.advise("Use --generate-etag so clients can revalidate cache hits cheaply")
+	}
+	return d, nil
+}
+
+func compressibleType(ct string) bool {
+	for _, t := range []string{"text/", "json", "xml", "javascript", "svg"} {
+		if strings.Contains(ct, t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// dumpedEntry is one line of GET /__admin/dump: the metadata of an entry,
+// without its body.
+type dumpedEntry struct {
+	Key        string    `json:"key"`
+	Status     int       `json:"status"`
+	Size       int64     `json:"size"`
+	BodyBytes  int       `json:"body_bytes"`
+	Stored     time.Time `json:"stored"`
+	AgeSeconds float64   `json:"age_seconds"`
+	// TTLSeconds is the remaining freshness lifetime; absent for entries
+	// that never expire.
+	TTLSeconds *float64 `json:"ttl_seconds,omitempty"`
+	Hits       int64    `json:"hits"`
+	Backend    string   `json:"backend"`
+	Pool       string   `json:"pool"`
+	Namespace  string   `json:"namespace,omitempty"`
+	Generation uint64   `json:"generation"`
+	// Tags are the origin's Surrogate-Key or Cache-Tag values.
+	Tags            []string `json:"tags,omitempty"`
+	ContentType     string   `json:"content_type,omitempty"`
+	ContentEncoding string   `json:"content_encoding,omitempty"`
+}
+
+// dumpHandler writes the metadata of every entry in the memory store as JSON
+// lines, as of one point in time. The cache lock is only held to copy the
+// entry pointers; entries are never modified once stored, so they are
+// encoded afterwards without blocking requests.
+func dumpHandler(w http.ResponseWriter, r *http.Request) {
+	type snapshotEntry struct {
+		key  string
+		c    *CachedResponse
+		hits int64
+	}
+	cacheMutex.Lock()
+	takenAt := time.Now()
+	entries := make([]snapshotEntry, 0, len(cache))
+	for k, c := range cache {
+		entries = append(entries, snapshotEntry{k, c, c.hits})
+	}
+	cacheMutex.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Snapshot-Time", takenAt.UTC().Format(time.RFC3339Nano))
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		c := e.c
+		d := dumpedEntry{
+			Key:             e.key,
+			Status:          c.StatusCode,
+			Size:            c.size(),
+			BodyBytes:       len(c.Response),
+			Stored:          c.Timestamp,
+			AgeSeconds:      takenAt.Sub(c.Timestamp).Seconds(),
+			Hits:            e.hits,
+			Backend:         c.Backend,
+			Pool:            c.pool.name,
+			Namespace:       c.Namespace,
+			Generation:      c.Generation,
+			Tags:            entryTags(c.Headers),
+			ContentType:     c.Headers.Get("Content-Type"),
+			ContentEncoding: c.Headers.Get("Content-Encoding"),
+		}
+		if lifetime := entryLifetime(c); lifetime > 0 {
+			ttl := (lifetime - takenAt.Sub(c.Timestamp)).Seconds()
+			d.TTLSeconds = &ttl
+		}
+		if err := enc.Encode(d); err != nil {
+			return
+		}
+	}
+}
+
+// entryLifetime is the freshness lifetime an entry expires after, 0 for
+// never.
+func entryLifetime(c *CachedResponse) time.Duration {
+	if c.Lifetime > 0 {
+		return c.Lifetime
+	}
+	return defaultTTL()
+}
+
+// entryTags returns the tags the origin attached with Surrogate-Key (space
+// separated) or Cache-Tag (comma separated).
+func entryTags(h http.Header) []string {
+	var tags []string
+	for _, v := range h.Values("Surrogate-Key") {
+		tags = append(tags, strings.Fields(v)...)
+	}
+	for _, v := range h.Values("Cache-Tag") {
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				tags = append(tags, t)
+			}
+		}
+	}
+	return tags
+}
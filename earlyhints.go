@@ -0,0 +1,31 @@
+package main
+
+import "net/http"
+
+// earlyHints enables synthesizing 103 Early Hints on cache hits. Interim
+// responses from the origin are always forwarded on misses.
+var earlyHints bool
+
+// sendEarlyHints writes a 103 interim response carrying the preload and
+// preconnect Link headers of a stored response, so browsers can start fetching
+// subresources while the main response is written.
+func sendEarlyHints(w http.ResponseWriter, stored http.Header) {
+	var hints []string
+	for _, v := range stored.Values("Link") {
+		for _, l := range parseLinkHeaders([]string{v}) {
+			if l.hasRel("preload") || l.hasRel("preconnect") {
+				hints = append(hints, v)
+				break
+			}
+		}
+	}
+	if len(hints) == 0 {
+		return
+	}
+
+	h := w.Header()
+	h["Link"] = hints
+	w.WriteHeader(http.StatusEarlyHints)
+	// 1xx responses do not reset the header map; the final response sets its own Link headers
+	h.Del("Link")
+}
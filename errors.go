@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+// Outcome classes of failed proxy requests, reported in request logs so that
+// origin, client and network problems can be told apart.
+const (
+	errClientAborted = "client_aborted"
+	errClientTimeout = "client_timeout"
+	errOriginTimeout = "origin_timeout"
+	errOriginRefused = "origin_refused"
+	errOriginReset   = "origin_reset"
+	errDNS           = "dns_error"
+	errTLS           = "tls_error"
+	errOriginBlocked = "origin_blocked"
+	errOrigin        = "origin_error"
+)
+
+// statusClientClosedRequest is logged for requests the client abandoned before
+// a response could be written (nginx's 499).
+const statusClientClosedRequest = 499
+
+// classifyProxyError maps an error from the origin round trip, or from copying
+// its body, to an outcome class.
+func classifyProxyError(r *http.Request, err error) string {
+	if errors.Is(r.Context().Err(), context.Canceled) {
+		return errClientAborted
+	}
+
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var blockedErr *errBlockedAddress
+	switch {
+	case errors.As(err, &blockedErr):
+		return errOriginBlocked
+	case errors.As(err, &dnsErr):
+		return errDNS
+	case errors.As(err, &certErr), errors.As(err, &recordErr), errors.As(err, &alertErr),
+		errors.As(err, &authorityErr), errors.As(err, &hostnameErr), errors.As(err, &invalidErr):
+		return errTLS
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return errOriginTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return errOriginRefused
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return errOriginReset
+	}
+	return errOrigin
+}
+
+// noteRequestError records the outcome class of a failed request on its log
+// event. Requests issued by the proxy itself carry no event.
+func noteRequestError(r *http.Request, class string) {
+	if e, ok := r.Context().Value(requestLogKey).(*requestLogEvent); ok {
+		e.Error = class
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// generateETags attaches a body-hash ETag to cached responses the origin sent
+// without one.
+var generateETags bool
+
+func bodyETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// weakETag returns etag as a weak validator.
+func weakETag(etag string) string {
+	if strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return "W/" + etag
+}
+
+// notModified reports whether a conditional request's If-None-Match matches
+// etag, using the weak comparison RFC 9110 prescribes for GET and HEAD.
+func notModified(r *http.Request, etag string) bool {
+	inm := r.Header.Get("If-None-Match")
+	if inm == "" || etag == "" {
+		return false
+	}
+	return etagListMatches(inm, etag)
+}
+
+// etagListMatches reports whether a comma-separated list of entity tags, or
+// "*", weakly matches etag.
+func etagListMatches(list, etag string) bool {
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(list, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
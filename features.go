@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// feature is an experimental subsystem that ships disabled and is turned on
+// per deployment with --enable-feature.
+type feature struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Enabled     bool   `json:"enabled"`
+}
+
+// Names of the guarded features.
+const (
+	featurePeers = "peers"
+)
+
+// features lists every guarded feature. Register a new one here and check it
+// with featureEnabled where the subsystem is started.
+var features = map[string]*feature{
+	featurePeers: {Name: featurePeers, Description: "Cluster mode: --store=peers fills local misses from other nodes"},
+}
+
+// enableFeatures turns on the features named in the --enable-feature values,
+// each a comma-separated list.
+func enableFeatures(specs []string) error {
+	for _, spec := range specs {
+		for _, name := range strings.Split(spec, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			f, ok := features[name]
+			if !ok {
+				return fmt.Errorf("unknown feature %q (known: %s)", name, strings.Join(featureNames(), ", "))
+			}
+			f.Enabled = true
+		}
+	}
+	return nil
+}
+
+func featureEnabled(name string) bool {
+	return features[name].Enabled
+}
+
+// requireFeature fails when a subsystem is configured without its feature
+// enabled.
+func requireFeature(name, what string) error {
+	if featureEnabled(name) {
+		return nil
+	}
+	return fmt.Errorf("%s is experimental; enable it with --enable-feature=%s", what, name)
+}
+
+func featureNames() []string {
+	names := make([]string, 0, len(features))
+	for name := range features {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// featuresHandler lists the guarded features and whether each is enabled.
+func featuresHandler(w http.ResponseWriter, r *http.Request) {
+	list := make([]*feature, 0, len(features))
+	for _, name := range featureNames() {
+		list = append(list, features[name])
+	}
+	writeJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// strictFraming rejects messages with framing anomalies instead of normalizing
+// them.
+//
+// Go's HTTP parser already rejects conflicting Content-Length values and
+// unsupported transfer codings, and drops Content-Length when a message is
+// chunked, so those smuggling vectors never reach the handler. What is left to
+// police here is what the cache itself could be desynchronized by.
+var strictFraming bool
+
+// checkRequestFraming handles bodies sent with GET and HEAD: the cache key
+// ignores the body, so forwarding it would let one client poison the entry for
+// everybody. In strict mode the request is rejected; otherwise the body is
+// dropped.
+func checkRequestFraming(r *http.Request) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return nil
+	}
+	if r.ContentLength == 0 && len(r.TransferEncoding) == 0 {
+		return nil
+	}
+	if strictFraming {
+		return fmt.Errorf("%s request with a body", r.Method)
+	}
+	logf("warn", "[Framing] Dropping body of %s request for %s", r.Method, r.URL.String())
+	// Reading the body would solicit it with 100 Continue; not reading it
+	// tells the client it is not wanted.
+	if !strings.EqualFold(r.Header.Get("Expect"), "100-continue") {
+		io.Copy(io.Discard, io.LimitReader(r.Body, 1<<20))
+	}
+	r.Header.Del("Expect")
+	r.Body = http.NoBody
+	r.ContentLength = 0
+	r.TransferEncoding = nil
+	r.Header.Del("Content-Length")
+	r.Header.Del("Transfer-Encoding")
+	return nil
+}
+
+// checkResponseFraming verifies that a fully read origin body agrees with the
+// framing headers that would be stored and replayed with it.
+func checkResponseFraming(resp *http.Response, body []byte) error {
+	cl := resp.Header.Get("Content-Length")
+	if cl == "" {
+		return nil
+	}
+	if len(resp.TransferEncoding) > 0 {
+		if strictFraming {
+			return fmt.Errorf("response has both Content-Length and Transfer-Encoding")
+		}
+		resp.Header.Del("Content-Length")
+		return nil
+	}
+	if resp.Request.Method == http.MethodHead || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		// These never carry a body, whatever Content-Length says
+		return nil
+	}
+	if n, err := strconv.ParseInt(cl, 10, 64); err != nil || n != int64(len(body)) {
+		return fmt.Errorf("Content-Length %q does not match the %d byte body", cl, len(body))
+	}
+	return nil
+}
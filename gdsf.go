@@ -0,0 +1,94 @@
+package main
+
+import (
+	"container/heap"
+	"time"
+)
+
+// gdsfPolicy implements Greedy-Dual-Size-Frequency eviction. Each entry has
+// the priority L + frequency * cost / size, where cost is how long the origin
+// took to produce it. The lowest priority is evicted and its value becomes the
+// new L, so entries that stop being accessed age out in favour of new ones.
+// Small, frequently used, expensive-to-fetch entries are kept longest.
+type gdsfPolicy struct {
+	inflation float64
+	items     map[string]*gdsfItem
+	queue     gdsfQueue
+}
+
+type gdsfItem struct {
+	key      string
+	freq     float64
+	cost     float64
+	size     float64
+	priority float64
+	index    int
+}
+
+func newGDSFPolicy() *gdsfPolicy {
+	return &gdsfPolicy{items: map[string]*gdsfItem{}}
+}
+
+func (p *gdsfPolicy) added(key string, c *CachedResponse) {
+	p.removed(key)
+	it := &gdsfItem{
+		key:  key,
+		freq: 1,
+		// Latency in milliseconds, at least 1 so never-measured entries
+		// still rank by size and frequency
+		cost: max(float64(c.FetchLatency)/float64(time.Millisecond), 1),
+		size: float64(max(c.size(), 1)),
+	}
+	it.priority = p.inflation + it.freq*it.cost/it.size
+	p.items[key] = it
+	heap.Push(&p.queue, it)
+}
+
+func (p *gdsfPolicy) accessed(key string) {
+	it, ok := p.items[key]
+	if !ok {
+		return
+	}
+	it.freq++
+	it.priority = p.inflation + it.freq*it.cost/it.size
+	heap.Fix(&p.queue, it.index)
+}
+
+func (p *gdsfPolicy) removed(key string) {
+	if it, ok := p.items[key]; ok {
+		heap.Remove(&p.queue, it.index)
+		delete(p.items, key)
+	}
+}
+
+func (p *gdsfPolicy) victim() (string, bool) {
+	if len(p.queue) == 0 {
+		return "", false
+	}
+	it := p.queue[0]
+	p.inflation = it.priority
+	return it.key, true
+}
+
+// gdsfQueue is a min-heap of items by priority.
+type gdsfQueue []*gdsfItem
+
+func (q gdsfQueue) Len() int           { return len(q) }
+func (q gdsfQueue) Less(i, j int) bool { return q[i].priority < q[j].priority }
+func (q gdsfQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index, q[j].index = i, j
+}
+
+func (q *gdsfQueue) Push(x any) {
+	it := x.(*gdsfItem)
+	it.index = len(*q)
+	*q = append(*q, it)
+}
+
+func (q *gdsfQueue) Pop() any {
+	old := *q
+	it := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return it
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// cacheGeneration namespaces every entry. Bumping it invalidates the whole
+// cache in O(1); stale entries are dropped when looked up or by a background
+// sweep.
+var cacheGeneration atomic.Uint64
+
+// sweepBatch is how many entries the sweeper inspects per lock acquisition, so
+// collecting a large cache never blocks the request path for long.
+const sweepBatch = 1000
+
+func bumpGeneration() uint64 {
+	gen := cacheGeneration.Add(1)
+	if disk != nil {
+		disk.saveState()
+	}
+	shareGenerations()
+	go sweepStaleEntries()
+	return gen
+}
+
+// sweepStaleEntries deletes entries invalidated by a global or namespace
+// generation bump.
+func sweepStaleEntries() {
+	cacheMutex.Lock()
+	keys := make([]string, 0, len(cache))
+	for k := range cache {
+		keys = append(keys, k)
+	}
+	cacheMutex.Unlock()
+
+	removed := 0
+	for start := 0; start < len(keys); start += sweepBatch {
+		end := min(start+sweepBatch, len(keys))
+		cacheMutex.Lock()
+		for _, k := range keys[start:end] {
+			if c, ok := cache[k]; ok && !c.live() {
+				removeEntryLocked(k)
+				removed++
+			}
+		}
+		cacheMutex.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	log.Printf("[Generation] Swept %d stale entries", removed)
+}
+
+// generationHandler reports the current cache generation; POST bumps it,
+// instantly invalidating every entry.
+func generationHandler(w http.ResponseWriter, r *http.Request) {
+	gen := cacheGeneration.Load()
+	if r.Method == http.MethodPost {
+		gen = bumpGeneration()
+		log.Printf("[Admin] Cache generation bumped to %d", gen)
+	}
+	writeJSON(w, http.StatusOK, map[string]uint64{"generation": gen})
+}
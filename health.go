@@ -0,0 +1,212 @@
+package main
+
+import (
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// originCheckInterval is how often readiness probes the origin backends; 0
+// leaves the origin out of readiness. With originFailover, unreachable
+// backends are also taken out of rotation.
+var (
+	originCheckInterval time.Duration
+	originCheckPath     = "/"
+	originFailover      bool
+)
+
+// originDownPage is sent, with originDownPageType, when no backend is up to
+// answer a request that isn't cached.
+var (
+	originDownPage     []byte
+	originDownPageType string
+)
+
+// originCheck is the outcome of the last reachability probe of a backend.
+type originCheck struct {
+	Backend   string    `json:"backend"`
+	Reachable bool      `json:"reachable"`
+	Status    int       `json:"status,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// lastOriginChecks holds the latest check of each backend.
+var lastOriginChecks = map[*backend]*atomic.Pointer[originCheck]{}
+
+// startOriginChecks probes every backend with GET originCheckPath every
+// originCheckInterval. Any answer below 500 counts as reachable: the origin
+// is up, whatever it thinks of the path.
+func startOriginChecks(t http.RoundTripper, pool *originPool) {
+	client := &http.Client{Transport: t, Timeout: min(originCheckInterval, 5*time.Second)}
+	for _, b := range pool.allBackends() {
+		lastOriginChecks[b] = &atomic.Pointer[originCheck]{}
+	}
+	go func() {
+		for {
+			for _, b := range pool.allBackends() {
+				go func() {
+					check := probeOrigin(client, b)
+					prev := lastOriginChecks[b].Swap(check)
+					if originFailover {
+						b.down.Store(!check.Reachable)
+					}
+					if prev == nil || prev.Reachable != check.Reachable {
+						switch {
+						case check.Reachable:
+							log.Printf("[Health] Origin %s is reachable", b.url)
+						case originFailover:
+							logf("warn", "[Health] Origin %s is unreachable, taking it out of rotation: %s", b.url, check.Error)
+						default:
+							logf("warn", "[Health] Origin %s is unreachable: %s", b.url, check.Error)
+						}
+					}
+				}()
+			}
+			time.Sleep(originCheckInterval)
+		}
+	}()
+}
+
+// available reports whether requests should be routed to the backend: it is
+// neither down nor paused.
+func (b *backend) available() bool {
+	return !b.down.Load() && !b.paused()
+}
+
+// allDown reports whether every backend of the pool is down.
+func (p *originPool) allDown() bool {
+	for _, b := range p.backends {
+		if !b.down.Load() {
+			return false
+		}
+	}
+	return true
+}
+
+// expiredEntry returns the memory entry for key even past its lifetime, to
+// serve while no backend is up to refresh it. no-cache entries are never
+// served unconfirmed.
+func expiredEntry(key string) (*CachedResponse, bool) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	c, ok := cache[key]
+	if !ok || !c.live() || revalidateOnReuse(c) {
+		return nil, false
+	}
+	return c, true
+}
+
+// loadOriginDownPage reads the page sent when every backend is down.
+func loadOriginDownPage(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	originDownPage = data
+	originDownPageType = mime.TypeByExtension(filepath.Ext(path))
+	if originDownPageType == "" {
+		originDownPageType = http.DetectContentType(data)
+	}
+	return nil
+}
+
+// writeOriginDown answers a request that no backend is up to serve.
+func writeOriginDown(w http.ResponseWriter, r *http.Request) {
+	logf("warn", "[Health] No origin backend is up for %s %s", r.Method, r.URL.String())
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, int(originCheckInterval.Seconds()))))
+	if originDownPage == nil {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", originDownPageType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if r.Method != http.MethodHead {
+		w.Write(originDownPage)
+	}
+}
+
+func probeOrigin(client *http.Client, b *backend) *originCheck {
+	check := &originCheck{Backend: b.url.String(), CheckedAt: time.Now()}
+	req, err := http.NewRequest(http.MethodGet, b.url.JoinPath(originCheckPath).String(), nil)
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	req.Host = b.host()
+	b.applyDefaultHeaders(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	check.Status = resp.StatusCode
+	check.Reachable = resp.StatusCode < 500
+	if !check.Reachable {
+		check.Error = "answered " + resp.Status
+	}
+	return check
+}
+
+// withHealthEndpoints answers GET /healthz and /readyz in front of next,
+// without authentication and without a request log entry, for load
+// balancer and Kubernetes probes.
+func withHealthEndpoints(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			switch r.URL.Path {
+			case "/healthz":
+				writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+				return
+			case "/readyz":
+				readyzHandler(w, r)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readyzHandler reports whether the proxy should receive traffic. Without
+// origin checks it is ready once it serves. With them, it is degraded while
+// any backend is unreachable and not ready (503) when none is reachable,
+// since then only cached URLs can be answered.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	status := "ok"
+	code := http.StatusOK
+	var checks []*originCheck
+	if originCheckInterval > 0 {
+		reachable := 0
+		for _, b := range origins.allBackends() {
+			check := lastOriginChecks[b].Load()
+			if check == nil {
+				// Not probed yet
+				check = &originCheck{Backend: b.url.String()}
+			}
+			if check.Reachable {
+				reachable++
+			}
+			checks = append(checks, check)
+		}
+		switch {
+		case reachable == 0:
+			status, code = "unavailable", http.StatusServiceUnavailable
+		case reachable < len(checks):
+			status = "degraded"
+		}
+	}
+	writeJSON(w, code, map[string]any{
+		"status":          status,
+		"origins":         checks,
+		"memory_pressure": memoryPressure.Load(),
+	})
+}
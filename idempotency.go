@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// idempotencyWindow is how long responses to requests carrying an
+// Idempotency-Key are kept for replay; 0 disables the layer.
+var idempotencyWindow time.Duration
+
+// maxIdempotentBody bounds the request and response bodies the layer handles;
+// larger exchanges are proxied without protection.
+const maxIdempotentBody = 1 << 20
+
+// idempotentExchange is the outcome of the first request made with a key.
+type idempotentExchange struct {
+	fingerprint string        // digest of the request body
+	done        chan struct{} // closed once the response is recorded
+	status      int
+	header      http.Header
+	body        []byte
+	expires     time.Time
+}
+
+var idempotency = struct {
+	sync.Mutex
+	exchanges map[string]*idempotentExchange
+}{exchanges: map[string]*idempotentExchange{}}
+
+// wantsIdempotency reports whether r is a non-idempotent request carrying an
+// Idempotency-Key.
+func wantsIdempotency(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return false
+	}
+	return idempotencyWindow > 0 && r.Header.Get("Idempotency-Key") != ""
+}
+
+// idempotencyScope identifies a key per caller, so one client's key never
+// replays a response for another.
+func idempotencyScope(r *http.Request, key string) string {
+	h := sha256.New()
+	for _, v := range []string{r.Method, r.URL.RequestURI(), key, r.Header.Get("Authorization"), r.Header.Get("Cookie")} {
+		h.Write([]byte(v))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// handleIdempotent replays the recorded response for a retried
+// Idempotency-Key instead of sending the request to the origin again. It
+// follows draft-ietf-httpapi-idempotency-key-header: reusing a key with a
+// different body is answered 422, and a retry racing the original 409.
+func handleIdempotent(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxIdempotentBody+1))
+	if err != nil || len(body) > maxIdempotentBody {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		next(w, r)
+		return
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	sum := sha256.Sum256(body)
+	fingerprint := hex.EncodeToString(sum[:])
+	scope := idempotencyScope(r, r.Header.Get("Idempotency-Key"))
+
+	idempotency.Lock()
+	ex, ok := idempotency.exchanges[scope]
+	if ok && time.Now().After(ex.expires) {
+		delete(idempotency.exchanges, scope)
+		ok = false
+	}
+	var recorded idempotentExchange
+	finished := false
+	if ok {
+		// The exchange is recorded and done closed under the lock, so this
+		// copy is either complete or still in progress.
+		recorded, finished = *ex, isClosed(ex.done)
+	} else {
+		ex = &idempotentExchange{fingerprint: fingerprint, done: make(chan struct{}), expires: time.Now().Add(idempotencyWindow)}
+		idempotency.exchanges[scope] = ex
+	}
+	idempotency.Unlock()
+
+	if ok {
+		switch {
+		case recorded.fingerprint != fingerprint:
+			http.Error(w, "Idempotency-Key reused with a different request body", http.StatusUnprocessableEntity)
+		case !finished:
+			http.Error(w, "A request with this Idempotency-Key is still being processed", http.StatusConflict)
+		case recorded.status == 0:
+			// The original failed and was not recorded: retry it for real
+			next(w, r)
+		default:
+			log.Printf("[Idempotency] Replaying response for %s %s", r.Method, r.URL.String())
+			for k, vv := range recorded.header {
+				w.Header()[k] = vv
+			}
+			w.Header().Set("X-Cache", "REPLAY")
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(recorded.status)
+			w.Write(recorded.body)
+		}
+		return
+	}
+
+	rec := &captureWriter{ResponseWriter: w, body: &limitedBuffer{max: maxIdempotentBody + 1}}
+	next(rec, r)
+
+	// Let failed or oversized exchanges be retried for real
+	idempotency.Lock()
+	if rec.status == 0 || rec.status >= 500 || len(rec.body.buf) > maxIdempotentBody {
+		delete(idempotency.exchanges, scope)
+	} else {
+		ex.status, ex.body = rec.status, rec.body.buf
+		ex.header = w.Header().Clone()
+		ex.header.Del("X-Cache")
+	}
+	close(ex.done)
+	idempotency.Unlock()
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// sweepIdempotency drops expired exchanges.
+func sweepIdempotency() {
+	for range time.Tick(time.Minute) {
+		now := time.Now()
+		idempotency.Lock()
+		for k, ex := range idempotency.exchanges {
+			if now.After(ex.expires) {
+				delete(idempotency.exchanges, k)
+			}
+		}
+		idempotency.Unlock()
+	}
+}
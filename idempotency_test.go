@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A retry that finds the original exchange failed goes to the origin instead
+// of replaying a response that was never recorded.
+func TestIdempotencyFailedOriginal(t *testing.T) {
+	idempotencyWindow = time.Minute
+	defer func() { idempotencyWindow = 0 }()
+	failing := func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "origin down", http.StatusBadGateway)
+	}
+	post := func() *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(`{"id":1}`))
+		r.Header.Set("Idempotency-Key", "k1")
+		return r
+	}
+
+	t.Run("concurrent", func(t *testing.T) {
+		for i := 0; i < 200; i++ {
+			var wg sync.WaitGroup
+			statuses := make([]int, 2)
+			for j := range statuses {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					w := httptest.NewRecorder()
+					handleIdempotent(w, post(), failing)
+					statuses[j] = w.Code
+				}()
+			}
+			wg.Wait()
+			for _, status := range statuses {
+				if status != http.StatusBadGateway && status != http.StatusConflict {
+					t.Fatalf("round %d: status %d, want 502 or 409", i, status)
+				}
+			}
+		}
+	})
+
+	t.Run("finished without a response", func(t *testing.T) {
+		r := post()
+		done := make(chan struct{})
+		close(done)
+		body := `{"id":1}`
+		idempotency.Lock()
+		idempotency.exchanges[idempotencyScope(r, "k1")] = &idempotentExchange{fingerprint: sha256Hex([]byte(body)), done: done, expires: time.Now().Add(time.Minute)}
+		idempotency.Unlock()
+
+		w := httptest.NewRecorder()
+		handleIdempotent(w, r, failing)
+		if w.Code != http.StatusBadGateway || w.Header().Get("Idempotent-Replayed") != "" {
+			t.Errorf("status %d, replayed %q, want the origin's 502", w.Code, w.Header().Get("Idempotent-Replayed"))
+		}
+	})
+}
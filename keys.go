@@ -0,0 +1,218 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Page sizes of GET /__admin/keys.
+const (
+	defaultKeyPage = 100
+	maxKeyPage     = 1000
+)
+
+// keySorts extract the value GET /__admin/keys orders entries by; ties are
+// broken by key. Age is ordered by the store time, newest first.
+var keySorts = map[string]func(e listedKey) int64{
+	"key":  func(e listedKey) int64 { return 0 },
+	"size": func(e listedKey) int64 { return e.c.size() },
+	"age":  func(e listedKey) int64 { return -e.c.Timestamp.UnixNano() },
+	"hits": func(e listedKey) int64 { return e.Hits },
+}
+
+// listedKey is one entry of a key listing.
+type listedKey struct {
+	Key        string  `json:"key"`
+	Size       int64   `json:"size"`
+	AgeSeconds float64 `json:"age_seconds"`
+	Hits       int64   `json:"hits"`
+
+	value int64
+	c     *CachedResponse
+}
+
+// keyCursor is the position after the last key of a page. It carries the
+// sort so it can't be reused with another one.
+type keyCursor struct {
+	Sort  string `json:"s"`
+	Desc  bool   `json:"d,omitempty"`
+	Value int64  `json:"v,omitempty"`
+	Key   string `json:"k"`
+}
+
+func (c keyCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeKeyCursor(s string) (keyCursor, error) {
+	var c keyCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(data, &c)
+	}
+	if err != nil {
+		return c, fmt.Errorf("invalid cursor")
+	}
+	return c, nil
+}
+
+// keyQuery selects and orders a page of keys.
+type keyQuery struct {
+	prefix string
+	regex  *regexp.Regexp
+	sort   string
+	desc   bool
+	limit  int
+	after  *keyCursor
+}
+
+func parseKeyQuery(r *http.Request) (keyQuery, error) {
+	q := r.URL.Query()
+	kq := keyQuery{prefix: q.Get("prefix"), sort: "key", limit: defaultKeyPage}
+	if s := q.Get("regex"); s != "" {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return kq, fmt.Errorf("invalid regex: %v", err)
+		}
+		kq.regex = re
+	}
+	if s := q.Get("sort"); s != "" {
+		if keySorts[s] == nil {
+			return kq, fmt.Errorf("unknown sort %q (want key, size, age or hits)", s)
+		}
+		kq.sort = s
+	}
+	switch q.Get("order") {
+	case "", "asc":
+	case "desc":
+		kq.desc = true
+	default:
+		return kq, fmt.Errorf("unknown order %q (want asc or desc)", q.Get("order"))
+	}
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > maxKeyPage {
+			return kq, fmt.Errorf("limit must be between 1 and %d", maxKeyPage)
+		}
+		kq.limit = n
+	}
+	if s := q.Get("cursor"); s != "" {
+		c, err := decodeKeyCursor(s)
+		if err != nil {
+			return kq, err
+		}
+		if c.Sort != kq.sort || c.Desc != kq.desc {
+			return kq, fmt.Errorf("cursor belongs to another sort order")
+		}
+		kq.after = &c
+	}
+	return kq, nil
+}
+
+// before reports whether a comes before b in the query's order.
+func (q keyQuery) before(aValue int64, aKey string, bValue int64, bKey string) bool {
+	switch {
+	case aValue != bValue:
+		return aValue < bValue != q.desc
+	case aKey != bKey:
+		return aKey < bKey != q.desc
+	}
+	return false
+}
+
+func (q keyQuery) match(key string) bool {
+	return strings.HasPrefix(key, q.prefix) && (q.regex == nil || q.regex.MatchString(key))
+}
+
+// keyPage is a heap holding the first entries of a listing, with the last
+// of them on top so it can be dropped when an earlier one turns up.
+type keyPage struct {
+	q       keyQuery
+	entries []listedKey
+}
+
+func (p *keyPage) Len() int { return len(p.entries) }
+func (p *keyPage) Less(i, j int) bool {
+	a, b := p.entries[i], p.entries[j]
+	return p.q.before(b.value, b.Key, a.value, a.Key)
+}
+func (p *keyPage) Swap(i, j int) { p.entries[i], p.entries[j] = p.entries[j], p.entries[i] }
+func (p *keyPage) Push(x any)    { p.entries = append(p.entries, x.(listedKey)) }
+func (p *keyPage) Pop() any {
+	e := p.entries[len(p.entries)-1]
+	p.entries = p.entries[:len(p.entries)-1]
+	return e
+}
+
+// listKeys returns the page of keys after the query's cursor, and whether
+// more follow. Like the dump, it only copies the entries while holding
+// cacheMutex, so a slow regex never holds up cache hits. It then makes a
+// single pass over them keeping only limit+1 candidates, so the cost of a
+// page doesn't grow with the page number.
+func listKeys(q keyQuery) ([]listedKey, bool) {
+	cacheMutex.Lock()
+	all := make([]listedKey, 0, len(cache))
+	for k, c := range cache {
+		all = append(all, listedKey{Key: k, c: c, Hits: c.hits})
+	}
+	cacheMutex.Unlock()
+
+	value := keySorts[q.sort]
+	page := &keyPage{q: q, entries: []listedKey{}}
+	now := time.Now()
+	for _, e := range all {
+		if !q.match(e.Key) {
+			continue
+		}
+		e.value = value(e)
+		if q.after != nil && !q.before(q.after.Value, q.after.Key, e.value, e.Key) {
+			continue
+		}
+		if page.Len() > q.limit {
+			last := page.entries[0]
+			if !q.before(e.value, e.Key, last.value, last.Key) {
+				continue
+			}
+			heap.Pop(page)
+		}
+		heap.Push(page, e)
+	}
+
+	entries := page.entries
+	sort.Slice(entries, func(i, j int) bool {
+		return q.before(entries[i].value, entries[i].Key, entries[j].value, entries[j].Key)
+	})
+	more := len(entries) > q.limit
+	entries = entries[:min(len(entries), q.limit)]
+	for i := range entries {
+		entries[i].Size = entries[i].c.size()
+		entries[i].AgeSeconds = now.Sub(entries[i].c.Timestamp).Seconds()
+	}
+	return entries, more
+}
+
+// keysHandler lists cached keys a page at a time, filtered by prefix and
+// regular expression and sorted by key, size, age or hits.
+func keysHandler(w http.ResponseWriter, r *http.Request) {
+	q, err := parseKeyQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries, more := listKeys(q)
+	resp := map[string]any{"keys": entries}
+	if more {
+		last := entries[len(entries)-1]
+		resp["next_cursor"] = keyCursor{Sort: q.sort, Desc: q.desc, Value: last.value, Key: last.Key}.encode()
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
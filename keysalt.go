@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// keySalt mixes a route-specific salt into cache keys, so a breaking origin
+// change can be rolled out by changing the salt instead of purging: entries
+// keyed under the old salt are simply never looked up again.
+type keySalt struct {
+	pattern pathPattern
+	static  string
+	header  string // derive the salt from this request header instead
+}
+
+var keySalts []keySalt
+
+// parseKeySalt parses PATTERN=SALT or PATTERN=header:NAME, e.g.
+// "/api/*=2024-06" or "/api/*=header:X-API-Version".
+func parseKeySalt(spec string) (keySalt, error) {
+	pattern, salt, ok := strings.Cut(spec, "=")
+	if !ok || salt == "" {
+		return keySalt{}, fmt.Errorf("invalid key salt %q (want PATTERN=SALT or PATTERN=header:NAME)", spec)
+	}
+	p, err := parsePathPattern(pattern)
+	if err != nil {
+		return keySalt{}, err
+	}
+	if name, ok := strings.CutPrefix(salt, "header:"); ok {
+		return keySalt{pattern: p, header: http.CanonicalHeaderKey(name)}, nil
+	}
+	return keySalt{pattern: p, static: salt}, nil
+}
+
+// saltKeySuffix returns the salt of the first rule matching the request.
+func saltKeySuffix(r *http.Request) string {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	for _, s := range keySalts {
+		if !s.pattern.match(r.URL.Path) {
+			continue
+		}
+		salt := s.static
+		if s.header != "" {
+			salt = s.header + ":" + r.Header.Get(s.header)
+		}
+		return "#salt=" + url.QueryEscape(salt)
+	}
+	return ""
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Log formats accepted by --log-format.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// minLogLevel is the least severe level written to the process log, one of
+// logLevels. Lines logged with the standard log package count as info.
+var (
+	minLogLevel = logLevels["debug"]
+	jsonLogs    bool
+)
+
+// textLogger writes leveled lines in text mode, bypassing levelWriter so they
+// are not counted as info.
+var textLogger = log.New(os.Stderr, "", log.LstdFlags)
+
+// processLogLine is one line of the process log in JSON mode.
+type processLogLine struct {
+	Time      time.Time `json:"time"`
+	Level     string    `json:"level"`
+	Component string    `json:"component,omitempty"`
+	Msg       string    `json:"msg"`
+}
+
+// setupLogging applies --log-level and --log-format to the standard logger.
+func setupLogging(level, format string) error {
+	n, ok := logLevels[level]
+	if !ok {
+		return fmt.Errorf("unknown --log-level %q (want debug, info, warn or error)", level)
+	}
+	switch format {
+	case logFormatText:
+	case logFormatJSON:
+		jsonLogs = true
+		log.SetFlags(0)
+	default:
+		return fmt.Errorf("unknown --log-format %q (want text or json)", format)
+	}
+	minLogLevel = n
+	log.SetOutput(levelWriter{os.Stderr})
+	return nil
+}
+
+// levelWriter receives the lines of the standard logger as info.
+type levelWriter struct{ out io.Writer }
+
+func (w levelWriter) Write(p []byte) (int, error) {
+	if logLevels["info"] < minLogLevel {
+		return len(p), nil
+	}
+	if !jsonLogs {
+		return w.out.Write(p)
+	}
+	writeJSONLog(w.out, "info", strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+// logEnabled reports whether lines at level are written.
+func logEnabled(level string) bool {
+	return logLevels[level] >= minLogLevel
+}
+
+// logf logs a line at level, which is one of logLevels.
+func logf(level, format string, args ...any) {
+	if !logEnabled(level) {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if jsonLogs {
+		writeJSONLog(os.Stderr, level, msg)
+		return
+	}
+	textLogger.Output(2, msg)
+}
+
+// fatalf logs at error level, which no --log-level hides, and exits.
+func fatalf(format string, args ...any) {
+	logf("error", format, args...)
+	os.Exit(1)
+}
+
+// writeJSONLog writes msg as one JSON line, lifting a leading "[Component]"
+// tag into its own field.
+func writeJSONLog(out io.Writer, level, msg string) {
+	line := processLogLine{Time: time.Now(), Level: level, Msg: msg}
+	if rest, ok := strings.CutPrefix(msg, "["); ok {
+		if component, text, ok := strings.Cut(rest, "] "); ok && !strings.ContainsAny(component, " ]") {
+			line.Component, line.Msg = component, text
+		}
+	}
+	data, _ := json.Marshal(line)
+	out.Write(append(data, '\n'))
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// routineLog rate-limits the per-request log lines, so a hot cached URL does
+// not produce thousands of identical lines per second. They are logged at
+// debug level. Errors and warnings are logged directly and never limited.
+var routineLog = &quietLog{hitSample: 1, recent: map[string]*repeatedLine{}}
+
+// quietLog samples cache hit lines and drops lines repeated within a window.
+type quietLog struct {
+	mu        sync.Mutex
+	hitSample int64 // log 1 in hitSample hits
+	hits      int64
+	window    time.Duration // 0 disables deduplication
+	recent    map[string]*repeatedLine
+}
+
+type repeatedLine struct {
+	at         time.Time
+	suppressed int
+}
+
+// maxRecentLines bounds the deduplication map between prunes.
+const maxRecentLines = 10000
+
+// hit logs a cache hit line, 1 in hitSample.
+func (q *quietLog) hit(format string, args ...any) {
+	if !logEnabled("debug") {
+		return
+	}
+	q.mu.Lock()
+	q.hits++
+	skip := q.hitSample > 1 && q.hits%q.hitSample != 1
+	q.mu.Unlock()
+	if !skip {
+		q.printf(format, args...)
+	}
+}
+
+// printf logs a line unless the same line was logged within the window. The
+// next line logged after the window reports how many copies were dropped.
+func (q *quietLog) printf(format string, args ...any) {
+	if !logEnabled("debug") {
+		return
+	}
+	q.mu.Lock()
+	if q.window <= 0 {
+		q.mu.Unlock()
+		logf("debug", format, args...)
+		return
+	}
+	line := fmt.Sprintf(format, args...)
+	now := time.Now()
+	if r, ok := q.recent[line]; ok && now.Sub(r.at) < q.window {
+		r.suppressed++
+		q.mu.Unlock()
+		return
+	}
+	suppressed := 0
+	if r, ok := q.recent[line]; ok {
+		suppressed = r.suppressed
+	}
+	if len(q.recent) >= maxRecentLines {
+		for l, r := range q.recent {
+			if now.Sub(r.at) >= q.window {
+				delete(q.recent, l)
+			}
+		}
+	}
+	q.recent[line] = &repeatedLine{at: now}
+	q.mu.Unlock()
+
+	if suppressed > 0 {
+		line += fmt.Sprintf(" (%d identical lines suppressed)", suppressed)
+	}
+	logf("debug", "%s", line)
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recentLogSize is how many request log events are kept for GET /__admin/logs.
+const recentLogSize = 200
+
+var logLevels = map[string]int{"debug": 0, "info": 1, "warn": 2, "error": 3}
+
+// requestLogEvent is the structured record published for every proxied request.
+type requestLogEvent struct {
+	Time       time.Time `json:"time"`
+	Level      string    `json:"level"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	Cache      string    `json:"cache"`
+	DurationMs float64   `json:"duration_ms"`
+	Bytes      int64     `json:"bytes"`
+	ClientIP   string    `json:"client_ip"`
+	// Error classifies failed requests, e.g. origin_timeout or client_aborted.
+	Error string `json:"error,omitempty"`
+
+	span *traceSpan
+	// Request details only the access log reports.
+	requestURI, proto, user, referer, userAgent string
+}
+
+// logFilter selects events by minimum level and route pattern.
+type logFilter struct {
+	level   int
+	pattern pathPattern
+}
+
+func (f logFilter) match(e *requestLogEvent) bool {
+	return logLevels[e.Level] >= f.level && (f.pattern == "" || f.pattern.match(e.Path))
+}
+
+// logBus fans request log events out to stream subscribers and keeps the most
+// recent ones. Slow subscribers lose events rather than slowing requests down.
+type logBus struct {
+	mu     sync.Mutex
+	subs   map[chan *requestLogEvent]logFilter
+	recent []*requestLogEvent
+	next   int
+}
+
+var requestLogs = &logBus{subs: map[chan *requestLogEvent]logFilter{}}
+
+func (b *logBus) publish(e *requestLogEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.recent) < recentLogSize {
+		b.recent = append(b.recent, e)
+	} else {
+		b.recent[b.next] = e
+		b.next = (b.next + 1) % recentLogSize
+	}
+	for ch, f := range b.subs {
+		if f.match(e) {
+			select {
+			case ch <- e:
+			default:
+			}
+		}
+	}
+}
+
+func (b *logBus) subscribe(f logFilter) chan *requestLogEvent {
+	ch := make(chan *requestLogEvent, 256)
+	b.mu.Lock()
+	b.subs[ch] = f
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *logBus) unsubscribe(ch chan *requestLogEvent) {
+	b.mu.Lock()
+	delete(b.subs, ch)
+	b.mu.Unlock()
+}
+
+// snapshot returns the retained events matching f, oldest first.
+func (b *logBus) snapshot(f logFilter) []*requestLogEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var out []*requestLogEvent
+	for i := range b.recent {
+		e := b.recent[(b.next+i)%len(b.recent)]
+		if f.match(e) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// statusRecorder captures the final status and size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 && status >= 200 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter { return r.ResponseWriter }
+
+// withRequestLog publishes a structured log event for every request. The event
+// travels in the request context so the proxy can classify failures on it.
+func withRequestLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := &requestLogEvent{Time: time.Now(), Level: "info", Method: r.Method, Path: r.URL.Path, ClientIP: clientIP(r)}
+		if accessLog != nil {
+			e.requestURI, e.proto, e.referer, e.userAgent = r.RequestURI, r.Proto, r.Referer(), r.UserAgent()
+			e.user, _, _ = r.BasicAuth()
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		r = r.WithContext(context.WithValue(r.Context(), requestLogKey, e))
+		if e.span = startServerSpan(r); e.span != nil {
+			r = withSpan(r, e.span)
+		}
+		defer func() {
+			// ReverseProxy aborts the handler when copying the body fails
+			if err := recover(); err != nil {
+				if e.Error == "" {
+					e.Error = errOriginReset
+					if r.Context().Err() != nil {
+						e.Error = errClientAborted
+					}
+				}
+				publishRequestLog(e, rec, w)
+				panic(err)
+			}
+			publishRequestLog(e, rec, w)
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+func publishRequestLog(e *requestLogEvent, rec *statusRecorder, w http.ResponseWriter) {
+	e.Status = rec.status
+	if e.Status == 0 && e.Error == errClientAborted {
+		e.Status = statusClientClosedRequest
+	}
+	e.Cache = w.Header().Get("X-Cache")
+	e.DurationMs = float64(time.Since(e.Time).Microseconds()) / 1000
+	e.Bytes = rec.bytes
+	switch {
+	case e.Status >= 500:
+		e.Level = "error"
+	case e.Status >= 400, e.Error != "":
+		e.Level = "warn"
+	}
+	requestLogs.publish(e)
+	requestMetrics.observeRequest(e)
+	accessLog.write(e)
+	e.span.finishRequest(e)
+}
+
+func parseLogFilter(q url.Values) (logFilter, error) {
+	var f logFilter
+	if lvl := q.Get("level"); lvl != "" {
+		n, ok := logLevels[lvl]
+		if !ok {
+			return f, fmt.Errorf("unknown level %q", lvl)
+		}
+		f.level = n
+	}
+	if p := q.Get("path"); p != "" {
+		pattern, err := parsePathPattern(p)
+		if err != nil {
+			return f, err
+		}
+		f.pattern = pattern
+	}
+	return f, nil
+}
+
+// recentLogsHandler returns the retained request log events as JSON lines.
+func recentLogsHandler(w http.ResponseWriter, r *http.Request) {
+	f, err := parseLogFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for _, e := range requestLogs.snapshot(f) {
+		enc.Encode(e)
+	}
+}
+
+// logStreamHandler streams request log events as server-sent events until the
+// client disconnects.
+func logStreamHandler(w http.ResponseWriter, r *http.Request) {
+	f, err := parseLogFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rc := http.NewResponseController(w)
+	ch := requestLogs.subscribe(f)
+	defer requestLogs.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case e := <-ch:
+			data, _ := json.Marshal(e)
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// runLogsCommand implements "caching-proxy logs": it prints the recent request
+// log of a remote instance, or tails it with -f.
+func runLogsCommand(args []string) {
+	fs := flag.NewFlagSet("logs", flag.ExitOnError)
+	adminURL := fs.String("admin-url", "http://localhost:8080", "Base URL of the proxy's admin API")
+	token := fs.String("admin-token", os.Getenv("CACHING_PROXY_ADMIN_TOKEN"), "Admin API token (defaults to $CACHING_PROXY_ADMIN_TOKEN)")
+	follow := fs.Bool("f", false, "Follow the log stream")
+	level := fs.String("level", "", "Minimum level: debug, info, warn or error")
+	pathFilter := fs.String("path", "", "Only show requests matching this route pattern")
+	fs.Parse(args)
+
+	q := url.Values{}
+	if *level != "" {
+		q.Set("level", *level)
+	}
+	if *pathFilter != "" {
+		q.Set("path", *pathFilter)
+	}
+	endpoint := "/__admin/logs"
+	if *follow {
+		endpoint = "/__admin/logs/stream"
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(*adminURL, "/")+endpoint+"?"+q.Encode(), nil)
+	if err != nil {
+		log.Fatalf("Invalid admin URL: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+*token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatalf("Failed to reach admin API: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("Admin API returned %s", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if *follow {
+			var ok bool
+			if line, ok = strings.CutPrefix(line, "data: "); !ok {
+				continue
+			}
+		}
+		var e requestLogEvent
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			continue
+		}
+		fmt.Printf("%s %-5s %s %s %d %s %.1fms %dB %s %s\n", e.Time.Format(time.RFC3339), e.Level, e.Method, e.Path, e.Status, e.Cache, e.DurationMs, e.Bytes, e.ClientIP, e.Error)
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("Log stream interrupted: %v", err)
+	}
+}
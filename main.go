@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -9,7 +10,9 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -20,137 +23,1229 @@ type CachedResponse struct {
 	StatusCode int
 	Headers    http.Header
 	Timestamp  time.Time
+	// FetchLatency is how long the origin took to produce the response.
+	FetchLatency time.Duration
+	// Lifetime is the freshness lifetime the origin gave the response; 0 means
+	// none was given and --cache-ttl applies.
+	Lifetime time.Duration
+	// Backend is the origin replica that produced the response.
+	Backend string
+	// Generation is the cache generation the entry was stored in; entries from
+	// older generations are treated as purged.
+	Generation uint64
+	// Namespace is the configured route namespace the entry belongs to ("" for
+	// the default namespace), with that namespace's generation at store time.
+	Namespace           string
+	NamespaceGeneration uint64
+
+	pool *cachePool
+	// hits counts the cache hits served from the entry, guarded by
+	// cacheMutex.
+	hits int64
+}
+
+// size approximates the memory held by an entry: its body plus header bytes.
+func (c *CachedResponse) size() int64 {
+	n := int64(len(c.Response))
+	for k, vv := range c.Headers {
+		for _, v := range vv {
+			n += int64(len(k) + len(v))
+		}
+	}
+	return n
 }
 
 var cache = make(map[string]*CachedResponse)
 var cacheMutex sync.Mutex
-var globalOriginURL *url.URL
+
+// cacheTTL is how long entries without an origin freshness lifetime are
+// served before being fetched again; 0 keeps them until purged or evicted.
+var cacheTTL time.Duration
+
+// defaultTTL returns --cache-ttl, which a configuration reload may change.
+func defaultTTL() time.Duration {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return cacheTTL
+}
+
+var origins *originPool
+
+// live reports whether neither the global nor the entry's namespace generation
+// has been bumped since it was stored.
+func (c *CachedResponse) live() bool {
+	if c.Generation != cacheGeneration.Load() {
+		return false
+	}
+	if c.Namespace == "" {
+		return true
+	}
+	ns := namespaceByName(c.Namespace)
+	return ns != nil && ns.generation.Load() == c.NamespaceGeneration
+}
+
+// expired reports whether the entry has outlived its freshness lifetime, or
+// --cache-ttl when the origin gave none.
+func (c *CachedResponse) expired() bool {
+	if c.Lifetime > 0 {
+		return time.Since(c.Timestamp) > c.Lifetime
+	}
+	ttl := defaultTTL()
+	return ttl > 0 && time.Since(c.Timestamp) > ttl
+}
+
+// lookupEntry returns the live entry for key.
+func lookupEntry(key string) (*CachedResponse, bool) {
+	return entryStore.Get(key)
+}
+
+func storeEntry(key string, c *CachedResponse) {
+	if maxCacheBytes > 0 && c.size() > int64(maxCacheBytes) {
+		log.Printf("[Cache] Not storing cacheKey '%s': %d bytes exceed --max-cache-bytes", key, c.size())
+		return
+	}
+	stampGenerations(key, c)
+	entryStore.Set(key, c)
+}
+
+// stampGenerations marks c as stored in the current cache generation and
+// that of its namespace.
+func stampGenerations(key string, c *CachedResponse) {
+	c.Generation = cacheGeneration.Load()
+	if ns := namespaceFor(cacheKeyPath(key)); ns != nil {
+		c.Namespace, c.NamespaceGeneration = ns.name, ns.generation.Load()
+	}
+}
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "logs" {
+		runLogsCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		runDoctorCommand(os.Args[2:])
+		return
+	}
+
 	port := flag.Int("port", 8080, "Port to run the caching proxy server on")
-	originStr := flag.String("origin", "", "URL of the origin server")
-	clearCache := flag.Bool("clear-cache", false, "Clear the cache and exit")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate (chain) to serve HTTPS with on --port; re-read on SIGHUP")
+	tlsKey := flag.String("tls-key", "", "PEM private key of --tls-cert")
+	var acmeDomains stringList
+	flag.Var(&acmeDomains, "acme-domain", "Domain to obtain and renew a certificate for from an ACME CA such as Let's Encrypt, serving HTTPS on --port (repeatable; one certificate covers them all)")
+	acmeEmail := flag.String("acme-email", "", "Contact address registered with the ACME CA for expiry notices")
+	acmeDirectory := flag.String("acme-directory", letsEncryptDirectory, "ACME directory URL")
+	acmeCacheDir := flag.String("acme-cache-dir", "acme", "Directory the ACME account key and certificate are kept in")
+	acmeHTTPPort := flag.Int("acme-http-port", 80, "Plain HTTP port answering HTTP-01 challenges and redirecting to HTTPS (0 uses TLS-ALPN-01 challenges on --port instead)")
+	originStr := flag.String("origin", "", "URL of the origin server (comma-separated list for multiple replicas)")
+	sticky := flag.String("sticky-sessions", stickyNone, "Session affinity for non-cacheable requests across origin replicas: none, cookie or ip")
+	var hostOriginSpecs stringList
+	flag.Var(&hostOriginSpecs, "host-origin", "Send requests for a Host to its own origin, as HOST=URL[,URL...] (repeatable); other hosts go to --origin, or get 421 without it. Implies --key-include-host")
+	var tenantRateSpecs, tenantBandwidthSpecs, tenantCacheSpecs stringList
+	flag.Var(&tenantRateSpecs, "tenant-rate", "Request rate limit of a --host-origin host, as HOST=RATE[:BURST] requests per second; excess requests get 429 (repeatable)")
+	flag.Var(&tenantBandwidthSpecs, "tenant-bandwidth", "Egress bandwidth shared by all responses of a --host-origin host, as HOST=RATE, e.g. example.com=10MB (repeatable)")
+	flag.Var(&tenantCacheSpecs, "tenant-cache", "Most cache memory the entries of a --host-origin host may take, as HOST=SIZE (repeatable)")
+	loadBalance := flag.String("load-balance", balanceRoundRobin, "How cache misses are spread across origin replicas: round-robin or least-connections (fewest requests in flight)")
+	stickyCookieName := flag.String("sticky-cookie", "cp_backend", "Cookie name used by --sticky-sessions=cookie")
+	flag.StringVar(&clientNoCache, "client-no-cache", noCacheRevalidate, "Handling of requests with Cache-Control: no-cache or max-age=0: revalidate (conditional origin request), refresh (full origin request) or ignore")
+	flag.IntVar(&maxEntries, "max-entries", 0, "Maximum number of cached entries; the least recently used are evicted beyond it (0 means unlimited)")
+	flag.Var(&maxCacheBytes, "max-cache-bytes", "Maximum total size of cached bodies and headers, e.g. 512MB; the least recently used entries are evicted beyond it (0 means unlimited)")
+	flag.DurationVar(&cacheTTL, "cache-ttl", 0, "How long cached entries are served before they are fetched again from the origin (0 keeps them until purged)")
+	var transportConfig originTransportConfig
+	flag.DurationVar(&transportConfig.expectContinueTimeout, "expect-continue-timeout", time.Second, "How long uploads with Expect: 100-continue wait for the origin's 100 Continue before the body is sent anyway")
+	flag.StringVar(&transportConfig.bindAddr, "origin-bind-addr", "", "Local IP address or interface name to make origin connections from")
+	flag.StringVar(&transportConfig.ipPreference, "origin-ip-preference", "", "Address family to dial origins with first: ipv4 or ipv6 (default: resolver order)")
+	flag.BoolVar(&transportConfig.dualStack, "origin-dual-stack", true, "Fall back to the other address family when dialing origins (Happy Eyeballs)")
+	flag.DurationVar(&transportConfig.fallbackDelay, "origin-fallback-delay", 300*time.Millisecond, "How long to wait for the preferred address family before racing the other one")
+	flag.IntVar(&transportConfig.prewarm, "origin-prewarm", 0, "Number of warm connections to keep open to each origin backend")
+	flag.StringVar(&transportConfig.caFile, "origin-ca", "", "PEM bundle of CA certificates trusted for https origins, on top of the system roots")
+	flag.BoolVar(&transportConfig.insecureSkipVerify, "origin-insecure-skip-verify", false, "Accept any certificate from https origins, without verification (insecure; for testing only)")
+	originDenyPrivate := flag.Bool("origin-deny-private", false, "Refuse to connect to origins at private (RFC 1918 and unique local) addresses")
+	var originDenySpecs, originAllowSpecs stringList
+	flag.Var(&originDenySpecs, "origin-deny-cidr", "Address range origin connections may not be made to, on top of link-local and metadata addresses (repeatable)")
+	flag.Var(&originAllowSpecs, "origin-allow-cidr", "Address range origin connections may be made to even if denied otherwise (repeatable)")
+	originRetries := flag.Int("origin-retries", 0, "Number of times to retry idempotent requests that fail to reach the origin")
+	retryBudgetRatio := flag.Float64("retry-budget", 0.1, "Maximum ratio of retries to requests over the retry budget window")
+	retryBudgetWindow := flag.Duration("retry-budget-window", 10*time.Second, "Sliding window over which the retry budget is computed")
+	flag.IntVar(&rangePrefetchCount, "range-prefetch", 0, "Number of following byte-range segments to prefetch after a single-range request")
+	flag.BoolVar(&prefetchPreload, "prefetch-preload", false, "Prefetch same-origin URLs from Link: rel=preload response headers into the cache")
+	flag.BoolVar(&earlyHints, "early-hints", false, "Send 103 Early Hints built from stored Link preload headers on cache hits")
+	var validateSpecs stringList
+	flag.Var(&validateSpecs, "validate", "Response validation rule PATTERN=CHECK[,CHECK...] with checks json, sniff, schema:FILE and reject (repeatable)")
+	var memoryLimit byteSize
+	flag.Var(&memoryLimit, "memory-limit", "Memory limit used for emergency eviction (e.g. 512MB); defaults to the container cgroup limit")
+	memoryHigh := flag.Float64("memory-high-watermark", 0.9, "Fraction of --memory-limit at which emergency eviction starts and new stores pause")
+	memoryLow := flag.Float64("memory-low-watermark", 0.75, "Fraction of --memory-limit emergency eviction brings usage back down to")
+	var purgeSchedules stringList
+	flag.Var(&purgeSchedules, "purge-schedule", "Scheduled purge as a cron expression followed by a route pattern, e.g. \"0 3 * * * /news/*\" (repeatable)")
+	var ttlSchedules stringList
+	flag.Var(&ttlSchedules, "ttl-schedule", "Lifetime of entries stored for a route while a cron expression matches, overriding the origin's, e.g. \"* 9-17 * * mon-fri /live/* ttl=10s\" (repeatable, first match wins)")
+	flag.BoolVar(&originCompression, "origin-compression", true, "Request gzip from the origin for cacheable requests and store entries compressed, decoding them for clients that don't accept gzip unless marked no-transform. Brotli is not requested, as the proxy has no decoder for it")
+	flag.BoolVar(&generateETags, "generate-etag", false, "Attach a body-hash ETag to cached responses the origin sent without one")
+	flag.BoolVar(&strictFraming, "strict-framing", false, "Reject requests and origin responses with framing anomalies instead of normalizing them")
+	flag.BoolVar(&strictHTTP, "strict-http", false, "Enable strict RFC 9110/9111 shared-cache semantics (storage rules, Age, Via, Max-Forwards)")
+	flag.BoolVar(&debugHeaders, "debug-headers", false, "Expose X-Cache-Key and X-Cache-Backend headers on responses and honor X-Cache-As-Of")
+	shadowInterval := flag.Duration("shadow-revalidate-interval", 0, "How often to compare a random sample of cached entries against the origin (0 disables)")
+	shadowSample := flag.Int("shadow-revalidate-sample", 10, "Number of entries compared per shadow revalidation round")
+	flag.IntVar(&keepVersions, "keep-versions", 0, "Number of superseded versions of each entry to retain for time-travel debugging")
+	var poolSpecs, poolRouteSpecs stringList
+	flag.Var(&poolSpecs, "cache-pool", "Named cache pool NAME=SIZE[:POLICY] with its own size budget and eviction policy (repeatable)")
+	flag.Var(&poolRouteSpecs, "pool-route", "Bind requests matching PATTERN to a cache pool, as PATTERN=POOL (repeatable)")
+	flag.Float64Var(&sampling.rate, "sample-rate", 0, "Fraction of requests to capture in full (headers and truncated bodies) for the admin API")
+	var samplePaths stringList
+	flag.Var(&samplePaths, "sample-path", "Always capture requests matching this route pattern (repeatable)")
+	flag.IntVar(&sampling.bodyBytes, "sample-body-bytes", 4096, "Maximum body bytes kept per captured request and response")
+	flag.IntVar(&samples.size, "sample-buffer", 100, "Number of captured requests kept")
+	flag.DurationVar(&clientWriteTimeout, "client-write-timeout", 30*time.Second, "How long a client may take to accept each chunk of a cached body before the response is aborted (0 disables)")
+	flag.Var(&clientBandwidth, "client-bandwidth", "Maximum rate per connection at which cached bodies are sent, in bytes per second (e.g. 5MB; 0 is unlimited)")
+	flag.BoolVar(&allowEncodedSlashes, "allow-encoded-slashes", false, "Forward paths containing %2F or %5C instead of rejecting them; they are cached under their escaped form")
+	flag.BoolVar(&keyIncludeHost, "key-include-host", false, "Include the request Host in cache keys, for proxies serving several sites")
+	flag.DurationVar(&idempotencyWindow, "idempotency-window", 0, "How long responses to non-cacheable requests with an Idempotency-Key are kept and replayed to retries (0 disables)")
+	var cacheRuleSpecs stringList
+	flag.Var(&cacheRuleSpecs, "cache-rule", "Caching policy of a route as a pattern followed by ttl=DURATION (lifetime when the origin gives none) or no-cache (bypass the cache), e.g. \"/static/* ttl=24h\" (repeatable, first match wins)")
+	var dedupSpecs stringList
+	flag.Var(&dedupSpecs, "dedup-route", "Answer identical concurrent non-GET requests on a route with one origin response, as PATTERN=WINDOW, e.g. /api/orders/*=2s (repeatable, first match wins)")
+	var sizeStatsSpecs stringList
+	flag.Var(&sizeStatsSpecs, "size-stats-route", "Route pattern to group response size statistics by (repeatable, first match wins; default: first path segment)")
+	var warmSeeds stringList
+	flag.Var(&warmSeeds, "warm-url", "Path or URL to fetch into the cache at startup (repeatable)")
+	flag.IntVar(&warming.depth, "warm-depth", 0, "How many links deep the warm-up crawler follows same-origin links from HTML pages")
+	flag.IntVar(&warming.concurrency, "warm-concurrency", 4, "Number of concurrent warm-up fetches")
+	flag.BoolVar(&warming.robots, "warm-robots", false, "Skip URLs disallowed by the origin's robots.txt while warming")
+	flag.StringVar(&bypassHeader, "bypass-header", bypassHeader, "Request header carrying the --bypass-token")
+	flag.StringVar(&bypassToken, "bypass-token", os.Getenv("CACHING_PROXY_BYPASS_TOKEN"), "Secret that, sent in --bypass-header, forces an origin fetch and cache refresh (defaults to $CACHING_PROXY_BYPASS_TOKEN)")
+	cacheDir := flag.String("cache-dir", "", "Directory to persist cached entries in, so the cache survives restarts (default: memory only)")
+	flag.BoolVar(&readOnly, "read-only", false, "Serve hits only, from --cache-dir or a shared --store that another instance writes; misses get 504 and the origin is never contacted")
+	var diskLimit byteSize
+	flag.Var(&diskLimit, "disk-limit", "Most space the --cache-dir entry files may take (e.g. 10GB); 0 means unlimited")
+	diskHigh := flag.Float64("disk-high-watermark", 0.9, "Fraction of --disk-limit at which least recently used entries are evicted")
+	diskLow := flag.Float64("disk-low-watermark", 0.75, "Fraction of --disk-limit eviction brings disk usage back down to")
+	storeName := flag.String("store", "memory", "Where cached entries are kept: memory, redis or memcached to share entries with other replicas, or peers to fill local misses from other nodes")
+	flag.Var(&peerSettings.urls, "peer", "Admin API URL of another node asked for local misses with --store=peers, e.g. http://10.0.0.2:9090 (repeatable)")
+	flag.DurationVar(&peerSettings.timeout, "peer-timeout", 100*time.Millisecond, "How long a local miss waits for peers before going to the origin")
+	flag.StringVar(&redisSettings.addr, "redis-addr", "localhost:6379", "Redis server address for --store=redis")
+	flag.StringVar(&redisSettings.password, "redis-password", os.Getenv("REDIS_PASSWORD"), "Redis password (defaults to $REDIS_PASSWORD)")
+	flag.IntVar(&redisSettings.db, "redis-db", 0, "Redis database number")
+	flag.StringVar(&redisSettings.prefix, "redis-prefix", "caching-proxy:", "Prefix of every Redis key, so several proxies can share one server")
+	flag.StringVar(&memcachedSettings.addrs, "memcached-addr", "localhost:11211", "Comma-separated memcached servers for --store=memcached")
+	flag.StringVar(&memcachedSettings.prefix, "memcached-prefix", "caching-proxy:", "Prefix of every memcached key, so several proxies can share the servers")
+	flag.IntVar(&storeQueueSize, "store-queue-size", storeQueueSize, "Writes to the shared store that may wait in its write-behind queue; further writes are dropped")
+	flag.DurationVar(&memcachedSettings.syncInterval, "memcached-sync-interval", 5*time.Second, "How often generation bumps and invalidations made by other replicas are picked up from memcached")
+	var keySaltSpecs stringList
+	flag.Var(&keySaltSpecs, "key-salt", "Salt mixed into the cache keys of a route, as PATTERN=SALT or PATTERN=header:NAME (repeatable, first match wins)")
+	var signRouteSpecs stringList
+	flag.Var(&signRouteSpecs, "sign-route", "Sign origin requests of a route, as PATTERN=sigv4:REGION:SERVICE (credentials from AWS_* variables) or PATTERN=hmac:ENV[:HEADER] (repeatable, first match wins)")
+	var oauthRouteSpecs stringList
+	flag.Var(&oauthRouteSpecs, "oauth-route", "Authenticate origin requests of a route with an OAuth2 client-credentials token, as PATTERN=TOKEN_URL[,scope=SCOPES][,client=PREFIX] (repeatable, first match wins)")
+	var acceptVariantSpecs stringList
+	flag.Var(&acceptVariantSpecs, "accept-variants", "Cache a route per Accept representation, as PATTERN=BUCKET,... with buckets json, xml, html, text or media types; the first is the default (repeatable)")
+	var clientClassSpecs, bandwidthLimitSpecs stringList
+	flag.Var(&clientClassSpecs, "client-class", "Named class of clients as NAME=CIDR,... for bandwidth limits (repeatable)")
+	flag.Var(&bandwidthLimitSpecs, "bandwidth-limit", "Per-connection egress rate limit as PATTERN=RATE[:CLASS], e.g. /downloads/*=5MB (repeatable, first match wins)")
+	var methodPolicySpecs, routeMethodSpecs, cacheableMethodSpecs stringList
+	flag.Var(&cacheableMethodSpecs, "cacheable-method", "Additional method whose responses are cached, as METHOD or METHOD:body to key by the request body (repeatable)")
+	flag.Var(&methodPolicySpecs, "method-policy", "Policy for a method as METHOD=pass|reject|local, * for unknown methods (repeatable)")
+	flag.Var(&routeMethodSpecs, "route-methods", "Methods accepted on a route as PATTERN=METHOD,... (repeatable)")
+	var namespaceSpecs stringList
+	flag.Var(&namespaceSpecs, "namespace", "Cache namespace NAME=PATTERN that can be cleared on its own via the admin API (repeatable)")
+	flag.StringVar(&adminToken, "admin-token", "", "Bearer token enabling the /__admin/ API (disabled when empty)")
+	accessLogPath := flag.String("access-log", "", "Write an access log in Apache combined format, with duration and cache status appended, to this file (- for standard output)")
+	logLevel := flag.String("log-level", "debug", "Minimum level of process log lines: debug (includes per-request lines), info, warn or error")
+	logFormat := flag.String("log-format", logFormatText, "Process log format: text or json (one object per line)")
+	flag.Int64Var(&routineLog.hitSample, "log-sample-hits", 1, "Log only 1 in N cache HIT lines (errors are always logged)")
+	flag.DurationVar(&routineLog.window, "log-dedup-window", 0, "Drop routine per-request log lines repeated within this window, e.g. 1s (0 logs every line)")
+	var purgeAllowSpecs stringList
+	flag.Var(&purgeAllowSpecs, "purge-allow", "Client address or CIDR allowed to send PURGE requests on the proxy port (repeatable)")
+	flag.StringVar(&purgeToken, "purge-token", os.Getenv("CACHING_PROXY_PURGE_TOKEN"), "Token that, sent in X-Purge-Token, authorizes PURGE requests (defaults to $CACHING_PROXY_PURGE_TOKEN)")
+	var syntheticSpecs stringList
+	flag.Var(&syntheticSpecs, "synthetic-check", "Path or URL requested through the proxy periodically to monitor its availability (repeatable)")
+	flag.DurationVar(&syntheticInterval, "synthetic-interval", 30*time.Second, "How often the synthetic checks run")
+	flag.DurationVar(&syntheticTimeout, "synthetic-timeout", 10*time.Second, "How long a synthetic check may take before it counts as failed")
+	var originSNISpecs, originHostSpecs stringList
+	flag.Var(&originSNISpecs, "origin-sni", "TLS server name sent to, and verified against, the https origin with this host, as HOST=NAME; a HOST of * sets every origin (repeatable)")
+	flag.Var(&originHostSpecs, "origin-host-header", "Host header sent to the origin with this host instead of its address, as HOST=NAME; a HOST of * sets every origin (repeatable)")
+	var originCredentialSpecs stringList
+	flag.Var(&originCredentialSpecs, "origin-credentials", "Whether client Authorization, Proxy-Authorization and Cookie headers reach the origin with this host, as HOST=forward|strip; a HOST of * sets every origin (repeatable, later entries win; default forward)")
+	var originHeaderSpecs stringList
+	flag.Var(&originHeaderSpecs, "origin-header", "Default header sent to the origin with this host when the client request lacks it, as HOST=NAME:VALUE; a VALUE of $VAR is read from the environment (repeatable)")
+	metricsPushURL := flag.String("metrics-push-url", "", "Prometheus Pushgateway base URL or remote-write endpoint the metrics are pushed to (pushing is off when empty)")
+	metricsPushFormat := flag.String("metrics-push-format", "pushgateway", "How --metrics-push-url takes metrics: pushgateway or remote-write")
+	metricsPushInterval := flag.Duration("metrics-push-interval", 15*time.Second, "How often metrics are pushed to --metrics-push-url")
+	metricsPushJob := flag.String("metrics-push-job", "caching-proxy", "Job label of pushed metrics")
+	var metricsPushLabels stringList
+	flag.Var(&metricsPushLabels, "metrics-push-label", "name=value label added to pushed metrics, e.g. instance=proxy-1 (repeatable)")
+	otlpEndpoint := flag.String("otlp-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "OTLP/HTTP collector URL spans are exported to, e.g. http://localhost:4318 (defaults to $OTEL_EXPORTER_OTLP_ENDPOINT; tracing is off when empty)")
+	traceSample := flag.Float64("trace-sample", 1, "Fraction of requests without a sampled traceparent that start a trace")
+	traceService := flag.String("trace-service-name", "caching-proxy", "service.name reported with exported spans")
+	healthEndpoints := flag.Bool("health-endpoints", false, "Answer GET /healthz and /readyz on the proxy port instead of forwarding them (they are always served on --admin-port)")
+	flag.DurationVar(&originCheckInterval, "readiness-origin-check", 0, "How often /readyz probes each origin backend; unreachable backends make the proxy degraded, and none reachable not ready (0 leaves origins out of readiness)")
+	flag.StringVar(&originCheckPath, "readiness-origin-path", "/", "Path requested from each backend by --readiness-origin-check")
+	flag.DurationVar(&negativeTTL, "negative-ttl", 0, "How long a failed origin fetch (5xx or no answer) of a cacheable key is answered from memory, so retries don't hammer a failing origin (0 disables)")
+	negativeExcludeStatus := flag.String("negative-exclude-status", "", "Comma-separated statuses never remembered by --negative-ttl, e.g. 503,504")
+	flag.BoolVar(&originFailover, "origin-failover", false, "Stop routing requests to backends --readiness-origin-check finds unreachable; with none up, serve cached content where possible and 503 otherwise")
+	originDownPagePath := flag.String("origin-down-page", "", "File sent with the 503 answered when no origin backend is up (requires --origin-failover)")
+	var featureSpecs stringList
+	flag.Var(&featureSpecs, "enable-feature", "Comma-separated experimental features to enable (repeatable); GET /__admin/features lists them")
+	configPath := flag.String("config", "", "YAML or TOML file of options, keyed by flag name; flags given on the command line override it")
+	adminPort := flag.Int("admin-port", 0, "Serve the /__admin/ API on this management port instead of the proxy port")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "How long in-flight requests may take to finish after SIGINT or SIGTERM")
+	shutdownReportPath := flag.String("shutdown-report", "", "File to write the JSON shutdown report to, on top of the log")
+	clearCache := flag.Bool("clear-cache", false, "Delete the entries persisted in --cache-dir and exit")
 
 	flag.Parse()
+	if *configPath != "" {
+		configReload = newConfigReloader(flag.CommandLine, *configPath)
+		if err := configReload.load(); err != nil {
+			fatalf("Invalid --config: %v", err)
+		}
+	}
+	if err := setupLogging(*logLevel, *logFormat); err != nil {
+		fatalf("Invalid logging configuration: %v", err)
+	}
+
+	if err := enableFeatures(featureSpecs); err != nil {
+		fatalf("Invalid --enable-feature: %v", err)
+	}
 
 	if *clearCache {
+		if *cacheDir == "" {
+			fatalf("--clear-cache requires --cache-dir: without it the cache only lives in memory")
+		}
 		fmt.Println("Clearing cache...")
-		cacheMutex.Lock()
-		cache = make(map[string]*CachedResponse)
-		cacheMutex.Unlock()
-		fmt.Println("Cache cleared successfully.")
+		n, err := clearDiskCache(*cacheDir)
+		if err != nil {
+			fatalf("Could not clear %s: %v", *cacheDir, err)
+		}
+		fmt.Printf("Cache cleared successfully (%d entries deleted from %s).\n", n, *cacheDir)
 		return
 	}
 
-	if *originStr == "" {
-		log.Fatal("--origin URL is required")
+	switch clientNoCache {
+	case noCacheRevalidate, noCacheRefresh, noCacheIgnore:
+	default:
+		fatalf("Invalid --client-no-cache %q (want revalidate, refresh or ignore)", clientNoCache)
+	}
+
+	if *originStr == "" && len(hostOriginSpecs) == 0 {
+		fatalf("--origin URL is required")
 	}
 
 	var err error
-	globalOriginURL, err = url.Parse(*originStr)
+	origins, err = newOriginPool(*originStr, *sticky, *stickyCookieName, *loadBalance)
+	if err != nil {
+		fatalf("Invalid origin configuration: %v", err)
+	}
+	for _, spec := range hostOriginSpecs {
+		if err := origins.addHostOrigin(spec); err != nil {
+			fatalf("Invalid --host-origin: %v", err)
+		}
+	}
+	for _, l := range []struct {
+		flag  string
+		specs stringList
+		set   func(*tenant, string) error
+	}{
+		{"tenant-rate", tenantRateSpecs, (*tenant).setRate},
+		{"tenant-bandwidth", tenantBandwidthSpecs, (*tenant).setBandwidth},
+		{"tenant-cache", tenantCacheSpecs, (*tenant).setCacheShare},
+	} {
+		for _, spec := range l.specs {
+			if err := addTenantLimit(spec, l.set); err != nil {
+				fatalf("Invalid --%s: %v", l.flag, err)
+			}
+		}
+	}
+	if len(hostOriginSpecs) > 0 {
+		// Hosts are cached separately, like with --key-include-host
+		keyIncludeHost = true
+	}
+	for _, spec := range originCredentialSpecs {
+		if err := origins.setCredentialPolicy(spec); err != nil {
+			fatalf("Invalid --origin-credentials: %v", err)
+		}
+	}
+	for _, spec := range originHeaderSpecs {
+		if err := origins.addDefaultHeader(spec); err != nil {
+			fatalf("Invalid --origin-header: %v", err)
+		}
+	}
+	for _, spec := range originSNISpecs {
+		if err := origins.setOriginName(spec, true); err != nil {
+			fatalf("Invalid --origin-sni: %v", err)
+		}
+	}
+	for _, spec := range originHostSpecs {
+		if err := origins.setOriginName(spec, false); err != nil {
+			fatalf("Invalid --origin-host-header: %v", err)
+		}
+	}
+	transportConfig.serverNames = origins.serverNames()
+
+	for _, spec := range validateSpecs {
+		rule, err := parseValidationRule(spec)
+		if err != nil {
+			fatalf("Invalid --validate rule: %v", err)
+		}
+		validationRules = append(validationRules, rule)
+	}
+
+	for _, spec := range poolSpecs {
+		pool, err := parseCachePool(spec)
+		if err != nil {
+			fatalf("Invalid --cache-pool: %v", err)
+		}
+		if poolByName(pool.name) != nil {
+			fatalf("Duplicate --cache-pool %q", pool.name)
+		}
+		cachePools = append(cachePools, pool)
+	}
+	for _, spec := range poolRouteSpecs {
+		route, err := parsePoolRoute(spec)
+		if err != nil {
+			fatalf("Invalid --pool-route: %v", err)
+		}
+		poolRoutes = append(poolRoutes, route)
+	}
+
+	for _, spec := range cacheRuleSpecs {
+		rule, err := parseCacheRule(spec)
+		if err != nil {
+			fatalf("Invalid --cache-rule: %v", err)
+		}
+		cacheRules = append(cacheRules, rule)
+	}
+
+	for _, spec := range sizeStatsSpecs {
+		p, err := parsePathPattern(spec)
+		if err != nil {
+			fatalf("Invalid --size-stats-route: %v", err)
+		}
+		sizeStatsRoutes = append(sizeStatsRoutes, p)
+	}
+
+	for _, spec := range keySaltSpecs {
+		s, err := parseKeySalt(spec)
+		if err != nil {
+			fatalf("Invalid --key-salt: %v", err)
+		}
+		keySalts = append(keySalts, s)
+	}
+
+	for _, spec := range signRouteSpecs {
+		rule, err := parseSigningRule(spec)
+		if err != nil {
+			fatalf("Invalid --sign-route: %v", err)
+		}
+		signingRules = append(signingRules, rule)
+	}
+
+	for _, spec := range acceptVariantSpecs {
+		a, err := parseAcceptVariants(spec)
+		if err != nil {
+			fatalf("Invalid --accept-variants: %v", err)
+		}
+		acceptVariantRules = append(acceptVariantRules, a)
+	}
+
+	for _, spec := range clientClassSpecs {
+		c, err := parseClientClass(spec)
+		if err != nil {
+			fatalf("Invalid --client-class: %v", err)
+		}
+		clientClasses = append(clientClasses, c)
+	}
+	for _, spec := range bandwidthLimitSpecs {
+		l, err := parseBandwidthLimit(spec)
+		if err != nil {
+			fatalf("Invalid --bandwidth-limit: %v", err)
+		}
+		bandwidthLimits = append(bandwidthLimits, l)
+	}
+
+	for _, spec := range methodPolicySpecs {
+		if err := parseMethodPolicy(spec); err != nil {
+			fatalf("Invalid --method-policy: %v", err)
+		}
+	}
+	for _, spec := range cacheableMethodSpecs {
+		if err := parseCacheableMethod(spec); err != nil {
+			fatalf("Invalid --cacheable-method: %v", err)
+		}
+	}
+	for _, spec := range routeMethodSpecs {
+		rule, err := parseRouteMethods(spec)
+		if err != nil {
+			fatalf("Invalid --route-methods: %v", err)
+		}
+		routeMethodRules = append(routeMethodRules, rule)
+	}
+
+	for _, spec := range samplePaths {
+		p, err := parsePathPattern(spec)
+		if err != nil {
+			fatalf("Invalid --sample-path: %v", err)
+		}
+		sampling.patterns = append(sampling.patterns, p)
+	}
+	if keepVersions < 0 {
+		fatalf("--keep-versions must not be negative")
+	}
+	if samples.size <= 0 {
+		fatalf("--sample-buffer must be positive")
+	}
+
+	for _, spec := range namespaceSpecs {
+		ns, err := parseNamespace(spec)
+		if err != nil {
+			fatalf("Invalid --namespace: %v", err)
+		}
+		if namespaceByName(ns.name) != nil {
+			fatalf("Duplicate --namespace %q", ns.name)
+		}
+		namespaces = append(namespaces, ns)
+	}
+
+	var scheduledPurges []*scheduledPurge
+	for _, spec := range purgeSchedules {
+		p, err := parseScheduledPurge(spec)
+		if err != nil {
+			fatalf("Invalid --purge-schedule: %v", err)
+		}
+		scheduledPurges = append(scheduledPurges, p)
+	}
+	if len(scheduledPurges) > 0 {
+		go runPurgeScheduler(scheduledPurges)
+	}
+	for _, spec := range ttlSchedules {
+		s, err := parseScheduledTTL(spec)
+		if err != nil {
+			fatalf("Invalid --ttl-schedule: %v", err)
+		}
+		scheduledTTLs = append(scheduledTTLs, s)
+	}
+
+	if *retryBudgetWindow < retryBudgetBuckets {
+		fatalf("--retry-budget-window is too small")
+	}
+	transportConfig.addresses, err = newAddressPolicy(*originDenyPrivate, originDenySpecs, originAllowSpecs)
 	if err != nil {
-		log.Fatalf("Invalid origin URL: %v", err)
+		fatalf("Invalid origin address policy: %v", err)
+	}
+	if err := checkOriginAddresses(transportConfig.addresses, origins); err != nil {
+		fatalf("Refusing to start: %v", err)
+	}
+	originTransport, err := newOriginTransport(transportConfig)
+	if err != nil {
+		fatalf("Invalid origin connection settings: %v", err)
+	}
+	if transportConfig.prewarm > 0 {
+		go prewarmOrigins(originTransport, origins, transportConfig.prewarm)
+	}
+	for _, spec := range oauthRouteSpecs {
+		route, err := parseOAuthRoute(spec, &http.Client{Transport: originTransport})
+		if err != nil {
+			fatalf("Invalid --oauth-route: %v", err)
+		}
+		oauthRoutes = append(oauthRoutes, route)
+	}
+	var transport http.RoundTripper = &metricsTransport{base: originTransport}
+	if *originRetries > 0 {
+		transport = &retryTransport{
+			base:    transport,
+			retries: *originRetries,
+			backoff: 50 * time.Millisecond,
+			budget:  newRetryBudget(*retryBudgetRatio, *retryBudgetWindow, 3),
+		}
+	}
+
+	if *traceSample < 0 || *traceSample > 1 {
+		fatalf("--trace-sample must be between 0 and 1")
+	}
+	if *metricsPushURL != "" {
+		if *metricsPushInterval <= 0 {
+			fatalf("Invalid --metrics-push-interval: must be positive")
+		}
+		if *metricsPushFormat != "pushgateway" && *metricsPushFormat != "remote-write" {
+			fatalf("Invalid --metrics-push-format: %q (want pushgateway or remote-write)", *metricsPushFormat)
+		}
+		if *metricsPushJob == "" {
+			fatalf("Invalid --metrics-push-job: must not be empty")
+		}
+		labels, err := parseMetricLabels(metricsPushLabels)
+		if err != nil {
+			fatalf("Invalid --metrics-push-label: %v", err)
+		}
+		if pusher, err = newMetricsPusher(*metricsPushURL, *metricsPushFormat, *metricsPushJob, labels); err != nil {
+			fatalf("Invalid --metrics-push-url: %v", err)
+		}
+		go pusher.run(*metricsPushInterval)
+		log.Printf("[Metrics] Pushing metrics to %s (%s) every %s", pusher.url, pusher.format, *metricsPushInterval)
+	}
+	if *otlpEndpoint != "" {
+		if tracer, err = newSpanExporter(*otlpEndpoint, *traceService, *traceSample); err != nil {
+			fatalf("Invalid --otlp-endpoint: %v", err)
+		}
+		transport = &tracingTransport{base: transport}
+		go tracer.run()
+		log.Printf("[Tracing] Exporting spans to %s", tracer.endpoint)
+	}
+
+	if memoryLimit == 0 {
+		memoryLimit = byteSize(detectMemoryLimit())
+	}
+	if memoryLimit > 0 {
+		if *memoryLow <= 0 || *memoryLow >= *memoryHigh || *memoryHigh > 1 {
+			fatalf("Memory watermarks must satisfy 0 < --memory-low-watermark < --memory-high-watermark <= 1")
+		}
+		log.Printf("Memory guard enabled with a limit of %d bytes", memoryLimit)
+		guard := &memoryGuard{limit: int64(memoryLimit), high: *memoryHigh, low: *memoryLow}
+		go guard.run(time.Second)
+	}
+
+	if idempotencyWindow > 0 {
+		go sweepIdempotency()
+	}
+	for _, spec := range dedupSpecs {
+		rule, err := parseDedupRule(spec)
+		if err != nil {
+			fatalf("Invalid --dedup-route: %v", err)
+		}
+		dedupRules = append(dedupRules, rule)
+	}
+	if len(dedupRules) > 0 {
+		go sweepDedup()
+	}
+	if *negativeExcludeStatus != "" {
+		if negativeExcluded, err = parseStatusList(*negativeExcludeStatus); err != nil {
+			fatalf("Invalid --negative-exclude-status: %v", err)
+		}
+	}
+	if negativeTTL > 0 {
+		go sweepNegative()
+	}
+	if configReload != nil {
+		go configReload.watchSignals()
 	}
 
-	log.Printf("Starting caching proxy on :%d, forwarding to %s", *port, globalOriginURL.String())
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), createProxyHandler(globalOriginURL)))
+	if readOnly {
+		switch {
+		case *cacheDir == "" && *storeName == "memory":
+			fatalf("--read-only needs a store written by another instance: --cache-dir or a shared --store")
+		case *cacheDir != "" && *storeName != "memory":
+			fatalf("--read-only serves from either --cache-dir or a shared --store, not both")
+		case diskLimit > 0:
+			fatalf("--disk-limit does not apply to --read-only, which never writes --cache-dir")
+		case *shadowInterval > 0:
+			fatalf("--shadow-revalidate-interval cannot be used with --read-only, which never contacts the origin")
+		case originCheckInterval > 0:
+			fatalf("--readiness-origin-check cannot be used with --read-only, which never contacts the origin")
+		}
+	}
+
+	diffClient = &http.Client{Transport: transport, Timeout: 30 * time.Second}
+	if *shadowInterval > 0 {
+		if *shadowSample <= 0 {
+			fatalf("--shadow-revalidate-sample must be positive")
+		}
+		shadow = newShadowRevalidator(transport, *shadowSample)
+		go shadow.run(*shadowInterval)
+	}
+
+	if *cacheDir != "" && !readOnly {
+		if disk, err = openDiskCache(*cacheDir); err != nil {
+			fatalf("Invalid --cache-dir: %v", err)
+		}
+		disk.load()
+	}
+	if diskLimit > 0 {
+		if disk == nil {
+			fatalf("--disk-limit requires --cache-dir")
+		}
+		if *diskLow <= 0 || *diskLow >= *diskHigh || *diskHigh > 1 {
+			fatalf("Disk watermarks must satisfy 0 < --disk-low-watermark < --disk-high-watermark <= 1")
+		}
+		quota := &diskQuota{limit: int64(diskLimit), high: *diskHigh, low: *diskLow}
+		quota.check()
+		go quota.run(time.Second)
+		log.Printf("[Disk] Limiting %s to %d bytes (%d in use)", disk.dir, diskLimit, disk.usage())
+	}
+	if *storeName == "peers" {
+		if err := requireFeature(featurePeers, "--store=peers"); err != nil {
+			fatalf("Invalid --store: %v", err)
+		}
+	}
+	if storeQueueSize < 1 {
+		fatalf("Invalid --store-queue-size: must be at least 1")
+	}
+	if entryStore, err = openStore(*storeName); err != nil {
+		fatalf("Invalid --store: %v", err)
+	}
+	if readOnly {
+		if t, ok := entryStore.(*tieredStore); ok {
+			t.shared = readOnlyStore{t.shared}
+			log.Printf("[ReadOnly] Serving hits from the %s store only", *storeName)
+		} else {
+			replica, err := openDiskReplica(*cacheDir)
+			if err != nil {
+				fatalf("Invalid --cache-dir: %v", err)
+			}
+			entryStore = replica
+			log.Printf("[ReadOnly] Serving hits from %s only", *cacheDir)
+		}
+	}
+	if *storeName == "peers" && adminToken == "" && *adminPort == 0 {
+		fatalf("--store=peers needs the admin API (--admin-token or --admin-port), which serves entries to the other nodes")
+	}
+
+	handler := createProxyHandler(origins, transport)
+	if sampling.enabled() {
+		handler = withSampling(handler)
+	}
+	if len(bandwidthLimits) > 0 {
+		handler = withThrottle(handler)
+	}
+	if len(tenants) > 0 {
+		handler = withTenantLimits(handler)
+	}
+	if purgeAllow, err = parsePrefixes(purgeAllowSpecs); err != nil {
+		fatalf("Invalid --purge-allow: %v", err)
+	}
+	if purgeMethodEnabled() {
+		handler = withPurgeMethod(handler)
+	}
+	if *accessLogPath != "" {
+		if accessLog, err = openAccessLog(*accessLogPath); err != nil {
+			fatalf("Invalid --access-log: %v", err)
+		}
+	}
+	handler = withRequestLog(handler)
+	if *healthEndpoints {
+		handler = withHealthEndpoints(handler)
+	}
+	if originFailover && originCheckInterval <= 0 {
+		fatalf("--origin-failover requires --readiness-origin-check")
+	}
+	if *originDownPagePath != "" {
+		if !originFailover {
+			fatalf("--origin-down-page requires --origin-failover")
+		}
+		if err := loadOriginDownPage(*originDownPagePath); err != nil {
+			fatalf("Invalid --origin-down-page: %v", err)
+		}
+	}
+	if originCheckInterval > 0 {
+		startOriginChecks(originTransport, origins)
+	}
+	warming.seeds = warmSeeds
+	if len(warming.seeds) > 0 {
+		go runWarmup(handler, warming)
+	}
+	for _, spec := range syntheticSpecs {
+		c, err := newSyntheticCheck(spec)
+		if err != nil {
+			fatalf("Invalid --synthetic-check: %v", err)
+		}
+		syntheticChecks = append(syntheticChecks, c)
+	}
+	if len(syntheticChecks) > 0 {
+		if syntheticInterval <= 0 {
+			fatalf("--synthetic-interval must be positive")
+		}
+		go runSyntheticChecks(handler)
+	}
+	if *adminPort != 0 {
+		go serveAdminPort(*adminPort, handler)
+	} else if adminToken != "" {
+		handler = withAdminAPI(handler)
+	}
+
+	srv := &http.Server{Addr: fmt.Sprintf(":%d", *port), Handler: handler}
+	scheme := "http"
+	if *tlsCert != "" || *tlsKey != "" {
+		if *tlsCert == "" || *tlsKey == "" {
+			fatalf("--tls-cert and --tls-key must be given together")
+		}
+		cert, err := loadListenerCert(*tlsCert, *tlsKey)
+		if err != nil {
+			fatalf("Invalid --tls-cert/--tls-key: %v", err)
+		}
+		go cert.watchSignals()
+		srv.TLSConfig = cert.tlsConfig()
+		scheme = "https"
+	}
+	if len(acmeDomains) > 0 {
+		if srv.TLSConfig != nil {
+			fatalf("--acme-domain cannot be combined with --tls-cert")
+		}
+		acme, err := newACMEManager(acmeDomains, *acmeEmail, *acmeDirectory, *acmeCacheDir, *acmeHTTPPort != 0)
+		if err != nil {
+			fatalf("Invalid --acme-cache-dir: %v", err)
+		}
+		if *acmeHTTPPort != 0 {
+			go func() {
+				log.Printf("[ACME] Answering HTTP-01 challenges on :%d", *acmeHTTPPort)
+				fatalf("%v", http.ListenAndServe(fmt.Sprintf(":%d", *acmeHTTPPort), acme.httpHandler(*port)))
+			}()
+		}
+		go acme.run()
+		srv.TLSConfig = acme.tlsConfig()
+		scheme = "https"
+	}
+
+	log.Printf("Starting caching proxy on %s://:%d, forwarding to %s", scheme, *port, origins)
+	serveUntilSignal(srv, *shutdownTimeout, *shutdownReportPath)
 }
 
-func createProxyHandler(originURL *url.URL) http.Handler {
-	proxy := httputil.NewSingleHostReverseProxy(originURL)
+func createProxyHandler(pool *originPool, transport http.RoundTripper) http.Handler {
+	proxy := &httputil.ReverseProxy{Transport: transport}
+	var handler http.HandlerFunc
 
 	proxy.ModifyResponse = func(resp *http.Response) error {
-		cacheKey := generateCacheKey(resp.Request)
-		log.Printf("[ModifyResponse] Processing response for cacheKey: '%s'", cacheKey)
+		st := requestStateFrom(resp.Request)
+		// Set on the response rather than the ResponseWriter: forwarding 1xx
+		// interim responses clears the ResponseWriter's header map.
+		defer func() {
+			resp.Header.Set("X-Cache", st.cacheStatus)
+			if debugHeaders {
+				setDebugHeaders(resp.Header, st.cacheKey, st.backend.url.String())
+			}
+		}()
+
+		if strictHTTP {
+			addVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+		}
+		noteRetryAfter(st.backend, resp)
+		if resp.StatusCode == http.StatusUnauthorized {
+			invalidateOAuthToken(resp.Request)
+		}
+
+		if !st.cacheable {
+			pool.forBackend(st.backend).setAffinityCookie(resp, st.backend)
+			return nil
+		}
+		// Entries are stored as fetched; decode afterwards for clients that
+		// can't accept the compressed form
+		defer decodeOriginResponse(resp)
+
+		if st.revalidating != nil && resp.StatusCode == http.StatusNotModified {
+			refreshNotModified(st.cacheKey, st.revalidating, resp)
+			st.cacheStatus = "REVALIDATED"
+			return nil
+		}
+
+		cacheKey := st.cacheKey
+		routineLog.printf("[ModifyResponse] Processing response for cacheKey: '%s'", cacheKey)
 
 		// Read the entire response body
 		body, err := io.ReadAll(resp.Body)
 		if err != nil {
-			log.Printf("[ModifyResponse] Failed to read response body for cacheKey '%s': %v", cacheKey, err)
+			logf("warn", "[ModifyResponse] Failed to read response body for cacheKey '%s': %v", cacheKey, err)
 			return fmt.Errorf("failed to read response body for caching: %w", err)
 		}
 		// IMPORTANT: Restore the body for subsequent reads (i.e., for the proxy to send it to the client)
 		resp.Body = io.NopCloser(bytes.NewBuffer(body))
 
-		// Only cache successful responses (2xx range)
-		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-			cacheMutex.Lock()
-			cache[cacheKey] = &CachedResponse{
-				Response:   body,
-				StatusCode: resp.StatusCode,
-				Headers:    resp.Header, // Capture ALL headers from the origin response
-				Timestamp:  time.Now(),
-			}
-			cacheMutex.Unlock()
-			log.Printf("[ModifyResponse] Successfully cached response for cacheKey: '%s' (Status: %d, Size: %d bytes)", cacheKey, resp.StatusCode, len(body))
+		if err := checkResponseFraming(resp, body); err != nil {
+			if strictFraming {
+				logf("warn", "[ModifyResponse] Framing anomaly for cacheKey '%s', returning 502: %v", cacheKey, err)
+				replaceWithBadGateway(resp, "malformed response from origin")
+				return nil
+			}
+			logf("warn", "[ModifyResponse] Not caching response for cacheKey '%s': %v", cacheKey, err)
+			return nil
+		}
+
+		if resp.StatusCode >= 500 {
+			rememberFailedResponse(cacheKey, resp, body)
 		} else {
+			forgetFailure(cacheKey)
+		}
+
+		// Only cache successful responses (2xx range)
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 			log.Printf("[ModifyResponse] Not caching response for cacheKey: '%s' (Status: %d, not a 2xx success)", cacheKey, resp.StatusCode)
+			return nil
+		}
+
+		// A 226 carries a delta against the client's own copy, not a
+		// representation that can be replayed to anybody else
+		if resp.StatusCode == http.StatusIMUsed {
+			log.Printf("[ModifyResponse] Not caching response for cacheKey: '%s' (226 IM Used)", cacheKey)
+			return nil
+		}
+
+		if ok, reason := responseStorable(resp); !ok {
+			log.Printf("[ModifyResponse] Not caching response for cacheKey: '%s' (%s)", cacheKey, reason)
+			return nil
+		}
+		if strictHTTP {
+			if ok, reason := strictStorable(resp.Request, resp); !ok {
+				log.Printf("[ModifyResponse] Not caching response for cacheKey: '%s' (%s)", cacheKey, reason)
+				return nil
+			}
+		}
+
+		// Keep malformed payloads from broken origin deploys out of the cache
+		if rule := findValidationRule(resp.Request.URL.Path); rule != nil {
+			if err := rule.validate(resp, body); err != nil {
+				if rule.reject {
+					logf("warn", "[ModifyResponse] Invalid response for cacheKey '%s', returning 502: %v", cacheKey, err)
+					replaceWithBadGateway(resp, "invalid response from origin")
+					return nil
+				}
+				logf("warn", "[ModifyResponse] Not caching invalid response for cacheKey '%s': %v", cacheKey, err)
+				return nil
+			}
+		}
+
+		recordResponseSize(cacheKey, len(body))
+
+		if memoryPressure.Load() {
+			log.Printf("[ModifyResponse] Not caching response for cacheKey: '%s' (memory pressure)", cacheKey)
+			return nil
+		}
+
+		if generateETags && servesRepresentation(resp.StatusCode) && resp.Header.Get("ETag") == "" {
+			resp.Header.Set("ETag", bodyETag(body))
+		}
+
+		// Responses that vary are stored per variant of the request headers
+		cacheKey, ok := storageKey(cacheKey, st.clientHeader, resp)
+		if !ok {
+			log.Printf("[ModifyResponse] Not caching response for cacheKey: '%s' (Vary: *)", st.cacheKey)
+			return nil
+		}
+
+		storeEntry(cacheKey, &CachedResponse{
+			Response:     body,
+			StatusCode:   resp.StatusCode,
+			Headers:      resp.Header.Clone(), // Capture ALL headers from the origin response
+			Timestamp:    time.Now(),
+			Lifetime:     storedLifetime(cacheKey, resp.Header),
+			FetchLatency: time.Since(st.started),
+			Backend:      st.backend.url.String(),
+		})
+		routineLog.printf("[ModifyResponse] Successfully cached response for cacheKey: '%s' (Status: %d, Size: %d bytes)", cacheKey, resp.StatusCode, len(body))
+
+		if prefetchPreload && !st.background {
+			go prefetchPreloadLinks(handler, resp.Request, resp.Header)
 		}
 
 		return nil
 	}
 
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		class := classifyProxyError(r, err)
+		logf("error", "[ErrorHandler] Origin request failed for %s %s (%s): %v", r.Method, r.URL.String(), class, err)
+		noteRequestError(r, class)
+		st := requestStateFrom(r)
+		w.Header().Set("X-Cache", st.cacheStatus)
+		if class == errClientAborted {
+			return // nobody left to answer
+		}
+		if st.cacheable {
+			rememberFailure(st.cacheKey, http.StatusBadGateway, nil, nil)
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}
+
 	// Director modifies the request before it's sent to the origin.
 	proxy.Director = func(req *http.Request) {
+		backend := requestStateFrom(req).backend
+		originURL := backend.url
 		req.URL.Host = originURL.Host
 		req.URL.Scheme = originURL.Scheme
-		req.Host = originURL.Host // Crucial for many origin servers (virtual hosts)
+		req.Host = backend.host() // Crucial for many origin servers (virtual hosts)
 		req.Header.Del("X-Cache") // Ensure no X-Cache header is forwarded to origin
-		log.Printf("[Director] Forwarding request to origin: %s %s", req.Method, req.URL.String())
+		if strictHTTP {
+			addVia(req.Header, req.ProtoMajor, req.ProtoMinor)
+		}
+		backend.stripClientCredentials(req)
+		backend.applyDefaultHeaders(req)
+		if err := injectOAuthToken(req); err != nil {
+			logf("error", "[Director] Could not obtain OAuth token for %s: %v", req.URL.String(), err)
+		}
+		if err := signOutbound(req, time.Now()); err != nil {
+			logf("error", "[Director] Could not sign request for %s: %v", req.URL.String(), err)
+		}
+		routineLog.printf("[Director] Forwarding request to origin: %s %s", req.Method, req.URL.String())
 	}
 
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// For simplicity, we only cache GET requests.
-		if r.Method != http.MethodGet {
-			log.Printf("[Handler] Non-GET request (%s) for %s, bypassing cache.", r.Method, r.URL.String())
-			w.Header().Set("X-Cache", "BYPASS") // Indicate bypass for clarity
-			proxy.ServeHTTP(w, r)
+	// forward sends r to its backend, counting it in flight for
+	// --load-balance=least-connections.
+	forward := func(w http.ResponseWriter, r *http.Request) {
+		if readOnly {
+			writeReadOnlyMiss(w, r)
 			return
 		}
+		b := requestStateFrom(r).backend
+		b.inflight.Add(1)
+		defer b.inflight.Add(-1)
+		proxy.ServeHTTP(w, r)
+	}
+
+	handler = func(w http.ResponseWriter, r *http.Request) {
+		if err := checkRequestFraming(r); err != nil {
+			logf("warn", "[Handler] Rejecting request for %s: %v", r.URL.String(), err)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		if err := normalizeRequest(r); err != nil {
+			logf("warn", "[Handler] Rejecting request for %s: %v", r.URL.String(), err)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		target := pool.forHost(r.Host)
+		if target == nil {
+			logf("warn", "[Handler] No origin for host %q, rejecting %s", r.Host, r.URL.String())
+			http.Error(w, "Misdirected Request", http.StatusMisdirectedRequest)
+			return
+		}
+
+		if checkBypass(r) {
+			log.Printf("[Handler] Operator bypass for %s from %s", r.URL.String(), clientIP(r))
+			r = withForceRefresh(r)
+		}
+
+		if applyMethodPolicy(w, r) {
+			return
+		}
+
+		if strictHTTP && handleMaxForwards(w, r) {
+			return
+		}
+
+		background := isBackground(w)
+		if !background && rangePrefetchCount > 0 && r.Header.Get("Range") != "" {
+			// Warm the following segments once this one has been served
+			defer func() {
+				total := contentRangeTotal(w.Header())
+				go prefetchNextRanges(handler, r, total)
+			}()
+		}
+
+		routeCached := routeCacheable(r.URL.Path)
+		if routeCached && r.Method == http.MethodHead && !forceRefresh(r) && !wantsRevalidation(r) {
+			if key, c, ok := lookupHeadFromGet(r); ok && !revalidateOnReuse(c) {
+				routineLog.hit("[Handler] Cache HIT for HEAD from cacheKey: '%s'", key)
+				writeCached(w, r, key, c, "HIT")
+				return
+			}
+		}
+
+		keyable := false
+		if _, ok := cacheableMethods[r.Method]; ok && routeCached {
+			r, keyable = withBodyKey(r)
+		}
+		if !keyable {
+			routineLog.printf("[Handler] Non-cacheable request (%s) for %s, bypassing cache.", r.Method, r.URL.String())
+			// Indicate bypass for clarity
+			r = withRequestState(r, &requestState{backend: target.pick(r, false), cacheKey: generateCacheKey(r), cacheStatus: "BYPASS"})
+			if requestStateFrom(r).backend.down.Load() {
+				writeOriginDown(w, r)
+				return
+			}
+			if wantsIdempotency(r) {
+				handleIdempotent(w, r, forward)
+				return
+			}
+			if window := dedupWindow(r); window > 0 {
+				handleDeduplicated(w, r, window, forward)
+				return
+			}
+			forward(w, r)
+			return
+		}
+
+		normalizeAccept(r)
+		r = negotiateOriginEncoding(r)
 
 		// Generate the cache key using the consistent function
-		cacheKey := generateCacheKey(r)
-		log.Printf("[Handler] Incoming request for cacheKey: '%s'", cacheKey)
+		cacheKey := variantKey(generateCacheKey(r), r)
+		routineLog.printf("[Handler] Incoming request for cacheKey: '%s'", cacheKey)
+		spanFrom(r).set("cache.key", cacheKey)
 
-		// Try to serve from cache first
-		cacheMutex.Lock()
-		cachedResp, found := cache[cacheKey]
-		cacheMutex.Unlock()
+		if asOf := r.Header.Get("X-Cache-As-Of"); asOf != "" && debugHeaders {
+			serveAsOf(w, r, cacheKey, asOf)
+			return
+		}
+
+		if target.allDown() && !background {
+			if stale, ok := expiredEntry(cacheKey); ok && stale.expired() {
+				log.Printf("[Health] Serving expired cacheKey '%s' while no origin backend is up", cacheKey)
+				writeCached(w, r, cacheKey, stale, "STALE")
+				return
+			}
+		}
+
+		// Try to serve from cache first, unless a fresh copy was requested
+		var cachedResp *CachedResponse
+		found := false
+		if !forceRefresh(r) {
+			cachedResp, found = lookupEntry(cacheKey)
+		}
+
+		var revalidating *CachedResponse
+		switch {
+		case found && revalidateOnReuse(cachedResp):
+			log.Printf("[Handler] Stored response for cacheKey '%s' is no-cache, revalidating", cacheKey)
+			if addValidators(r, cachedResp) {
+				revalidating = cachedResp
+			}
+			found = false
+		case found && wantsRevalidation(r):
+			log.Printf("[Handler] Client asked to revalidate cacheKey: '%s'", cacheKey)
+			if clientNoCache == noCacheRevalidate && addValidators(r, cachedResp) {
+				revalidating = cachedResp
+			}
+			found = false
+		}
 
 		if found {
-			log.Printf("[Handler] Cache HIT for cacheKey: '%s'", cacheKey)
-			w.Header().Set("X-Cache", "HIT")
-			// Copy all headers from the cached response
-			for k, vv := range cachedResp.Headers {
-				// Avoid adding hop-by-hop headers that are specific to the origin connection
-				// (e.g., Connection, Transfer-Encoding)
-				if k == "Connection" || k == "Transfer-Encoding" {
-					continue
-				}
-				for _, v := range vv {
-					w.Header().Add(k, v)
-				}
+			routineLog.hit("[Handler] Cache HIT for cacheKey: '%s'", cacheKey)
+			if earlyHints && r.ProtoAtLeast(1, 1) {
+				sendEarlyHints(w, cachedResp.Headers)
 			}
-			// Explicitly set Content-Length from the cached response body
-			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(cachedResp.Response)))
-			w.WriteHeader(cachedResp.StatusCode)
-			w.Write(cachedResp.Response)
+			writeCached(w, r, cacheKey, cachedResp, "HIT")
+			return
+		}
+
+		// Operator bypasses and admin refreshes go to the origin whatever
+		// failed before; a success there forgets the failure.
+		if neg, ok := lookupNegative(cacheKey); ok && !forceRefresh(r) {
+			if background {
+				w.WriteHeader(neg.status)
+				return
+			}
+			if stale, ok := latestVersion(cacheKey); ok {
+				log.Printf("[Negative] Serving stale cacheKey '%s' while its origin fails", cacheKey)
+				writeCached(w, r, cacheKey, stale, "STALE")
+				return
+			}
+			writeNegative(w, r, cacheKey, neg)
 			return
 		}
 
 		// If not in cache, forward to origin
-		log.Printf("[Handler] Cache MISS for cacheKey: '%s'. Forwarding to origin.", cacheKey)
-		w.Header().Set("X-Cache", "MISS")
+		routineLog.printf("[Handler] Cache MISS for cacheKey: '%s'. Forwarding to origin.", cacheKey)
+		st := &requestState{backend: target.pick(r, true), cacheKey: cacheKey, cacheable: true, clientHeader: r.Header, background: background, cacheStatus: "MISS", revalidating: revalidating, started: time.Now()}
+		if st.backend.down.Load() {
+			if background {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			if stale, ok := latestVersion(cacheKey); ok {
+				log.Printf("[Health] Serving stale cacheKey '%s' while no origin backend is up", cacheKey)
+				writeCached(w, r, cacheKey, stale, "STALE")
+				return
+			}
+			writeOriginDown(w, r)
+			return
+		}
+		if st.backend.paused() {
+			if background {
+				log.Printf("[Backoff] Skipping background fetch of cacheKey '%s' from paused %s", cacheKey, st.backend.url)
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			if stale, ok := latestVersion(cacheKey); ok {
+				log.Printf("[Backoff] Serving stale cacheKey '%s' while %s is paused", cacheKey, st.backend.url)
+				writeCached(w, r, cacheKey, stale, "STALE")
+				return
+			}
+		}
+		r = withRequestState(r, st)
+		forward(w, r)
+	}
+	return handler
+}
 
-		proxy.ServeHTTP(w, r)
-	})
+// writeCached serves a stored response, reporting cacheStatus in X-Cache and
+// answering conditional requests with 304 when the client's copy is still
+// current.
+func writeCached(w http.ResponseWriter, r *http.Request, key string, c *CachedResponse, cacheStatus string) {
+	w.Header().Set("X-Cache", cacheStatus)
+	if debugHeaders {
+		setDebugHeaders(w.Header(), key, c.Backend)
+	}
+	// Copy all headers from the cached response
+	for k, vv := range c.Headers {
+		// Avoid adding hop-by-hop headers that are specific to the origin connection
+		// (e.g., Connection, Transfer-Encoding)
+		if k == "Connection" || k == "Transfer-Encoding" {
+			continue
+		}
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+	if strictHTTP {
+		setAge(w.Header(), c.Timestamp)
+	}
+	// Let clients revalidate their own copy without a body transfer
+	if servesRepresentation(c.StatusCode) && notModified(r, c.Headers.Get("ETag")) {
+		w.Header().Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	status := c.StatusCode
+	body, err := decodeForClient(r, w.Header(), c.Response)
+	if err != nil {
+		logf("error", "[Handler] Could not decode cacheKey '%s' for %s: %v", key, clientIP(r), err)
+		w.Header().Del("Content-Length")
+		http.Error(w, "stored response is corrupt", http.StatusBadGateway)
+		return
+	}
+	switch {
+	case !bodyAllowed(status):
+		// 1xx, 204 and 304 responses carry neither a body nor Content-Length
+		w.Header().Del("Content-Length")
+		w.WriteHeader(status)
+		return
+	case r.Method == http.MethodHead:
+		// A stored HEAD response keeps the origin's Content-Length, which
+		// describes the GET body; a GET entry reports the body it leaves out.
+		if !strings.HasPrefix(key, http.MethodHead+":") {
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		}
+		w.WriteHeader(status)
+		return
+	}
+	// Explicitly set Content-Length from the cached response body
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	if err := streamBody(r.Context(), w, body); err != nil {
+		logf("warn", "[Handler] Stopped sending cacheKey '%s' to %s: %v", key, clientIP(r), err)
+		if errors.Is(err, errClientTooSlow) {
+			noteRequestError(r, errClientTimeout)
+		} else {
+			noteRequestError(r, errClientAborted)
+		}
+	}
 }
 
+// bodyAllowed reports whether a response with this status carries a body.
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// lookupHeadFromGet finds the stored GET response a HEAD request can be
+// answered from, so HEAD requests don't need their own entries.
+func lookupHeadFromGet(r *http.Request) (string, *CachedResponse, bool) {
+	g := r.Clone(r.Context())
+	g.Method = http.MethodGet
+	normalizeAccept(g)
+	g = negotiateOriginEncoding(g)
+	key := variantKey(generateCacheKey(g), g)
+	c, ok := lookupEntry(key)
+	return key, c, ok
+}
+
+// generateCacheKey builds keys of the single shape METHOD:[//HOST]PATH?QUERY
+// followed by #-separated variant suffixes. The "?" is present even without a
+// query, so a key prefix such as "GET:/news?" selects exactly one path.
 func generateCacheKey(r *http.Request) string {
 	params := r.URL.Query()
-	if len(params) == 0 {
-		return r.Method + ":" + r.URL.Path
-	}
 
 	// Sort query parameters for consistent key generation
 	var keys []string
@@ -162,9 +1257,24 @@ func generateCacheKey(r *http.Request) string {
 	var queryParts []string
 	for _, k := range keys {
 		for _, v := range params[k] {
-			queryParts = append(queryParts, fmt.Sprintf("%s=%s", k, v))
+			queryParts = append(queryParts, url.QueryEscape(k)+"="+url.QueryEscape(v))
 		}
 	}
 	sortedQuery := strings.Join(queryParts, "&")
-	return r.Method + ":" + r.URL.Path + "?" + sortedQuery
+
+	host := ""
+	if keyIncludeHost {
+		host = "//" + strings.ToLower(r.Host)
+	}
+	return r.Method + ":" + host + keyPath(r) + "?" + sortedQuery + rangeKeySuffix(r) + bodyKeySuffix(r) + saltKeySuffix(r) + acceptKeySuffix(r)
+}
+
+// rangeKeySuffix keys partial responses as separate segments of the object, so
+// a 206 for one range is never replayed for another range or the full body.
+func rangeKeySuffix(r *http.Request) string {
+	rng := r.Header.Get("Range")
+	if rng == "" {
+		return ""
+	}
+	return "#" + strings.ReplaceAll(rng, " ", "")
 }
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestProxy serves the proxy handler in front of origin, starting from an
+// empty cache, for end-to-end tests.
+func newTestProxy(t *testing.T, origin http.Handler) *httptest.Server {
+	t.Helper()
+	originSrv := httptest.NewServer(origin)
+	t.Cleanup(originSrv.Close)
+	pool, err := newOriginPool(originSrv.URL, stickyNone, "cp_backend", balanceRoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := origins
+	origins = pool
+	cacheMutex.Lock()
+	for key := range cache {
+		evictEntryLocked(key)
+	}
+	varyIndex = map[string]*varyInfo{}
+	cacheMutex.Unlock()
+	srv := httptest.NewServer(createProxyHandler(pool, http.DefaultTransport))
+	t.Cleanup(func() {
+		srv.Close()
+		origins = prev
+	})
+	return srv
+}
+
+func TestGenerateCacheKey(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		host        string
+		header      http.Header
+		includeHost bool
+		want        string
+	}{
+		{"no query", "GET", "/a", "", nil, false, "GET:/a?"},
+		{"empty query", "GET", "/a?", "", nil, false, "GET:/a?"},
+		{"root", "GET", "/", "", nil, false, "GET:/?"},
+		{"query", "GET", "/a?x=1", "", nil, false, "GET:/a?x=1"},
+		{"sorted parameters", "GET", "/a?z=1&b=2&m=3", "", nil, false, "GET:/a?b=2&m=3&z=1"},
+		{"repeated parameter keeps its order", "GET", "/a?b=2&a=1&b=1", "", nil, false, "GET:/a?a=1&b=2&b=1"},
+		{"escaping is normalized", "GET", "/a?q=a%20b&r=a+b", "", nil, false, "GET:/a?q=a+b&r=a+b"},
+		{"parameter without value", "GET", "/a?flag", "", nil, false, "GET:/a?flag="},
+		{"method", "HEAD", "/a", "", nil, false, "HEAD:/a?"},
+		{"range", "GET", "/a", "", http.Header{"Range": {"bytes=0-99"}}, false, "GET:/a?#bytes=0-99"},
+		{"range spaces dropped", "GET", "/a", "", http.Header{"Range": {"bytes= 0-99, 200-"}}, false, "GET:/a?#bytes=0-99,200-"},
+		{"host ignored by default", "GET", "/a", "example.com", nil, false, "GET:/a?"},
+		{"host included", "GET", "/a", "example.com", nil, true, "GET://example.com/a?"},
+		{"host lower-cased", "GET", "/a?x=1", "Example.COM:8080", nil, true, "GET://example.com:8080/a?x=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyIncludeHost = tt.includeHost
+			defer func() { keyIncludeHost = false }()
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			if tt.host != "" {
+				r.Host = tt.host
+			}
+			for k, vv := range tt.header {
+				r.Header[k] = vv
+			}
+			if got := generateCacheKey(r); got != tt.want {
+				t.Errorf("generateCacheKey = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// Keys with and without a query share one shape, so a key prefix selects a
+// path whatever the query.
+func TestGenerateCacheKeyPrefixes(t *testing.T) {
+	for _, includeHost := range []bool{false, true} {
+		keyIncludeHost = includeHost
+		bare := generateCacheKey(httptest.NewRequest("GET", "/news/1", nil))
+		withQuery := generateCacheKey(httptest.NewRequest("GET", "/news/1?page=2", nil))
+		if bare[:len(bare)-1] != withQuery[:len(bare)-1] || bare[len(bare)-1] != '?' {
+			t.Errorf("includeHost=%v: %q is not a prefix of %q up to the query", includeHost, bare, withQuery)
+		}
+		if got := cacheKeyPath(withQuery); got != "/news/1" {
+			t.Errorf("includeHost=%v: cacheKeyPath(%q) = %q", includeHost, withQuery, got)
+		}
+	}
+	keyIncludeHost = false
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// memcachedServer speaks the memcached text protocol over a small pool of
+// connections.
+type memcachedServer struct {
+	addr string
+	idle chan *memcachedConn
+}
+
+type memcachedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// errMemcachedReply is a protocol-level failure; the connection is dropped.
+var errMemcachedReply = errors.New("memcached: unexpected reply")
+
+// memcachedMaxRelative is the largest expiration memcached treats as
+// relative; longer ones must be given as a Unix time.
+const memcachedMaxRelative = 30 * 24 * time.Hour
+
+func (s *memcachedServer) conn() (*memcachedConn, error) {
+	select {
+	case mc := <-s.idle:
+		return mc, nil
+	default:
+	}
+	conn, err := net.DialTimeout("tcp", s.addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &memcachedConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// roundTrip sends req and parses the reply with read, returning the
+// connection to the pool when both succeed.
+func (s *memcachedServer) roundTrip(req []byte, read func(*bufio.Reader) error) error {
+	mc, err := s.conn()
+	if err != nil {
+		return err
+	}
+	mc.SetDeadline(time.Now().Add(redisTimeout))
+	if _, err = mc.Write(req); err == nil {
+		err = read(mc.r)
+	}
+	if err != nil {
+		mc.Close()
+		return err
+	}
+	select {
+	case s.idle <- mc:
+	default:
+		mc.Close()
+	}
+	return nil
+}
+
+func readMemcachedLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	return strings.TrimSuffix(line, "\r\n"), err
+}
+
+// get returns the value stored under key, or nil when there is none.
+func (s *memcachedServer) get(key string) ([]byte, error) {
+	var value []byte
+	err := s.roundTrip([]byte("get "+key+"\r\n"), func(r *bufio.Reader) error {
+		line, err := readMemcachedLine(r)
+		if err != nil {
+			return err
+		}
+		if line == "END" {
+			return nil
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 4 || fields[0] != "VALUE" {
+			return fmt.Errorf("%w %q", errMemcachedReply, line)
+		}
+		n, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return err
+		}
+		if line, err = readMemcachedLine(r); err != nil || line != "END" {
+			return fmt.Errorf("%w %q", errMemcachedReply, line)
+		}
+		value = buf[:n]
+		return nil
+	})
+	return value, err
+}
+
+// set stores value under key; ttl 0 never expires.
+func (s *memcachedServer) set(key string, value []byte, ttl time.Duration) error {
+	exptime := int64(0)
+	switch {
+	case ttl > memcachedMaxRelative:
+		exptime = time.Now().Add(ttl).Unix()
+	case ttl > 0:
+		exptime = int64((ttl + time.Second - 1) / time.Second)
+	}
+	var req bytes.Buffer
+	fmt.Fprintf(&req, "set %s 0 %d %d\r\n", key, exptime, len(value))
+	req.Write(value)
+	req.WriteString("\r\n")
+	return s.roundTrip(req.Bytes(), func(r *bufio.Reader) error {
+		line, err := readMemcachedLine(r)
+		if err == nil && line != "STORED" {
+			// e.g. SERVER_ERROR object too large for cache
+			return fmt.Errorf("%w %q", errMemcachedReply, line)
+		}
+		return err
+	})
+}
+
+// add stores value under key unless the key already exists.
+func (s *memcachedServer) add(key string, value []byte) error {
+	var req bytes.Buffer
+	fmt.Fprintf(&req, "add %s 0 0 %d\r\n", key, len(value))
+	req.Write(value)
+	req.WriteString("\r\n")
+	return s.roundTrip(req.Bytes(), func(r *bufio.Reader) error {
+		line, err := readMemcachedLine(r)
+		if err == nil && line != "STORED" && line != "NOT_STORED" {
+			return fmt.Errorf("%w %q", errMemcachedReply, line)
+		}
+		return err
+	})
+}
+
+// incr increments the counter stored under key and returns its new value,
+// or found false when there is no such key.
+func (s *memcachedServer) incr(key string) (n uint64, found bool, err error) {
+	err = s.roundTrip([]byte("incr "+key+" 1\r\n"), func(r *bufio.Reader) error {
+		line, err := readMemcachedLine(r)
+		if err != nil || line == "NOT_FOUND" {
+			return err
+		}
+		if n, err = strconv.ParseUint(line, 10, 64); err != nil {
+			return fmt.Errorf("%w %q", errMemcachedReply, line)
+		}
+		found = true
+		return nil
+	})
+	return n, found, err
+}
+
+func (s *memcachedServer) delete(key string) error {
+	return s.roundTrip([]byte("delete "+key+"\r\n"), func(r *bufio.Reader) error {
+		line, err := readMemcachedLine(r)
+		if err == nil && line != "DELETED" && line != "NOT_FOUND" {
+			return fmt.Errorf("%w %q", errMemcachedReply, line)
+		}
+		return err
+	})
+}
+
+// memcachedStore shares entries between replicas through memcached, like
+// redisStore. Memcached has neither pub/sub nor key listing, so generations
+// are polled instead of announced, and so are invalidations: deletes and
+// purges are recorded in a numbered log on the first server, which every
+// replica applies to its memory cache. A pattern purge can only delete the
+// shared copies of the keys some replica has cached; others are ignored on
+// lookup for as long as the purge is logged. Keys are hashed to fit
+// memcached's key rules and spread over the servers by that hash.
+type memcachedStore struct {
+	servers  []*memcachedServer
+	prefix   string
+	instance string // tags our own invalidations so they can be ignored
+	writes   *writeQueue[func()]
+
+	// Used by the sync goroutine only: the last invalidation applied, and
+	// one found missing, which is skipped if it is still missing next time.
+	seen, missing uint64
+
+	mu     sync.Mutex
+	purges []memcachedPurge // logged purges, oldest first
+
+	hits, misses, errors atomic.Int64
+}
+
+// memcachedPurge is a pattern purge entries stored before at no longer
+// survive.
+type memcachedPurge struct {
+	m  purgeMatcher
+	at time.Time
+}
+
+// memcachedLogRetention is how long invalidations stay in the shared log.
+const memcachedLogRetention = time.Hour
+
+// memcachedConfig holds the --memcached-* flags.
+type memcachedConfig struct {
+	addrs        string
+	prefix       string
+	syncInterval time.Duration
+}
+
+var memcachedSettings memcachedConfig
+
+func openMemcachedStore(cfg memcachedConfig) (*memcachedStore, error) {
+	prefix := cfg.prefix
+	id := make([]byte, 8)
+	rand.Read(id)
+	s := &memcachedStore{prefix: prefix, instance: hex.EncodeToString(id)}
+	for _, addr := range strings.Split(cfg.addrs, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			s.servers = append(s.servers, &memcachedServer{addr: addr, idle: make(chan *memcachedConn, 8)})
+		}
+	}
+	if len(s.servers) == 0 {
+		return nil, errors.New("no memcached servers")
+	}
+	for _, srv := range s.servers {
+		if _, err := srv.get(prefix + "__generation"); err != nil {
+			return nil, fmt.Errorf("%s: %w", srv.addr, err)
+		}
+	}
+	s.writes = newWriteQueue(storeQueueSize, func(batch []func()) {
+		for _, write := range batch {
+			write()
+		}
+	})
+	s.syncGenerations()
+	s.seen, _ = s.lastInvalidation()
+	go func() {
+		for range time.Tick(cfg.syncInterval) {
+			s.syncInvalidations()
+			if s.syncGenerations() {
+				sweepStaleEntries()
+			}
+		}
+	}()
+	log.Printf("[Memcached] Sharing the cache through %s", cfg.addrs)
+	return s, nil
+}
+
+// locate maps a cache key to its memcached key and server.
+func (s *memcachedStore) locate(key string) (string, *memcachedServer) {
+	sum := sha256.Sum256([]byte(key))
+	h := fnv.New32a()
+	h.Write(sum[:])
+	return s.prefix + hex.EncodeToString(sum[:16]), s.servers[h.Sum32()%uint32(len(s.servers))]
+}
+
+// Get fetches a shared entry on a local miss.
+func (s *memcachedStore) Get(key string) (*CachedResponse, bool) {
+	mkey, srv := s.locate(key)
+	data, err := srv.get(mkey)
+	if err != nil {
+		s.errors.Add(1)
+		logf("error", "[Memcached] Failed to get cacheKey '%s': %v", key, err)
+		return nil, false
+	}
+	if data == nil {
+		s.misses.Add(1)
+		return nil, false
+	}
+	var e diskEntry
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&e); err != nil || e.Key != key {
+		s.errors.Add(1)
+		logf("warn", "[Memcached] Ignoring unreadable entry for cacheKey '%s'", key)
+		return nil, false
+	}
+	if s.purged(key, e.Entry) {
+		s.misses.Add(1)
+		return nil, false
+	}
+	s.hits.Add(1)
+	return e.Entry, true
+}
+
+// Set writes an entry behind, mapping its remaining freshness lifetime to
+// the memcached expiration. The entry is dropped when the write queue is
+// full.
+func (s *memcachedStore) Set(key string, c *CachedResponse) {
+	s.writes.add(key, func() {
+		ttl := remainingLifetime(c)
+		if ttl < 0 {
+			return
+		}
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(diskEntry{Key: key, Entry: c}); err != nil {
+			logf("error", "[Memcached] Failed to encode cacheKey '%s': %v", key, err)
+			return
+		}
+		mkey, srv := s.locate(key)
+		if err := srv.set(mkey, buf.Bytes(), ttl); err != nil {
+			s.errors.Add(1)
+			logf("error", "[Memcached] Failed to set cacheKey '%s': %v", key, err)
+		}
+	})
+}
+
+// Delete removes an entry and has the other replicas drop their copies.
+func (s *memcachedStore) Delete(key string) bool {
+	s.queue(key, func() {
+		s.deleteShared(key)
+		s.invalidate("drop " + key)
+	})
+	return false
+}
+
+func (s *memcachedStore) deleteShared(key string) {
+	mkey, srv := s.locate(key)
+	if err := srv.delete(mkey); err != nil {
+		s.errors.Add(1)
+		logf("error", "[Memcached] Failed to delete cacheKey '%s': %v", key, err)
+	}
+}
+
+// Purge deletes the shared copies of the local entries m matches and has the
+// other replicas purge their memory caches too.
+func (s *memcachedStore) Purge(m purgeMatcher) int {
+	cacheMutex.Lock()
+	var keys []string
+	for k := range cache {
+		if m.match(k) {
+			keys = append(keys, k)
+		}
+	}
+	cacheMutex.Unlock()
+	s.remember(m)
+	s.queue("\x00purge "+m.String(), func() {
+		for _, k := range keys {
+			s.deleteShared(k)
+		}
+		s.invalidate("purge " + m.String())
+	})
+	return len(keys)
+}
+
+// queue adds an invalidation to the write queue. Unlike a dropped entry, a
+// dropped invalidation leaves stale copies behind, so it is logged.
+func (s *memcachedStore) queue(key string, write func()) {
+	if !s.writes.add(key, write) {
+		logf("warn", "[Memcached] Write queue full, dropped the invalidation of '%s'", strings.TrimPrefix(key, "\x00"))
+	}
+}
+
+// invalidate appends msg to the shared invalidation log.
+func (s *memcachedStore) invalidate(msg string) {
+	srv, counter := s.servers[0], s.prefix+"__invalidations"
+	n, found, err := srv.incr(counter)
+	if err == nil && !found {
+		if err = srv.add(counter, []byte("0")); err == nil {
+			n, _, err = srv.incr(counter)
+		}
+	}
+	if err == nil {
+		err = srv.set(s.prefix+"__invalidation:"+strconv.FormatUint(n, 10), []byte(s.instance+" "+msg), memcachedLogRetention)
+	}
+	if err != nil {
+		s.errors.Add(1)
+		logf("error", "[Memcached] Failed to log invalidation '%s': %v", msg, err)
+	}
+}
+
+// lastInvalidation returns the number of the latest logged invalidation.
+func (s *memcachedStore) lastInvalidation() (uint64, error) {
+	v, err := s.servers[0].get(s.prefix + "__invalidations")
+	if err != nil || v == nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(v)), 10, 64)
+}
+
+// syncInvalidations applies the invalidations the other replicas logged
+// since the last poll.
+func (s *memcachedStore) syncInvalidations() {
+	last, err := s.lastInvalidation()
+	if err != nil {
+		s.errors.Add(1)
+		logf("error", "[Memcached] Failed to read the invalidation log: %v", err)
+		return
+	}
+	if last < s.seen {
+		s.seen = last // the log was lost, e.g. by a server restart
+	}
+	for s.seen < last {
+		n := s.seen + 1
+		v, err := s.servers[0].get(s.prefix + "__invalidation:" + strconv.FormatUint(n, 10))
+		if err != nil {
+			return
+		}
+		if v == nil && n != s.missing {
+			// Numbered but maybe not written yet
+			s.missing = n
+			return
+		}
+		s.seen = n
+		from, msg, _ := strings.Cut(string(v), " ")
+		if v == nil || from == s.instance {
+			continue
+		}
+		verb, arg, _ := strings.Cut(msg, " ")
+		if verb == "purge" {
+			if m, err := parsePurgeMatcher(arg); err == nil {
+				s.remember(m)
+			}
+		}
+		applyInvalidation("Memcached", verb, arg)
+	}
+}
+
+// remember keeps a purge for as long as it is logged, so shared copies it
+// could not delete are ignored.
+func (s *memcachedStore) remember(m purgeMatcher) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.purges) > 0 && now.Sub(s.purges[0].at) > memcachedLogRetention {
+		s.purges = s.purges[1:]
+	}
+	s.purges = append(s.purges, memcachedPurge{m: m, at: now})
+}
+
+// purged reports whether a remembered purge invalidated the shared entry.
+func (s *memcachedStore) purged(key string, c *CachedResponse) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.purges {
+		if c.Timestamp.Before(p.at) && p.m.match(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Len is unknown: memcached cannot list keys.
+func (s *memcachedStore) Len() int { return -1 }
+
+func (s *memcachedStore) Stats() StoreStats {
+	return StoreStats{Backend: "memcached", Entries: -1, Hits: s.hits.Load(), Misses: s.misses.Load(), Errors: s.errors.Load(),
+		QueueDepth: s.writes.depth(), DroppedWrites: s.writes.dropped.Load()}
+}
+
+// saveGenerations shares the local generations after a bump. They are kept
+// on the first server.
+func (s *memcachedStore) saveGenerations() {
+	gens := map[string]uint64{"__generation": cacheGeneration.Load()}
+	for _, ns := range namespaces {
+		gens["__namespace:"+ns.name] = ns.generation.Load()
+	}
+	s.queue("\x00generations", func() {
+		for k, g := range gens {
+			if err := s.servers[0].set(s.prefix+k, []byte(strconv.FormatUint(g, 10)), 0); err != nil {
+				logf("error", "[Memcached] Failed to save %s: %v", k, err)
+			}
+		}
+	})
+}
+
+// syncGenerations adopts the shared generations when they are ahead of ours
+// and reports whether any changed.
+func (s *memcachedStore) syncGenerations() bool {
+	changed := false
+	if v, err := s.servers[0].get(s.prefix + "__generation"); err == nil && v != nil {
+		changed = adoptGeneration("", string(v))
+	}
+	for _, ns := range namespaces {
+		if v, err := s.servers[0].get(s.prefix + "__namespace:" + ns.name); err == nil && v != nil {
+			changed = adoptGeneration(ns.name, string(v)) || changed
+		}
+	}
+	return changed
+}
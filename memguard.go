@@ -0,0 +1,102 @@
+package main
+
+import (
+	"log"
+	"os"
+	"runtime/debug"
+	"runtime/metrics"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// memoryPressure is set while process memory is above the high watermark; the
+// proxy stops storing new entries until it drops below the low watermark.
+var memoryPressure atomic.Bool
+
+// memoryGuard watches the Go runtime's memory footprint against a limit and
+// sheds cache entries before the process gets OOM-killed.
+type memoryGuard struct {
+	limit int64
+	high  float64
+	low   float64
+}
+
+// detectMemoryLimit returns the container memory limit from cgroup v2 or v1,
+// or 0 when the process is unconstrained.
+func detectMemoryLimit() int64 {
+	if data, err := os.ReadFile("/sys/fs/cgroup/memory.max"); err == nil {
+		if n, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); err == nil {
+			return n
+		}
+		return 0 // "max"
+	}
+	if data, err := os.ReadFile("/sys/fs/cgroup/memory/memory.limit_in_bytes"); err == nil {
+		// cgroup v1 reports "unlimited" as a huge page-aligned number
+		if n, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); err == nil && n < 1<<60 {
+			return n
+		}
+	}
+	return 0
+}
+
+// memoryInUse reports all memory mapped by the Go runtime, which tracks the
+// process RSS closely for a proxy that does not use cgo.
+func memoryInUse() int64 {
+	sample := []metrics.Sample{{Name: "/memory/classes/total:bytes"}}
+	metrics.Read(sample)
+	return int64(sample[0].Value.Uint64())
+}
+
+func (g *memoryGuard) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		g.check()
+	}
+}
+
+func (g *memoryGuard) check() {
+	used := memoryInUse()
+	highMark := int64(float64(g.limit) * g.high)
+	lowMark := int64(float64(g.limit) * g.low)
+
+	if used < highMark {
+		if used < lowMark && memoryPressure.CompareAndSwap(true, false) {
+			log.Printf("[Memory] Usage back to %d bytes (low watermark %d), resuming cache stores", used, lowMark)
+		}
+		return
+	}
+
+	if memoryPressure.CompareAndSwap(false, true) {
+		logf("warn", "[Memory] Usage %d bytes above high watermark %d (limit %d), pausing cache stores", used, highMark, g.limit)
+	}
+	evicted, freed := evictOldest(used - lowMark)
+	if evicted > 0 {
+		logf("warn", "[Memory] Emergency eviction removed %d entries (%d bytes)", evicted, freed)
+		debug.FreeOSMemory()
+	}
+}
+
+// evictOldest removes the least recently stored entries until at least target
+// bytes of cached data have been released.
+func evictOldest(target int64) (evicted int, freed int64) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	keys := make([]string, 0, len(cache))
+	for k := range cache {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return cache[keys[i]].Timestamp.Before(cache[keys[j]].Timestamp) })
+
+	for _, k := range keys {
+		if freed >= target {
+			break
+		}
+		freed += cache[k].size()
+		evictEntryLocked(k)
+		evicted++
+	}
+	return evicted, freed
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"slices"
+	"strings"
+)
+
+// Method policies.
+const (
+	methodPass   = "pass"   // forward to the origin
+	methodReject = "reject" // answer 405 Method Not Allowed
+	methodLocal  = "local"  // answer from the proxy (OPTIONS and TRACE only)
+)
+
+// knownMethods are the methods a policy can name; "*" stands for any other.
+var knownMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+	http.MethodDelete, http.MethodOptions, http.MethodTrace, http.MethodConnect,
+}
+
+// methodPolicies maps a method, or "*" for unknown methods, to its policy.
+// Methods without an entry are passed through.
+var methodPolicies = map[string]string{}
+
+// routeMethods restricts the methods accepted on matching routes.
+type routeMethods struct {
+	pattern pathPattern
+	allowed []string
+}
+
+var routeMethodRules []routeMethods
+
+// parseMethodPolicy parses METHOD=POLICY, e.g. "TRACE=reject" or "*=reject".
+func parseMethodPolicy(spec string) error {
+	method, policy, ok := strings.Cut(spec, "=")
+	if !ok {
+		return fmt.Errorf("invalid method policy %q (want METHOD=pass|reject|local)", spec)
+	}
+	method = strings.ToUpper(method)
+	if method != "*" && !slices.Contains(knownMethods, method) {
+		return fmt.Errorf("method policy %q names an unknown method; use * for those", spec)
+	}
+	switch policy {
+	case methodPass, methodReject:
+	case methodLocal:
+		if method != http.MethodOptions && method != http.MethodTrace {
+			return fmt.Errorf("method policy %q: only OPTIONS and TRACE can be answered locally", spec)
+		}
+	default:
+		return fmt.Errorf("unknown method policy %q (want pass, reject or local)", policy)
+	}
+	methodPolicies[method] = policy
+	return nil
+}
+
+// parseRouteMethods parses PATTERN=METHOD,METHOD,..., e.g. "/api/*=GET,HEAD,POST".
+func parseRouteMethods(spec string) (routeMethods, error) {
+	pattern, list, ok := strings.Cut(spec, "=")
+	if !ok || list == "" {
+		return routeMethods{}, fmt.Errorf("invalid route methods %q (want PATTERN=METHOD,...)", spec)
+	}
+	p, err := parsePathPattern(pattern)
+	if err != nil {
+		return routeMethods{}, err
+	}
+	rule := routeMethods{pattern: p}
+	for _, m := range strings.Split(list, ",") {
+		rule.allowed = append(rule.allowed, strings.ToUpper(strings.TrimSpace(m)))
+	}
+	return rule, nil
+}
+
+func methodPolicy(method string) string {
+	if !slices.Contains(knownMethods, method) {
+		method = "*"
+	}
+	if p, ok := methodPolicies[method]; ok {
+		return p
+	}
+	return methodPass
+}
+
+// allowedMethods lists the known methods a route accepts, as advertised in
+// Allow headers.
+func allowedMethods(urlPath string) []string {
+	var allowed []string
+	for _, m := range knownMethods {
+		if m != http.MethodConnect && methodAllowed(m, urlPath) {
+			allowed = append(allowed, m)
+		}
+	}
+	return allowed
+}
+
+func methodAllowed(method, urlPath string) bool {
+	if methodPolicy(method) == methodReject {
+		return false
+	}
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	for _, rule := range routeMethodRules {
+		if rule.pattern.match(urlPath) {
+			return slices.Contains(rule.allowed, method)
+		}
+	}
+	return true
+}
+
+// applyMethodPolicy answers requests whose method is rejected or handled
+// locally, and reports whether it did.
+func applyMethodPolicy(w http.ResponseWriter, r *http.Request) bool {
+	if !methodAllowed(r.Method, r.URL.Path) {
+		log.Printf("[Methods] Rejecting %s for %s", r.Method, r.URL.String())
+		w.Header().Set("Allow", strings.Join(allowedMethods(r.URL.Path), ", "))
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return true
+	}
+	if methodPolicy(r.Method) != methodLocal {
+		return false
+	}
+	log.Printf("[Methods] Answering %s for %s locally", r.Method, r.URL.String())
+	if r.Method == http.MethodOptions {
+		answerOptions(w, r)
+	} else {
+		answerTrace(w, r)
+	}
+	return true
+}
+
+func answerOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", strings.Join(allowedMethods(r.URL.Path), ", "))
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusOK)
+}
+
+// answerTrace echoes the received request, minus credentials (RFC 9110 §9.3.8).
+func answerTrace(w http.ResponseWriter, r *http.Request) {
+	r.Header.Del("Authorization")
+	r.Header.Del("Cookie")
+	dump, err := httputil.DumpRequest(r, false)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "message/http")
+	w.WriteHeader(http.StatusOK)
+	w.Write(dump)
+}
+
+// cacheableMethods lists the methods whose responses are cached, mapped to
+// whether the request body is part of the cache key. Safe methods that carry
+// their query in the body, like QUERY or REPORT, must be keyed by it.
+var cacheableMethods = map[string]bool{http.MethodGet: false}
+
+// maxKeyedBody is the largest request body hashed into a cache key; bigger
+// requests bypass the cache.
+const maxKeyedBody = 1 << 20
+
+// parseCacheableMethod parses METHOD or METHOD:body, e.g. "QUERY:body".
+func parseCacheableMethod(spec string) error {
+	method, rule, _ := strings.Cut(spec, ":")
+	if method == "" || (rule != "" && rule != "body") {
+		return fmt.Errorf("invalid cacheable method %q (want METHOD or METHOD:body)", spec)
+	}
+	cacheableMethods[strings.ToUpper(method)] = rule == "body"
+	return nil
+}
+
+// withBodyKey reads the body of a request to a body-keyed method and records
+// its digest for generateCacheKey. It reports false when the body is too large
+// to be keyed.
+func withBodyKey(r *http.Request) (*http.Request, bool) {
+	if !cacheableMethods[r.Method] {
+		return r, true
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxKeyedBody+1))
+	if err != nil || len(body) > maxKeyedBody {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return r, false
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+	sum := sha256.Sum256(body)
+	return r.WithContext(context.WithValue(r.Context(), bodyKeyKey, hex.EncodeToString(sum[:8]))), true
+}
+
+// bodyKeySuffix keys body-keyed methods by a digest of their request body.
+func bodyKeySuffix(r *http.Request) string {
+	digest, ok := r.Context().Value(bodyKeyKey).(string)
+	if !ok {
+		return ""
+	}
+	return "#body=" + digest
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// originLatencyBuckets are the upper bounds, in seconds, of the origin
+// request duration histogram.
+var originLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(originLatencyBuckets))
+	}
+	for i, b := range originLatencyBuckets {
+		if v <= b {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// proxyMetrics holds the counters exported on /metrics that are not already
+// kept elsewhere.
+type proxyMetrics struct {
+	mu       sync.Mutex
+	requests map[string]uint64 // by X-Cache outcome
+	bytes    map[string]uint64 // body bytes sent, by X-Cache outcome
+	errors   map[string]uint64 // by error class
+	origin   map[[2]string]*histogram
+}
+
+var requestMetrics = &proxyMetrics{requests: map[string]uint64{}, bytes: map[string]uint64{}, errors: map[string]uint64{}, origin: map[[2]string]*histogram{}}
+
+func (m *proxyMetrics) observeRequest(e *requestLogEvent) {
+	cache := e.Cache
+	if cache == "" {
+		cache = "none"
+	}
+	m.mu.Lock()
+	m.requests[cache]++
+	m.bytes[cache] += uint64(e.Bytes)
+	if e.Error != "" {
+		m.errors[e.Error]++
+	}
+	m.mu.Unlock()
+}
+
+func (m *proxyMetrics) observeOrigin(backend, code string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := [2]string{backend, code}
+	h, ok := m.origin[key]
+	if !ok {
+		h = &histogram{}
+		m.origin[key] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// metricsTransport times every origin request attempt.
+type metricsTransport struct {
+	base http.RoundTripper
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	requestMetrics.observeOrigin(req.URL.Host, code, time.Since(start))
+	return resp, err
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promWriter writes the Prometheus text exposition format, or hands each
+// sample to collect instead when it is set.
+type promWriter struct {
+	w       *bufio.Writer
+	collect func(name string, value float64, labels []string)
+}
+
+func (p promWriter) family(name, typ, help string) {
+	if p.w == nil {
+		return
+	}
+	fmt.Fprintf(p.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes one sample; labels alternate names and values.
+func (p promWriter) sample(name string, value float64, labels ...string) {
+	if p.collect != nil {
+		p.collect(name, value, labels)
+		return
+	}
+	p.w.WriteString(name)
+	if len(labels) > 0 {
+		p.w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				p.w.WriteByte(',')
+			}
+			fmt.Fprintf(p.w, `%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		p.w.WriteByte('}')
+	}
+	p.w.WriteByte(' ')
+	p.w.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	p.w.WriteByte('\n')
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// metricsHandler exports the proxy's counters in Prometheus format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	writeMetrics(promWriter{w: bw})
+}
+
+// writeMetrics writes every metric the proxy exports to p.
+func writeMetrics(p promWriter) {
+	requestMetrics.mu.Lock()
+	p.family("caching_proxy_requests_total", "counter", "Requests served, by cache outcome (X-Cache).")
+	for _, k := range sortedKeys(requestMetrics.requests) {
+		p.sample("caching_proxy_requests_total", float64(requestMetrics.requests[k]), "cache", k)
+	}
+	p.family("caching_proxy_response_bytes_total", "counter", "Response body bytes sent to clients, by cache outcome (X-Cache).")
+	for _, k := range sortedKeys(requestMetrics.bytes) {
+		p.sample("caching_proxy_response_bytes_total", float64(requestMetrics.bytes[k]), "cache", k)
+	}
+	p.family("caching_proxy_request_errors_total", "counter", "Failed requests, by error class.")
+	for _, k := range sortedKeys(requestMetrics.errors) {
+		p.sample("caching_proxy_request_errors_total", float64(requestMetrics.errors[k]), "class", k)
+	}
+	p.family("caching_proxy_origin_request_duration_seconds", "histogram", "Duration of origin request attempts, by backend and status code.")
+	keys := make([][2]string, 0, len(requestMetrics.origin))
+	for k := range requestMetrics.origin {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1]
+	})
+	for _, k := range keys {
+		h := requestMetrics.origin[k]
+		var cumulative uint64
+		for i, b := range originLatencyBuckets {
+			cumulative += h.counts[i]
+			p.sample("caching_proxy_origin_request_duration_seconds_bucket", float64(cumulative), "backend", k[0], "code", k[1], "le", strconv.FormatFloat(b, 'g', -1, 64))
+		}
+		p.sample("caching_proxy_origin_request_duration_seconds_bucket", float64(h.count), "backend", k[0], "code", k[1], "le", "+Inf")
+		p.sample("caching_proxy_origin_request_duration_seconds_sum", h.sum, "backend", k[0], "code", k[1])
+		p.sample("caching_proxy_origin_request_duration_seconds_count", float64(h.count), "backend", k[0], "code", k[1])
+	}
+	requestMetrics.mu.Unlock()
+
+	cacheMutex.Lock()
+	entries, bytes, evictions := len(cache), cacheBytes, entryEvictions
+	type poolUsage struct {
+		name             string
+		bytes, evictions int64
+	}
+	pools := make([]poolUsage, 0, len(cachePools))
+	for _, pool := range cachePools {
+		pools = append(pools, poolUsage{pool.name, pool.bytes, pool.evictions})
+	}
+	cacheMutex.Unlock()
+	p.family("caching_proxy_cache_entries", "gauge", "Entries in the memory cache.")
+	p.sample("caching_proxy_cache_entries", float64(entries))
+	p.family("caching_proxy_cache_bytes", "gauge", "Size of the entries in the memory cache.")
+	p.sample("caching_proxy_cache_bytes", float64(bytes))
+	p.family("caching_proxy_evictions_total", "counter", "Entries evicted by --max-entries and --max-cache-bytes.")
+	p.sample("caching_proxy_evictions_total", float64(evictions))
+	p.family("caching_proxy_pool_bytes", "gauge", "Size of the entries in each cache pool.")
+	for _, pool := range pools {
+		p.sample("caching_proxy_pool_bytes", float64(pool.bytes), "pool", pool.name)
+	}
+	p.family("caching_proxy_pool_evictions_total", "counter", "Entries evicted from each cache pool to stay within its budget.")
+	for _, pool := range pools {
+		p.sample("caching_proxy_pool_evictions_total", float64(pool.evictions), "pool", pool.name)
+	}
+	p.family("caching_proxy_origin_inflight", "gauge", "Requests being forwarded to each origin backend.")
+	for _, b := range origins.allBackends() {
+		p.sample("caching_proxy_origin_inflight", float64(b.inflight.Load()), "backend", b.url.String())
+	}
+	p.family("caching_proxy_cache_generation", "gauge", "Current cache generation.")
+	p.sample("caching_proxy_cache_generation", float64(cacheGeneration.Load()))
+
+	stores := storeStats()
+	p.family("caching_proxy_store_lookups_total", "counter", "Store lookups, by store and result.")
+	for _, s := range stores {
+		p.sample("caching_proxy_store_lookups_total", float64(s.Hits), "store", s.Backend, "result", "hit")
+		p.sample("caching_proxy_store_lookups_total", float64(s.Misses), "store", s.Backend, "result", "miss")
+	}
+	p.family("caching_proxy_store_errors_total", "counter", "Failed store operations, by store.")
+	for _, s := range stores {
+		p.sample("caching_proxy_store_errors_total", float64(s.Errors), "store", s.Backend)
+	}
+	p.family("caching_proxy_store_queue_depth", "gauge", "Writes waiting in each store's write-behind queue.")
+	for _, s := range stores {
+		p.sample("caching_proxy_store_queue_depth", float64(s.QueueDepth), "store", s.Backend)
+	}
+	p.family("caching_proxy_store_dropped_writes_total", "counter", "Writes dropped because the store's write-behind queue was full.")
+	for _, s := range stores {
+		p.sample("caching_proxy_store_dropped_writes_total", float64(s.DroppedWrites), "store", s.Backend)
+	}
+
+	if disk != nil {
+		p.family("caching_proxy_disk_bytes", "gauge", "Space taken by the disk cache's entry files.")
+		p.sample("caching_proxy_disk_bytes", float64(disk.usage()))
+		p.family("caching_proxy_disk_evictions_total", "counter", "Entries evicted to keep the disk cache within --disk-limit.")
+		p.sample("caching_proxy_disk_evictions_total", float64(disk.evictions.Load()))
+	}
+
+	if shadow != nil {
+		shadow.mu.Lock()
+		p.family("caching_proxy_shadow_checked_total", "counter", "Cached entries compared against their origin, by backend.")
+		for _, b := range sortedKeys(shadow.backends) {
+			p.sample("caching_proxy_shadow_checked_total", float64(shadow.backends[b].Checked), "backend", b)
+		}
+		p.family("caching_proxy_shadow_diverged_total", "counter", "Cached entries that differed from their origin, by backend.")
+		for _, b := range sortedKeys(shadow.backends) {
+			p.sample("caching_proxy_shadow_diverged_total", float64(shadow.backends[b].Diverged), "backend", b)
+		}
+		shadow.mu.Unlock()
+	}
+
+	if len(syntheticChecks) > 0 {
+		p.family("caching_proxy_synthetic_up", "gauge", "Whether the last run of each synthetic check succeeded.")
+		for _, c := range syntheticChecks {
+			c.mu.Lock()
+			up := 0.0
+			if c.last.Up {
+				up = 1
+			}
+			c.mu.Unlock()
+			p.sample("caching_proxy_synthetic_up", up, "url", c.url.String())
+		}
+		p.family("caching_proxy_synthetic_runs_total", "counter", "Synthetic check runs, by URL and result.")
+		for _, c := range syntheticChecks {
+			c.mu.Lock()
+			p.sample("caching_proxy_synthetic_runs_total", float64(c.runs-c.failures), "url", c.url.String(), "result", "up")
+			p.sample("caching_proxy_synthetic_runs_total", float64(c.failures), "url", c.url.String(), "result", "down")
+			c.mu.Unlock()
+		}
+		p.family("caching_proxy_synthetic_latency_seconds_total", "counter", "Total latency of synthetic check runs, by URL.")
+		for _, c := range syntheticChecks {
+			c.mu.Lock()
+			p.sample("caching_proxy_synthetic_latency_seconds_total", c.latencyTotal.Seconds(), "url", c.url.String())
+			c.mu.Unlock()
+		}
+	}
+
+	if tracer != nil {
+		p.family("caching_proxy_trace_spans_dropped_total", "counter", "Spans dropped because the OTLP export queue was full.")
+		p.sample("caching_proxy_trace_spans_dropped_total", float64(tracer.dropped.Load()))
+	}
+}
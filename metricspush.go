@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// metricsPusher periodically sends the metrics served on /metrics to a
+// Prometheus Pushgateway or remote-write endpoint, for environments that
+// cannot scrape the proxy.
+type metricsPusher struct {
+	url    string
+	format string // "pushgateway" or "remote-write"
+	job    string
+	labels []string // alternating names and values, sorted by name
+	client *http.Client
+}
+
+var pusher *metricsPusher
+
+var metricLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// newMetricsPusher pushes to rawURL in format, labeling every series with
+// job and labels.
+func newMetricsPusher(rawURL, format, job string, labels []string) (*metricsPusher, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("%q is not an http(s) URL", rawURL)
+	}
+	return &metricsPusher{url: strings.TrimSuffix(rawURL, "/"), format: format, job: job, labels: labels, client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+// parseMetricLabels parses --metrics-push-label specs into alternating names
+// and values, sorted by name.
+func parseMetricLabels(specs []string) ([]string, error) {
+	specs = slices.Clone(specs)
+	sort.Strings(specs)
+	var labels []string
+	for _, spec := range specs {
+		name, value, ok := strings.Cut(spec, "=")
+		if !ok || !metricLabelName.MatchString(name) || strings.HasPrefix(name, "__") || value == "" {
+			return nil, fmt.Errorf("%q is not a name=value label", spec)
+		}
+		if name == "job" {
+			return nil, fmt.Errorf("set the job label with --metrics-push-job")
+		}
+		labels = append(labels, name, value)
+	}
+	return labels, nil
+}
+
+func (p *metricsPusher) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		p.push()
+	}
+}
+
+// push sends the current metrics once, logging a failure.
+func (p *metricsPusher) push() {
+	var req *http.Request
+	var err error
+	if p.format == "pushgateway" {
+		req, err = p.pushgatewayRequest()
+	} else {
+		req, err = p.remoteWriteRequest()
+	}
+	if err == nil {
+		var resp *http.Response
+		if resp, err = p.client.Do(req); err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				err = fmt.Errorf("answered %s", resp.Status)
+			}
+		}
+	}
+	if err != nil {
+		logf("warn", "[Metrics] Push to %s failed: %v", p.url, err)
+	}
+}
+
+// pushgatewayRequest replaces the metrics of the proxy's grouping key, the
+// job and labels, with the text exposition format.
+func (p *metricsPusher) pushgatewayRequest() (*http.Request, error) {
+	target := p.url + "/metrics/job/" + url.PathEscape(p.job)
+	for i := 0; i < len(p.labels); i += 2 {
+		target += "/" + p.labels[i] + "/" + url.PathEscape(p.labels[i+1])
+	}
+	var body bytes.Buffer
+	bw := bufio.NewWriter(&body)
+	writeMetrics(promWriter{w: bw})
+	bw.Flush()
+	req, err := http.NewRequest(http.MethodPut, target, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	return req, nil
+}
+
+// remoteWriteRequest encodes the metrics as a snappy-compressed Prometheus
+// remote-write WriteRequest, every series labeled with the job and labels.
+func (p *metricsPusher) remoteWriteRequest() (*http.Request, error) {
+	now := time.Now().UnixMilli()
+	var msg []byte
+	extra := append([]string{"job", p.job}, p.labels...)
+	writeMetrics(promWriter{collect: func(name string, value float64, labels []string) {
+		all := append([]string{"__name__", name}, labels...)
+		for i := 0; i+1 < len(extra); i += 2 {
+			if !hasLabel(labels, extra[i]) { // the metric's own label wins
+				all = append(all, extra[i], extra[i+1])
+			}
+		}
+		msg = protoAppendBytes(msg, 1, encodeTimeSeries(all, value, now))
+	}})
+	req, err := http.NewRequest(http.MethodPost, p.url, bytes.NewReader(snappyLiteralBlock(msg)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	return req, nil
+}
+
+func hasLabel(labels []string, name string) bool {
+	for i := 0; i < len(labels); i += 2 {
+		if labels[i] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeTimeSeries encodes a TimeSeries message holding one sample. labels
+// alternate names and values; remote write wants them sorted by name.
+func encodeTimeSeries(labels []string, value float64, timestamp int64) []byte {
+	idx := make([]int, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		idx = append(idx, i)
+	}
+	sort.SliceStable(idx, func(a, b int) bool { return labels[idx[a]] < labels[idx[b]] })
+	var ts []byte
+	for _, i := range idx {
+		var label []byte
+		label = protoAppendBytes(label, 1, []byte(labels[i]))
+		label = protoAppendBytes(label, 2, []byte(labels[i+1]))
+		ts = protoAppendBytes(ts, 1, label)
+	}
+	var sample []byte
+	sample = protoAppendVarint(sample, 1<<3|1) // value, fixed64
+	sample = binary.LittleEndian.AppendUint64(sample, math.Float64bits(value))
+	sample = protoAppendVarint(sample, 2<<3|0) // timestamp, varint
+	sample = protoAppendVarint(sample, uint64(timestamp))
+	return protoAppendBytes(ts, 2, sample)
+}
+
+func protoAppendVarint(b []byte, v uint64) []byte { return binary.AppendUvarint(b, v) }
+
+// protoAppendBytes appends a length-delimited field.
+func protoAppendBytes(b []byte, field int, data []byte) []byte {
+	b = protoAppendVarint(b, uint64(field)<<3|2)
+	b = protoAppendVarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// snappyLiteralBlock frames data as a snappy block of literals only. That is
+// valid snappy, just not compressed, and the metrics of one proxy are small.
+func snappyLiteralBlock(data []byte) []byte {
+	out := binary.AppendUvarint(nil, uint64(len(data)))
+	for len(data) > 0 {
+		n := min(len(data), 1<<16)
+		if n <= 60 {
+			out = append(out, byte(n-1)<<2)
+		} else {
+			// Tag 61: the length minus one follows in two bytes.
+			out = append(out, 61<<2)
+			out = binary.LittleEndian.AppendUint16(out, uint16(n-1))
+		}
+		out = append(out, data[:n]...)
+		data = data[n:]
+	}
+	return out
+}
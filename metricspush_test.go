@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// unsnappy decodes a snappy block of literals, the only elements
+// snappyLiteralBlock writes.
+func unsnappy(t *testing.T, b []byte) []byte {
+	t.Helper()
+	n, k := binary.Uvarint(b)
+	b = b[k:]
+	var out []byte
+	for len(b) > 0 {
+		tag := b[0]
+		if tag&3 != 0 {
+			t.Fatalf("element with tag %#x is not a literal", tag)
+		}
+		length := int(tag>>2) + 1
+		b = b[1:]
+		switch tag >> 2 {
+		case 60:
+			length, b = int(b[0])+1, b[1:]
+		case 61:
+			length, b = int(binary.LittleEndian.Uint16(b))+1, b[2:]
+		}
+		out, b = append(out, b[:length]...), b[length:]
+	}
+	if uint64(len(out)) != n {
+		t.Fatalf("decoded %d bytes, header says %d", len(out), n)
+	}
+	return out
+}
+
+// protoFields splits a protobuf message into its fields: varints as
+// uint64, fixed64 as uint64 bits, length-delimited fields as []byte.
+func protoFields(t *testing.T, b []byte) (fields []int, values []any) {
+	t.Helper()
+	for len(b) > 0 {
+		key, k := binary.Uvarint(b)
+		b = b[k:]
+		fields = append(fields, int(key>>3))
+		switch key & 7 {
+		case 0:
+			v, k := binary.Uvarint(b)
+			values, b = append(values, v), b[k:]
+		case 1:
+			values, b = append(values, binary.LittleEndian.Uint64(b)), b[8:]
+		case 2:
+			n, k := binary.Uvarint(b)
+			b = b[k:]
+			values, b = append(values, b[:n]), b[n:]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+	}
+	return fields, values
+}
+
+func TestSnappyLiteralBlock(t *testing.T) {
+	for _, n := range []int{0, 1, 60, 61, 1000, 1 << 16, 1<<16 + 1, 200000} {
+		data := bytes.Repeat([]byte("metrics!"), n/8+1)[:n]
+		if got := unsnappy(t, snappyLiteralBlock(data)); !bytes.Equal(got, data) {
+			t.Errorf("%d bytes do not round-trip", n)
+		}
+	}
+}
+
+func TestEncodeTimeSeries(t *testing.T) {
+	ts := encodeTimeSeries([]string{"__name__", "m", "store", "redis", "job", "caching-proxy"}, 2.5, 1700000000000)
+	fields, values := protoFields(t, ts)
+	var labels []string
+	var sample []byte
+	for i, f := range fields {
+		switch f {
+		case 1:
+			_, lv := protoFields(t, values[i].([]byte))
+			labels = append(labels, string(lv[0].([]byte)), string(lv[1].([]byte)))
+		case 2:
+			sample = values[i].([]byte)
+		}
+	}
+	want := []string{"__name__", "m", "job", "caching-proxy", "store", "redis"}
+	if !slices.Equal(labels, want) {
+		t.Errorf("labels = %q, want %q sorted by name", labels, want)
+	}
+	sf, sv := protoFields(t, sample)
+	if !slices.Equal(sf, []int{1, 2}) || math.Float64frombits(sv[0].(uint64)) != 2.5 || sv[1].(uint64) != 1700000000000 {
+		t.Errorf("sample = %v %v, want value 2.5 at 1700000000000", sf, sv)
+	}
+}
+
+func TestParseMetricLabels(t *testing.T) {
+	got, err := parseMetricLabels([]string{"region=eu-west", "instance=proxy-1"})
+	if err != nil || !slices.Equal(got, []string{"instance", "proxy-1", "region", "eu-west"}) {
+		t.Errorf("parseMetricLabels = %q, %v", got, err)
+	}
+	for _, spec := range []string{"instance", "instance=", "1x=a", "__name__=x", "job=x", "a-b=c"} {
+		if _, err := parseMetricLabels([]string{spec}); err == nil {
+			t.Errorf("parseMetricLabels(%q) accepted", spec)
+		}
+	}
+}
+
+func TestMetricsPush(t *testing.T) {
+	origins = &originPool{}
+	defer func() { origins = nil }()
+
+	type pushed struct {
+		method, path, encoding string
+		body                   []byte
+	}
+	got := make(chan pushed, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- pushed{r.Method, r.URL.EscapedPath(), r.Header.Get("Content-Encoding"), body}
+	}))
+	defer srv.Close()
+
+	p, err := newMetricsPusher(srv.URL+"/", "pushgateway", "caching-proxy", []string{"instance", "proxy 1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.push()
+	req := <-got
+	if req.method != http.MethodPut || req.path != "/metrics/job/caching-proxy/instance/proxy%201" {
+		t.Errorf("pushed with %s %s", req.method, req.path)
+	}
+	if !strings.Contains(string(req.body), "# TYPE caching_proxy_requests_total counter") {
+		t.Errorf("pushgateway body lacks the text format:\n%s", req.body)
+	}
+
+	p.format = "remote-write"
+	p.push()
+	req = <-got
+	if req.method != http.MethodPost || req.encoding != "snappy" {
+		t.Errorf("remote write sent with %s, Content-Encoding %q", req.method, req.encoding)
+	}
+	fields, values := protoFields(t, unsnappy(t, req.body))
+	if len(fields) == 0 {
+		t.Fatal("remote write sent no series")
+	}
+	for i, f := range fields {
+		if f != 1 {
+			t.Fatalf("WriteRequest field %d, want only timeseries", f)
+		}
+		labelFields, labelValues := protoFields(t, values[i].([]byte))
+		var names []string
+		for j, lf := range labelFields {
+			if lf == 1 {
+				_, lv := protoFields(t, labelValues[j].([]byte))
+				names = append(names, string(lv[0].([]byte)))
+			}
+		}
+		if !slices.IsSorted(names) || !slices.Contains(names, "job") || !slices.Contains(names, "instance") {
+			t.Fatalf("series labels %q are unsorted or miss job and instance", names)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// cacheNamespace groups the entries of a configured route so they can be
+// cleared together by bumping the namespace's own generation.
+type cacheNamespace struct {
+	name       string
+	pattern    pathPattern
+	generation atomic.Uint64
+}
+
+// namespaces is fixed at startup; entries outside every namespace belong to
+// the default one, which only the global generation clears.
+var namespaces []*cacheNamespace
+
+func parseNamespace(spec string) (*cacheNamespace, error) {
+	name, pattern, ok := strings.Cut(spec, "=")
+	if !ok || name == "" {
+		return nil, fmt.Errorf("invalid namespace %q (want NAME=PATTERN)", spec)
+	}
+	p, err := parsePathPattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &cacheNamespace{name: name, pattern: p}, nil
+}
+
+func namespaceFor(urlPath string) *cacheNamespace {
+	for _, ns := range namespaces {
+		if ns.pattern.match(urlPath) {
+			return ns
+		}
+	}
+	return nil
+}
+
+func namespaceByName(name string) *cacheNamespace {
+	for _, ns := range namespaces {
+		if ns.name == name {
+			return ns
+		}
+	}
+	return nil
+}
+
+// namespacesHandler lists the configured namespaces and their generations.
+func namespacesHandler(w http.ResponseWriter, r *http.Request) {
+	list := make([]map[string]any, 0, len(namespaces))
+	for _, ns := range namespaces {
+		list = append(list, map[string]any{"name": ns.name, "pattern": ns.pattern, "generation": ns.generation.Load()})
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// namespaceClearHandler invalidates every entry of one namespace in O(1).
+func namespaceClearHandler(w http.ResponseWriter, r *http.Request) {
+	ns := namespaceByName(r.PathValue("name"))
+	if ns == nil {
+		http.Error(w, "no such namespace", http.StatusNotFound)
+		return
+	}
+	gen := ns.generation.Add(1)
+	if disk != nil {
+		disk.saveState()
+	}
+	shareGenerations()
+	go sweepStaleEntries()
+	log.Printf("[Admin] Namespace '%s' cleared (generation %d)", ns.name, gen)
+	writeJSON(w, http.StatusOK, map[string]any{"namespace": ns.name, "generation": gen})
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxNegativeBody is the largest error body a negative entry keeps; larger
+// failures are remembered by status alone. At most maxNegativeEntries
+// failures are remembered at a time.
+const (
+	maxNegativeBody    = 16 << 10
+	maxNegativeEntries = 10000
+)
+
+// negativeTTL is how long a failed fetch of a cacheable key is answered from
+// memory instead of going back to the origin; 0 disables negative entries.
+// Failures with a status in negativeExcluded are never remembered.
+var (
+	negativeTTL      time.Duration
+	negativeExcluded = map[int]bool{}
+)
+
+// negativeEntry is the failure a key's last fetch ended with.
+type negativeEntry struct {
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+	// stamp carries only the generations the failure was remembered in, so
+	// generation bumps and namespace clears forget it like any entry.
+	stamp CachedResponse
+}
+
+var negativeEntries = struct {
+	sync.Mutex
+	m map[string]*negativeEntry
+}{m: map[string]*negativeEntry{}}
+
+// parseStatusList parses a comma-separated list of HTTP status codes.
+func parseStatusList(s string) (map[int]bool, error) {
+	statuses := map[int]bool{}
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		code, err := strconv.Atoi(field)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid status %q", field)
+		}
+		statuses[code] = true
+	}
+	return statuses, nil
+}
+
+// rememberFailure stores a negative entry for key unless they are disabled or
+// status is excluded.
+func rememberFailure(key string, status int, header http.Header, body []byte) {
+	if negativeTTL <= 0 || negativeExcluded[status] {
+		return
+	}
+	neg := &negativeEntry{status: status, header: header, body: body, expires: time.Now().Add(negativeTTL)}
+	stampGenerations(key, &neg.stamp)
+	negativeEntries.Lock()
+	defer negativeEntries.Unlock()
+	if _, ok := negativeEntries.m[key]; !ok && len(negativeEntries.m) >= maxNegativeEntries {
+		dropExpiredNegativeLocked(time.Now())
+		if len(negativeEntries.m) >= maxNegativeEntries {
+			routineLog.printf("[Negative] Not remembering %d for cacheKey '%s': %d failures already remembered", status, key, maxNegativeEntries)
+			return
+		}
+	}
+	routineLog.printf("[Negative] Remembering %d for cacheKey '%s' for %s", status, key, negativeTTL)
+	negativeEntries.m[key] = neg
+}
+
+// rememberFailedResponse stores a negative entry for a 5xx origin response.
+// Its body is kept when small and not content-coded, since it is replayed
+// as is to every client.
+func rememberFailedResponse(key string, resp *http.Response, body []byte) {
+	if negativeTTL <= 0 || negativeExcluded[resp.StatusCode] {
+		return
+	}
+	header := resp.Header.Clone()
+	header.Del("X-Cache")
+	if len(body) > maxNegativeBody || header.Get("Content-Encoding") != "" {
+		body = nil
+		header.Del("Content-Encoding")
+	}
+	rememberFailure(key, resp.StatusCode, header, slices.Clone(body))
+}
+
+// lookupNegative returns key's unexpired negative entry.
+func lookupNegative(key string) (*negativeEntry, bool) {
+	negativeEntries.Lock()
+	defer negativeEntries.Unlock()
+	neg, ok := negativeEntries.m[key]
+	if ok && (time.Now().After(neg.expires) || !neg.stamp.live()) {
+		delete(negativeEntries.m, key)
+		return nil, false
+	}
+	return neg, ok
+}
+
+// forgetFailure drops key's negative entry once a fetch of it succeeds or the
+// key is deleted.
+func forgetFailure(key string) {
+	if negativeTTL <= 0 {
+		return
+	}
+	negativeEntries.Lock()
+	delete(negativeEntries.m, key)
+	negativeEntries.Unlock()
+}
+
+// forgetFailures drops the negative entries a purge matches.
+func forgetFailures(m purgeMatcher) {
+	if negativeTTL <= 0 {
+		return
+	}
+	negativeEntries.Lock()
+	for k := range negativeEntries.m {
+		if m.match(k) {
+			delete(negativeEntries.m, k)
+		}
+	}
+	negativeEntries.Unlock()
+}
+
+// writeNegative answers with a remembered failure.
+func writeNegative(w http.ResponseWriter, r *http.Request, key string, neg *negativeEntry) {
+	routineLog.printf("[Negative] Answering cacheKey '%s' with the %d its last fetch failed with", key, neg.status)
+	for k, vv := range neg.header {
+		w.Header()[k] = vv
+	}
+	if neg.body == nil {
+		w.Header().Del("Content-Length")
+	}
+	w.Header().Set("X-Cache", "NEGATIVE")
+	w.WriteHeader(neg.status)
+	if r.Method != http.MethodHead {
+		w.Write(neg.body)
+	}
+}
+
+// sweepNegative drops expired negative entries every minute.
+func sweepNegative() {
+	for range time.Tick(time.Minute) {
+		negativeEntries.Lock()
+		dropExpiredNegativeLocked(time.Now())
+		negativeEntries.Unlock()
+	}
+}
+
+// dropExpiredNegativeLocked drops the negative entries that expired or were
+// invalidated by a generation bump. negativeEntries must be locked.
+func dropExpiredNegativeLocked(now time.Time) {
+	for k, neg := range negativeEntries.m {
+		if now.After(neg.expires) || !neg.stamp.live() {
+			delete(negativeEntries.m, k)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A forced refresh reaches the origin past a remembered failure, and its
+// success lets ordinary requests through again.
+func TestNegativeForcedRefresh(t *testing.T) {
+	negativeTTL = time.Minute
+	defer func() { negativeTTL = 0 }()
+	var failing atomic.Bool
+	failing.Store(true)
+	srv := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("ok"))
+	}))
+	get := func(force bool) (int, string) {
+		r := httptest.NewRequest(http.MethodGet, "/x", nil)
+		if force {
+			r = withForceRefresh(r)
+		}
+		w := httptest.NewRecorder()
+		srv.Config.Handler.ServeHTTP(w, r)
+		return w.Code, w.Header().Get("X-Cache")
+	}
+
+	if status, _ := get(false); status != http.StatusServiceUnavailable {
+		t.Fatalf("first request: status %d, want the origin's 503", status)
+	}
+	failing.Store(false)
+	if status, cache := get(false); cache != "NEGATIVE" {
+		t.Fatalf("second request: status %d, X-Cache %q, want the remembered failure", status, cache)
+	}
+	if status, _ := get(true); status != http.StatusOK {
+		t.Errorf("forced refresh: status %d, want the origin's 200", status)
+	}
+	if status, cache := get(false); status != http.StatusOK || cache != "HIT" {
+		t.Errorf("after the refresh: status %d, X-Cache %q, want a 200 HIT", status, cache)
+	}
+}
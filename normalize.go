@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// allowEncodedSlashes passes %2F and %5C in paths through to the origin
+// instead of rejecting them. Such paths are then keyed on their escaped form,
+// so /a%2Fb and /a/b stay separate entries.
+var allowEncodedSlashes bool
+
+var (
+	errNullByte      = errors.New("null byte in path")
+	errControlChar   = errors.New("control character in path")
+	errInvalidUTF8   = errors.New("path is not valid UTF-8 (overlong or truncated encoding)")
+	errEncodedSlash  = errors.New("encoded slash in path")
+	errInvalidEscape = errors.New("invalid percent-encoding in path")
+)
+
+// normalizeRequest rewrites the request target into a canonical form before
+// it is keyed and forwarded, so the cache key always describes what the origin
+// is asked for. Requests that cannot be normalized safely are rejected.
+func normalizeRequest(r *http.Request) error {
+	raw, err := normalizeEscapes(r.URL.EscapedPath())
+	if err != nil {
+		return err
+	}
+	raw = removeDotSegments(raw)
+	decoded, err := url.PathUnescape(raw)
+	if err != nil {
+		return errInvalidEscape
+	}
+	if !utf8.ValidString(decoded) {
+		return errInvalidUTF8
+	}
+	for i := 0; i < len(decoded); i++ {
+		if c := decoded[i]; c < 0x20 || c == 0x7f {
+			return errControlChar
+		}
+	}
+	r.URL.Path, r.URL.RawPath = decoded, raw
+	r.Host = canonicalHost(r.Host, r.TLS != nil)
+	return nil
+}
+
+// normalizeEscapes applies RFC 3986 §6.2.2: unreserved characters are
+// decoded and all other escapes use upper-case hex. Encoded dots are thus
+// decoded before dot segments are removed, so %2e%2e cannot hide a "..".
+func normalizeEscapes(path string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] != '%' {
+			b.WriteByte(path[i])
+			continue
+		}
+		if i+2 >= len(path) || !isHex(path[i+1]) || !isHex(path[i+2]) {
+			return "", errInvalidEscape
+		}
+		c := unhex(path[i+1])<<4 | unhex(path[i+2])
+		i += 2
+		switch {
+		case c == 0:
+			return "", errNullByte
+		case c == '/' || c == '\\':
+			if !allowEncodedSlashes {
+				return "", errEncodedSlash
+			}
+			fmt.Fprintf(&b, "%%%02X", c)
+		case isUnreserved(c):
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String(), nil
+}
+
+// removeDotSegments resolves "." and ".." segments (RFC 3986 §5.2.4). ".."
+// never climbs above the root.
+func removeDotSegments(path string) string {
+	if !strings.Contains(path, ".") {
+		return path
+	}
+	segments := strings.Split(path, "/")
+	out := make([]string, 0, len(segments))
+	for i, s := range segments {
+		last := i == len(segments)-1
+		switch s {
+		case ".":
+			if last {
+				out = append(out, "")
+			}
+		case "..":
+			if len(out) > 1 {
+				out = out[:len(out)-1]
+			}
+			if last {
+				out = append(out, "")
+			}
+		default:
+			out = append(out, s)
+		}
+	}
+	if len(out) == 1 && out[0] == "" {
+		return "/"
+	}
+	return strings.Join(out, "/")
+}
+
+// canonicalHost lower-cases the Host header value and drops a trailing dot
+// and the scheme's default port.
+func canonicalHost(host string, tls bool) string {
+	host = strings.ToLower(host)
+	h, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return strings.TrimSuffix(host, ".")
+	}
+	h = strings.TrimSuffix(h, ".")
+	if (port == "80" && !tls) || (port == "443" && tls) {
+		if strings.Contains(h, ":") {
+			return "[" + h + "]"
+		}
+		return h
+	}
+	return net.JoinHostPort(h, port)
+}
+
+// keyPath is the path a request is cached under.
+func keyPath(r *http.Request) string {
+	if allowEncodedSlashes && r.URL.RawPath != "" {
+		return r.URL.EscapedPath()
+	}
+	return r.URL.Path
+}
+
+func isUnreserved(c byte) bool {
+	return 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	}
+	return c - 'A' + 10
+}
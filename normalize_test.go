@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestNormalizeRequest(t *testing.T) {
+	tests := []struct {
+		target  string
+		path    string // decoded, when normalization succeeds
+		rawPath string
+		err     error
+	}{
+		{"/a/b", "/a/b", "/a/b", nil},
+		{"/a/./b/../c", "/a/c", "/a/c", nil},
+		{"/a/%2e%2e/b", "/b", "/b", nil},
+		{"/a/%2E%2e/%2E/b", "/b", "/b", nil},
+		{"/../../etc/passwd", "/etc/passwd", "/etc/passwd", nil},
+		{"/a/..", "/", "/", nil},
+		{"/%7euser/%41", "/~user/A", "/~user/A", nil},
+		{"/caf%c3%a9", "/café", "/caf%C3%A9", nil},
+		{"/a%20b", "/a b", "/a%20b", nil},
+		{"/a%2Fb", "", "", errEncodedSlash},
+		{"/a%2fb", "", "", errEncodedSlash},
+		{"/a%5Cb", "", "", errEncodedSlash},
+		{"/a%00b", "", "", errNullByte},
+		{"/a%0Ab", "", "", errControlChar},
+		{"/a%7Fb", "", "", errControlChar},
+		{"/%C0%AE%C0%AE/etc", "", "", errInvalidUTF8},
+		{"/%C0%AF", "", "", errInvalidUTF8},
+		{"/%E0%80%AF", "", "", errInvalidUTF8},
+		{"/%C3", "", "", errInvalidUTF8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			err := normalizeRequest(r)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("normalizeRequest error = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if r.URL.Path != tt.path {
+				t.Errorf("Path = %q, want %q", r.URL.Path, tt.path)
+			}
+			if got := r.URL.EscapedPath(); got != tt.rawPath {
+				t.Errorf("EscapedPath = %q, want %q", got, tt.rawPath)
+			}
+		})
+	}
+}
+
+func TestNormalizeRequestEncodedSlashesAllowed(t *testing.T) {
+	allowEncodedSlashes = true
+	defer func() { allowEncodedSlashes = false }()
+
+	r := httptest.NewRequest(http.MethodGet, "/a%2fb/%5c", nil)
+	if err := normalizeRequest(r); err != nil {
+		t.Fatal(err)
+	}
+	if got := keyPath(r); got != "/a%2Fb/%5C" {
+		t.Errorf("keyPath = %q, want the escaped form", got)
+	}
+	other := httptest.NewRequest(http.MethodGet, "/a/b/", nil)
+	normalizeRequest(other)
+	if keyPath(r) == keyPath(other) {
+		t.Error("encoded and literal slashes share a key")
+	}
+}
+
+func TestCanonicalHost(t *testing.T) {
+	tests := []struct {
+		host string
+		tls  bool
+		want string
+	}{
+		{"Example.COM", false, "example.com"},
+		{"example.com.", false, "example.com"},
+		{"example.com:80", false, "example.com"},
+		{"example.com:443", true, "example.com"},
+		{"example.com:443", false, "example.com:443"},
+		{"EXAMPLE.com.:8080", false, "example.com:8080"},
+		{"[::1]:80", false, "[::1]"},
+		{"[::1]:8080", false, "[::1]:8080"},
+	}
+	for _, tt := range tests {
+		if got := canonicalHost(tt.host, tt.tls); got != tt.want {
+			t.Errorf("canonicalHost(%q, %v) = %q, want %q", tt.host, tt.tls, got, tt.want)
+		}
+	}
+}
+
+// FuzzNormalizeRequest checks that whatever path a client sends, a request
+// that passes normalization is keyed on a canonical, safe path that
+// normalizing again leaves unchanged.
+func FuzzNormalizeRequest(f *testing.F) {
+	for _, seed := range []string{
+		"/",
+		"/a/b?c=d",
+		"/a/%2e%2e/b",
+		"/%2E%2E/%2e/secret",
+		"/a/.%2e/b",
+		"/a%2Fb",
+		"/a%2f..%2fb",
+		"/a%5Cb",
+		"/a%5c..%5cb",
+		"/a%00b",
+		"/%00",
+		"/%C0%AE%C0%AE/",
+		"/%C0%AF",
+		"/%E0%80%AF",
+		"/%F0%80%80%AF",
+		"/caf%C3%A9",
+		"/%7Euser",
+		"/a%",
+		"/a%G0",
+		"//double//slash/",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, target string) {
+		u, err := url.ParseRequestURI(target)
+		if err != nil || !strings.HasPrefix(target, "/") {
+			return
+		}
+		r := &http.Request{Method: http.MethodGet, URL: u, Host: "Example.COM:80", Header: http.Header{}}
+		if err := normalizeRequest(r); err != nil {
+			return
+		}
+		path := r.URL.Path
+		if !strings.HasPrefix(path, "/") {
+			t.Fatalf("%q normalized to %q, which is not absolute", target, path)
+		}
+		if !utf8.ValidString(path) {
+			t.Fatalf("%q normalized to invalid UTF-8 %q", target, path)
+		}
+		for i := 0; i < len(path); i++ {
+			if c := path[i]; c < 0x20 || c == 0x7f {
+				t.Fatalf("%q normalized to %q, with control character %#x", target, path, c)
+			}
+		}
+		for _, seg := range strings.Split(path, "/") {
+			if seg == "." || seg == ".." {
+				t.Fatalf("%q normalized to %q, which keeps a dot segment", target, path)
+			}
+		}
+		if r.Host != "example.com" {
+			t.Fatalf("Host normalized to %q", r.Host)
+		}
+
+		// The escaped form must normalize to itself, or the key would
+		// depend on how many hops normalized the path.
+		again := &http.Request{Method: http.MethodGet, URL: &url.URL{Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery}, Host: r.Host, Header: http.Header{}}
+		if err := normalizeRequest(again); err != nil {
+			t.Fatalf("%q normalized to %q, which fails to normalize: %v", target, r.URL.EscapedPath(), err)
+		}
+		if again.URL.Path != path || again.URL.EscapedPath() != r.URL.EscapedPath() {
+			t.Fatalf("normalizing %q twice gave %q/%q, then %q/%q", target, path, r.URL.EscapedPath(), again.URL.Path, again.URL.EscapedPath())
+		}
+		if generateCacheKey(again) != generateCacheKey(r) {
+			t.Fatalf("cache key of %q changes when normalized twice", target)
+		}
+	})
+}
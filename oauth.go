@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oauthTokenSource obtains access tokens with the OAuth2 client credentials
+// grant (RFC 6749 §4.4) and reuses them until shortly before they expire.
+type oauthTokenSource struct {
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	scope        string
+	client       *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// oauthRoute injects tokens from source into origin requests matching pattern.
+type oauthRoute struct {
+	pattern pathPattern
+	source  *oauthTokenSource
+}
+
+var oauthRoutes []oauthRoute
+
+// parseOAuthRoute parses PATTERN=TOKEN_URL[,scope=SCOPES][,client=PREFIX].
+// The client ID and secret come from PREFIX_CLIENT_ID and PREFIX_CLIENT_SECRET
+// (PREFIX defaults to OAUTH). Routes with the same token endpoint, client and
+// scope share a token.
+func parseOAuthRoute(spec string, client *http.Client) (oauthRoute, error) {
+	pattern, rest, ok := strings.Cut(spec, "=")
+	if !ok {
+		return oauthRoute{}, fmt.Errorf("invalid OAuth route %q (want PATTERN=TOKEN_URL[,scope=SCOPES][,client=PREFIX])", spec)
+	}
+	p, err := parsePathPattern(pattern)
+	if err != nil {
+		return oauthRoute{}, err
+	}
+	params := strings.Split(rest, ",")
+	u, err := url.Parse(params[0])
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return oauthRoute{}, fmt.Errorf("OAuth route %q: invalid token URL %q", spec, params[0])
+	}
+	src := &oauthTokenSource{tokenURL: params[0], client: client}
+	prefix := "OAUTH"
+	for _, param := range params[1:] {
+		name, value, _ := strings.Cut(param, "=")
+		switch name {
+		case "scope":
+			src.scope = strings.ReplaceAll(value, "+", " ")
+		case "client":
+			prefix = value
+		default:
+			return oauthRoute{}, fmt.Errorf("OAuth route %q: unknown parameter %q", spec, name)
+		}
+	}
+	src.clientID, src.clientSecret = os.Getenv(prefix+"_CLIENT_ID"), os.Getenv(prefix+"_CLIENT_SECRET")
+	if src.clientID == "" || src.clientSecret == "" {
+		return oauthRoute{}, fmt.Errorf("OAuth route %q needs %s_CLIENT_ID and %s_CLIENT_SECRET", spec, prefix, prefix)
+	}
+	for _, r := range oauthRoutes {
+		s := r.source
+		if s.tokenURL == src.tokenURL && s.clientID == src.clientID && s.scope == src.scope {
+			src = s
+			break
+		}
+	}
+	return oauthRoute{pattern: p, source: src}, nil
+}
+
+func findOAuthRoute(urlPath string) *oauthRoute {
+	for i := range oauthRoutes {
+		if oauthRoutes[i].pattern.match(urlPath) {
+			return &oauthRoutes[i]
+		}
+	}
+	return nil
+}
+
+// injectsCredentials reports whether the proxy authenticates origin requests
+// for urlPath itself, in which case the client is anonymous and the response
+// may be shared.
+func injectsCredentials(urlPath string) bool {
+	return findSigningRule(urlPath) != nil || findOAuthRoute(urlPath) != nil
+}
+
+// injectOAuthToken sets the route's bearer token on an origin request,
+// replacing any client credentials.
+func injectOAuthToken(req *http.Request) error {
+	route := findOAuthRoute(req.URL.Path)
+	if route == nil {
+		return nil
+	}
+	req.Header.Del("Authorization")
+	token, err := route.source.get(req.Context())
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// invalidateOAuthToken drops the token used for a request the origin rejected
+// with 401, so the next request fetches a fresh one.
+func invalidateOAuthToken(req *http.Request) {
+	route := findOAuthRoute(req.URL.Path)
+	if route == nil {
+		return
+	}
+	s := route.source
+	s.mu.Lock()
+	if "Bearer "+s.token == req.Header.Get("Authorization") {
+		s.token = ""
+	}
+	s.mu.Unlock()
+}
+
+// get returns a valid token, fetching one when needed. Concurrent callers
+// wait for a single fetch.
+func (s *oauthTokenSource) get(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && time.Now().Before(s.expires) {
+		return s.token, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if s.scope != "" {
+		form.Set("scope", s.scope)
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(s.clientID), url.QueryEscape(s.clientSecret))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+		Error       string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil && resp.StatusCode == http.StatusOK {
+		return "", fmt.Errorf("invalid token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || body.AccessToken == "" {
+		return "", fmt.Errorf("token endpoint returned %s %s", resp.Status, body.Error)
+	}
+	if body.TokenType != "" && !strings.EqualFold(body.TokenType, "bearer") {
+		return "", fmt.Errorf("unsupported token type %q", body.TokenType)
+	}
+
+	lifetime := time.Duration(body.ExpiresIn) * time.Second
+	if lifetime <= 0 {
+		lifetime = time.Hour
+	}
+	// Refresh a little early so tokens don't expire in flight
+	s.token, s.expires = body.AccessToken, time.Now().Add(lifetime-min(lifetime/10, time.Minute))
+	return s.token, nil
+}
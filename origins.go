@@ -0,0 +1,461 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Session affinity modes for non-cacheable traffic.
+const (
+	stickyNone   = "none"
+	stickyCookie = "cookie"
+	stickyIP     = "ip"
+)
+
+// Load balancing strategies for spreading requests across replicas.
+const (
+	balanceRoundRobin       = "round-robin"
+	balanceLeastConnections = "least-connections"
+)
+
+// backend is a single origin replica requests can be forwarded to.
+type backend struct {
+	url *url.URL
+	// id is a stable identifier derived from the URL, used as the sticky-session
+	// cookie value so affinity survives reordering of the --origin list.
+	id string
+	// pausedUntil is when the backend's last Retry-After window ends, in Unix
+	// nanoseconds.
+	pausedUntil atomic.Int64
+	// headers are sent to this backend when the client request lacks them.
+	headers http.Header
+	// stripCredentials keeps the client's credentials from this backend.
+	stripCredentials bool
+	// serverName and hostHeader replace the URL's host as TLS SNI and as the
+	// Host header, for backends addressed by IP.
+	serverName string
+	hostHeader string
+	// inflight counts the requests being forwarded to this backend.
+	inflight atomic.Int64
+	// down is set while origin checks find the backend unreachable, with
+	// --origin-failover.
+	down atomic.Bool
+}
+
+// originPool holds the configured origin replicas and decides which one serves
+// a given request.
+type originPool struct {
+	backends   []*backend
+	next       atomic.Uint64
+	sticky     string
+	cookieName string
+	balance    string
+	// hosts route requests by Host to their own replicas; other hosts are
+	// served by backends.
+	hosts map[string]*originPool
+}
+
+// newOriginPool parses a comma-separated list of origin URLs. An empty list
+// gives a pool that only serves the hosts added to it.
+func newOriginPool(origins string, sticky string, cookieName string, balance string) (*originPool, error) {
+	switch sticky {
+	case stickyNone, stickyCookie, stickyIP:
+	default:
+		return nil, fmt.Errorf("unknown sticky session mode %q (want none, cookie or ip)", sticky)
+	}
+	switch balance {
+	case balanceRoundRobin, balanceLeastConnections:
+	default:
+		return nil, fmt.Errorf("unknown load balancing strategy %q (want round-robin or least-connections)", balance)
+	}
+
+	pool := &originPool{sticky: sticky, cookieName: cookieName, balance: balance}
+	if origins == "" {
+		return pool, nil
+	}
+	for _, raw := range strings.Split(origins, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid origin URL %q: %w", raw, err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid origin URL %q: scheme and host are required", raw)
+		}
+		h := fnv.New32a()
+		h.Write([]byte(u.String()))
+		pool.backends = append(pool.backends, &backend{url: u, id: fmt.Sprintf("%08x", h.Sum32())})
+	}
+	if len(pool.backends) == 0 {
+		return nil, fmt.Errorf("at least one origin URL is required")
+	}
+	return pool, nil
+}
+
+// addHostOrigin parses HOST=URL[,URL...] and sends requests for HOST to those
+// replicas, with the pool's session affinity and load balancing.
+func (p *originPool) addHostOrigin(spec string) error {
+	host, urls, ok := strings.Cut(spec, "=")
+	host = strings.ToLower(strings.TrimSpace(host))
+	if !ok || host == "" || strings.TrimSpace(urls) == "" {
+		return fmt.Errorf("invalid host origin %q (want HOST=URL[,URL...])", spec)
+	}
+	if _, dup := p.hosts[host]; dup {
+		return fmt.Errorf("duplicate host origin for %q", host)
+	}
+	sub, err := newOriginPool(urls, p.sticky, p.cookieName, p.balance)
+	if err != nil {
+		return fmt.Errorf("host %q: %w", host, err)
+	}
+	if p.hosts == nil {
+		p.hosts = map[string]*originPool{}
+	}
+	p.hosts[host] = sub
+	return nil
+}
+
+// forHost returns the pool serving requests with this Host header, or nil
+// when no backend does.
+func (p *originPool) forHost(host string) *originPool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if sub, ok := p.hosts[strings.ToLower(host)]; ok {
+		return sub
+	}
+	if len(p.backends) == 0 {
+		return nil
+	}
+	return p
+}
+
+// forBackend returns the pool b belongs to.
+func (p *originPool) forBackend(b *backend) *originPool {
+	for _, sub := range p.hosts {
+		if slices.Contains(sub.backends, b) {
+			return sub
+		}
+	}
+	return p
+}
+
+// allBackends returns the pool's backends followed by those of its hosts.
+func (p *originPool) allBackends() []*backend {
+	all := slices.Clone(p.backends)
+	for _, host := range sortedKeys(p.hosts) {
+		all = append(all, p.hosts[host].backends...)
+	}
+	return all
+}
+
+// addDefaultHeader parses HOST=NAME:VALUE and sends the header to the
+// backends with that host, unless the client request already carries it. A
+// VALUE of $VAR is read from the environment, keeping secrets off the command
+// line.
+func (p *originPool) addDefaultHeader(spec string) error {
+	host, header, ok := strings.Cut(spec, "=")
+	name, value, hasValue := strings.Cut(header, ":")
+	name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+	if !ok || !hasValue || host == "" || name == "" {
+		return fmt.Errorf("invalid origin header %q (want HOST=NAME:VALUE)", spec)
+	}
+	if env, ok := strings.CutPrefix(value, "$"); ok {
+		if value = os.Getenv(env); value == "" {
+			return fmt.Errorf("origin header %q: $%s is not set", name, env)
+		}
+	}
+	matched := false
+	for _, b := range p.allBackends() {
+		if strings.EqualFold(b.url.Host, host) {
+			if b.headers == nil {
+				b.headers = http.Header{}
+			}
+			b.headers.Add(name, value)
+			matched = true
+		}
+	}
+	if !matched {
+		return fmt.Errorf("origin header %q: no origin with host %q", name, host)
+	}
+	return nil
+}
+
+// Credential policies of --origin-credentials.
+const (
+	credentialsForward = "forward"
+	credentialsStrip   = "strip"
+)
+
+// credentialHeaders carry client credentials that an untrusted backend must
+// not see.
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// setCredentialPolicy parses HOST=forward|strip, where a HOST of * applies
+// to every backend, and decides whether the client's credentials reach the
+// backends with that host.
+func (p *originPool) setCredentialPolicy(spec string) error {
+	host, policy, ok := strings.Cut(spec, "=")
+	if !ok || host == "" || (policy != credentialsForward && policy != credentialsStrip) {
+		return fmt.Errorf("invalid origin credential policy %q (want HOST=forward|strip)", spec)
+	}
+	matched := false
+	for _, b := range p.allBackends() {
+		if host == "*" || strings.EqualFold(b.url.Host, host) {
+			b.stripCredentials = policy == credentialsStrip
+			matched = true
+		}
+	}
+	if !matched {
+		return fmt.Errorf("origin credential policy %q: no origin with host %q", spec, host)
+	}
+	return nil
+}
+
+// setOriginName parses HOST=NAME for --origin-sni (sni) or
+// --origin-host-header, where a HOST of * applies to every backend.
+func (p *originPool) setOriginName(spec string, sni bool) error {
+	host, name, ok := strings.Cut(spec, "=")
+	if !ok || host == "" || name == "" {
+		return fmt.Errorf("invalid origin name %q (want HOST=NAME)", spec)
+	}
+	matched := false
+	for _, b := range p.allBackends() {
+		if host == "*" || strings.EqualFold(b.url.Host, host) {
+			if sni {
+				b.serverName = name
+			} else {
+				b.hostHeader = name
+			}
+			matched = true
+		}
+	}
+	if !matched {
+		return fmt.Errorf("origin name %q: no origin with host %q", spec, host)
+	}
+	return nil
+}
+
+// host is the Host header requests to the backend carry.
+func (b *backend) host() string {
+	if b.hostHeader != "" {
+		return b.hostHeader
+	}
+	return b.url.Host
+}
+
+// serverNames maps the dial address of every https backend with an SNI
+// override to that name.
+func (p *originPool) serverNames() map[string]string {
+	names := map[string]string{}
+	for _, b := range p.allBackends() {
+		if b.serverName == "" || b.url.Scheme != "https" {
+			continue
+		}
+		addr := b.url.Host
+		if b.url.Port() == "" {
+			addr = net.JoinHostPort(b.url.Hostname(), "443")
+		}
+		names[addr] = b.serverName
+	}
+	return names
+}
+
+// stripClientCredentials removes the client's credentials from an origin
+// request when the backend is not trusted with them. Credentials the proxy
+// adds itself (default headers, OAuth tokens, signatures) are applied later.
+func (b *backend) stripClientCredentials(req *http.Request) {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	if !b.stripCredentials {
+		return
+	}
+	for _, name := range credentialHeaders {
+		req.Header.Del(name)
+	}
+}
+
+// applyDefaultHeaders adds the backend's default headers missing from req.
+func (b *backend) applyDefaultHeaders(req *http.Request) {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	for name, values := range b.headers {
+		if _, ok := req.Header[name]; !ok {
+			req.Header[name] = slices.Clone(values)
+		}
+	}
+}
+
+// scratch returns a copy of the pool's backends without their settings, for
+// validating reloaded ones before they are installed.
+func (p *originPool) scratch() *originPool {
+	s := &originPool{}
+	for _, b := range p.allBackends() {
+		s.backends = append(s.backends, &backend{url: b.url, id: b.id})
+	}
+	return s
+}
+
+func (p *originPool) String() string {
+	urls := make([]string, 0, len(p.backends)+len(p.hosts))
+	for _, b := range p.backends {
+		urls = append(urls, b.url.String())
+	}
+	for _, host := range sortedKeys(p.hosts) {
+		urls = append(urls, host+"="+p.hosts[host].String())
+	}
+	return strings.Join(urls, ", ")
+}
+
+// pick chooses the backend for a request. Cacheable requests are spread
+// round-robin, or to the backend with the fewest requests in flight under
+// least-connections, skipping backends that are down or paused by
+// Retry-After while others are available; non-cacheable ones honor the
+// configured session affinity so stateful origins keep seeing the same user,
+// unless their backend is down.
+func (p *originPool) pick(r *http.Request, cacheable bool) *backend {
+	if len(p.backends) == 1 {
+		return p.backends[0]
+	}
+	if !cacheable {
+		switch p.sticky {
+		case stickyCookie:
+			if c, err := r.Cookie(p.cookieName); err == nil {
+				for _, b := range p.backends {
+					if b.id == c.Value && !b.down.Load() {
+						return b
+					}
+				}
+			}
+		case stickyIP:
+			h := fnv.New32a()
+			h.Write([]byte(clientIP(r)))
+			if b := p.backends[h.Sum32()%uint32(len(p.backends))]; !b.down.Load() {
+				return b
+			}
+		}
+	}
+	n := uint64(len(p.backends))
+	start := p.next.Add(1) - 1
+	if p.balance == balanceLeastConnections {
+		// Scanning from the rotating start breaks ties round-robin.
+		var best *backend
+		for i := range n {
+			b := p.backends[(start+i)%n]
+			if b.available() && (best == nil || b.inflight.Load() < best.inflight.Load()) {
+				best = b
+			}
+		}
+		if best != nil {
+			return best
+		}
+	}
+	for i := range n {
+		if b := p.backends[(start+i)%n]; b.available() {
+			return b
+		}
+	}
+	for i := range n {
+		if b := p.backends[(start+i)%n]; !b.down.Load() {
+			return b
+		}
+	}
+	return p.backends[start%n]
+}
+
+// backendByURL returns the backend an entry was fetched from, if it is still
+// configured.
+func (p *originPool) backendByURL(u string) *backend {
+	for _, b := range p.allBackends() {
+		if b.url.String() == u {
+			return b
+		}
+	}
+	return nil
+}
+
+// setAffinityCookie pins the client to the backend that served a non-cacheable
+// response, unless the request already carried a cookie for it.
+func (p *originPool) setAffinityCookie(resp *http.Response, b *backend) {
+	if p.sticky != stickyCookie || len(p.backends) == 1 {
+		return
+	}
+	if c, err := resp.Request.Cookie(p.cookieName); err == nil && c.Value == b.id {
+		return
+	}
+	cookie := &http.Cookie{Name: p.cookieName, Value: b.id, Path: "/", HttpOnly: true}
+	resp.Header.Add("Set-Cookie", cookie.String())
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+type contextKey int
+
+const (
+	requestStateKey contextKey = iota
+	forceRefreshKey
+	requestLogKey
+	bodyKeyKey
+	clientEncodingKey
+	traceSpanKey
+)
+
+// requestState carries per-request proxy decisions from the handler through the
+// Director and ModifyResponse hooks.
+type requestState struct {
+	backend *backend
+	// cacheKey is computed from the client's request; the Director rewrites
+	// the outgoing one for the origin.
+	cacheKey  string
+	cacheable bool
+	// clientHeader holds the client's request headers, which variants are
+	// keyed on, without those the Director adds for the origin.
+	clientHeader http.Header
+	// background marks fetches issued by the proxy itself (prefetches) rather
+	// than by a client.
+	background bool
+	// cacheStatus is reported to the client in the X-Cache header.
+	cacheStatus string
+	// started is when the request was sent on to the origin.
+	started time.Time
+	// revalidating is the stored entry the origin request was made
+	// conditional on, if any.
+	revalidating *CachedResponse
+}
+
+func withRequestState(r *http.Request, st *requestState) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestStateKey, st))
+}
+
+func requestStateFrom(r *http.Request) *requestState {
+	st, _ := r.Context().Value(requestStateKey).(*requestState)
+	return st
+}
+
+// withForceRefresh makes the handler skip the cache lookup and fetch a fresh
+// copy from the origin, replacing any stored entry.
+func withForceRefresh(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), forceRefreshKey, true))
+}
+
+func forceRefresh(r *http.Request) bool {
+	refresh, _ := r.Context().Value(forceRefreshKey).(bool)
+	return refresh
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// peerConfig holds the --peer settings for --store=peers.
+type peerConfig struct {
+	urls    stringList
+	timeout time.Duration
+}
+
+var peerSettings peerConfig
+
+// peerStore is the cluster mode of the proxy: nodes keep their own memory
+// caches, and a local miss is first asked of the other nodes, so a node that
+// just joined fills up from its peers instead of sending every request to the
+// origin. Peers are asked all at once and the first to have the entry wins;
+// those that don't answer within the timeout are skipped. Writes and
+// invalidations stay local.
+type peerStore struct {
+	peers   []*url.URL
+	timeout time.Duration
+	client  *http.Client
+
+	hits, misses, errors atomic.Int64
+}
+
+func openPeerStore(cfg peerConfig) (*peerStore, error) {
+	if len(cfg.urls) == 0 {
+		return nil, fmt.Errorf("--store=peers needs at least one --peer")
+	}
+	if cfg.timeout <= 0 {
+		return nil, fmt.Errorf("--peer-timeout must be positive")
+	}
+	s := &peerStore{timeout: cfg.timeout, client: &http.Client{}}
+	for _, raw := range cfg.urls {
+		u, err := url.Parse(strings.TrimSuffix(raw, "/"))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid --peer %q (want the http(s) URL of a node's admin API)", raw)
+		}
+		s.peers = append(s.peers, u)
+	}
+	log.Printf("[Peers] Looking up local misses on %d peers (timeout %s)", len(s.peers), s.timeout)
+	return s, nil
+}
+
+// Get asks every peer for key and returns the first entry found, stamped
+// with this node's generations so it counts as live here.
+func (s *peerStore) Get(key string) (*CachedResponse, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	found := make(chan *CachedResponse, len(s.peers))
+	for _, p := range s.peers {
+		go func() {
+			c, err := s.fetch(ctx, p, key)
+			if err != nil && ctx.Err() == nil {
+				s.errors.Add(1)
+				logf("warn", "[Peers] Lookup of cacheKey '%s' on %s failed: %v", key, p.Host, err)
+			}
+			found <- c
+		}()
+	}
+wait:
+	for range s.peers {
+		select {
+		case c := <-found:
+			if c != nil {
+				s.hits.Add(1)
+				stampGenerations(key, c)
+				routineLog.printf("[Peers] Filled cacheKey '%s' from a peer", key)
+				return c, true
+			}
+		case <-ctx.Done():
+			break wait
+		}
+	}
+	s.misses.Add(1)
+	return nil, false
+}
+
+// fetch returns the peer's entry for key, or nil when it has none.
+func (s *peerStore) fetch(ctx context.Context, peer *url.URL, key string) (*CachedResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, peer.String()+"/__admin/peer?key="+url.QueryEscape(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	if adminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("peer answered %s", resp.Status)
+	}
+	var e diskEntry
+	if err := gob.NewDecoder(resp.Body).Decode(&e); err != nil {
+		return nil, err
+	}
+	if e.Key != key || e.Entry == nil {
+		return nil, fmt.Errorf("peer answered with cacheKey '%s'", e.Key)
+	}
+	return e.Entry, nil
+}
+
+func (s *peerStore) Set(key string, c *CachedResponse) {}
+func (s *peerStore) Delete(key string) bool            { return false }
+func (s *peerStore) Purge(m purgeMatcher) int          { return 0 }
+func (s *peerStore) Len() int                          { return -1 }
+
+func (s *peerStore) Stats() StoreStats {
+	return StoreStats{Backend: "peers", Entries: -1, Hits: s.hits.Load(), Misses: s.misses.Load(), Errors: s.errors.Load()}
+}
+
+// peerEntryHandler serves GET /__admin/peer?key=K to other nodes: the entry
+// from this node's memory store, never one looked up on its own peers, so
+// lookups don't travel around the cluster.
+func peerEntryHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	c, ok := memory.Get(key)
+	if !ok {
+		http.Error(w, "not cached", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if err := gob.NewEncoder(w).Encode(diskEntry{Key: key, Entry: c}); err != nil {
+		logf("warn", "[Peers] Failed to send cacheKey '%s' to %s: %v", key, clientIP(r), err)
+	}
+}
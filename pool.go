@@ -0,0 +1,268 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// evictionPolicy orders the entries of a pool for eviction. All methods are
+// called with cacheMutex held.
+type evictionPolicy interface {
+	added(key string, c *CachedResponse)
+	accessed(key string)
+	removed(key string)
+	// victim returns the next key to evict, if any.
+	victim() (string, bool)
+}
+
+// fifoPolicy evicts entries in the order they were stored.
+type fifoPolicy struct {
+	order *list.List
+	elems map[string]*list.Element
+}
+
+func newFIFOPolicy() *fifoPolicy {
+	return &fifoPolicy{order: list.New(), elems: map[string]*list.Element{}}
+}
+
+func (p *fifoPolicy) added(key string, c *CachedResponse) {
+	p.removed(key)
+	p.elems[key] = p.order.PushBack(key)
+}
+
+func (p *fifoPolicy) accessed(key string) {}
+
+func (p *fifoPolicy) removed(key string) {
+	if e, ok := p.elems[key]; ok {
+		p.order.Remove(e)
+		delete(p.elems, key)
+	}
+}
+
+func (p *fifoPolicy) victim() (string, bool) {
+	e := p.order.Front()
+	if e == nil {
+		return "", false
+	}
+	return e.Value.(string), true
+}
+
+// lruPolicy evicts the least recently used entry first.
+type lruPolicy struct {
+	fifoPolicy
+}
+
+func newLRUPolicy() *lruPolicy {
+	return &lruPolicy{*newFIFOPolicy()}
+}
+
+func (p *lruPolicy) accessed(key string) {
+	if e, ok := p.elems[key]; ok {
+		p.order.MoveToBack(e)
+	}
+}
+
+// evictionPolicies maps policy names accepted in pool specs to constructors.
+var evictionPolicies = map[string]func() evictionPolicy{
+	"fifo": func() evictionPolicy { return newFIFOPolicy() },
+	"gdsf": func() evictionPolicy { return newGDSFPolicy() },
+	"lru":  func() evictionPolicy { return newLRUPolicy() },
+}
+
+// cachePool is a named budget of cache memory with its own eviction policy.
+// Routes are bound to pools so that, e.g., small hot API responses and large
+// static assets don't compete for the same space.
+type cachePool struct {
+	name     string
+	maxBytes int64 // 0 means unlimited
+	policy   evictionPolicy
+
+	// Accounting, guarded by cacheMutex.
+	bytes     int64
+	entries   int
+	evictions int64
+}
+
+// poolRoute binds requests matching pattern to a pool.
+type poolRoute struct {
+	pattern pathPattern
+	pool    *cachePool
+}
+
+// maxEntries and maxCacheBytes cap the number and total size of entries
+// across all pools; the least recently used entry is evicted first. 0 means
+// unlimited.
+var (
+	maxEntries     int
+	maxCacheBytes  byteSize
+	cacheBytes     int64
+	entryRecency   = newLRUPolicy()
+	entryEvictions int64
+)
+
+var (
+	defaultPool = &cachePool{name: "default", policy: newFIFOPolicy()}
+	cachePools  = []*cachePool{defaultPool}
+	poolRoutes  []poolRoute
+)
+
+// parseCachePool parses NAME=SIZE[:POLICY], e.g. "assets=512MB:fifo".
+func parseCachePool(spec string) (*cachePool, error) {
+	name, rest, ok := strings.Cut(spec, "=")
+	if !ok || name == "" {
+		return nil, fmt.Errorf("invalid cache pool %q (want NAME=SIZE[:POLICY])", spec)
+	}
+	size, policyName, _ := strings.Cut(rest, ":")
+	if policyName == "" {
+		policyName = "fifo"
+	}
+	newPolicy, ok := evictionPolicies[policyName]
+	if !ok {
+		return nil, fmt.Errorf("unknown eviction policy %q for pool %q", policyName, name)
+	}
+	maxBytes, err := parseByteSize(size)
+	if err != nil {
+		return nil, fmt.Errorf("pool %q: %w", name, err)
+	}
+	return &cachePool{name: name, maxBytes: maxBytes, policy: newPolicy()}, nil
+}
+
+// parsePoolRoute parses PATTERN=POOL against the configured pools.
+func parsePoolRoute(spec string) (poolRoute, error) {
+	pattern, name, ok := strings.Cut(spec, "=")
+	if !ok {
+		return poolRoute{}, fmt.Errorf("invalid pool route %q (want PATTERN=POOL)", spec)
+	}
+	p, err := parsePathPattern(pattern)
+	if err != nil {
+		return poolRoute{}, err
+	}
+	pool := poolByName(name)
+	if pool == nil {
+		return poolRoute{}, fmt.Errorf("pool route %q refers to unknown pool %q", spec, name)
+	}
+	return poolRoute{pattern: p, pool: pool}, nil
+}
+
+func poolByName(name string) *cachePool {
+	for _, p := range cachePools {
+		if p.name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func poolFor(urlPath string) *cachePool {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	for _, r := range poolRoutes {
+		if r.pattern.match(urlPath) {
+			return r.pool
+		}
+	}
+	return defaultPool
+}
+
+// addEntryLocked stores c under key in its pool, evicting from that pool as
+// needed to stay within its budget. Callers must hold cacheMutex.
+func addEntryLocked(key string, c *CachedResponse) {
+	// Counted before the old entry goes, so replacing a URL's only variant
+	// doesn't drop it from the Vary index.
+	variantAddedLocked(key)
+	removeEntryLocked(key)
+	if c.pool = tenantPoolFor(key); c.pool == nil {
+		c.pool = poolFor(cacheKeyPath(key))
+	}
+	cache[key] = c
+	c.pool.bytes += c.size()
+	c.pool.entries++
+	c.pool.policy.added(key, c)
+	entryRecency.added(key, c)
+	cacheBytes += c.size()
+	c.pool.enforceLocked()
+	enforceCacheLimitsLocked()
+}
+
+// accessedLocked records a hit on key. Callers must hold cacheMutex.
+func accessedLocked(key string, c *CachedResponse) {
+	c.hits++
+	c.pool.policy.accessed(key)
+	entryRecency.accessed(key)
+}
+
+// removeEntryLocked deletes key from the cache and its pool's accounting,
+// keeping it as a superseded version. Callers must hold cacheMutex.
+func removeEntryLocked(key string) {
+	c, ok := cache[key]
+	if !ok {
+		return
+	}
+	delete(cache, key)
+	variantRemovedLocked(key)
+	retireVersionLocked(key, c)
+	c.pool.bytes -= c.size()
+	c.pool.entries--
+	c.pool.policy.removed(key)
+	entryRecency.removed(key)
+	cacheBytes -= c.size()
+	if disk != nil {
+		disk.remove(key)
+	}
+}
+
+// evictEntryLocked removes key and its superseded versions to free space.
+// Callers must hold cacheMutex.
+func evictEntryLocked(key string) {
+	removeEntryLocked(key)
+	delete(entryVersions, key)
+}
+
+func (p *cachePool) enforceLocked() {
+	for p.maxBytes > 0 && p.bytes > p.maxBytes {
+		key, ok := p.policy.victim()
+		if !ok {
+			return
+		}
+		evictEntryLocked(key)
+		p.evictions++
+		log.Printf("[Pool] Evicted cacheKey '%s' from pool '%s' (%d/%d bytes used)", key, p.name, p.bytes, p.maxBytes)
+	}
+}
+
+func enforceCacheLimitsLocked() {
+	for {
+		var limit string
+		switch {
+		case maxEntries > 0 && len(cache) > maxEntries:
+			limit = fmt.Sprintf("limit %d entries", maxEntries)
+		case maxCacheBytes > 0 && cacheBytes > int64(maxCacheBytes):
+			limit = fmt.Sprintf("%d/%d bytes used", cacheBytes, maxCacheBytes)
+		default:
+			return
+		}
+		key, ok := entryRecency.victim()
+		if !ok {
+			return
+		}
+		evictEntryLocked(key)
+		entryEvictions++
+		log.Printf("[Cache] Evicted least recently used cacheKey '%s' (%s, %d evictions so far)", key, limit, entryEvictions)
+	}
+}
+
+// poolsHandler reports the usage of every cache pool.
+func poolsHandler(w http.ResponseWriter, r *http.Request) {
+	cacheMutex.Lock()
+	list := make([]map[string]any, 0, len(cachePools))
+	for _, p := range cachePools {
+		list = append(list, map[string]any{
+			"name": p.name, "max_bytes": p.maxBytes, "bytes": p.bytes, "entries": p.entries, "evictions": p.evictions,
+		})
+	}
+	cacheMutex.Unlock()
+	writeJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// rangePrefetchCount is how many following segments are fetched in the
+// background after a single-range request; 0 disables range prefetching.
+var rangePrefetchCount int
+
+// prefetchPreload enables warming the targets of Link: rel=preload headers.
+var prefetchPreload bool
+
+// prefetchInFlight deduplicates background fetches by cache key.
+var prefetchInFlight sync.Map
+
+// discardResponseWriter lets background fetches run through the proxy handler,
+// so they populate the cache exactly like client requests do.
+type discardResponseWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *discardResponseWriter) Header() http.Header         { return w.header }
+func (w *discardResponseWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *discardResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// isBackground reports whether w belongs to a fetch issued by the proxy
+// itself, looking through middleware that wraps the ResponseWriter.
+func isBackground(w http.ResponseWriter) bool {
+	for {
+		switch v := w.(type) {
+		case *discardResponseWriter:
+			return true
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = v.Unwrap()
+		default:
+			return false
+		}
+	}
+}
+
+// backgroundFetch sends req through the proxy handler, discarding the response
+// body. Only one fetch per cache key runs at a time; duplicates are dropped.
+func backgroundFetch(h http.Handler, req *http.Request) {
+	cacheKey := generateCacheKey(req)
+	if _, busy := prefetchInFlight.LoadOrStore(cacheKey, true); busy {
+		return
+	}
+	defer prefetchInFlight.Delete(cacheKey)
+
+	w := &discardResponseWriter{header: http.Header{}}
+	h.ServeHTTP(w, req)
+	log.Printf("[Prefetch] Fetched cacheKey: '%s' (Status: %d, X-Cache: %s)", cacheKey, w.status, w.header.Get("X-Cache"))
+}
+
+func isCached(req *http.Request) bool {
+	_, found := lookupEntry(variantKey(generateCacheKey(req), req))
+	return found
+}
+
+// newBackgroundRequest derives a request for url from a client request,
+// detached from the client's lifetime.
+func newBackgroundRequest(r *http.Request, target string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = r.Host
+	req.RemoteAddr = r.RemoteAddr
+	for _, h := range []string{"User-Agent", "Accept", "Accept-Encoding", "Accept-Language"} {
+		if v := r.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	return req, nil
+}
+
+// byteRange is a single closed "bytes=start-end" range.
+type byteRange struct {
+	start, end int64
+}
+
+func parseSingleByteRange(h string) (byteRange, bool) {
+	spec, ok := strings.CutPrefix(strings.TrimSpace(h), "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return byteRange{}, false
+	}
+	first, last, ok := strings.Cut(spec, "-")
+	if !ok {
+		return byteRange{}, false
+	}
+	start, err1 := strconv.ParseInt(strings.TrimSpace(first), 10, 64)
+	end, err2 := strconv.ParseInt(strings.TrimSpace(last), 10, 64)
+	if err1 != nil || err2 != nil || start < 0 || end < start {
+		return byteRange{}, false
+	}
+	return byteRange{start, end}, true
+}
+
+// contentRangeTotal returns the complete length from a "bytes a-b/total"
+// Content-Range header, or -1 when it is absent or unknown.
+func contentRangeTotal(h http.Header) int64 {
+	_, total, ok := strings.Cut(h.Get("Content-Range"), "/")
+	if !ok {
+		return -1
+	}
+	n, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// prefetchNextRanges warms the cache with the segments following the range a
+// client just read, assuming it keeps reading sequentially with the same
+// segment size (as video players do).
+func prefetchNextRanges(h http.Handler, r *http.Request, total int64) {
+	rng, ok := parseSingleByteRange(r.Header.Get("Range"))
+	if !ok {
+		return
+	}
+	size := rng.end - rng.start + 1
+	for i := int64(1); i <= int64(rangePrefetchCount); i++ {
+		next := byteRange{start: rng.start + i*size, end: rng.end + i*size}
+		if total >= 0 && next.start >= total {
+			return
+		}
+		req, err := newBackgroundRequest(r, r.URL.String())
+		if err != nil {
+			logf("warn", "[Prefetch] Failed to build range prefetch request for %s: %v", r.URL.String(), err)
+			return
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", next.start, next.end))
+
+		if !isCached(req) {
+			backgroundFetch(h, req)
+		}
+	}
+}
+
+// link is one entry of a Link header.
+type link struct {
+	target string
+	params map[string]string
+}
+
+// parseLinkHeaders parses RFC 8288 Link header values into their entries.
+func parseLinkHeaders(values []string) []link {
+	var links []link
+	for _, v := range values {
+		for v != "" {
+			start := strings.IndexByte(v, '<')
+			end := strings.IndexByte(v, '>')
+			if start < 0 || end < start {
+				break
+			}
+			l := link{target: v[start+1 : end], params: map[string]string{}}
+			rest := v[end+1:]
+			next := strings.IndexByte(rest, '<')
+			if next < 0 {
+				next = len(rest)
+			}
+			for _, param := range strings.Split(rest[:next], ";") {
+				name, value, _ := strings.Cut(strings.Trim(strings.TrimSpace(param), ","), "=")
+				if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+					l.params[name] = strings.Trim(strings.TrimSpace(value), `"`)
+				}
+			}
+			links = append(links, l)
+			v = rest[next:]
+		}
+	}
+	return links
+}
+
+// hasRel reports whether the link's rel parameter contains relType.
+func (l link) hasRel(relType string) bool {
+	for _, rel := range strings.Fields(strings.ToLower(l.params["rel"])) {
+		if rel == relType {
+			return true
+		}
+	}
+	return false
+}
+
+// prefetchPreloadLinks fetches the same-origin rel=preload targets of an origin
+// response into the cache, so the client's follow-up requests hit warm entries.
+func prefetchPreloadLinks(h http.Handler, r *http.Request, header http.Header) {
+	for _, l := range parseLinkHeaders(header.Values("Link")) {
+		if !l.hasRel("preload") {
+			continue
+		}
+		target, err := r.URL.Parse(l.target)
+		if err != nil || (target.Host != "" && target.Host != r.URL.Host) {
+			continue
+		}
+		req, err := newBackgroundRequest(r, target.RequestURI())
+		if err != nil {
+			continue
+		}
+		if !isCached(req) {
+			backgroundFetch(h, req)
+		}
+	}
+}
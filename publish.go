@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// publishConcurrency bounds the origin re-fetches issued by a single publish
+// notification.
+const publishConcurrency = 8
+
+// publishRequest is the body a CMS POSTs to /__admin/publish.
+type publishRequest struct {
+	URLs []string `json:"urls"`
+	// Soft keeps serving the current copy until the re-fetch replaces it,
+	// instead of deleting it up front.
+	Soft bool `json:"soft"`
+}
+
+type publishResult struct {
+	URL    string `json:"url"`
+	Key    string `json:"key,omitempty"`
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// publishHandler purges the published URLs and immediately re-fetches them
+// through the proxy, so changes appear at once while the cache stays warm.
+func publishHandler(proxyHandler http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req publishRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		results := make([]publishResult, len(req.URLs))
+		sem := make(chan struct{}, publishConcurrency)
+		var wg sync.WaitGroup
+		for i, raw := range req.URLs {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func() {
+				defer func() { <-sem; wg.Done() }()
+				results[i] = republish(proxyHandler, r, raw, req.Soft)
+			}()
+		}
+		wg.Wait()
+
+		log.Printf("[Admin] Published %d URLs (soft: %t)", len(req.URLs), req.Soft)
+		writeJSON(w, http.StatusOK, map[string]any{"results": results})
+	}
+}
+
+func republish(proxyHandler http.Handler, r *http.Request, raw string, soft bool) publishResult {
+	result := publishResult{URL: raw}
+	u, err := url.Parse(raw)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	req, err := newBackgroundRequest(r, u.RequestURI())
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	// An absolute URL names the host to cache and route it under.
+	if u.Host != "" {
+		req.Host = canonicalHost(u.Host, u.Scheme == "https")
+	}
+	result.Key = generateCacheKey(req)
+
+	if !soft {
+		base, _, _ := strings.Cut(result.Key, "#")
+		entryStore.Purge(purgeMatcher{variants: base})
+	}
+
+	w := &discardResponseWriter{header: http.Header{}}
+	proxyHandler.ServeHTTP(w, withForceRefresh(req))
+	result.Status = w.status
+	return result
+}
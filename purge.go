@@ -0,0 +1,304 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// keyIncludeHost adds the request Host to cache keys.
+var keyIncludeHost bool
+
+// cacheKeyPath extracts the URL path from a cache key of the form
+// METHOD:[//HOST]PATH?QUERY[#...].
+func cacheKeyPath(key string) string {
+	path, _, _ := strings.Cut(cacheKeyRequestURI(key), "?")
+	return path
+}
+
+// cacheKeyHost extracts the host from a cache key that includes it, or
+// returns "".
+func cacheKeyHost(key string) string {
+	_, rest, _ := strings.Cut(key, ":")
+	hostAndPath, ok := strings.CutPrefix(rest, "//")
+	if !ok {
+		return ""
+	}
+	host, _, _ := strings.Cut(hostAndPath, "/")
+	host, _, _ = strings.Cut(host, "?")
+	host, _, _ = strings.Cut(host, "#")
+	return host
+}
+
+// cacheKeyRequestURI extracts PATH?QUERY from a cache key, without the "?"
+// when the query is empty.
+func cacheKeyRequestURI(key string) string {
+	_, rest, _ := strings.Cut(key, ":")
+	if hostAndPath, ok := strings.CutPrefix(rest, "//"); ok {
+		rest = "/"
+		if i := strings.IndexByte(hostAndPath, '/'); i >= 0 {
+			rest = hostAndPath[i:]
+		}
+	}
+	rest, _, _ = strings.Cut(rest, "#")
+	return strings.TrimSuffix(rest, "?")
+}
+
+// purgeMatcher selects the entries of a pattern purge: either a route
+// pattern matched against the path, a regular expression matched against
+// the path and query, or a cache key with all of its variants.
+type purgeMatcher struct {
+	pattern  pathPattern
+	regex    *regexp.Regexp
+	variants string
+}
+
+const (
+	regexPurgePrefix    = "regex:"
+	variantsPurgePrefix = "variants:"
+)
+
+// parsePurgeMatcher parses a route pattern, a regular expression prefixed
+// with "regex:", or a key prefixed with "variants:", the forms String
+// produces.
+func parsePurgeMatcher(spec string) (purgeMatcher, error) {
+	if key, ok := strings.CutPrefix(spec, variantsPurgePrefix); ok {
+		return purgeMatcher{variants: key}, nil
+	}
+	if expr, ok := strings.CutPrefix(spec, regexPurgePrefix); ok {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return purgeMatcher{}, err
+		}
+		return purgeMatcher{regex: re}, nil
+	}
+	pattern, err := parsePathPattern(spec)
+	return purgeMatcher{pattern: pattern}, err
+}
+
+func (m purgeMatcher) match(key string) bool {
+	if m.variants != "" {
+		return key == m.variants || strings.HasPrefix(key, m.variants+"#")
+	}
+	if m.regex != nil {
+		return m.regex.MatchString(cacheKeyRequestURI(key))
+	}
+	return m.pattern.match(cacheKeyPath(key))
+}
+
+func (m purgeMatcher) String() string {
+	if m.variants != "" {
+		return variantsPurgePrefix + m.variants
+	}
+	if m.regex != nil {
+		return regexPurgePrefix + m.regex.String()
+	}
+	return string(m.pattern)
+}
+
+// purgeMatching removes every entry whose path matches pattern and returns the
+// number of entries removed from the memory cache.
+func purgeMatching(pattern pathPattern) int {
+	return entryStore.Purge(purgeMatcher{pattern: pattern})
+}
+
+// purgeRequest is the body of POST /__admin/purge; any list may be empty.
+type purgeRequest struct {
+	Keys        []string           `json:"keys"`
+	Patterns    []string           `json:"patterns"`
+	Regexes     []string           `json:"regexes"`
+	Conditional []conditionalPurge `json:"conditional"`
+	// Soft marks the entries stale and re-fetches them over Window (a
+	// duration such as "5m") instead of removing them at once.
+	Soft   bool   `json:"soft"`
+	Window string `json:"window"`
+}
+
+// conditionalPurge is a key purged only while its cached copy is still the
+// one the caller knows about, so an entry stored after a content update is
+// not purged by a notification about the update.
+type conditionalPurge struct {
+	Key string `json:"key"`
+	// IfUnmodifiedSince (RFC 3339 or Unix seconds) purges the entry only if
+	// it was stored no later; IfMatch only if its ETag weakly matches one of
+	// the listed tags. Set both to require both.
+	IfUnmodifiedSince string `json:"if_unmodified_since"`
+	IfMatch           string `json:"if_match"`
+}
+
+// check reports why c may not be purged, or "" if it may. status is 400 for
+// an invalid condition and 412 for one c fails.
+func (p conditionalPurge) check(c *CachedResponse) (status int, reason string) {
+	if p.IfUnmodifiedSince != "" {
+		t, err := parseAsOf(p.IfUnmodifiedSince)
+		if err != nil {
+			return http.StatusBadRequest, fmt.Sprintf("invalid if_unmodified_since %q (want RFC 3339 or Unix seconds)", p.IfUnmodifiedSince)
+		}
+		if c.Timestamp.Truncate(time.Second).After(t) {
+			return http.StatusPreconditionFailed, "cached copy was stored at " + c.Timestamp.UTC().Format(time.RFC3339)
+		}
+	}
+	if p.IfMatch != "" {
+		etag := c.Headers.Get("Etag")
+		if etag == "" {
+			return http.StatusPreconditionFailed, "cached copy has no ETag"
+		}
+		if !etagListMatches(p.IfMatch, etag) {
+			return http.StatusPreconditionFailed, "cached copy has ETag " + etag
+		}
+	}
+	return 0, ""
+}
+
+// batchResult reports the outcome of one item of a batch admin request.
+type batchResult struct {
+	Key     string     `json:"key,omitempty"`
+	Pattern string     `json:"pattern,omitempty"`
+	Regex   string     `json:"regex,omitempty"`
+	Status  int        `json:"status"`
+	Purged  int        `json:"purged,omitempty"`
+	Entry   *entryInfo `json:"entry,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+// purgeHandler purges a batch of keys, route patterns and regular expressions
+// in one request, reporting a status per item. A soft purge reports 202 for
+// the items whose entries it marked.
+func purgeHandler(proxyHandler http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req purgeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		window := defaultSoftPurgeWindow
+		if req.Window != "" {
+			d, err := time.ParseDuration(req.Window)
+			if err != nil || d <= 0 {
+				http.Error(w, "invalid window: must be a positive duration such as 5m", http.StatusBadRequest)
+				return
+			}
+			window = d
+		}
+		purge := func(m purgeMatcher) (int, int) {
+			if req.Soft {
+				return softPurge(proxyHandler, r, m.match, window), http.StatusAccepted
+			}
+			return entryStore.Purge(m), http.StatusOK
+		}
+
+		results := make([]batchResult, 0, len(req.Keys)+len(req.Conditional)+len(req.Patterns)+len(req.Regexes))
+		for _, key := range req.Keys {
+			res := batchResult{Key: key, Status: http.StatusNotFound}
+			if req.Soft {
+				if n := softPurge(proxyHandler, r, func(k string) bool { return k == key }, window); n > 0 {
+					res.Status, res.Purged = http.StatusAccepted, n
+				}
+			} else if entryStore.Delete(key) {
+				res.Status, res.Purged = http.StatusOK, 1
+			}
+			results = append(results, res)
+		}
+		for _, item := range req.Conditional {
+			res := batchResult{Key: item.Key, Status: http.StatusNotFound}
+			if c, found := lookupEntry(item.Key); found {
+				if status, reason := item.check(c); status != 0 {
+					res.Status, res.Error = status, reason
+				} else if req.Soft {
+					res.Purged = softPurge(proxyHandler, r, func(k string) bool { return k == item.Key }, window)
+					res.Status = http.StatusAccepted
+				} else if entryStore.Delete(item.Key) {
+					res.Status, res.Purged = http.StatusOK, 1
+				}
+			}
+			results = append(results, res)
+		}
+		for _, raw := range req.Patterns {
+			res := batchResult{Pattern: raw}
+			if pattern, err := parsePathPattern(raw); err != nil {
+				res.Status, res.Error = http.StatusBadRequest, err.Error()
+			} else {
+				res.Purged, res.Status = purge(purgeMatcher{pattern: pattern})
+			}
+			results = append(results, res)
+		}
+		for _, expr := range req.Regexes {
+			res := batchResult{Regex: expr}
+			if m, err := parsePurgeMatcher(regexPurgePrefix + expr); err != nil {
+				res.Status, res.Error = http.StatusBadRequest, err.Error()
+			} else {
+				res.Purged, res.Status = purge(m)
+			}
+			results = append(results, res)
+		}
+		if req.Soft {
+			log.Printf("[Admin] Soft-purged %d keys, %d patterns and %d regexes over %s", len(req.Keys)+len(req.Conditional), len(req.Patterns), len(req.Regexes), window)
+		} else {
+			log.Printf("[Admin] Purged %d keys, %d patterns and %d regexes", len(req.Keys)+len(req.Conditional), len(req.Patterns), len(req.Regexes))
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"results": results})
+	}
+}
+
+// purgeAllow and purgeToken gate the PURGE method on the proxy port: a
+// request is honored from an allowed client address or with the token in
+// X-Purge-Token.
+var (
+	purgeAllow []netip.Prefix
+	purgeToken string
+)
+
+func purgeMethodEnabled() bool { return len(purgeAllow) > 0 || purgeToken != "" }
+
+func purgeAuthorized(r *http.Request) bool {
+	if purgeToken != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Purge-Token")), []byte(purgeToken)) == 1 {
+		return true
+	}
+	addr, err := netip.ParseAddr(clientIP(r))
+	if err != nil {
+		return false
+	}
+	for _, p := range purgeAllow {
+		if p.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// withPurgeMethod answers "PURGE /path", Varnish-style, by removing every
+// cached variant of the URL: its GET and HEAD entries with any range, body,
+// salt, Accept or Vary suffix.
+func withPurgeMethod(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PURGE" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !purgeAuthorized(r) {
+			logf("warn", "[Purge] Rejected PURGE %s from %s", r.URL.String(), clientIP(r))
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if err := normalizeRequest(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		n := 0
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			req := r.Clone(r.Context())
+			req.Method = method
+			req.Header = http.Header{}
+			base, _, _ := strings.Cut(generateCacheKey(req), "#")
+			n += entryStore.Purge(purgeMatcher{variants: base})
+		}
+		log.Printf("[Purge] PURGE %s from %s removed %d entries", r.URL.String(), clientIP(r), n)
+		writeJSON(w, http.StatusOK, map[string]any{"purged": n})
+	})
+}
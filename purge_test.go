@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCacheKeyPath(t *testing.T) {
+	tests := []struct {
+		key, path, requestURI string
+	}{
+		{"GET:/a?", "/a", "/a"},
+		{"GET:/?", "/", "/"},
+		{"GET:/a?x=1&y=2", "/a", "/a?x=1&y=2"},
+		{"HEAD:/a/b?", "/a/b", "/a/b"},
+		{"GET://example.com/a?x=1", "/a", "/a?x=1"},
+		{"GET://example.com:8080/?", "/", "/"},
+		{"GET://example.com", "/", "/"},
+		{"GET:/a?#bytes=0-99", "/a", "/a"},
+		{"GET:/a?x=1#vary=accept-language:de", "/a", "/a?x=1"},
+		{"QUERY:/search?#body=abc", "/search", "/search"},
+		{"GET:/a%2Fb?", "/a%2Fb", "/a%2Fb"},
+	}
+	for _, tt := range tests {
+		if got := cacheKeyPath(tt.key); got != tt.path {
+			t.Errorf("cacheKeyPath(%q) = %q, want %q", tt.key, got, tt.path)
+		}
+		if got := cacheKeyRequestURI(tt.key); got != tt.requestURI {
+			t.Errorf("cacheKeyRequestURI(%q) = %q, want %q", tt.key, got, tt.requestURI)
+		}
+	}
+}
+
+func TestPurgeMatcher(t *testing.T) {
+	tests := []struct {
+		spec string
+		key  string
+		want bool
+	}{
+		{"/news/*", "GET:/news/1?", true},
+		{"/news/*", "GET:/news/1?page=2", true},
+		{"/news/*", "GET://example.com/news/1?", true},
+		{"/news/*", "GET:/sport/1?", false},
+		{"regex:^/a\\?x=1$", "GET:/a?x=1", true},
+		{"regex:^/a\\?x=1$", "GET:/a?x=2", false},
+		{"regex:^/a$", "GET:/a?", true},
+		{"variants:GET:/a?", "GET:/a?", true},
+		{"variants:GET:/a?", "GET:/a?#vary=0123456789abcdef", true},
+		{"variants:GET:/a?", "GET:/a?#accept=webp", true},
+		{"variants:GET:/a?", "GET:/a?x=1", false},
+		{"variants:GET:/a?", "GET:/ab?", false},
+	}
+	for _, tt := range tests {
+		m, err := parsePurgeMatcher(tt.spec)
+		if err != nil {
+			t.Fatalf("parsePurgeMatcher(%q): %v", tt.spec, err)
+		}
+		if got := m.match(tt.key); got != tt.want {
+			t.Errorf("%q matching %q = %v, want %v", tt.spec, tt.key, got, tt.want)
+		}
+		if m.String() != tt.spec {
+			t.Errorf("String() = %q, want %q", m.String(), tt.spec)
+		}
+	}
+}
+
+func TestConditionalPurgeCheck(t *testing.T) {
+	stored := time.Date(2026, 3, 1, 12, 0, 0, 500_000_000, time.UTC)
+	entry := &CachedResponse{Timestamp: stored, Headers: http.Header{"Etag": {`W/"v1"`}}}
+	tests := []struct {
+		name string
+		cond conditionalPurge
+		want int
+	}{
+		{"unconditional", conditionalPurge{}, 0},
+		{"stored before", conditionalPurge{IfUnmodifiedSince: "2026-03-01T12:00:01Z"}, 0},
+		{"stored in the same second", conditionalPurge{IfUnmodifiedSince: "2026-03-01T12:00:00Z"}, 0},
+		{"stored after", conditionalPurge{IfUnmodifiedSince: "2026-03-01T11:59:59Z"}, http.StatusPreconditionFailed},
+		{"Unix seconds", conditionalPurge{IfUnmodifiedSince: "1772366401"}, 0},
+		{"invalid time", conditionalPurge{IfUnmodifiedSince: "yesterday"}, http.StatusBadRequest},
+		{"ETag matches weakly", conditionalPurge{IfMatch: `"v1"`}, 0},
+		{"ETag in a list", conditionalPurge{IfMatch: `"v0", W/"v1"`}, 0},
+		{"any ETag", conditionalPurge{IfMatch: "*"}, 0},
+		{"other ETag", conditionalPurge{IfMatch: `"v2"`}, http.StatusPreconditionFailed},
+		{"both must hold", conditionalPurge{IfUnmodifiedSince: "2026-03-01T11:00:00Z", IfMatch: `"v1"`}, http.StatusPreconditionFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, reason := tt.cond.check(entry)
+			if status != tt.want {
+				t.Errorf("check = %d (%q), want %d", status, reason, tt.want)
+			}
+			if status != 0 && reason == "" {
+				t.Error("refusal without a reason")
+			}
+		})
+	}
+	if status, _ := (conditionalPurge{IfMatch: "*"}).check(&CachedResponse{Headers: http.Header{}}); status != http.StatusPreconditionFailed {
+		t.Errorf("If-Match * on an entry without ETag = %d, want 412", status)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/gob"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// readOnly makes the proxy a replica that only serves what a writer instance
+// cached: misses are answered with 504 instead of going to the origin, and
+// nothing is written to the shared store or --cache-dir.
+var readOnly bool
+
+// writeReadOnlyMiss answers a request a read-only replica cannot serve from
+// its store, the way RFC 9111 answers only-if-cached misses.
+func writeReadOnlyMiss(w http.ResponseWriter, r *http.Request) {
+	routineLog.printf("[ReadOnly] Not forwarding %s %s to the origin", r.Method, r.URL.String())
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Cache", "MISS")
+	http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
+}
+
+// readOnlyStore reads through a shared store and drops every write, so a
+// read-only replica never changes what the writer stored. Invalidations the
+// writer announces still reach the replica's memory cache.
+type readOnlyStore struct {
+	Store
+}
+
+func (readOnlyStore) Set(key string, c *CachedResponse) {}
+func (readOnlyStore) Delete(key string) bool            { return false }
+func (readOnlyStore) Purge(m purgeMatcher) int          { return 0 }
+
+// diskReplicaStore serves a read-only replica from the --cache-dir a writer
+// instance maintains, typically on a shared volume. Every lookup reads the
+// entry's file, so the writer's updates and deletions show at once; the OS
+// page cache keeps popular files in memory. The generations in state.json are
+// re-read when the file changes.
+type diskReplicaStore struct {
+	dir                  *diskCache // for its layout; never written
+	stateModified        atomic.Int64
+	hits, misses, errors atomic.Int64
+}
+
+func openDiskReplica(dir string) (*diskReplicaStore, error) {
+	s := &diskReplicaStore{dir: &diskCache{dir: dir}}
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	s.reloadState()
+	go func() {
+		for range time.Tick(time.Second) {
+			s.reloadState()
+		}
+	}()
+	return s, nil
+}
+
+func (s *diskReplicaStore) reloadState() {
+	info, err := os.Stat(s.dir.statePath())
+	if err != nil || info.ModTime().UnixNano() == s.stateModified.Load() {
+		return
+	}
+	if err := s.dir.loadState(); err != nil {
+		logf("error", "[ReadOnly] Failed to read the cache state: %v", err)
+		return
+	}
+	s.stateModified.Store(info.ModTime().UnixNano())
+}
+
+func (s *diskReplicaStore) Get(key string) (*CachedResponse, bool) {
+	f, err := os.Open(s.dir.path(key))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.errors.Add(1)
+			logf("error", "[ReadOnly] Failed to read cacheKey '%s': %v", key, err)
+		}
+		s.misses.Add(1)
+		return nil, false
+	}
+	var e diskEntry
+	err = gob.NewDecoder(f).Decode(&e)
+	f.Close()
+	if err != nil {
+		// Most likely replaced while being read; the next lookup sees the
+		// new file.
+		s.errors.Add(1)
+		s.misses.Add(1)
+		return nil, false
+	}
+	if e.Key != key || e.Entry == nil || !e.Entry.live() || e.Entry.expired() {
+		s.misses.Add(1)
+		return nil, false
+	}
+	s.hits.Add(1)
+	return e.Entry, true
+}
+
+func (s *diskReplicaStore) Set(key string, c *CachedResponse) {}
+func (s *diskReplicaStore) Delete(key string) bool            { return false }
+func (s *diskReplicaStore) Purge(m purgeMatcher) int          { return 0 }
+func (s *diskReplicaStore) Len() int                          { return -1 }
+
+func (s *diskReplicaStore) Stats() StoreStats {
+	return StoreStats{Backend: "disk", Entries: -1, Hits: s.hits.Load(), Misses: s.misses.Load(), Errors: s.errors.Load()}
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// redisClient speaks just enough RESP for the shared store: commands are
+// sent as arrays of bulk strings over a small pool of connections.
+type redisClient struct {
+	addr     string
+	password string
+	db       int
+	idle     chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// redisError is an error reply from the server. The connection stays usable.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+const redisTimeout = 5 * time.Second
+
+func newRedisClient(addr, password string, db int) *redisClient {
+	return &redisClient{addr: addr, password: password, db: db, idle: make(chan *redisConn, 8)}
+}
+
+func (c *redisClient) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", c.addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{Conn: conn, r: bufio.NewReader(conn)}
+	rc.SetDeadline(time.Now().Add(redisTimeout))
+	if c.password != "" {
+		if _, err := rc.do("AUTH", c.password); err != nil {
+			rc.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := rc.do("SELECT", strconv.Itoa(c.db)); err != nil {
+			rc.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// do runs one command on a pooled connection.
+func (c *redisClient) do(args ...string) (any, error) {
+	rc, err := c.conn()
+	if err != nil {
+		return nil, err
+	}
+	v, err := rc.do(args...)
+	c.release(rc, err)
+	return v, err
+}
+
+// pipeline sends cmds in one write and then reads all their replies, so a
+// batch costs a single round trip. Error replies are returned in place of
+// their command's reply.
+func (c *redisClient) pipeline(cmds [][]string) ([]any, error) {
+	rc, err := c.conn()
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	for _, args := range cmds {
+		writeRedisCommand(&b, args)
+	}
+	replies := make([]any, len(cmds))
+	_, err = rc.Write(b.Bytes())
+	for i := 0; err == nil && i < len(cmds); i++ {
+		replies[i], err = rc.read()
+		var replyErr redisError
+		if errors.As(err, &replyErr) {
+			replies[i], err = replyErr, nil
+		}
+	}
+	c.release(rc, err)
+	return replies, err
+}
+
+func (c *redisClient) conn() (*redisConn, error) {
+	var rc *redisConn
+	select {
+	case rc = <-c.idle:
+	default:
+		var err error
+		if rc, err = c.dial(); err != nil {
+			return nil, err
+		}
+	}
+	rc.SetDeadline(time.Now().Add(redisTimeout))
+	return rc, nil
+}
+
+// release returns rc to the pool after a command. Connections that failed at
+// the network level are discarded instead.
+func (c *redisClient) release(rc *redisConn, err error) {
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		rc.Close()
+		return
+	}
+	select {
+	case c.idle <- rc:
+	default:
+		rc.Close()
+	}
+}
+
+func (rc *redisConn) do(args ...string) (any, error) {
+	var b bytes.Buffer
+	writeRedisCommand(&b, args)
+	if _, err := rc.Write(b.Bytes()); err != nil {
+		return nil, err
+	}
+	return rc.read()
+}
+
+func writeRedisCommand(b *bytes.Buffer, args []string) {
+	fmt.Fprintf(b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(b, "$%d\r\n%s\r\n", len(a), a)
+	}
+}
+
+// read parses one reply: simple strings as string, integers as int64, bulk
+// strings as []byte, arrays as []any and nil replies as nil.
+func (rc *redisConn) read() (any, error) {
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		out := make([]any, n)
+		for i := range out {
+			if out[i], err = rc.read(); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// redisStore shares entries between proxy replicas through Redis. Each
+// replica keeps serving from its memory cache; a local miss is looked up in
+// Redis before going to the origin, and stores are written through. Purges
+// and generation bumps are applied in Redis and announced over pub/sub, so
+// every replica drops its local copies as well. Writes and invalidations
+// are queued behind, off the request path, and pipelined in batches.
+type redisStore struct {
+	client   *redisClient
+	prefix   string
+	instance string // tags our own announcements so they can be ignored
+	writes   *writeQueue[redisWrite]
+
+	hits, misses, errors atomic.Int64
+}
+
+// redisConfig holds the --redis-* flags.
+type redisConfig struct {
+	addr     string
+	password string
+	db       int
+	prefix   string
+}
+
+var redisSettings redisConfig
+
+// redisWrite builds the commands of a queued write when its batch is sent.
+type redisWrite func() [][]string
+
+func openRedisStore(cfg redisConfig) (*redisStore, error) {
+	id := make([]byte, 8)
+	rand.Read(id)
+	s := &redisStore{
+		client:   newRedisClient(cfg.addr, cfg.password, cfg.db),
+		prefix:   cfg.prefix,
+		instance: hex.EncodeToString(id),
+	}
+	if _, err := s.client.do("PING"); err != nil {
+		return nil, err
+	}
+	s.writes = newWriteQueue(storeQueueSize, s.write)
+	s.syncGenerations()
+	go s.subscribe()
+	log.Printf("[Redis] Sharing the cache through %s", cfg.addr)
+	return s, nil
+}
+
+// write sends a batch of queued writes in one pipeline.
+func (s *redisStore) write(batch []redisWrite) {
+	var cmds [][]string
+	for _, w := range batch {
+		cmds = append(cmds, w()...)
+	}
+	if len(cmds) == 0 {
+		return
+	}
+	replies, err := s.client.pipeline(cmds)
+	if err != nil {
+		s.errors.Add(1)
+		logf("error", "[Redis] Failed to write %d commands: %v", len(cmds), err)
+		return
+	}
+	for i, v := range replies {
+		if err, ok := v.(redisError); ok {
+			s.errors.Add(1)
+			logf("error", "[Redis] %s of '%s' failed: %v", cmds[i][0], strings.TrimPrefix(cmds[i][1], s.prefix), err)
+		}
+	}
+}
+
+func (s *redisStore) channel() string { return s.prefix + "__invalidations" }
+
+// Get fetches a shared entry on a local miss.
+func (s *redisStore) Get(key string) (*CachedResponse, bool) {
+	v, err := s.client.do("GET", s.prefix+key)
+	if err != nil {
+		s.errors.Add(1)
+		logf("error", "[Redis] Failed to get cacheKey '%s': %v", key, err)
+		return nil, false
+	}
+	data, ok := v.([]byte)
+	if !ok {
+		s.misses.Add(1)
+		return nil, false
+	}
+	var c CachedResponse
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&c); err != nil {
+		s.errors.Add(1)
+		logf("warn", "[Redis] Dropping undecodable cacheKey '%s': %v", key, err)
+		return nil, false
+	}
+	s.hits.Add(1)
+	return &c, true
+}
+
+// Set writes an entry behind, expiring it in Redis with its freshness
+// lifetime, and tells the other replicas to drop their older copy. The entry
+// is dropped when the write queue is full.
+func (s *redisStore) Set(key string, c *CachedResponse) {
+	s.writes.add(key, func() [][]string {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(c); err != nil {
+			logf("error", "[Redis] Failed to encode cacheKey '%s': %v", key, err)
+			return nil
+		}
+		args := []string{"SET", s.prefix + key, buf.String()}
+		if ttl := remainingLifetime(c); ttl > 0 {
+			args = append(args, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+		} else if ttl < 0 {
+			return nil
+		}
+		return [][]string{args, s.announcement("drop " + key)}
+	})
+}
+
+// announcement is the command telling the other replicas about msg.
+func (s *redisStore) announcement(msg string) []string {
+	return []string{"PUBLISH", s.channel(), s.instance + " " + msg}
+}
+
+// Delete removes an entry everywhere.
+func (s *redisStore) Delete(key string) bool {
+	s.queue(key, func() [][]string {
+		return [][]string{{"DEL", s.prefix + key}, s.announcement("drop " + key)}
+	})
+	return false
+}
+
+// Purge deletes the shared entries m matches and has the other replicas
+// purge their memory caches too.
+func (s *redisStore) Purge(m purgeMatcher) int {
+	s.queue("\x00purge "+m.String(), func() [][]string {
+		var cmds [][]string
+		cursor, n := "0", 0
+		for {
+			v, err := s.client.do("SCAN", cursor, "MATCH", s.prefix+"*", "COUNT", "1000")
+			reply, ok := v.([]any)
+			if err != nil || !ok || len(reply) != 2 {
+				s.errors.Add(1)
+				logf("error", "[Redis] Purge of '%s' interrupted: %v", m, err)
+				break
+			}
+			keys, _ := reply[1].([]any)
+			del := []string{"DEL"}
+			for _, k := range keys {
+				b, _ := k.([]byte)
+				key := strings.TrimPrefix(string(b), s.prefix)
+				if !strings.HasPrefix(key, "__") && m.match(key) {
+					del = append(del, string(b))
+				}
+			}
+			if len(del) > 1 {
+				cmds = append(cmds, del)
+				n += len(del) - 1
+			}
+			next, _ := reply[0].([]byte)
+			if cursor = string(next); cursor == "0" || cursor == "" {
+				break
+			}
+		}
+		log.Printf("[Redis] Purging %d shared entries matching '%s'", n, m)
+		return append(cmds, s.announcement("purge "+m.String()))
+	})
+	return 0
+}
+
+// queue adds an invalidation to the write queue. Unlike a dropped entry, a
+// dropped invalidation leaves stale copies behind, so it is logged.
+func (s *redisStore) queue(key string, w redisWrite) {
+	if !s.writes.add(key, w) {
+		logf("warn", "[Redis] Write queue full, dropped the invalidation of '%s'", strings.TrimPrefix(key, "\x00"))
+	}
+}
+
+// Len is not tracked: counting would mean scanning every key.
+func (s *redisStore) Len() int { return -1 }
+
+func (s *redisStore) Stats() StoreStats {
+	return StoreStats{Backend: "redis", Entries: -1, Hits: s.hits.Load(), Misses: s.misses.Load(), Errors: s.errors.Load(),
+		QueueDepth: s.writes.depth(), DroppedWrites: s.writes.dropped.Load()}
+}
+
+// saveGenerations publishes the local generations after a bump. Shared
+// entries from older generations then count as purged on every replica.
+func (s *redisStore) saveGenerations() {
+	gen := cacheGeneration.Load()
+	nsGens := map[string]uint64{}
+	for _, ns := range namespaces {
+		nsGens[ns.name] = ns.generation.Load()
+	}
+	s.queue("\x00generations", func() [][]string {
+		cmds := [][]string{
+			{"SET", s.prefix + "__generation", strconv.FormatUint(gen, 10)},
+			s.announcement("gen " + strconv.FormatUint(gen, 10)),
+		}
+		for name, g := range nsGens {
+			cmds = append(cmds,
+				[]string{"SET", s.prefix + "__namespace:" + name, strconv.FormatUint(g, 10)},
+				s.announcement("ns "+name+" "+strconv.FormatUint(g, 10)))
+		}
+		return cmds
+	})
+}
+
+// syncGenerations adopts the shared generations when they are ahead of ours.
+func (s *redisStore) syncGenerations() {
+	if v, err := s.client.do("GET", s.prefix+"__generation"); err == nil {
+		if b, ok := v.([]byte); ok {
+			adoptGeneration("", string(b))
+		}
+	}
+	for _, ns := range namespaces {
+		if v, err := s.client.do("GET", s.prefix+"__namespace:"+ns.name); err == nil {
+			if b, ok := v.([]byte); ok {
+				adoptGeneration(ns.name, string(b))
+			}
+		}
+	}
+}
+
+// adoptGeneration moves the global ("" name) or a namespace generation
+// forward to value and reports whether it changed.
+func adoptGeneration(name, value string) bool {
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return false
+	}
+	gen := &cacheGeneration
+	if name != "" {
+		ns := namespaceByName(name)
+		if ns == nil {
+			return false
+		}
+		gen = &ns.generation
+	}
+	for {
+		cur := gen.Load()
+		if n <= cur {
+			return false
+		}
+		if gen.CompareAndSwap(cur, n) {
+			return true
+		}
+	}
+}
+
+// subscribe applies the other replicas' announcements to the memory cache,
+// reconnecting until the process exits.
+func (s *redisStore) subscribe() {
+	for {
+		err := s.listen()
+		logf("warn", "[Redis] Invalidation subscription lost, reconnecting: %v", err)
+		time.Sleep(time.Second)
+	}
+}
+
+func (s *redisStore) listen() error {
+	rc, err := s.client.dial()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	rc.SetDeadline(time.Now().Add(redisTimeout))
+	if _, err := rc.do("SUBSCRIBE", s.channel()); err != nil {
+		return err
+	}
+	rc.SetDeadline(time.Time{})
+	for {
+		v, err := rc.read()
+		if err != nil {
+			return err
+		}
+		msg, ok := v.([]any)
+		if !ok || len(msg) != 3 {
+			continue
+		}
+		payload, _ := msg[2].([]byte)
+		s.apply(string(payload))
+	}
+}
+
+func (s *redisStore) apply(payload string) {
+	from, msg, _ := strings.Cut(payload, " ")
+	if from == s.instance {
+		return
+	}
+	verb, arg, _ := strings.Cut(msg, " ")
+	switch verb {
+	case "drop", "purge":
+		applyInvalidation("Redis", verb, arg)
+	case "gen":
+		if adoptGeneration("", arg) {
+			go sweepStaleEntries()
+		}
+	case "ns":
+		name, gen, _ := strings.Cut(arg, " ")
+		if adoptGeneration(name, gen) {
+			go sweepStaleEntries()
+		}
+	}
+}
+
+// remainingLifetime is how much longer an entry stays fresh: 0 when it never
+// expires, negative once it has.
+func remainingLifetime(c *CachedResponse) time.Duration {
+	lifetime := c.Lifetime
+	if lifetime == 0 {
+		lifetime = defaultTTL()
+	}
+	if lifetime == 0 {
+		return 0
+	}
+	if left := lifetime - time.Since(c.Timestamp); left > 0 {
+		return left
+	}
+	return -1
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var errKeyNotRebuildable = errors.New("key depends on request headers and cannot be re-fetched on its own")
+
+// refreshKey re-fetches key from the origin through the proxy and replaces
+// the cached entry in place. Unlike purging and waiting for the next request,
+// the old copy keeps being served until the new one is stored, and a failed
+// fetch leaves it untouched.
+func refreshKey(proxyHandler http.Handler, r *http.Request, key string) (entryInfo, int, error) {
+	method, rest, _ := strings.Cut(key, ":")
+	if method != http.MethodGet {
+		return entryInfo{}, http.StatusBadRequest, fmt.Errorf("only GET keys can be refreshed, not %q", key)
+	}
+	host := r.Host
+	if hostAndPath, ok := strings.CutPrefix(rest, "//"); ok {
+		host, _, _ = strings.Cut(hostAndPath, "/")
+	}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, cacheKeyRequestURI(key), nil)
+	if err != nil {
+		return entryInfo{}, http.StatusBadRequest, err
+	}
+	req.Host = host
+	req.RemoteAddr = r.RemoteAddr
+	if rebuilt := variantKey(generateCacheKey(req), req); rebuilt != key {
+		return entryInfo{}, http.StatusUnprocessableEntity, errKeyNotRebuildable
+	}
+
+	old, _ := lookupEntry(key)
+	w := &discardResponseWriter{header: http.Header{}}
+	proxyHandler.ServeHTTP(w, withForceRefresh(req))
+	c, found := lookupEntry(key)
+	if !found || c == old {
+		return entryInfo{}, http.StatusBadGateway, fmt.Errorf("origin answered %d, entry not replaced", w.status)
+	}
+	info := newEntryInfo(key, c)
+	info.Headers = c.Headers
+	return info, http.StatusOK, nil
+}
+
+// refreshRequest is the body of a batch POST /__admin/refresh.
+type refreshRequest struct {
+	Keys []string `json:"keys"`
+}
+
+// refreshHandler refreshes the entry named by the key query parameter and
+// returns the new entry's metadata. Without the parameter it refreshes the
+// keys listed in the JSON body, reporting a result per key.
+func refreshHandler(proxyHandler http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if key := r.URL.Query().Get("key"); key != "" {
+			info, status, err := refreshKey(proxyHandler, r, key)
+			if err != nil {
+				logf("warn", "[Admin] Refresh of cacheKey '%s' failed: %v", key, err)
+				http.Error(w, err.Error(), status)
+				return
+			}
+			log.Printf("[Admin] Refreshed cacheKey '%s'", key)
+			writeJSON(w, status, info)
+			return
+		}
+
+		var req refreshRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		results := make([]batchResult, len(req.Keys))
+		sem := make(chan struct{}, publishConcurrency)
+		var wg sync.WaitGroup
+		for i, key := range req.Keys {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func() {
+				defer func() { <-sem; wg.Done() }()
+				results[i] = batchResult{Key: key}
+				info, status, err := refreshKey(proxyHandler, r, key)
+				results[i].Status = status
+				if err != nil {
+					results[i].Error = err.Error()
+				} else {
+					results[i].Entry = &info
+				}
+			}()
+		}
+		wg.Wait()
+
+		log.Printf("[Admin] Refreshed %d keys", len(req.Keys))
+		writeJSON(w, http.StatusOK, map[string]any{"results": results})
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// settingsMu guards the settings a configuration reload replaces while
+// requests read them.
+var settingsMu sync.RWMutex
+
+// reloadableOptions parse the new values of the options a reload applies and
+// return a function installing them, which is called with settingsMu held.
+// Options missing from the file go back to their defaults. All other options
+// only take effect at startup.
+var reloadableOptions = map[string]func(values []string) (func(), error){
+	"cache-ttl": func(values []string) (func(), error) {
+		var ttl time.Duration
+		if len(values) > 0 {
+			d, err := time.ParseDuration(values[len(values)-1])
+			if err != nil {
+				return nil, err
+			}
+			ttl = d
+		}
+		return func() { cacheTTL = ttl }, nil
+	},
+	"cache-rule": func(values []string) (func(), error) {
+		rules, err := parseEach(values, parseCacheRule)
+		return func() { cacheRules = rules }, err
+	},
+	"dedup-route": func(values []string) (func(), error) {
+		rules, err := parseEach(values, parseDedupRule)
+		return func() { dedupRules = rules }, err
+	},
+	"key-salt": func(values []string) (func(), error) {
+		salts, err := parseEach(values, parseKeySalt)
+		return func() { keySalts = salts }, err
+	},
+	"pool-route": func(values []string) (func(), error) {
+		routes, err := parseEach(values, parsePoolRoute)
+		return func() { poolRoutes = routes }, err
+	},
+	"route-methods": func(values []string) (func(), error) {
+		rules, err := parseEach(values, parseRouteMethods)
+		return func() { routeMethodRules = rules }, err
+	},
+	"size-stats-route": func(values []string) (func(), error) {
+		routes, err := parseEach(values, parsePathPattern)
+		return func() { sizeStatsRoutes = routes }, err
+	},
+	"origin-credentials": func(values []string) (func(), error) {
+		scratch := origins.scratch()
+		for _, spec := range values {
+			if err := scratch.setCredentialPolicy(spec); err != nil {
+				return nil, err
+			}
+		}
+		return func() {
+			for i, b := range origins.allBackends() {
+				b.stripCredentials = scratch.backends[i].stripCredentials
+			}
+		}, nil
+	},
+	"origin-header": func(values []string) (func(), error) {
+		scratch := origins.scratch()
+		for _, spec := range values {
+			if err := scratch.addDefaultHeader(spec); err != nil {
+				return nil, err
+			}
+		}
+		return func() {
+			for i, b := range origins.allBackends() {
+				b.headers = scratch.backends[i].headers
+			}
+		}, nil
+	},
+}
+
+func parseEach[T any](specs []string, parse func(string) (T, error)) ([]T, error) {
+	var out []T
+	for _, spec := range specs {
+		v, err := parse(spec)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+// configReloader re-reads --config on SIGHUP or POST /__admin/reload and
+// applies the reloadable options without restarting, so the cache is kept.
+type configReloader struct {
+	mu       sync.Mutex // serializes reloads
+	fs       *flag.FlagSet
+	path     string
+	explicit map[string]bool // flags given on the command line, which a reload leaves alone
+	// loaded holds the options in effect: reloadable ones as last applied,
+	// the others as read at startup.
+	loaded map[string][]string
+}
+
+// configReload is nil when the proxy was started without --config.
+var configReload *configReloader
+
+func newConfigReloader(fs *flag.FlagSet, path string) *configReloader {
+	return &configReloader{fs: fs, path: path, explicit: explicitFlags(fs)}
+}
+
+// load reads the file at startup.
+func (c *configReloader) load() error {
+	values, err := loadConfigFile(c.fs, c.path)
+	if err != nil {
+		return err
+	}
+	c.loaded = values
+	return nil
+}
+
+// reloadResult lists the options a reload changed.
+type reloadResult struct {
+	Applied []string `json:"applied"`
+	// RestartRequired are options that changed in the file but only take
+	// effect at startup.
+	RestartRequired []string `json:"restart_required"`
+}
+
+// reload applies the file's reloadable options. Nothing is changed when any
+// of them is invalid.
+func (c *configReloader) reload() (reloadResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	result := reloadResult{Applied: []string{}, RestartRequired: []string{}}
+	opts, err := readConfigFile(c.fs, c.path)
+	if err != nil {
+		return result, err
+	}
+	values := map[string][]string{}
+	for _, opt := range opts {
+		values[opt.name] = append(values[opt.name], opt.values...)
+	}
+
+	var commits []func()
+	for _, name := range sortedKeys(reloadableOptions) {
+		if c.explicit[name] {
+			continue
+		}
+		commit, err := reloadableOptions[name](values[name])
+		if err != nil {
+			return result, fmt.Errorf("%s: invalid %s: %v", c.path, name, err)
+		}
+		commits = append(commits, commit, func() { c.setFlag(name, values[name]) })
+		if !slices.Equal(values[name], c.loaded[name]) {
+			result.Applied = append(result.Applied, name)
+		}
+	}
+	seen := map[string]bool{}
+	for name := range values {
+		seen[name] = true
+	}
+	for name := range c.loaded {
+		seen[name] = true
+	}
+	for _, name := range sortedKeys(seen) {
+		if _, ok := reloadableOptions[name]; ok || c.explicit[name] || slices.Equal(values[name], c.loaded[name]) {
+			continue
+		}
+		result.RestartRequired = append(result.RestartRequired, name)
+	}
+
+	settingsMu.Lock()
+	for _, commit := range commits {
+		commit()
+	}
+	settingsMu.Unlock()
+	for name := range reloadableOptions {
+		if values[name] != nil {
+			c.loaded[name] = values[name]
+		} else {
+			delete(c.loaded, name)
+		}
+	}
+	return result, nil
+}
+
+// setFlag updates the flag behind a reloaded option so GET /__admin/config
+// reports it. Scalar values are already installed by the option's commit.
+func (c *configReloader) setFlag(name string, values []string) {
+	f := c.fs.Lookup(name)
+	if list, ok := f.Value.(*stringList); ok {
+		*list = slices.Clone(values)
+	}
+}
+
+func (c *configReloader) logReload(result reloadResult) {
+	applied := "nothing changed"
+	if len(result.Applied) > 0 {
+		applied = "applied " + strings.Join(result.Applied, ", ")
+	}
+	log.Printf("[Config] Reloaded %s: %s", c.path, applied)
+	if len(result.RestartRequired) > 0 {
+		logf("warn", "[Config] Changes to %s only take effect after a restart", strings.Join(result.RestartRequired, ", "))
+	}
+}
+
+// watchSignals reloads the file on every SIGHUP.
+func (c *configReloader) watchSignals() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		result, err := c.reload()
+		if err != nil {
+			logf("error", "[Config] Reload failed, keeping the current settings: %v", err)
+			continue
+		}
+		c.logReload(result)
+	}
+}
+
+// reloadHandler reloads the configuration file and reports what changed.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if configReload == nil {
+		http.Error(w, "The proxy was started without --config", http.StatusConflict)
+		return
+	}
+	result, err := configReload.reload()
+	if err != nil {
+		logf("error", "[Config] Reload failed, keeping the current settings: %v", err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	configReload.logReload(result)
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// retryBudgetBuckets is the number of slots the budget window is divided into.
+const retryBudgetBuckets = 10
+
+// retryBudget caps retries to a fraction of the requests seen over a sliding
+// window, so retries cannot amplify an origin outage into a retry storm.
+type retryBudget struct {
+	mu         sync.Mutex
+	ratio      float64
+	minRetries int
+	bucketSize time.Duration
+	buckets    [retryBudgetBuckets]retryBucket
+}
+
+type retryBucket struct {
+	start    time.Time
+	requests int
+	retries  int
+}
+
+func newRetryBudget(ratio float64, window time.Duration, minRetries int) *retryBudget {
+	return &retryBudget{
+		ratio:      ratio,
+		minRetries: minRetries,
+		bucketSize: window / retryBudgetBuckets,
+	}
+}
+
+// bucket returns the slot for now, resetting it if it belongs to an older
+// window. Callers must hold b.mu.
+func (b *retryBudget) bucket(now time.Time) *retryBucket {
+	start := now.Truncate(b.bucketSize)
+	slot := &b.buckets[(start.UnixNano()/int64(b.bucketSize))%retryBudgetBuckets]
+	if !slot.start.Equal(start) {
+		*slot = retryBucket{start: start}
+	}
+	return slot
+}
+
+// totals sums requests and retries over the buckets still inside the window.
+// Callers must hold b.mu.
+func (b *retryBudget) totals(now time.Time) (requests, retries int) {
+	oldest := now.Add(-b.bucketSize * retryBudgetBuckets)
+	for _, slot := range b.buckets {
+		if slot.start.After(oldest) {
+			requests += slot.requests
+			retries += slot.retries
+		}
+	}
+	return requests, retries
+}
+
+func (b *retryBudget) recordRequest() {
+	b.mu.Lock()
+	b.bucket(time.Now()).requests++
+	b.mu.Unlock()
+}
+
+// tryRetry reports whether a retry (or any other extra origin request, such as
+// a hedge) fits in the budget, and accounts for it if so.
+func (b *retryBudget) tryRetry() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	requests, retries := b.totals(now)
+	allowed := int(float64(requests) * b.ratio)
+	if allowed < b.minRetries {
+		allowed = b.minRetries
+	}
+	if retries >= allowed {
+		return false
+	}
+	b.bucket(now).retries++
+	return true
+}
+
+// retryTransport retries idempotent, bodiless origin requests that failed at
+// the transport level, as long as the retry budget allows it.
+type retryTransport struct {
+	base    http.RoundTripper
+	retries int
+	backoff time.Duration
+	budget  *retryBudget
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.budget.recordRequest()
+
+	resp, err := t.base.RoundTrip(req)
+	for attempt := 1; err != nil && attempt <= t.retries && isRetryable(req); attempt++ {
+		if !t.budget.tryRetry() {
+			logf("warn", "[Retry] Retry budget exhausted, not retrying %s %s: %v", req.Method, req.URL.String(), err)
+			break
+		}
+		logf("warn", "[Retry] Attempt %d/%d for %s %s after error: %v", attempt, t.retries, req.Method, req.URL.String(), err)
+
+		select {
+		case <-time.After(t.backoff * time.Duration(attempt)):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		resp, err = t.base.RoundTrip(req)
+	}
+	return resp, err
+}
+
+func isRetryable(req *http.Request) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// How requests carrying Cache-Control: no-cache or max-age=0 are handled.
+const (
+	noCacheRevalidate = "revalidate" // ask the origin conditionally
+	noCacheRefresh    = "refresh"    // fetch the full response again
+	noCacheIgnore     = "ignore"     // serve the stored copy anyway
+)
+
+var clientNoCache = noCacheRevalidate
+
+// wantsRevalidation reports whether the client asked not to be served a stored
+// response without checking with the origin first (RFC 9111 §5.2.1).
+func wantsRevalidation(r *http.Request) bool {
+	if clientNoCache == noCacheIgnore {
+		return false
+	}
+	if r.Header.Get("Cache-Control") == "" {
+		return r.Header.Get("Pragma") == "no-cache"
+	}
+	cc := parseCacheControl(r.Header)
+	maxAge, ok := cc.seconds("max-age")
+	return cc.has("no-cache") || (ok && maxAge == 0)
+}
+
+// revalidateOnReuse reports whether a stored response was sent with
+// Cache-Control: no-cache, which makes it stale from the start: it may only be
+// reused once the origin has confirmed it (RFC 9111 §5.2.2.4).
+func revalidateOnReuse(c *CachedResponse) bool {
+	return parseCacheControl(c.Headers).has("no-cache")
+}
+
+// addValidators makes an origin request conditional on the stored entry. The
+// client's own validators take precedence: the origin's answer to those has
+// to reach the client unchanged.
+func addValidators(r *http.Request, c *CachedResponse) bool {
+	if r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+		return false
+	}
+	etag, lastModified := c.Headers.Get("ETag"), c.Headers.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		return false
+	}
+	if etag != "" {
+		r.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		r.Header.Set("If-Modified-Since", lastModified)
+	}
+	return true
+}
+
+// refreshNotModified handles the origin confirming a stored entry with 304: the
+// entry is stored again with the updated headers (RFC 9111 §4.3.4) and the
+// response is rewritten into the full stored one for the client.
+func refreshNotModified(key string, stored *CachedResponse, resp *http.Response) {
+	headers := stored.Headers.Clone()
+	for k, vv := range resp.Header {
+		switch k {
+		case "Content-Length", "Transfer-Encoding", "Connection", "X-Cache":
+			continue
+		}
+		headers[k] = append([]string(nil), vv...)
+	}
+	refreshed := *stored
+	refreshed.Headers, refreshed.Timestamp, refreshed.Lifetime = headers, time.Now(), storedLifetime(key, headers)
+	storeEntry(key, &refreshed)
+	log.Printf("[Revalidate] Origin confirmed cacheKey '%s', entry refreshed", key)
+
+	resp.Body.Close()
+	resp.StatusCode = stored.StatusCode
+	resp.Status = fmt.Sprintf("%d %s", stored.StatusCode, http.StatusText(stored.StatusCode))
+	resp.Header = headers.Clone()
+	resp.Header.Set("Content-Length", strconv.Itoa(len(stored.Response)))
+	resp.ContentLength = int64(len(stored.Response))
+	resp.Body = io.NopCloser(bytes.NewReader(stored.Response))
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// pathPattern matches request paths against a configured route pattern. A
+// trailing "/*" matches the whole subtree below the prefix; any other pattern
+// is matched with path.Match semantics.
+type pathPattern string
+
+func parsePathPattern(s string) (pathPattern, error) {
+	if !strings.HasPrefix(s, "/") {
+		return "", fmt.Errorf("route pattern %q must start with /", s)
+	}
+	if _, err := path.Match(s, ""); err != nil {
+		return "", fmt.Errorf("invalid route pattern %q: %w", s, err)
+	}
+	return pathPattern(s), nil
+}
+
+func (p pathPattern) match(urlPath string) bool {
+	if prefix, ok := strings.CutSuffix(string(p), "/*"); ok {
+		return urlPath == prefix || strings.HasPrefix(urlPath, prefix+"/")
+	}
+	ok, _ := path.Match(string(p), urlPath)
+	return ok
+}
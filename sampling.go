@@ -0,0 +1,187 @@
+package main
+
+import (
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// sampleConfig controls which requests get a detailed capture.
+type sampleConfig struct {
+	rate      float64
+	patterns  []pathPattern
+	bodyBytes int
+}
+
+var sampling sampleConfig
+
+// sensitiveHeaders are redacted from captures.
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// requestSample is a captured request/response exchange with truncated bodies.
+type requestSample struct {
+	Time            time.Time   `json:"time"`
+	Method          string      `json:"method"`
+	URL             string      `json:"url"`
+	ClientIP        string      `json:"client_ip"`
+	RequestHeaders  http.Header `json:"request_headers"`
+	RequestBody     string      `json:"request_body,omitempty"`
+	Status          int         `json:"status"`
+	ResponseHeaders http.Header `json:"response_headers"`
+	ResponseBody    string      `json:"response_body,omitempty"`
+	DurationMs      float64     `json:"duration_ms"`
+}
+
+// sampleRing keeps the most recent captures.
+type sampleRing struct {
+	mu      sync.Mutex
+	size    int
+	samples []*requestSample
+	next    int
+}
+
+var samples = &sampleRing{size: 100}
+
+func (s *sampleRing) add(sample *requestSample) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.samples) < s.size {
+		s.samples = append(s.samples, sample)
+		return
+	}
+	s.samples[s.next] = sample
+	s.next = (s.next + 1) % s.size
+}
+
+// list returns the captures oldest first.
+func (s *sampleRing) list() []*requestSample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]*requestSample, 0, len(s.samples))
+	for i := range s.samples {
+		out = append(out, s.samples[(s.next+i)%len(s.samples)])
+	}
+	return out
+}
+
+func (s *sampleRing) reset() {
+	s.mu.Lock()
+	s.samples, s.next = nil, 0
+	s.mu.Unlock()
+}
+
+func (c sampleConfig) enabled() bool {
+	return c.rate > 0 || len(c.patterns) > 0
+}
+
+func (c sampleConfig) shouldSample(r *http.Request) bool {
+	for _, p := range c.patterns {
+		if p.match(r.URL.Path) {
+			return true
+		}
+	}
+	return c.rate > 0 && rand.Float64() < c.rate
+}
+
+// limitedBuffer keeps the first max bytes written to it.
+type limitedBuffer struct {
+	buf []byte
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - len(b.buf); room > 0 {
+		b.buf = append(b.buf, p[:min(room, len(p))]...)
+	}
+	return len(p), nil
+}
+
+// teeReadCloser records what the proxy reads from a request body.
+type teeReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// captureWriter records the status and the first bytes of a response.
+type captureWriter struct {
+	http.ResponseWriter
+	status int
+	body   *limitedBuffer
+}
+
+func (w *captureWriter) WriteHeader(status int) {
+	if w.status == 0 && status >= 200 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *captureWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *captureWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *captureWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+func redactHeaders(h http.Header) http.Header {
+	h = h.Clone()
+	for _, name := range sensitiveHeaders {
+		if _, ok := h[name]; ok {
+			h[name] = []string{"[redacted]"}
+		}
+	}
+	return h
+}
+
+// withSampling captures the full exchange for a sampled subset of requests.
+func withSampling(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !sampling.shouldSample(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		reqHeaders := redactHeaders(r.Header)
+		reqBody := &limitedBuffer{max: sampling.bodyBytes}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = teeReadCloser{Reader: io.TeeReader(r.Body, reqBody), Closer: r.Body}
+		}
+		cw := &captureWriter{ResponseWriter: w, body: &limitedBuffer{max: sampling.bodyBytes}}
+		next.ServeHTTP(cw, r)
+
+		samples.add(&requestSample{
+			Time:            start,
+			Method:          r.Method,
+			URL:             r.URL.String(),
+			ClientIP:        clientIP(r),
+			RequestHeaders:  reqHeaders,
+			RequestBody:     string(reqBody.buf),
+			Status:          cw.status,
+			ResponseHeaders: redactHeaders(w.Header()),
+			ResponseBody:    string(cw.body.buf),
+			DurationMs:      float64(time.Since(start).Microseconds()) / 1000,
+		})
+	})
+}
+
+// samplesHandler returns the captured exchanges; DELETE empties the buffer.
+func samplesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		samples.reset()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, samples.list())
+}
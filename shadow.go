@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// shadowRevalidator periodically refetches a random sample of cached entries
+// from their origin and compares them with the stored copy. Entries that differ
+// while still considered fresh point at origins whose caching headers lie.
+type shadowRevalidator struct {
+	client *http.Client
+	sample int
+
+	mu       sync.Mutex
+	backends map[string]*shadowStats
+	recent   []shadowMismatch
+}
+
+type shadowStats struct {
+	Checked  int64 `json:"checked"`
+	Diverged int64 `json:"diverged"`
+}
+
+// shadowMismatch records a fresh entry that no longer matches its origin.
+type shadowMismatch struct {
+	Time    time.Time `json:"time"`
+	Key     string    `json:"key"`
+	Backend string    `json:"backend"`
+	Reason  string    `json:"reason"`
+	Age     float64   `json:"age_seconds"`
+}
+
+// shadowRecentSize is how many mismatches are kept for the admin API.
+const shadowRecentSize = 50
+
+// shadow is nil unless --shadow-revalidate-interval is set.
+var shadow *shadowRevalidator
+
+func newShadowRevalidator(transport http.RoundTripper, sample int) *shadowRevalidator {
+	return &shadowRevalidator{
+		client:   &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		sample:   sample,
+		backends: map[string]*shadowStats{},
+	}
+}
+
+func (s *shadowRevalidator) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		for key, c := range s.pick() {
+			s.check(key, c)
+		}
+	}
+}
+
+// pick reservoir-samples live, fresh, full-body entries.
+func (s *shadowRevalidator) pick() map[string]*CachedResponse {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	keys := make([]string, 0, s.sample)
+	seen := 0
+	for k, c := range cache {
+		if !c.live() || c.expired() || !strings.HasPrefix(k, "GET:") || strings.Contains(k, "#") {
+			continue
+		}
+		seen++
+		if len(keys) < s.sample {
+			keys = append(keys, k)
+		} else if i := rand.IntN(seen); i < s.sample {
+			keys[i] = k
+		}
+	}
+	picked := make(map[string]*CachedResponse, len(keys))
+	for _, k := range keys {
+		picked[k] = cache[k]
+	}
+	return picked
+}
+
+func (s *shadowRevalidator) check(key string, c *CachedResponse) {
+	if b := origins.backendByURL(c.Backend); b != nil && !b.available() {
+		return
+	}
+	resp, body, err := fetchStoredRepresentation(s.client, key, c)
+	if err != nil {
+		logf("warn", "[Shadow] Revalidation of cacheKey '%s' failed: %v", key, err)
+		return
+	}
+
+	reason := compareShadow(c, resp, body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.backends[c.Backend]
+	if stats == nil {
+		stats = &shadowStats{}
+		s.backends[c.Backend] = stats
+	}
+	stats.Checked++
+	if reason == "" {
+		return
+	}
+	stats.Diverged++
+	m := shadowMismatch{Time: time.Now(), Key: key, Backend: c.Backend, Reason: reason, Age: time.Since(c.Timestamp).Seconds()}
+	s.recent = append(s.recent, m)
+	if len(s.recent) > shadowRecentSize {
+		s.recent = s.recent[1:]
+	}
+	logf("warn", "[Shadow] cacheKey '%s' diverged from %s: %s", key, c.Backend, reason)
+}
+
+// fetchStoredRepresentation requests an entry's URL from the backend that
+// produced it, asking for the content coding that was stored so bodies are
+// comparable. The request gets the default headers, OAuth token and
+// signature the Director would add.
+func fetchStoredRepresentation(client *http.Client, key string, c *CachedResponse) (*http.Response, []byte, error) {
+	target := strings.TrimSuffix(c.Backend, "/") + cacheKeyRequestURI(key)
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if enc := c.Headers.Get("Content-Encoding"); enc != "" {
+		req.Header.Set("Accept-Encoding", enc)
+	} else {
+		req.Header.Set("Accept-Encoding", "identity")
+	}
+	if b := origins.backendByURL(c.Backend); b != nil {
+		req.Host = b.host()
+		b.applyDefaultHeaders(req)
+	}
+	if err := injectOAuthToken(req); err != nil {
+		return nil, nil, fmt.Errorf("could not obtain OAuth token: %w", err)
+	}
+	if err := signOutbound(req, time.Now()); err != nil {
+		return nil, nil, fmt.Errorf("could not sign request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, body, nil
+}
+
+// compareShadow explains how the origin's current response differs from the
+// stored one, or returns "" if they match. Validators are only compared when
+// the origin sends them.
+func compareShadow(c *CachedResponse, resp *http.Response, body []byte) string {
+	if resp.StatusCode != c.StatusCode {
+		return fmt.Sprintf("status %d became %d", c.StatusCode, resp.StatusCode)
+	}
+	for _, h := range []string{"ETag", "Last-Modified"} {
+		if v := resp.Header.Get(h); v != "" && v != c.Headers.Get(h) {
+			return h + " changed"
+		}
+	}
+	if sha256.Sum256(c.Response) != sha256.Sum256(body) {
+		return "body changed"
+	}
+	return ""
+}
+
+// shadowHandler reports per-origin divergence ratios and recent mismatches.
+func shadowHandler(w http.ResponseWriter, r *http.Request) {
+	if shadow == nil {
+		http.Error(w, "shadow revalidation is disabled", http.StatusNotFound)
+		return
+	}
+	shadow.mu.Lock()
+	defer shadow.mu.Unlock()
+	backends := map[string]map[string]any{}
+	for b, st := range shadow.backends {
+		backends[b] = map[string]any{
+			"checked": st.Checked, "diverged": st.Diverged, "divergence_ratio": float64(st.Diverged) / float64(st.Checked),
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"backends": backends, "recent": shadow.recent})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// shutdownTopKeys is how many of the most requested entries the shutdown
+// report lists.
+const shutdownTopKeys = 10
+
+// cacheServed are the X-Cache outcomes answered without the origin sending a
+// body; cacheLookups adds the misses they are measured against for the hit
+// ratio.
+var (
+	cacheServed  = []string{"HIT", "STALE", "REVALIDATED", "REPLAY", "NEGATIVE"}
+	cacheLookups = []string{"HIT", "STALE", "REVALIDATED", "MISS"}
+)
+
+// keyHits is an entry in the shutdown report's top keys.
+type keyHits struct {
+	Key  string `json:"key"`
+	Hits int64  `json:"hits"`
+}
+
+// shutdownReport summarizes a process lifetime.
+type shutdownReport struct {
+	Started         time.Time         `json:"started"`
+	Stopped         time.Time         `json:"stopped"`
+	UptimeSeconds   float64           `json:"uptime_seconds"`
+	Requests        uint64            `json:"requests"`
+	RequestsByCache map[string]uint64 `json:"requests_by_cache"`
+	HitRatio        float64           `json:"hit_ratio"`
+	BytesFromCache  uint64            `json:"bytes_from_cache"`
+	BytesFromOrigin uint64            `json:"bytes_from_origin"`
+	Errors          map[string]uint64 `json:"errors"`
+	// TopKeys are the entries with the most hits among those still cached.
+	TopKeys []keyHits `json:"top_keys"`
+}
+
+func buildShutdownReport() shutdownReport {
+	now := time.Now()
+	rep := shutdownReport{Started: startedAt, Stopped: now, UptimeSeconds: now.Sub(startedAt).Seconds(), RequestsByCache: map[string]uint64{}, Errors: map[string]uint64{}}
+
+	requestMetrics.mu.Lock()
+	for k, n := range requestMetrics.requests {
+		rep.RequestsByCache[k] = n
+		rep.Requests += n
+	}
+	for k, n := range requestMetrics.errors {
+		rep.Errors[k] = n
+	}
+	for k, n := range requestMetrics.bytes {
+		switch k {
+		case "MISS", "BYPASS":
+			rep.BytesFromOrigin += n
+		default:
+			if slices.Contains(cacheServed, k) {
+				rep.BytesFromCache += n
+			}
+		}
+	}
+	requestMetrics.mu.Unlock()
+
+	var hits, lookups uint64
+	for _, k := range cacheLookups {
+		lookups += rep.RequestsByCache[k]
+		if k != "MISS" {
+			hits += rep.RequestsByCache[k]
+		}
+	}
+	if lookups > 0 {
+		rep.HitRatio = float64(hits) / float64(lookups)
+	}
+
+	cacheMutex.Lock()
+	rep.TopKeys = make([]keyHits, 0, len(cache))
+	for k, c := range cache {
+		if c.hits > 0 {
+			rep.TopKeys = append(rep.TopKeys, keyHits{Key: k, Hits: c.hits})
+		}
+	}
+	cacheMutex.Unlock()
+	sort.Slice(rep.TopKeys, func(i, j int) bool {
+		a, b := rep.TopKeys[i], rep.TopKeys[j]
+		return a.Hits > b.Hits || a.Hits == b.Hits && a.Key < b.Key
+	})
+	rep.TopKeys = rep.TopKeys[:min(len(rep.TopKeys), shutdownTopKeys)]
+	return rep
+}
+
+// logShutdownReport writes the report to the log and, if path is set, as JSON
+// to that file.
+func logShutdownReport(rep shutdownReport, path string) {
+	log.Printf("[Shutdown] Uptime %s, %d requests, hit ratio %.1f%%, %d bytes served from cache, %d from origin",
+		time.Duration(rep.UptimeSeconds*float64(time.Second)).Round(time.Second), rep.Requests, rep.HitRatio*100, rep.BytesFromCache, rep.BytesFromOrigin)
+	for i, k := range rep.TopKeys {
+		log.Printf("[Shutdown] Top key %d: '%s' (%d hits)", i+1, k.Key, k.Hits)
+	}
+	if path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(rep, "", "  ")
+	if err == nil {
+		err = os.WriteFile(path, append(data, '\n'), 0o644)
+	}
+	if err != nil {
+		logf("error", "[Shutdown] Could not write report to %s: %v", path, err)
+	}
+}
+
+// serveUntilSignal serves srv until SIGINT or SIGTERM, then lets in-flight
+// requests finish for up to timeout, flushes the disk cache and writes the
+// shutdown report.
+func serveUntilSignal(srv *http.Server, timeout time.Duration, reportPath string) {
+	errc := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			errc <- srv.ListenAndServeTLS("", "")
+		} else {
+			errc <- srv.ListenAndServe()
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-errc:
+		fatalf("%v", err)
+	case sig := <-stop:
+		log.Printf("[Shutdown] Received %v, draining requests for up to %s", sig, timeout)
+	}
+	signal.Stop(stop)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logf("warn", "[Shutdown] Requests still in flight after %s: %v", timeout, err)
+	}
+	if disk != nil {
+		disk.flush()
+	}
+	if pusher != nil {
+		pusher.push() // the last interval's counts
+	}
+	logShutdownReport(buildShutdownReport(), reportPath)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"hash/maphash"
+	"math"
+	"math/bits"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// sizeWindow is how many recent response sizes are kept per route for the
+// percentiles.
+const sizeWindow = 1024
+
+// hllPrecision gives 2^10 registers per route, about 3% error on the
+// distinct key estimate for 1KB of memory.
+const hllPrecision = 10
+
+// sizeStatsRoutes groups responses for size statistics; paths matching none
+// are grouped by their first segment.
+var sizeStatsRoutes []pathPattern
+
+// routeSizeStats accumulates the sizes of origin responses for one route.
+type routeSizeStats struct {
+	responses  int64
+	totalBytes int64
+	maxBytes   int64
+	recent     []int64 // ring of the last sizeWindow sizes
+	next       int
+	keys       [1 << hllPrecision]uint8
+}
+
+var hllSeed = maphash.MakeSeed()
+
+var (
+	sizeStatsMu sync.Mutex
+	sizeStats   = map[string]*routeSizeStats{}
+)
+
+// sizeStatsRoute returns the route a path is accounted under.
+func sizeStatsRoute(urlPath string) string {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	for _, p := range sizeStatsRoutes {
+		if p.match(urlPath) {
+			return string(p)
+		}
+	}
+	first, _, nested := strings.Cut(strings.TrimPrefix(urlPath, "/"), "/")
+	if !nested {
+		return "/*"
+	}
+	return "/" + first + "/*"
+}
+
+// recordResponseSize accounts a cacheable origin response of n bytes.
+func recordResponseSize(key string, n int) {
+	route := sizeStatsRoute(cacheKeyPath(key))
+	sizeStatsMu.Lock()
+	defer sizeStatsMu.Unlock()
+	s := sizeStats[route]
+	if s == nil {
+		s = &routeSizeStats{}
+		sizeStats[route] = s
+	}
+	s.responses++
+	s.totalBytes += int64(n)
+	s.maxBytes = max(s.maxBytes, int64(n))
+	if len(s.recent) < sizeWindow {
+		s.recent = append(s.recent, int64(n))
+	} else {
+		s.recent[s.next] = int64(n)
+		s.next = (s.next + 1) % sizeWindow
+	}
+	s.addKey(key)
+}
+
+// addKey feeds the HyperLogLog sketch estimating distinct keys.
+func (s *routeSizeStats) addKey(key string) {
+	x := maphash.String(hllSeed, key)
+	idx := x >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	s.keys[idx] = max(s.keys[idx], rank)
+}
+
+func (s *routeSizeStats) distinctKeys() int64 {
+	const m = 1 << hllPrecision
+	sum, zeros := 0.0, 0
+	for _, r := range s.keys {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(float64(m)/float64(zeros)) // linear counting for small sets
+	}
+	return int64(math.Round(estimate))
+}
+
+func percentile(sorted []int64, p float64) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[min(len(sorted)-1, int(p*float64(len(sorted))))]
+}
+
+// sizeStatsHandler reports response size statistics per route, with the
+// number of distinct keys seen and what caching all of them would take.
+func sizeStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stored := map[string][2]int64{}
+	cacheMutex.Lock()
+	for key, c := range cache {
+		route := sizeStatsRoute(cacheKeyPath(key))
+		s := stored[route]
+		stored[route] = [2]int64{s[0] + 1, s[1] + c.size()}
+	}
+	cacheMutex.Unlock()
+
+	sizeStatsMu.Lock()
+	defer sizeStatsMu.Unlock()
+	routes := make([]map[string]any, 0, len(sizeStats))
+	for route, s := range sizeStats {
+		sorted := slices.Clone(s.recent)
+		slices.Sort(sorted)
+		mean := s.totalBytes / s.responses
+		distinct := s.distinctKeys()
+		routes = append(routes, map[string]any{
+			"route":           route,
+			"responses":       s.responses,
+			"mean_bytes":      mean,
+			"p50_bytes":       percentile(sorted, 0.50),
+			"p95_bytes":       percentile(sorted, 0.95),
+			"p99_bytes":       percentile(sorted, 0.99),
+			"max_bytes":       s.maxBytes,
+			"distinct_keys":   distinct,
+			"projected_bytes": distinct * mean,
+			"cached_entries":  stored[route][0],
+			"cached_bytes":    stored[route][1],
+		})
+	}
+	slices.SortFunc(routes, func(a, b map[string]any) int { return strings.Compare(a["route"].(string), b["route"].(string)) })
+	writeJSON(w, http.StatusOK, routes)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// defaultSoftPurgeWindow is how long a soft purge spreads its re-fetches
+// over when the request does not say.
+const defaultSoftPurgeWindow = time.Minute
+
+// softPurgeSlots bounds the re-fetches of all soft purges running at once.
+var softPurgeSlots = make(chan struct{}, publishConcurrency)
+
+// softPurge marks the cached entries match selects as stale without removing
+// them. Each is re-fetched at a random point within window and served until
+// the new copy replaces it, so purging a large prefix at peak traffic does
+// not send all of it to the origin at once. An entry that cannot be re-fetched
+// on its own, or whose re-fetch fails, is deleted at its turn instead. Entries
+// replaced in the meantime are left alone. It returns how many entries were
+// marked.
+func softPurge(proxyHandler http.Handler, r *http.Request, match func(string) bool, window time.Duration) int {
+	cacheMutex.Lock()
+	marked := map[string]*CachedResponse{}
+	for k, c := range cache {
+		if match(k) {
+			marked[k] = c
+		}
+	}
+	cacheMutex.Unlock()
+
+	for key, c := range marked {
+		time.AfterFunc(rand.N(window), func() {
+			softPurgeSlots <- struct{}{}
+			defer func() { <-softPurgeSlots }()
+			cacheMutex.Lock()
+			current := cache[key]
+			cacheMutex.Unlock()
+			if current != c {
+				return
+			}
+			if _, _, err := refreshKey(proxyHandler, r, key); err != nil {
+				routineLog.printf("[Purge] Soft purge could not re-fetch cacheKey '%s', deleting it: %v", key, err)
+				entryStore.Delete(key)
+			}
+		})
+	}
+	return len(marked)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+)
+
+// defaultDeniedRanges are never dialed unless explicitly allowed: link-local
+// addresses, which host the cloud metadata services, and the unspecified
+// network.
+var defaultDeniedRanges = []string{
+	"0.0.0.0/8",
+	"169.254.0.0/16",
+	"fe80::/10",
+	"fd00:ec2::254/128",  // AWS metadata over IPv6
+	"100.100.100.200/32", // Alibaba Cloud metadata
+}
+
+// privateRanges are the RFC 1918 and unique local networks denied with
+// --origin-deny-private.
+var privateRanges = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"}
+
+// addressPolicy decides which IP addresses the proxy may connect to for origin
+// traffic, so a misconfigured route cannot be used to reach internal services.
+// Allowed prefixes take precedence over denied ones.
+type addressPolicy struct {
+	deny  []netip.Prefix
+	allow []netip.Prefix
+}
+
+// errBlockedAddress is returned when dialing an address the policy denies.
+type errBlockedAddress struct{ addr netip.Addr }
+
+func (e *errBlockedAddress) Error() string {
+	return fmt.Sprintf("connecting to %s is not allowed by the origin address policy", e.addr)
+}
+
+func parsePrefixes(specs []string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, spec := range specs {
+		p, err := netip.ParsePrefix(spec)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(spec)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid CIDR %q", spec)
+			}
+			p = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
+
+func newAddressPolicy(denyPrivate bool, deny, allow []string) (*addressPolicy, error) {
+	specs := append([]string{}, defaultDeniedRanges...)
+	if denyPrivate {
+		specs = append(specs, privateRanges...)
+	}
+	denied, err := parsePrefixes(append(specs, deny...))
+	if err != nil {
+		return nil, err
+	}
+	allowed, err := parsePrefixes(allow)
+	if err != nil {
+		return nil, err
+	}
+	return &addressPolicy{deny: denied, allow: allowed}, nil
+}
+
+func (p *addressPolicy) permits(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range p.allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	for _, prefix := range p.deny {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// control is a net.Dialer Control hook. It sees the resolved address of every
+// connection attempt, so the policy holds even when an origin's DNS records
+// change after startup.
+func (p *addressPolicy) control(network, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !p.permits(ap.Addr()) {
+		return &errBlockedAddress{addr: ap.Addr().Unmap()}
+	}
+	return nil
+}
+
+// checkOriginAddresses fails fast when a configured origin currently resolves
+// to a denied address. Hosts that don't resolve yet are checked on dial.
+func checkOriginAddresses(p *addressPolicy, pool *originPool) error {
+	for _, b := range pool.allBackends() {
+		host := b.url.Hostname()
+		addrs, err := net.DefaultResolver.LookupNetIP(context.Background(), "ip", host)
+		if err != nil {
+			logf("warn", "[SSRF] Could not resolve origin %s at startup: %v", host, err)
+			continue
+		}
+		for _, addr := range addrs {
+			if !p.permits(addr) {
+				return fmt.Errorf("origin %s resolves to %s, which the origin address policy denies", b.url, addr.Unmap())
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Store keeps cached entries. The proxy always serves from the memory store;
+// --store selects a shared store layered behind it. Further backends only
+// need to implement Store and register a constructor in storeBackends.
+type Store interface {
+	// Get returns the live, unexpired entry for key.
+	Get(key string) (*CachedResponse, bool)
+	Set(key string, c *CachedResponse)
+	// Delete removes key and reports whether it was stored. Stores that
+	// write asynchronously always report false.
+	Delete(key string) bool
+	// Purge removes the entries m matches and returns how many it removed,
+	// as far as the store can tell.
+	Purge(m purgeMatcher) int
+	// Len returns the number of entries, or -1 when the store cannot count
+	// them cheaply.
+	Len() int
+	Stats() StoreStats
+}
+
+// StoreStats is what GET /__admin/store reports for each store.
+type StoreStats struct {
+	Backend string `json:"backend"`
+	Entries int    `json:"entries"`
+	Bytes   int64  `json:"bytes,omitempty"`
+	Hits    int64  `json:"hits"`
+	Misses  int64  `json:"misses"`
+	Errors  int64  `json:"errors"`
+
+	// Writes waiting in the write-behind queue, and those dropped because
+	// it was full.
+	QueueDepth    int   `json:"queue_depth,omitempty"`
+	DroppedWrites int64 `json:"dropped_writes,omitempty"`
+
+	// Space taken by the --cache-dir files, and entries evicted to keep it
+	// within --disk-limit.
+	DiskBytes     int64 `json:"disk_bytes,omitempty"`
+	DiskEvictions int64 `json:"disk_evictions,omitempty"`
+}
+
+// generationStore is implemented by shared stores that propagate generation
+// bumps and namespace clears to other replicas.
+type generationStore interface {
+	saveGenerations()
+}
+
+// storeBackends maps --store names to constructors of shared stores, which
+// read their settings from their own flags.
+var storeBackends = map[string]func() (Store, error){
+	"redis":     func() (Store, error) { return openRedisStore(redisSettings) },
+	"memcached": func() (Store, error) { return openMemcachedStore(memcachedSettings) },
+	"peers":     func() (Store, error) { return openPeerStore(peerSettings) },
+}
+
+// memoryStore is the process-local cache: the cache map with its pools,
+// limits and superseded versions, mirrored to --cache-dir when set.
+type memoryStore struct {
+	hits, misses atomic.Int64
+}
+
+var memory = &memoryStore{}
+
+// entryStore is the store the proxy reads and writes through.
+var entryStore Store = memory
+
+// openStore layers the shared store named by --store behind memory.
+func openStore(name string) (Store, error) {
+	if name == "memory" {
+		return memory, nil
+	}
+	open, ok := storeBackends[name]
+	if !ok {
+		names := []string{"memory"}
+		for n := range storeBackends {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown store %q (want %s)", name, strings.Join(names, ", "))
+	}
+	shared, err := open()
+	if err != nil {
+		return nil, err
+	}
+	return &tieredStore{local: memory, shared: shared}, nil
+}
+
+// Get lazily drops entries left over from an older generation or past their
+// TTL.
+func (m *memoryStore) Get(key string) (*CachedResponse, bool) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	c, found := cache[key]
+	if found && !c.live() {
+		removeEntryLocked(key)
+		found = false
+	}
+	if found && c.expired() {
+		log.Printf("[Cache] Entry for cacheKey '%s' expired after %s", key, time.Since(c.Timestamp).Round(time.Second))
+		removeEntryLocked(key)
+		found = false
+	}
+	if !found {
+		m.misses.Add(1)
+		return nil, false
+	}
+	m.hits.Add(1)
+	accessedLocked(key, c)
+	return c, true
+}
+
+func (m *memoryStore) Set(key string, c *CachedResponse) {
+	cacheMutex.Lock()
+	addEntryLocked(key, c)
+	cacheMutex.Unlock()
+	if disk != nil {
+		disk.store(key, c)
+	}
+}
+
+// Delete and Purge forget remembered failures of the keys too, so the next
+// request goes to the origin.
+func (m *memoryStore) Delete(key string) bool {
+	forgetFailure(key)
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	_, found := cache[key]
+	removeEntryLocked(key)
+	return found
+}
+
+func (m *memoryStore) Purge(match purgeMatcher) int {
+	forgetFailures(match)
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	n := 0
+	for k := range cache {
+		if match.match(k) {
+			removeEntryLocked(k)
+			n++
+		}
+	}
+	purgeVaryIndexLocked(match)
+	return n
+}
+
+func (m *memoryStore) Len() int {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	return len(cache)
+}
+
+func (m *memoryStore) Stats() StoreStats {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	st := StoreStats{Backend: "memory", Entries: len(cache), Bytes: cacheBytes, Hits: m.hits.Load(), Misses: m.misses.Load()}
+	if disk != nil {
+		st.QueueDepth = disk.writes.depth()
+		st.DiskBytes, st.DiskEvictions = disk.usage(), disk.evictions.Load()
+	}
+	return st
+}
+
+// tieredStore serves from local and falls back to shared on a miss, copying
+// what it finds there into local. Writes and invalidations go to both.
+type tieredStore struct {
+	local  Store
+	shared Store
+}
+
+func (t *tieredStore) Get(key string) (*CachedResponse, bool) {
+	if c, found := t.local.Get(key); found {
+		return c, true
+	}
+	// Another replica may already have fetched it
+	c, found := t.shared.Get(key)
+	if !found || !c.live() || c.expired() {
+		return nil, false
+	}
+	t.local.Set(key, c)
+	return c, true
+}
+
+func (t *tieredStore) Set(key string, c *CachedResponse) {
+	t.local.Set(key, c)
+	t.shared.Set(key, c)
+}
+
+func (t *tieredStore) Delete(key string) bool {
+	found := t.local.Delete(key)
+	return t.shared.Delete(key) || found
+}
+
+// Purge purges shared first: a store without key listing purges the keys it
+// finds locally.
+func (t *tieredStore) Purge(m purgeMatcher) int {
+	t.shared.Purge(m)
+	return t.local.Purge(m)
+}
+
+func (t *tieredStore) Len() int          { return t.local.Len() }
+func (t *tieredStore) Stats() StoreStats { return t.local.Stats() }
+
+// shareGenerations hands the current generations to the shared store, if it
+// propagates them.
+func shareGenerations() {
+	if t, ok := entryStore.(*tieredStore); ok {
+		if g, ok := t.shared.(generationStore); ok {
+			g.saveGenerations()
+		}
+	}
+}
+
+// applyInvalidation applies another replica's "drop KEY" or "purge MATCHER"
+// to the memory cache. component tags the log lines.
+func applyInvalidation(component, verb, arg string) {
+	switch verb {
+	case "drop":
+		memory.Delete(arg)
+	case "purge":
+		m, err := parsePurgeMatcher(arg)
+		if err != nil {
+			logf("warn", "[%s] Ignoring invalid purge '%s': %v", component, arg, err)
+			return
+		}
+		n := memory.Purge(m)
+		log.Printf("[%s] Purged %d local entries matching '%s' for another replica", component, n, arg)
+	}
+}
+
+// storeStats returns the statistics of the memory store and, if any, of the
+// shared store or the --cache-dir a read-only replica serves from.
+func storeStats() []StoreStats {
+	list := []StoreStats{memory.Stats()}
+	switch s := entryStore.(type) {
+	case *tieredStore:
+		list = append(list, s.shared.Stats())
+	case *diskReplicaStore:
+		list = append(list, s.Stats())
+	}
+	return list
+}
+
+// storeHandler reports the statistics of the stores.
+func storeHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, storeStats())
+}
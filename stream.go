@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// streamChunk is how much of a cached body is written at a time.
+const streamChunk = 32 << 10
+
+var (
+	// clientWriteTimeout bounds how long a client may take to accept each
+	// chunk of a cached body; 0 disables the deadline.
+	clientWriteTimeout time.Duration
+	// clientBandwidth caps the rate, in bytes per second, at which cached
+	// bodies are sent to each connection; 0 means unlimited.
+	clientBandwidth byteSize
+)
+
+// errClientTooSlow reports a client that stopped accepting data.
+var errClientTooSlow = errors.New("client write deadline exceeded")
+
+// streamBody writes a cached body in chunks, pacing it to clientBandwidth and
+// giving up on clients that do not keep up with clientWriteTimeout, so slow
+// clients cannot block a goroutine indefinitely.
+func streamBody(ctx context.Context, w http.ResponseWriter, body []byte) error {
+	rc := http.NewResponseController(w)
+	if clientWriteTimeout > 0 {
+		defer rc.SetWriteDeadline(time.Time{})
+	}
+	chunk := streamChunk
+	if clientBandwidth > 0 {
+		chunk = paceStep(int64(clientBandwidth))
+	}
+	start := time.Now()
+	for off := 0; off < len(body); off += chunk {
+		if clientBandwidth > 0 {
+			if err := pace(ctx, start, int64(off), int64(clientBandwidth)); err != nil {
+				return err
+			}
+		}
+		if clientWriteTimeout > 0 {
+			rc.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+		}
+		if _, err := w.Write(body[off:min(off+chunk, len(body))]); err != nil {
+			if isTimeout(err) {
+				return errClientTooSlow
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func isTimeout(err error) bool {
+	var t interface{ Timeout() bool }
+	return errors.As(err, &t) && t.Timeout()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// strictHTTP enables RFC 9110/9111 behavior a compliant shared cache needs but
+// that the default, forgiving mode skips.
+var strictHTTP bool
+
+// viaPseudonym identifies the proxy in Via headers.
+const viaPseudonym = "caching-proxy"
+
+// heuristicallyCacheable lists the 2xx statuses RFC 9110 §15.1 allows a cache
+// to store without explicit freshness information.
+var heuristicallyCacheable = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusPartialContent:       true,
+}
+
+// strictStorable applies the storage rules of RFC 9111 §3 for a shared cache
+// beyond the response directives every mode honors (see responseStorable),
+// returning the reason when the response must not be stored.
+func strictStorable(req *http.Request, resp *http.Response) (bool, string) {
+	reqCC, respCC := parseCacheControl(req.Header), parseCacheControl(resp.Header)
+	switch {
+	case reqCC.has("no-store"):
+		return false, "no-store"
+	case req.Header.Get("Authorization") != "" && !injectsCredentials(req.URL.Path) &&
+		!respCC.has("public") && !respCC.has("s-maxage") && !respCC.has("must-revalidate"):
+		return false, "authenticated request without explicit permission to cache"
+	}
+
+	explicit := respCC.has("max-age") || respCC.has("s-maxage") || respCC.has("public") || resp.Header.Get("Expires") != ""
+	if !explicit && !heuristicallyCacheable[resp.StatusCode] {
+		return false, fmt.Sprintf("status %d is not cacheable without explicit freshness", resp.StatusCode)
+	}
+	return true, ""
+}
+
+// addVia records this hop in the Via header (RFC 9110 §7.6.3).
+func addVia(h http.Header, protoMajor, protoMinor int) {
+	h.Add("Via", fmt.Sprintf("%d.%d %s", protoMajor, protoMinor, viaPseudonym))
+}
+
+// setAge reports how long a stored response has been in the cache
+// (RFC 9111 §5.1), accounting for any Age the origin already sent.
+func setAge(h http.Header, stored time.Time) {
+	age := int64(time.Since(stored) / time.Second)
+	if prev, err := strconv.ParseInt(h.Get("Age"), 10, 64); err == nil && prev > 0 {
+		age += prev
+	}
+	h.Set("Age", strconv.FormatInt(age, 10))
+}
+
+// handleMaxForwards implements Max-Forwards for TRACE and OPTIONS
+// (RFC 9110 §7.6.2): at zero the proxy answers itself, otherwise it decrements
+// the value. It reports whether the response has been written.
+func handleMaxForwards(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodTrace && r.Method != http.MethodOptions {
+		return false
+	}
+	raw := r.Header.Get("Max-Forwards")
+	if raw == "" {
+		return false
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 {
+		http.Error(w, "invalid Max-Forwards", http.StatusBadRequest)
+		return true
+	}
+	if n > 0 {
+		r.Header.Set("Max-Forwards", strconv.Itoa(n-1))
+		return false
+	}
+
+	log.Printf("[Strict] Answering %s for %s locally (Max-Forwards: 0)", r.Method, r.URL.String())
+	if r.Method == http.MethodOptions {
+		answerOptions(w, r)
+	} else {
+		answerTrace(w, r)
+	}
+	return true
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStrictStorable(t *testing.T) {
+	tests := []struct {
+		name       string
+		reqHeader  http.Header
+		status     int
+		respHeader http.Header
+		want       bool
+	}{
+		{"plain 200", nil, 200, nil, true},
+		{"request no-store", http.Header{"Cache-Control": {"no-store"}}, 200, nil, false},
+		{"request no-store among others", http.Header{"Cache-Control": {"max-age=0, No-Store"}}, 200, nil, false},
+		{"authorization", http.Header{"Authorization": {"Bearer x"}}, 200, nil, false},
+		{"authorization with public", http.Header{"Authorization": {"Bearer x"}}, 200, http.Header{"Cache-Control": {"public"}}, true},
+		{"authorization with s-maxage", http.Header{"Authorization": {"Bearer x"}}, 200, http.Header{"Cache-Control": {"s-maxage=60"}}, true},
+		{"authorization with must-revalidate", http.Header{"Authorization": {"Bearer x"}}, 200, http.Header{"Cache-Control": {"must-revalidate"}}, true},
+		{"authorization with max-age only", http.Header{"Authorization": {"Bearer x"}}, 200, http.Header{"Cache-Control": {"max-age=60"}}, false},
+		{"heuristic 203", nil, 203, nil, true},
+		{"heuristic 204", nil, 204, nil, true},
+		{"heuristic 206", nil, 206, nil, true},
+		{"302 without freshness", nil, 302, nil, false},
+		{"404 without freshness", nil, 404, nil, false},
+		{"404 with max-age", nil, 404, http.Header{"Cache-Control": {"max-age=60"}}, true},
+		{"404 with s-maxage", nil, 404, http.Header{"Cache-Control": {"s-maxage=60"}}, true},
+		{"302 with public", nil, 302, http.Header{"Cache-Control": {"public"}}, true},
+		{"301 with Expires", nil, 301, http.Header{"Expires": {"Thu, 01 Jan 2099 00:00:00 GMT"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/page", nil)
+			for k, vv := range tt.reqHeader {
+				req.Header[k] = vv
+			}
+			resp := &http.Response{StatusCode: tt.status, Header: http.Header{}}
+			for k, vv := range tt.respHeader {
+				resp.Header[k] = vv
+			}
+			got, reason := strictStorable(req, resp)
+			if got != tt.want {
+				t.Errorf("strictStorable = %v (%q), want %v", got, reason, tt.want)
+			}
+			if !got && reason == "" {
+				t.Error("refusal without a reason")
+			}
+		})
+	}
+}
+
+func TestSetAge(t *testing.T) {
+	tests := []struct {
+		name   string
+		stored time.Duration // ago
+		prev   string
+		want   string
+	}{
+		{"fresh", 0, "", "0"},
+		{"stored a while", 90 * time.Second, "", "90"},
+		{"origin age added", 10 * time.Second, "5", "15"},
+		{"invalid origin age ignored", 10 * time.Second, "soon", "10"},
+		{"negative origin age ignored", 10 * time.Second, "-3", "10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			if tt.prev != "" {
+				h.Set("Age", tt.prev)
+			}
+			setAge(h, time.Now().Add(-tt.stored))
+			if got := h.Get("Age"); got != tt.want {
+				t.Errorf("Age = %q, want %q", got, tt.want)
+			}
+			if n := len(h.Values("Age")); n != 1 {
+				t.Errorf("%d Age headers, want 1", n)
+			}
+		})
+	}
+}
+
+func TestAddVia(t *testing.T) {
+	tests := []struct {
+		name         string
+		prev         []string
+		major, minor int
+		want         []string
+	}{
+		{"first hop", nil, 1, 1, []string{"1.1 caching-proxy"}},
+		{"HTTP/2", nil, 2, 0, []string{"2.0 caching-proxy"}},
+		{"appended after upstream hops", []string{"1.0 fred", "1.1 p.example.net"}, 1, 1,
+			[]string{"1.0 fred", "1.1 p.example.net", "1.1 caching-proxy"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			for _, v := range tt.prev {
+				h.Add("Via", v)
+			}
+			addVia(h, tt.major, tt.minor)
+			if got := h.Values("Via"); !slices.Equal(got, tt.want) {
+				t.Errorf("Via = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleMaxForwards(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		maxForwards string
+		handled     bool
+		status      int    // when handled
+		forwarded   string // Max-Forwards sent on when not handled
+	}{
+		{"GET ignores Max-Forwards", http.MethodGet, "0", false, 0, "0"},
+		{"OPTIONS without Max-Forwards", http.MethodOptions, "", false, 0, ""},
+		{"OPTIONS decremented", http.MethodOptions, "3", false, 0, "2"},
+		{"TRACE decremented to zero", http.MethodTrace, "1", false, 0, "0"},
+		{"OPTIONS answered at zero", http.MethodOptions, "0", true, http.StatusOK, ""},
+		{"TRACE answered at zero", http.MethodTrace, "0", true, http.StatusOK, ""},
+		{"invalid", http.MethodOptions, "many", true, http.StatusBadRequest, ""},
+		{"negative", http.MethodTrace, "-1", true, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/page", nil)
+			if tt.maxForwards != "" {
+				r.Header.Set("Max-Forwards", tt.maxForwards)
+			}
+			w := httptest.NewRecorder()
+			if got := handleMaxForwards(w, r); got != tt.handled {
+				t.Fatalf("handled = %v, want %v", got, tt.handled)
+			}
+			if tt.handled {
+				if w.Code != tt.status {
+					t.Errorf("status = %d, want %d", w.Code, tt.status)
+				}
+				return
+			}
+			if got := r.Header.Get("Max-Forwards"); got != tt.forwarded {
+				t.Errorf("Max-Forwards = %q, want %q", got, tt.forwarded)
+			}
+		})
+	}
+}
+
+func TestTraceAnswerOmitsCredentials(t *testing.T) {
+	r := httptest.NewRequest(http.MethodTrace, "/page", nil)
+	r.Header.Set("Max-Forwards", "0")
+	r.Header.Set("Authorization", "Bearer secret")
+	r.Header.Set("Cookie", "session=secret")
+	w := httptest.NewRecorder()
+	handleMaxForwards(w, r)
+	if ct := w.Header().Get("Content-Type"); ct != "message/http" {
+		t.Errorf("Content-Type = %q, want message/http", ct)
+	}
+	body := w.Body.String()
+	if !strings.HasPrefix(body, "TRACE /page") {
+		t.Errorf("TRACE echo = %q, want the request", body)
+	}
+	if strings.Contains(body, "secret") {
+		t.Errorf("TRACE echo leaks credentials: %q", body)
+	}
+}
+
+func TestParseCacheControl(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  cacheControl
+	}{
+		{"empty", nil, cacheControl{}},
+		{"flags and arguments", []string{"public, max-age=60"}, cacheControl{"public": "", "max-age": "60"}},
+		{"case-insensitive names", []string{"No-Cache, MAX-AGE=5"}, cacheControl{"no-cache": "", "max-age": "5"}},
+		{"quoted argument", []string{`private="Set-Cookie"`}, cacheControl{"private": "Set-Cookie"}},
+		{"spaces", []string{"  s-maxage = 30 ,must-revalidate "}, cacheControl{"s-maxage": "30", "must-revalidate": ""}},
+		{"several lines", []string{"no-transform", "max-age=1"}, cacheControl{"no-transform": "", "max-age": "1"}},
+		{"empty members", []string{",,no-store,"}, cacheControl{"no-store": ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{"Cache-Control": tt.lines}
+			got := parseCacheControl(h)
+			if len(got) != len(tt.want) {
+				t.Fatalf("parseCacheControl = %v, want %v", got, tt.want)
+			}
+			for k, v := range tt.want {
+				if got[k] != v || !got.has(k) {
+					t.Errorf("%s = %q, want %q", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestCacheControlSeconds(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		present bool
+	}{
+		{"max-age=60", time.Minute, true},
+		{"max-age=0", 0, true},
+		{"max-age=soon", 0, true},
+		{"max-age=-5", 0, true},
+		{`max-age="10"`, 10 * time.Second, true},
+		{"public", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, ok := parseCacheControl(http.Header{"Cache-Control": {tt.value}}).seconds("max-age")
+			if got != tt.want || ok != tt.present {
+				t.Errorf("seconds = %v, %v, want %v, %v", got, ok, tt.want, tt.present)
+			}
+		})
+	}
+}
+
+func TestFreshnessLifetime(t *testing.T) {
+	date := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+		ok     bool
+	}{
+		{"none", http.Header{}, 0, false},
+		{"max-age", http.Header{"Cache-Control": {"max-age=60"}}, time.Minute, true},
+		{"s-maxage wins for a shared cache", http.Header{"Cache-Control": {"max-age=60, s-maxage=10"}}, 10 * time.Second, true},
+		{"Age subtracted", http.Header{"Cache-Control": {"max-age=60"}, "Age": {"15"}}, 45 * time.Second, true},
+		{"Age beyond lifetime", http.Header{"Cache-Control": {"max-age=60"}, "Age": {"90"}}, 0, true},
+		{"max-age wins over Expires", http.Header{"Cache-Control": {"max-age=5"}, "Expires": {date.Add(time.Hour).Format(http.TimeFormat)}}, 5 * time.Second, true},
+		{"Expires against Date", http.Header{"Date": {date.Format(http.TimeFormat)}, "Expires": {date.Add(time.Hour).Format(http.TimeFormat)}}, time.Hour, true},
+		{"Expires before Date", http.Header{"Date": {date.Format(http.TimeFormat)}, "Expires": {date.Add(-time.Hour).Format(http.TimeFormat)}}, 0, true},
+		{"invalid Expires is expired", http.Header{"Expires": {"0"}}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := freshnessLifetime(tt.header)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("freshnessLifetime = %v, %v, want %v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestResponseStorable(t *testing.T) {
+	tests := []struct {
+		cacheControl string
+		age          string
+		etag         string
+		want         bool
+	}{
+		{"", "", "", true},
+		{"max-age=60", "", "", true},
+		{"public, max-age=60", "", "", true},
+		{"no-store", "", "", false},
+		{"private", "", "", false},
+		{`private="Set-Cookie"`, "", "", false},
+		{"no-cache", "", "", false},
+		{"no-cache", "", `"v1"`, true},
+		{"no-cache, max-age=0", "", `"v1"`, true},
+		{"no-store, no-cache", "", `"v1"`, false},
+		{"max-age=0", "", "", false},
+		{"max-age=60", "60", "", false},
+		{"max-age=60", "59", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cacheControl+"/age="+tt.age+"/etag="+tt.etag, func(t *testing.T) {
+			resp := &http.Response{Header: http.Header{}}
+			if tt.cacheControl != "" {
+				resp.Header.Set("Cache-Control", tt.cacheControl)
+			}
+			if tt.age != "" {
+				resp.Header.Set("Age", tt.age)
+			}
+			if tt.etag != "" {
+				resp.Header.Set("ETag", tt.etag)
+			}
+			got, reason := responseStorable(resp)
+			if got != tt.want {
+				t.Errorf("responseStorable = %v (%q), want %v", got, reason, tt.want)
+			}
+		})
+	}
+}
+
+// conformanceStep is one client request in a conformance case, with the
+// response the scripted origin gives if the proxy forwards it.
+type conformanceStep struct {
+	reqHeader  http.Header
+	status     int // origin status, 200 when zero
+	respHeader http.Header
+	body       string
+
+	wantOrigin    bool              // the request reaches the origin
+	wantOriginReq map[string]string // headers it must carry there
+	wantStatus    int               // 200 when zero
+	wantCache     string            // X-Cache, when set
+	wantBody      string            // when set
+	wantHeader    map[string]string // response headers; "" means absent
+}
+
+// TestConformance runs the proxy against a scripted origin through the
+// freshness, validation, Vary and header cases of the cache-tests.fyi
+// corpus that apply to a shared cache. Each case starts from an empty cache.
+func TestConformance(t *testing.T) {
+	past := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	fresh := http.Header{"Cache-Control": {"max-age=3600"}}
+	tests := []struct {
+		name  string
+		steps []conformanceStep
+	}{
+		// Freshness (RFC 9111 §4.2)
+		{"max-age is reused", []conformanceStep{
+			{respHeader: fresh, body: "a", wantOrigin: true, wantCache: "MISS"},
+			{wantCache: "HIT", wantBody: "a"},
+		}},
+		{"s-maxage overrides max-age", []conformanceStep{
+			{respHeader: http.Header{"Cache-Control": {"max-age=0, s-maxage=3600"}}, wantOrigin: true},
+			{wantCache: "HIT"},
+		}},
+		{"Expires in the future is reused", []conformanceStep{
+			{respHeader: http.Header{"Expires": {future}}, wantOrigin: true},
+			{wantCache: "HIT"},
+		}},
+		{"Expires in the past is not reused", []conformanceStep{
+			{respHeader: http.Header{"Expires": {past}}, wantOrigin: true},
+			{respHeader: http.Header{"Expires": {past}}, wantOrigin: true},
+		}},
+		{"invalid Expires is stale", []conformanceStep{
+			{respHeader: http.Header{"Expires": {"0"}}, wantOrigin: true},
+			{respHeader: http.Header{"Expires": {"0"}}, wantOrigin: true},
+		}},
+		{"max-age=0 is not reused", []conformanceStep{
+			{respHeader: http.Header{"Cache-Control": {"max-age=0"}}, wantOrigin: true},
+			{respHeader: http.Header{"Cache-Control": {"max-age=0"}}, wantOrigin: true},
+		}},
+		{"origin Age counts against max-age", []conformanceStep{
+			{respHeader: http.Header{"Cache-Control": {"max-age=60"}, "Age": {"120"}}, wantOrigin: true},
+			{respHeader: fresh, wantOrigin: true},
+		}},
+		{"max-age wins over Expires", []conformanceStep{
+			{respHeader: http.Header{"Cache-Control": {"max-age=3600"}, "Expires": {past}}, wantOrigin: true},
+			{wantCache: "HIT"},
+		}},
+
+		// Storage (RFC 9111 §3)
+		{"no-store is not stored", []conformanceStep{
+			{respHeader: http.Header{"Cache-Control": {"no-store, max-age=3600"}}, wantOrigin: true},
+			{respHeader: fresh, wantOrigin: true},
+		}},
+		{"private is not stored in a shared cache", []conformanceStep{
+			{respHeader: http.Header{"Cache-Control": {"private, max-age=3600"}}, wantOrigin: true},
+			{respHeader: fresh, wantOrigin: true},
+		}},
+		{"request no-store is not stored", []conformanceStep{
+			{reqHeader: http.Header{"Cache-Control": {"no-store"}}, respHeader: fresh, wantOrigin: true},
+			{respHeader: fresh, wantOrigin: true},
+		}},
+		{"Authorization is not stored without public", []conformanceStep{
+			{reqHeader: http.Header{"Authorization": {"Bearer x"}}, respHeader: fresh, wantOrigin: true},
+			{respHeader: fresh, wantOrigin: true},
+		}},
+		{"Authorization is stored with public", []conformanceStep{
+			{reqHeader: http.Header{"Authorization": {"Bearer x"}}, respHeader: http.Header{"Cache-Control": {"public, max-age=3600"}}, wantOrigin: true},
+			{wantCache: "HIT"},
+		}},
+		{"204 is stored heuristically", []conformanceStep{
+			{status: 204, respHeader: http.Header{"Last-Modified": {past}}, wantOrigin: true, wantStatus: 204},
+			{wantStatus: 204, wantCache: "HIT"},
+		}},
+		{"other 2xx needs explicit freshness", []conformanceStep{
+			{status: 299, wantOrigin: true, wantStatus: 299},
+			{status: 299, wantOrigin: true, wantStatus: 299},
+		}},
+		{"404 is left to the origin", []conformanceStep{
+			{status: 404, respHeader: fresh, wantOrigin: true, wantStatus: 404},
+			{status: 404, respHeader: fresh, wantOrigin: true, wantStatus: 404},
+		}},
+		{"500 is not stored", []conformanceStep{
+			{status: 500, respHeader: fresh, wantOrigin: true, wantStatus: 500},
+			{respHeader: fresh, wantOrigin: true},
+		}},
+
+		// Validation (RFC 9111 §4.3)
+		{"client no-cache revalidates with the stored ETag", []conformanceStep{
+			{respHeader: http.Header{"Cache-Control": {"max-age=3600"}, "ETag": {`"v1"`}}, body: "a", wantOrigin: true},
+			{reqHeader: http.Header{"Cache-Control": {"no-cache"}}, status: 304, wantOrigin: true,
+				wantOriginReq: map[string]string{"If-None-Match": `"v1"`}, wantBody: "a"},
+			{wantCache: "HIT", wantBody: "a"},
+		}},
+		{"client max-age=0 revalidates with Last-Modified", []conformanceStep{
+			{respHeader: http.Header{"Cache-Control": {"max-age=3600"}, "Last-Modified": {past}}, body: "a", wantOrigin: true},
+			{reqHeader: http.Header{"Cache-Control": {"max-age=0"}}, status: 304, wantOrigin: true,
+				wantOriginReq: map[string]string{"If-Modified-Since": past}, wantBody: "a"},
+		}},
+		{"changed content replaces the entry", []conformanceStep{
+			{respHeader: http.Header{"Cache-Control": {"max-age=3600"}, "ETag": {`"v1"`}}, body: "a", wantOrigin: true},
+			{reqHeader: http.Header{"Cache-Control": {"no-cache"}}, respHeader: http.Header{"Cache-Control": {"max-age=3600"}, "ETag": {`"v2"`}}, body: "b", wantOrigin: true, wantBody: "b"},
+			{wantCache: "HIT", wantBody: "b", wantHeader: map[string]string{"ETag": `"v2"`}},
+		}},
+		{"304 headers update the entry", []conformanceStep{
+			{respHeader: http.Header{"Cache-Control": {"max-age=3600"}, "ETag": {`"v1"`}, "X-Version": {"1"}}, wantOrigin: true},
+			{reqHeader: http.Header{"Cache-Control": {"no-cache"}}, status: 304, respHeader: http.Header{"X-Version": {"2"}}, wantOrigin: true},
+			{wantCache: "HIT", wantHeader: map[string]string{"X-Version": "2"}},
+		}},
+		{"no-cache is revalidated on every reuse", []conformanceStep{
+			{respHeader: http.Header{"Cache-Control": {"no-cache"}, "ETag": {`"v1"`}}, body: "a", wantOrigin: true},
+			{status: 304, wantOrigin: true, wantOriginReq: map[string]string{"If-None-Match": `"v1"`},
+				wantCache: "REVALIDATED", wantBody: "a"},
+			{status: 304, wantOrigin: true, wantOriginReq: map[string]string{"If-None-Match": `"v1"`},
+				wantCache: "REVALIDATED", wantBody: "a"},
+		}},
+		{"no-cache with max-age=0 is stored", []conformanceStep{
+			{respHeader: http.Header{"Cache-Control": {"no-cache, max-age=0"}, "Last-Modified": {past}}, body: "a", wantOrigin: true},
+			{status: 304, wantOrigin: true, wantOriginReq: map[string]string{"If-Modified-Since": past}, wantBody: "a"},
+		}},
+		{"no-cache without a validator is not stored", []conformanceStep{
+			{respHeader: http.Header{"Cache-Control": {"no-cache"}}, wantOrigin: true},
+			{respHeader: http.Header{"Cache-Control": {"no-cache"}}, wantOrigin: true},
+		}},
+		{"no-cache is not served when revalidation fails", []conformanceStep{
+			{respHeader: http.Header{"Cache-Control": {"no-cache"}, "ETag": {`"v1"`}}, body: "a", wantOrigin: true},
+			{status: 500, body: "down", wantOrigin: true, wantStatus: 500, wantBody: "down"},
+		}},
+		{"matching If-None-Match is answered 304 from the cache", []conformanceStep{
+			{respHeader: http.Header{"Cache-Control": {"max-age=3600"}, "ETag": {`"v1"`}}, wantOrigin: true},
+			{reqHeader: http.Header{"If-None-Match": {`W/"v1"`}}, wantStatus: 304, wantCache: "HIT"},
+		}},
+		{"other If-None-Match gets the full response", []conformanceStep{
+			{respHeader: http.Header{"Cache-Control": {"max-age=3600"}, "ETag": {`"v1"`}}, body: "a", wantOrigin: true},
+			{reqHeader: http.Header{"If-None-Match": {`"v0"`}}, wantCache: "HIT", wantBody: "a"},
+		}},
+
+		// Vary (RFC 9111 §4.1)
+		{"Vary matches the same header value", []conformanceStep{
+			{reqHeader: http.Header{"Accept-Language": {"en"}}, respHeader: http.Header{"Cache-Control": {"max-age=3600"}, "Vary": {"Accept-Language"}}, body: "en", wantOrigin: true},
+			{reqHeader: http.Header{"Accept-Language": {"en"}}, wantCache: "HIT", wantBody: "en"},
+		}},
+		{"Vary keeps other header values apart", []conformanceStep{
+			{reqHeader: http.Header{"Accept-Language": {"en"}}, respHeader: http.Header{"Cache-Control": {"max-age=3600"}, "Vary": {"Accept-Language"}}, body: "en", wantOrigin: true},
+			{reqHeader: http.Header{"Accept-Language": {"de"}}, respHeader: http.Header{"Cache-Control": {"max-age=3600"}, "Vary": {"Accept-Language"}}, body: "de", wantOrigin: true, wantBody: "de"},
+			{reqHeader: http.Header{"Accept-Language": {"en"}}, wantCache: "HIT", wantBody: "en"},
+		}},
+		{"Vary treats an absent header as a value", []conformanceStep{
+			{reqHeader: http.Header{"Accept-Language": {"en"}}, respHeader: http.Header{"Cache-Control": {"max-age=3600"}, "Vary": {"Accept-Language"}}, wantOrigin: true},
+			{respHeader: http.Header{"Cache-Control": {"max-age=3600"}, "Vary": {"Accept-Language"}}, wantOrigin: true},
+			{wantCache: "HIT"},
+		}},
+		{"Vary whitespace is normalized", []conformanceStep{
+			{reqHeader: http.Header{"Accept-Language": {"en, de"}}, respHeader: http.Header{"Cache-Control": {"max-age=3600"}, "Vary": {"accept-language"}}, wantOrigin: true},
+			{reqHeader: http.Header{"Accept-Language": {"en,de"}}, wantCache: "HIT"},
+		}},
+		{"Vary: * is not stored", []conformanceStep{
+			{respHeader: http.Header{"Cache-Control": {"max-age=3600"}, "Vary": {"*"}}, wantOrigin: true},
+			{respHeader: fresh, wantOrigin: true},
+		}},
+
+		// Headers (RFC 9111 §5.1, RFC 9110 §7.6.3)
+		{"hits carry Age and Via", []conformanceStep{
+			{respHeader: http.Header{"Cache-Control": {"max-age=3600"}, "Age": {"30"}}, wantOrigin: true,
+				wantOriginReq: map[string]string{"Via": "1.1 caching-proxy"}},
+			{wantCache: "HIT", wantHeader: map[string]string{"Age": "30"}},
+		}},
+		{"hop-by-hop headers are not replayed", []conformanceStep{
+			{respHeader: http.Header{"Cache-Control": {"max-age=3600"}, "Keep-Alive": {"timeout=5"}}, wantOrigin: true},
+			{wantCache: "HIT", wantHeader: map[string]string{"Keep-Alive": ""}},
+		}},
+	}
+
+	strictHTTP = true
+	defer func() { strictHTTP = false }()
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var step conformanceStep
+			var originReq *http.Request
+			srv := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				originReq = r
+				for k, vv := range step.respHeader {
+					w.Header()[k] = vv
+				}
+				w.WriteHeader(cmp.Or(step.status, http.StatusOK))
+				io.WriteString(w, step.body)
+			}))
+			target := fmt.Sprintf("%s/conformance/%d", srv.URL, i)
+			for n, s := range tt.steps {
+				step, originReq = s, nil
+				req, _ := http.NewRequest(http.MethodGet, target, nil)
+				for k, vv := range s.reqHeader {
+					req.Header[k] = vv
+				}
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+
+				if reached := originReq != nil; reached != s.wantOrigin {
+					t.Errorf("step %d: reached the origin = %v, want %v", n+1, reached, s.wantOrigin)
+				}
+				for k, want := range s.wantOriginReq {
+					if originReq != nil && !strings.Contains(originReq.Header.Get(k), want) {
+						t.Errorf("step %d: origin request %s = %q, want %q", n+1, k, originReq.Header.Get(k), want)
+					}
+				}
+				if want := cmp.Or(s.wantStatus, http.StatusOK); resp.StatusCode != want {
+					t.Errorf("step %d: status %d, want %d", n+1, resp.StatusCode, want)
+				}
+				if s.wantCache != "" && resp.Header.Get("X-Cache") != s.wantCache {
+					t.Errorf("step %d: X-Cache %q, want %q", n+1, resp.Header.Get("X-Cache"), s.wantCache)
+				}
+				if s.wantBody != "" && string(body) != s.wantBody {
+					t.Errorf("step %d: body %q, want %q", n+1, body, s.wantBody)
+				}
+				for k, want := range s.wantHeader {
+					if got := resp.Header.Get(k); got != want {
+						t.Errorf("step %d: %s = %q, want %q", n+1, k, got, want)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// syntheticCheck periodically requests one URL through the proxy's own
+// handler, exactly like a client would, and records the outcome.
+type syntheticCheck struct {
+	url *url.URL
+
+	mu           sync.Mutex
+	runs         int64
+	failures     int64
+	latencyTotal time.Duration
+	last         syntheticResult
+}
+
+// syntheticResult is the outcome of one check run.
+type syntheticResult struct {
+	Time      time.Time `json:"time"`
+	Status    int       `json:"status"`
+	Cache     string    `json:"cache,omitempty"`
+	LatencyMs float64   `json:"latency_ms"`
+	Bytes     int64     `json:"bytes"`
+	Up        bool      `json:"up"`
+	Error     string    `json:"error,omitempty"`
+}
+
+var (
+	syntheticChecks   []*syntheticCheck
+	syntheticInterval time.Duration
+	syntheticTimeout  time.Duration
+)
+
+// syntheticWriter records the status, X-Cache outcome and size of a check.
+type syntheticWriter struct {
+	header http.Header
+	status int
+	bytes  int64
+}
+
+func (w *syntheticWriter) Header() http.Header { return w.header }
+func (w *syntheticWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.bytes += int64(len(p))
+	return len(p), nil
+}
+func (w *syntheticWriter) WriteHeader(status int) {
+	if w.status == 0 && status >= 200 {
+		w.status = status
+	}
+}
+
+func newSyntheticCheck(raw string) (*syntheticCheck, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	return &syntheticCheck{url: u}, nil
+}
+
+// run performs one check. The check counts as up when the proxy answered
+// with a status below 400 before the timeout.
+func (c *syntheticCheck) run(h http.Handler) syntheticResult {
+	ctx, cancel := context.WithTimeout(context.Background(), syntheticTimeout)
+	defer cancel()
+	res := syntheticResult{Time: time.Now()}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url.RequestURI(), nil)
+	if err != nil {
+		res.Error = err.Error()
+		return c.record(res)
+	}
+	req.Host = c.url.Host
+	req.RemoteAddr = "127.0.0.1:0"
+	req.Header.Set("User-Agent", "caching-proxy-synthetic")
+
+	w := &syntheticWriter{header: http.Header{}}
+	func() {
+		// A broken origin stream aborts the handler, like for a client
+		defer func() {
+			if p := recover(); p != nil {
+				res.Error = "response aborted"
+			}
+		}()
+		h.ServeHTTP(w, req)
+	}()
+	res.LatencyMs = float64(time.Since(res.Time).Microseconds()) / 1000
+	res.Status, res.Cache, res.Bytes = w.status, w.header.Get("X-Cache"), w.bytes
+	if ctx.Err() != nil && res.Error == "" {
+		res.Error = "timed out after " + syntheticTimeout.String()
+	}
+	res.Up = res.Error == "" && res.Status > 0 && res.Status < 400
+	return c.record(res)
+}
+
+func (c *syntheticCheck) record(res syntheticResult) syntheticResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.runs++
+	if !res.Up {
+		c.failures++
+		reason := res.Error
+		if reason == "" {
+			reason = http.StatusText(res.Status)
+		}
+		logf("warn", "[Synthetic] Check of %s failed (status %d): %s", c.url, res.Status, reason)
+	}
+	c.latencyTotal += time.Duration(res.LatencyMs * float64(time.Millisecond))
+	c.last = res
+	return res
+}
+
+// runSyntheticChecks runs every check each syntheticInterval.
+func runSyntheticChecks(h http.Handler) {
+	log.Printf("[Synthetic] Checking %d URLs every %s", len(syntheticChecks), syntheticInterval)
+	for {
+		for _, c := range syntheticChecks {
+			c.run(h)
+		}
+		time.Sleep(syntheticInterval)
+	}
+}
+
+// syntheticHandler reports the availability, latency and last outcome of
+// every synthetic check.
+func syntheticHandler(w http.ResponseWriter, r *http.Request) {
+	list := make([]map[string]any, 0, len(syntheticChecks))
+	for _, c := range syntheticChecks {
+		c.mu.Lock()
+		availability, avgLatency := 0.0, 0.0
+		if c.runs > 0 {
+			availability = float64(c.runs-c.failures) / float64(c.runs)
+			avgLatency = float64(c.latencyTotal.Microseconds()) / 1000 / float64(c.runs)
+		}
+		list = append(list, map[string]any{
+			"url": c.url.String(), "runs": c.runs, "failures": c.failures,
+			"availability": availability, "avg_latency_ms": avgLatency, "last": c.last,
+		})
+		c.mu.Unlock()
+	}
+	writeJSON(w, http.StatusOK, list)
+}
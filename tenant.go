@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tenant holds the limits of one --host-origin host, so one tenant cannot
+// consume the whole proxy: a request rate, an egress bandwidth shared by all
+// of its connections, and a share of the cache.
+type tenant struct {
+	host string
+
+	// Requests per second, with a burst of that many; 0 is unlimited.
+	rate, burst float64
+	mu          sync.Mutex
+	tokens      float64
+	refilled    time.Time
+
+	// Bytes per second across all of the tenant's responses; 0 is
+	// unlimited. sendAt is when the bandwidth already handed out is used up.
+	bandwidth int64
+	sendMu    sync.Mutex
+	sendAt    time.Time
+
+	// pool holds the tenant's entries when its cache share is limited.
+	pool *cachePool
+
+	requests, limited, bytes atomic.Int64
+}
+
+// tenants maps lowercase hosts to their limits.
+var tenants = map[string]*tenant{}
+
+// tenantFor returns the tenant named by host, ignoring any port.
+func tenantFor(host string) *tenant {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return tenants[strings.ToLower(host)]
+}
+
+// addTenantLimit parses HOST=VALUE for a --tenant-* flag and applies it with
+// set, creating the host's tenant on first use. Only hosts with their own
+// origin are tenants.
+func addTenantLimit(spec string, set func(*tenant, string) error) error {
+	host, value, ok := strings.Cut(spec, "=")
+	host = strings.ToLower(strings.TrimSpace(host))
+	if !ok || host == "" || value == "" {
+		return fmt.Errorf("invalid tenant limit %q (want HOST=VALUE)", spec)
+	}
+	if _, ok := origins.hosts[host]; !ok {
+		return fmt.Errorf("%q is not a --host-origin host", host)
+	}
+	t, ok := tenants[host]
+	if !ok {
+		t = &tenant{host: host}
+		tenants[host] = t
+	}
+	if err := set(t, value); err != nil {
+		return fmt.Errorf("host %q: %w", host, err)
+	}
+	return nil
+}
+
+// setRate parses RATE[:BURST] requests per second.
+func (t *tenant) setRate(value string) error {
+	rateSpec, burstSpec, hasBurst := strings.Cut(value, ":")
+	rate, err := strconv.ParseFloat(rateSpec, 64)
+	if err != nil || rate <= 0 {
+		return fmt.Errorf("request rate %q must be a positive number per second", rateSpec)
+	}
+	burst := max(rate, 1)
+	if hasBurst {
+		if burst, err = strconv.ParseFloat(burstSpec, 64); err != nil || burst < 1 {
+			return fmt.Errorf("burst %q must be at least 1", burstSpec)
+		}
+	}
+	t.rate, t.burst, t.tokens = rate, burst, burst
+	return nil
+}
+
+func (t *tenant) setBandwidth(value string) error {
+	rate, err := parseByteSize(value)
+	if err != nil || rate <= 0 {
+		return fmt.Errorf("bandwidth %q must be a positive size per second", value)
+	}
+	t.bandwidth = rate
+	return nil
+}
+
+// setCacheShare gives the tenant a pool of at most value bytes, evicting its
+// least recently used entries.
+func (t *tenant) setCacheShare(value string) error {
+	size, err := parseByteSize(value)
+	if err != nil || size <= 0 {
+		return fmt.Errorf("cache share %q must be a positive size", value)
+	}
+	t.pool = &cachePool{name: "tenant:" + t.host, maxBytes: size, policy: newLRUPolicy()}
+	cachePools = append(cachePools, t.pool)
+	return nil
+}
+
+// allow takes a token from the tenant's request bucket.
+func (t *tenant) allow() bool {
+	if t.rate == 0 {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	t.tokens = min(t.burst, t.tokens+now.Sub(t.refilled).Seconds()*t.rate)
+	t.refilled = now
+	if t.tokens < 1 {
+		return false
+	}
+	t.tokens--
+	return true
+}
+
+// reserve hands out n bytes of the tenant's bandwidth and returns how long to
+// wait before sending them.
+func (t *tenant) reserve(n int) time.Duration {
+	t.sendMu.Lock()
+	defer t.sendMu.Unlock()
+	now := time.Now()
+	if t.sendAt.Before(now) {
+		t.sendAt = now
+	}
+	wait := t.sendAt.Sub(now)
+	t.sendAt = t.sendAt.Add(time.Duration(float64(n) / float64(t.bandwidth) * float64(time.Second)))
+	return wait
+}
+
+// tenantPoolFor returns the pool of the tenant key belongs to, if its cache
+// share is limited.
+func tenantPoolFor(key string) *cachePool {
+	if len(tenants) == 0 {
+		return nil
+	}
+	if t := tenantFor(cacheKeyHost(key)); t != nil {
+		return t.pool
+	}
+	return nil
+}
+
+// tenantWriter counts the body bytes sent for a tenant and paces them to its
+// bandwidth. Responses served from the cache are counted but not paced, so a
+// tenant's miss traffic never holds up its hits.
+type tenantWriter struct {
+	http.ResponseWriter
+	r *http.Request
+	t *tenant
+}
+
+// fromCache reports whether the response is being served from the cache.
+func (w *tenantWriter) fromCache() bool {
+	switch w.Header().Get("X-Cache") {
+	case "HIT", "STALE":
+		return true
+	}
+	return false
+}
+
+func (w *tenantWriter) Write(p []byte) (int, error) {
+	if w.t.bandwidth == 0 || w.fromCache() {
+		n, err := w.ResponseWriter.Write(p)
+		w.t.bytes.Add(int64(n))
+		return n, err
+	}
+	written := 0
+	step := paceStep(w.t.bandwidth)
+	for len(p) > 0 {
+		chunk := p[:min(step, len(p))]
+		if wait := w.t.reserve(len(chunk)); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-w.r.Context().Done():
+				timer.Stop()
+				return written, w.r.Context().Err()
+			case <-timer.C:
+			}
+		}
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		w.t.bytes.Add(int64(n))
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (w *tenantWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *tenantWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// withTenantLimits answers 429 to tenants over their request rate and paces
+// the origin responses of the others to their bandwidth.
+func withTenantLimits(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := tenantFor(r.Host)
+		if t == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		t.requests.Add(1)
+		if !t.allow() {
+			t.limited.Add(1)
+			routineLog.printf("[Tenant] Host '%s' is over its request rate, rejecting %s", t.host, r.URL.String())
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(&tenantWriter{ResponseWriter: w, r: r, t: t}, r)
+	})
+}
+
+// tenantStats reports each tenant's usage for /__admin/stats.
+func tenantStats() map[string]any {
+	out := map[string]any{}
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	for h, t := range tenants {
+		usage := map[string]any{
+			"requests":     t.requests.Load(),
+			"rate_limited": t.limited.Load(),
+			"bytes_sent":   t.bytes.Load(),
+		}
+		if t.pool != nil {
+			usage["cache_bytes"] = t.pool.bytes
+			usage["cache_max_bytes"] = t.pool.maxBytes
+			usage["cache_entries"] = t.pool.entries
+			usage["cache_evictions"] = t.pool.evictions
+		}
+		out[h] = usage
+	}
+	return out
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// clientClass groups clients by source network so they can get their own
+// bandwidth limits, e.g. internal mirrors versus the public.
+type clientClass struct {
+	name string
+	nets []*net.IPNet
+}
+
+// bandwidthLimit caps the per-connection egress rate of matching responses.
+type bandwidthLimit struct {
+	pattern pathPattern
+	class   *clientClass // nil matches every client
+	rate    int64        // bytes per second
+}
+
+var (
+	clientClasses   []*clientClass
+	bandwidthLimits []bandwidthLimit
+)
+
+// parseClientClass parses NAME=CIDR,..., e.g. "internal=10.0.0.0/8,192.168.0.0/16".
+func parseClientClass(spec string) (*clientClass, error) {
+	name, list, ok := strings.Cut(spec, "=")
+	if !ok || name == "" || list == "" {
+		return nil, fmt.Errorf("invalid client class %q (want NAME=CIDR,...)", spec)
+	}
+	c := &clientClass{name: name}
+	for _, cidr := range strings.Split(list, ",") {
+		_, n, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("client class %q: %w", name, err)
+		}
+		c.nets = append(c.nets, n)
+	}
+	return c, nil
+}
+
+func (c *clientClass) contains(ip net.IP) bool {
+	for _, n := range c.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseBandwidthLimit parses PATTERN=RATE[:CLASS], e.g. "/downloads/*=5MB".
+func parseBandwidthLimit(spec string) (bandwidthLimit, error) {
+	pattern, rest, ok := strings.Cut(spec, "=")
+	if !ok {
+		return bandwidthLimit{}, fmt.Errorf("invalid bandwidth limit %q (want PATTERN=RATE[:CLASS])", spec)
+	}
+	p, err := parsePathPattern(pattern)
+	if err != nil {
+		return bandwidthLimit{}, err
+	}
+	rateSpec, className, _ := strings.Cut(rest, ":")
+	rate, err := parseByteSize(rateSpec)
+	if err != nil || rate <= 0 {
+		return bandwidthLimit{}, fmt.Errorf("bandwidth limit %q needs a positive rate", spec)
+	}
+	limit := bandwidthLimit{pattern: p, rate: rate}
+	if className != "" {
+		for _, c := range clientClasses {
+			if c.name == className {
+				limit.class = c
+			}
+		}
+		if limit.class == nil {
+			return bandwidthLimit{}, fmt.Errorf("bandwidth limit %q refers to unknown client class %q", spec, className)
+		}
+	}
+	return limit, nil
+}
+
+// bandwidthFor returns the rate limit of the first rule matching the request,
+// or 0 if it is unlimited.
+func bandwidthFor(r *http.Request) int64 {
+	ip := net.ParseIP(clientIP(r))
+	for _, l := range bandwidthLimits {
+		if l.pattern.match(r.URL.Path) && (l.class == nil || (ip != nil && l.class.contains(ip))) {
+			return l.rate
+		}
+	}
+	return 0
+}
+
+// pace waits until sending sent bytes since start no longer exceeds rate.
+func pace(ctx context.Context, start time.Time, sent, rate int64) error {
+	due := start.Add(time.Duration(float64(sent) / float64(rate) * float64(time.Second)))
+	wait := time.Until(due)
+	if wait <= 0 {
+		return nil
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// paceStep is how much is written between pauses at a given rate: about
+// 100ms worth, so the limit holds for small bodies too.
+func paceStep(rate int64) int {
+	return int(max(min(rate/10, streamChunk), 1<<10))
+}
+
+// throttledWriter paces the body written through it to rate.
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx   context.Context
+	rate  int64
+	start time.Time
+	sent  int64
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	if w.start.IsZero() {
+		w.start = time.Now()
+	}
+	written := 0
+	step := paceStep(w.rate)
+	for len(p) > 0 {
+		if err := pace(w.ctx, w.start, w.sent, w.rate); err != nil {
+			return written, err
+		}
+		n, err := w.ResponseWriter.Write(p[:min(step, len(p))])
+		written += n
+		w.sent += int64(n)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (w *throttledWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *throttledWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// withThrottle applies the configured bandwidth limits to hits and misses
+// alike, so big downloads don't starve latency-sensitive API traffic.
+func withThrottle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rate := bandwidthFor(r); rate > 0 {
+			w = &throttledWriter{ResponseWriter: w, ctx: r.Context(), rate: rate}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
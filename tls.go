@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// listenerCert holds the certificate the proxy listener presents. It is
+// re-read from its files on SIGHUP, so renewed certificates are picked up
+// without dropping connections.
+type listenerCert struct {
+	certFile, keyFile string
+	cert              atomic.Pointer[tls.Certificate]
+}
+
+func loadListenerCert(certFile, keyFile string) (*listenerCert, error) {
+	lc := &listenerCert{certFile: certFile, keyFile: keyFile}
+	if err := lc.load(); err != nil {
+		return nil, err
+	}
+	return lc, nil
+}
+
+// loadKeyPair is tls.LoadX509KeyPair with the leaf certificate parsed.
+func loadKeyPair(certFile, keyFile string) (tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err == nil {
+		err = parseLeaf(&cert)
+	}
+	return cert, err
+}
+
+func parseLeaf(cert *tls.Certificate) error {
+	if cert.Leaf != nil {
+		return nil
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	cert.Leaf = leaf
+	return err
+}
+
+func (lc *listenerCert) load() error {
+	cert, err := loadKeyPair(lc.certFile, lc.keyFile)
+	if err != nil {
+		return err
+	}
+	lc.cert.Store(&cert)
+	log.Printf("[TLS] Serving certificate for %v, valid until %s", cert.Leaf.DNSNames, cert.Leaf.NotAfter.Format("2006-01-02"))
+	return nil
+}
+
+func (lc *listenerCert) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return lc.cert.Load(), nil
+}
+
+// watchSignals re-reads the certificate on every SIGHUP, keeping the current
+// one when the files are invalid.
+func (lc *listenerCert) watchSignals() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		if err := lc.load(); err != nil {
+			logf("error", "[TLS] Could not reload %s, keeping the current certificate: %v", lc.certFile, err)
+		}
+	}
+}
+
+// tlsConfig returns the listener configuration. HTTP/2 is negotiated by the
+// server.
+func (lc *listenerCert) tlsConfig() *tls.Config {
+	return &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: lc.getCertificate}
+}
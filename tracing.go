@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	mathrand "math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tracer is the OTLP span exporter, nil unless --otlp-endpoint is set.
+var tracer *spanExporter
+
+// Span kinds and status codes of the OTLP data model.
+const (
+	spanKindServer = 2
+	spanKindClient = 3
+	spanStatusErr  = 2
+)
+
+// Batching limits of the span exporter.
+const (
+	spanQueueSize   = 4096
+	spanBatchSize   = 512
+	spanFlushPeriod = 5 * time.Second
+)
+
+// traceSpan is one span of a trace. Attributes may be set from any request
+// goroutine until the span ends; the nil span ignores everything, so callers
+// need not check whether the request is traced.
+type traceSpan struct {
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte
+	name    string
+	kind    int
+	start   time.Time
+
+	mu        sync.Mutex
+	attrs     map[string]any
+	errorText string
+}
+
+func newSpanID() (id [8]byte) {
+	rand.Read(id[:])
+	return id
+}
+
+// startServerSpan starts the span for an incoming request, continuing the
+// caller's trace when it sends a W3C traceparent header. Requests of traces
+// the caller did not sample, or outside --trace-sample, are not traced.
+func startServerSpan(r *http.Request) *traceSpan {
+	if tracer == nil {
+		return nil
+	}
+	s := &traceSpan{name: r.Method, kind: spanKindServer, start: time.Now(), spanID: newSpanID(), attrs: map[string]any{}}
+	if traceID, parent, sampled, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		if !sampled {
+			return nil
+		}
+		s.traceID, s.parent = traceID, parent
+	} else {
+		if mathrand.Float64() >= tracer.sample {
+			return nil
+		}
+		rand.Read(s.traceID[:])
+	}
+	s.set("http.request.method", r.Method)
+	s.set("url.path", r.URL.Path)
+	s.set("client.address", clientIP(r))
+	return s
+}
+
+// child starts a span within s, or returns nil when s is not traced.
+func (s *traceSpan) child(name string, kind int) *traceSpan {
+	if s == nil {
+		return nil
+	}
+	return &traceSpan{traceID: s.traceID, parent: s.spanID, spanID: newSpanID(), name: name, kind: kind, start: time.Now(), attrs: map[string]any{}}
+}
+
+func (s *traceSpan) set(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs[key] = value
+	s.mu.Unlock()
+}
+
+func (s *traceSpan) fail(text string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.errorText = text
+	s.mu.Unlock()
+}
+
+// end completes the span and queues it for export.
+func (s *traceSpan) end() {
+	if s == nil {
+		return
+	}
+	tracer.export(s, time.Now())
+}
+
+// finishRequest tags the server span with the outcome of the request and
+// ends it.
+func (s *traceSpan) finishRequest(e *requestLogEvent) {
+	if s == nil {
+		return
+	}
+	s.set("http.response.status_code", e.Status)
+	s.set("http.response.body.size", e.Bytes)
+	if e.Cache != "" {
+		s.set("cache.status", e.Cache)
+	}
+	switch {
+	case e.Error != "":
+		s.set("error.type", e.Error)
+		s.fail(e.Error)
+	case e.Status >= 500:
+		s.fail(strconv.Itoa(e.Status))
+	}
+	s.end()
+}
+
+// traceparent formats the header that propagates s to the next hop.
+func (s *traceSpan) traceparent() string {
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-01"
+}
+
+// parseTraceparent parses a W3C traceparent header, e.g.
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+func parseTraceparent(h string) (traceID [16]byte, parent [8]byte, sampled, ok bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, parent, false, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return traceID, parent, false, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return traceID, parent, false, false
+	}
+	if _, err := hex.Decode(parent[:], []byte(parts[2])); err != nil || parent == [8]byte{} {
+		return traceID, parent, false, false
+	}
+	return traceID, parent, flags[0]&1 == 1, true
+}
+
+func withSpan(r *http.Request, s *traceSpan) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), traceSpanKey, s))
+}
+
+func spanFrom(r *http.Request) *traceSpan {
+	s, _ := r.Context().Value(traceSpanKey).(*traceSpan)
+	return s
+}
+
+// tracingTransport records a client span for each origin fetch of a traced
+// request and propagates the trace to the origin.
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	span := spanFrom(req).child("origin "+req.Method, spanKindClient)
+	if span == nil {
+		return t.base.RoundTrip(req)
+	}
+	span.set("http.request.method", req.Method)
+	span.set("server.address", req.URL.Host)
+	span.set("url.full", req.URL.String())
+	if st := requestStateFrom(req); st != nil {
+		span.set("cache.key", st.cacheKey)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("traceparent", span.traceparent())
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		span.fail(err.Error())
+	} else {
+		span.set("http.response.status_code", resp.StatusCode)
+		if resp.ContentLength >= 0 {
+			span.set("http.response.body.size", resp.ContentLength)
+		}
+		if resp.StatusCode >= 500 {
+			span.fail(resp.Status)
+		}
+	}
+	span.end()
+	return resp, err
+}
+
+// spanExporter batches ended spans and posts them to an OTLP/HTTP collector
+// as JSON. Spans are dropped rather than slowing requests down when the
+// collector falls behind.
+type spanExporter struct {
+	endpoint string
+	service  string
+	sample   float64
+	client   *http.Client
+	queue    chan otlpSpan
+	dropped  atomic.Int64
+}
+
+func newSpanExporter(endpoint, service string, sample float64) (*spanExporter, error) {
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		return nil, fmt.Errorf("endpoint %q must be an http or https URL", endpoint)
+	}
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+	return &spanExporter{
+		endpoint: endpoint,
+		service:  service,
+		sample:   sample,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan otlpSpan, spanQueueSize),
+	}, nil
+}
+
+// The OTLP/JSON encoding of spans. IDs are hex, and 64-bit integers are strings.
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func otlpValue(v any) map[string]any {
+	switch v := v.(type) {
+	case int:
+		return map[string]any{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]any{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+		return map[string]any{"doubleValue": v}
+	case bool:
+		return map[string]any{"boolValue": v}
+	default:
+		return map[string]any{"stringValue": fmt.Sprint(v)}
+	}
+}
+
+func (x *spanExporter) export(s *traceSpan, end time.Time) {
+	s.mu.Lock()
+	out := otlpSpan{
+		TraceID: hex.EncodeToString(s.traceID[:]),
+		SpanID:  hex.EncodeToString(s.spanID[:]),
+		Name:    s.name,
+		Kind:    s.kind,
+		Start:   strconv.FormatInt(s.start.UnixNano(), 10),
+		End:     strconv.FormatInt(end.UnixNano(), 10),
+	}
+	if s.parent != [8]byte{} {
+		out.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	for k, v := range s.attrs {
+		out.Attributes = append(out.Attributes, otlpAttribute{Key: k, Value: otlpValue(v)})
+	}
+	if s.errorText != "" {
+		out.Status = &otlpStatus{Code: spanStatusErr, Message: s.errorText}
+	}
+	s.mu.Unlock()
+
+	select {
+	case x.queue <- out:
+	default:
+		x.dropped.Add(1)
+	}
+}
+
+// run sends queued spans in batches until the process exits.
+func (x *spanExporter) run() {
+	ticker := time.NewTicker(spanFlushPeriod)
+	defer ticker.Stop()
+	var batch []otlpSpan
+	for {
+		select {
+		case s := <-x.queue:
+			if batch = append(batch, s); len(batch) < spanBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := x.send(batch); err != nil {
+			logf("warn", "[Tracing] Failed to export %d spans to %s: %v", len(batch), x.endpoint, err)
+		}
+		batch = nil
+	}
+}
+
+func (x *spanExporter) send(spans []otlpSpan) error {
+	payload := map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": []otlpAttribute{
+				{Key: "service.name", Value: otlpValue(x.service)},
+			}},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "caching-proxy"},
+				"spans": spans,
+			}},
+		}},
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := x.client.Post(x.endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+package main
+
+import "net/http"
+
+// servesRepresentation reports whether a status carries a full
+// representation that validators and 304 answers apply to.
+func servesRepresentation(status int) bool {
+	return status == http.StatusOK || status == http.StatusNonAuthoritativeInfo
+}
+
+// mayTransform reports whether the proxy may change a response's content
+// coding, which origins forbid with no-transform. The proxy rewrites no
+// bodies, so nothing it sends is marked as transformed.
+func mayTransform(h http.Header) bool {
+	return !parseCacheControl(h).has("no-transform")
+}
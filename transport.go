@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// originTransportConfig holds the settings of the connections made to origins.
+type originTransportConfig struct {
+	expectContinueTimeout time.Duration
+	// bindAddr is the local IP address or interface name origin connections
+	// are made from.
+	bindAddr string
+	// ipPreference is "ipv4", "ipv6" or empty to follow the resolver's order.
+	ipPreference string
+	// dualStack races the other address family after fallbackDelay (Happy
+	// Eyeballs). Without it only the preferred family is dialed, or, with no
+	// preference, addresses are tried one after another.
+	dualStack     bool
+	fallbackDelay time.Duration
+	// prewarm is how many idle connections are kept open to each backend.
+	prewarm int
+	// addresses restricts which IP addresses may be dialed.
+	addresses *addressPolicy
+	// serverNames overrides the TLS server name by dial address.
+	serverNames map[string]string
+	// caFile holds CA certificates trusted for origins besides the system
+	// roots.
+	caFile string
+	// insecureSkipVerify disables verification of origin certificates.
+	insecureSkipVerify bool
+}
+
+// tlsSessionCacheSize bounds the TLS sessions kept for resumption, shared by
+// all origins.
+const tlsSessionCacheSize = 256
+
+// prewarmInterval is how often warm connections are topped up; it is well
+// below the transport's idle timeout so they never expire.
+const prewarmInterval = 30 * time.Second
+
+// newOriginTransport builds the base transport for origin traffic on top of
+// http.DefaultTransport's pooling and timeout defaults.
+func newOriginTransport(cfg originTransportConfig) (*http.Transport, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	// Uploads carrying "Expect: 100-continue" are held back until the origin
+	// answers with 100 Continue, which the client then receives when the body
+	// is first read, or until this timeout for origins that ignore Expect.
+	// Origins that reject the upload outright answer the client without the
+	// body ever being sent.
+	t.ExpectContinueTimeout = cfg.expectContinueTimeout
+	// Resume TLS sessions so reconnecting to an origin skips the full handshake
+	t.TLSClientConfig = &tls.Config{ClientSessionCache: tls.NewLRUClientSessionCache(tlsSessionCacheSize)}
+	if cfg.caFile != "" {
+		pool, err := loadCertPool(cfg.caFile)
+		if err != nil {
+			return nil, err
+		}
+		t.TLSClientConfig.RootCAs = pool
+	}
+	if cfg.insecureSkipVerify {
+		logf("warn", "Origin certificates are NOT verified (--origin-insecure-skip-verify): origin connections can be intercepted")
+		t.TLSClientConfig.InsecureSkipVerify = true
+	}
+	t.MaxIdleConnsPerHost = max(t.MaxIdleConnsPerHost, http.DefaultMaxIdleConnsPerHost, cfg.prewarm)
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if cfg.bindAddr != "" {
+		ip, err := resolveBindAddr(cfg.bindAddr)
+		if err != nil {
+			return nil, err
+		}
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+		log.Printf("Origin connections bound to local address %s", ip)
+	}
+	if cfg.addresses != nil {
+		dialer.Control = cfg.addresses.control
+	}
+	dialer.FallbackDelay = cfg.fallbackDelay
+	if !cfg.dualStack {
+		dialer.FallbackDelay = -1
+	}
+	switch cfg.ipPreference {
+	case "":
+		t.DialContext = dialer.DialContext
+	case "ipv4":
+		t.DialContext = preferFamilyDialer(dialer, "tcp4", "tcp6", cfg)
+	case "ipv6":
+		t.DialContext = preferFamilyDialer(dialer, "tcp6", "tcp4", cfg)
+	default:
+		return nil, fmt.Errorf("unknown IP preference %q (want ipv4 or ipv6)", cfg.ipPreference)
+	}
+	if len(cfg.serverNames) > 0 {
+		t.DialTLSContext = serverNameDialer(t, cfg.serverNames)
+	}
+	return t, nil
+}
+
+// prewarmOrigins keeps n idle connections open to every backend by issuing n
+// concurrent HEAD requests for "/", so cold-path misses to far-away origins do
+// not pay for a TCP and TLS handshake.
+func prewarmOrigins(t *http.Transport, pool *originPool, n int) {
+	client := &http.Client{Transport: t, Timeout: prewarmInterval}
+	for {
+		for _, b := range pool.allBackends() {
+			if !b.available() {
+				continue
+			}
+			var wg sync.WaitGroup
+			for range n {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					resp, err := client.Head(b.url.String())
+					if err != nil {
+						logf("warn", "[Prewarm] Failed to warm connection to %s: %v", b.url, err)
+						return
+					}
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}()
+			}
+			wg.Wait()
+		}
+		time.Sleep(prewarmInterval)
+	}
+}
+
+// loadCertPool returns the system roots plus the certificates in the PEM
+// file at path.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no PEM certificates found", path)
+	}
+	return pool, nil
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// serverNameDialer makes TLS connections with the server name configured for
+// their address, or the address's host. The rest of the TLS settings are the
+// transport's, read at dial time.
+func serverNameDialer(t *http.Transport, names map[string]string) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := t.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		cfg := t.TLSClientConfig.Clone()
+		if cfg.ServerName = names[addr]; cfg.ServerName == "" {
+			cfg.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
+
+// preferFamilyDialer dials the preferred address family first. Origins with
+// broken AAAA (or A) records then cost at most the fallback delay instead of a
+// full connect timeout.
+func preferFamilyDialer(d *net.Dialer, primary, fallback string, cfg originTransportConfig) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if network != "tcp" {
+			return d.DialContext(ctx, network, addr)
+		}
+		if !cfg.dualStack {
+			return d.DialContext(ctx, primary, addr)
+		}
+		return dialRace(ctx, d, primary, fallback, addr, cfg.fallbackDelay)
+	}
+}
+
+// dialRace starts dialing the fallback network once the primary one has
+// failed or has not connected within delay, and returns the first connection
+// established.
+func dialRace(ctx context.Context, d *net.Dialer, primary, fallback, addr string, delay time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	results := make(chan result, 2)
+	dial := func(network string, isPrimary bool) {
+		conn, err := d.DialContext(ctx, network, addr)
+		results <- result{conn, err, isPrimary}
+	}
+	go dial(primary, true)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	pending, fallbackStarted := 1, false
+	startFallback := func() {
+		if !fallbackStarted {
+			fallbackStarted = true
+			pending++
+			go dial(fallback, false)
+		}
+	}
+	var primaryErr, fallbackErr error
+	for {
+		select {
+		case <-timer.C:
+			startFallback()
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				if pending > 0 {
+					// Close the loser if it connects after all
+					go func() {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}()
+				}
+				return res.conn, nil
+			}
+			if res.primary {
+				primaryErr = res.err
+			} else {
+				fallbackErr = res.err
+			}
+			startFallback()
+			if pending == 0 {
+				if primaryErr != nil {
+					return nil, primaryErr
+				}
+				return nil, fallbackErr
+			}
+		}
+	}
+}
+
+// resolveBindAddr accepts an IP address or the name of a local interface, in
+// which case its first IPv4 address (or IPv6 if it has none) is used.
+func resolveBindAddr(s string) (net.IP, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		return ip, nil
+	}
+	iface, err := net.InterfaceByName(s)
+	if err != nil {
+		return nil, fmt.Errorf("bind address %q is neither an IP nor an interface", s)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("interface %s: %w", s, err)
+	}
+	var v6 net.IP
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return ipNet.IP, nil
+		}
+		if v6 == nil {
+			v6 = ipNet.IP
+		}
+	}
+	if v6 == nil {
+		return nil, fmt.Errorf("interface %s has no usable address", s)
+	}
+	return v6, nil
+}
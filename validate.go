@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// validationRule describes the checks applied to origin responses whose path
+// matches pattern, configured as PATTERN=CHECK[,CHECK...] where a check is one
+// of json, sniff, schema:FILE or reject.
+type validationRule struct {
+	pattern pathPattern
+	json    bool
+	sniff   bool
+	schema  map[string]any
+	// reject turns invalid responses into 502s instead of only skipping the cache.
+	reject bool
+}
+
+var validationRules []*validationRule
+
+func parseValidationRule(spec string) (*validationRule, error) {
+	pattern, checks, ok := strings.Cut(spec, "=")
+	if !ok || checks == "" {
+		return nil, fmt.Errorf("invalid validation rule %q (want PATTERN=CHECK[,CHECK...])", spec)
+	}
+	p, err := parsePathPattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	rule := &validationRule{pattern: p}
+	for _, check := range strings.Split(checks, ",") {
+		switch check = strings.TrimSpace(check); {
+		case check == "json":
+			rule.json = true
+		case check == "sniff":
+			rule.sniff = true
+		case check == "reject":
+			rule.reject = true
+		case strings.HasPrefix(check, "schema:"):
+			data, err := os.ReadFile(strings.TrimPrefix(check, "schema:"))
+			if err != nil {
+				return nil, fmt.Errorf("failed to read schema for %q: %w", pattern, err)
+			}
+			if err := json.Unmarshal(data, &rule.schema); err != nil {
+				return nil, fmt.Errorf("failed to parse schema for %q: %w", pattern, err)
+			}
+			rule.json = true
+		default:
+			return nil, fmt.Errorf("unknown validation check %q in rule %q", check, spec)
+		}
+	}
+	return rule, nil
+}
+
+func findValidationRule(urlPath string) *validationRule {
+	for _, rule := range validationRules {
+		if rule.pattern.match(urlPath) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// validate checks a fully read origin response body against the rule.
+func (v *validationRule) validate(resp *http.Response, body []byte) error {
+	if len(body) == 0 {
+		return nil
+	}
+	body, ok := identityBody(resp.Header, body)
+	if !ok {
+		// The stored body is in a coding the proxy can't read; there is nothing meaningful to inspect.
+		return nil
+	}
+
+	if v.sniff {
+		declared, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(body))
+		if !sniffCompatible(declared, sniffed) {
+			return fmt.Errorf("body looks like %s but Content-Type is %q", sniffed, declared)
+		}
+	}
+	if v.json {
+		var doc any
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return fmt.Errorf("body is not valid JSON: %w", err)
+		}
+		if v.schema != nil {
+			if err := validateSchema(v.schema, doc, "$"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sniffCompatible reports whether a sniffed media type is plausible for the
+// declared one. Content sniffing cannot tell textual formats apart, so any text
+// result is accepted for textual declared types.
+func sniffCompatible(declared, sniffed string) bool {
+	if declared == "" || sniffed == declared || sniffed == "application/octet-stream" {
+		return true
+	}
+	if strings.HasPrefix(sniffed, "text/") {
+		return isTextualMediaType(declared)
+	}
+	return false
+}
+
+func isTextualMediaType(mediaType string) bool {
+	if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml", "application/x-www-form-urlencoded":
+		return true
+	}
+	return false
+}
+
+// validateSchema implements the commonly used subset of JSON Schema: type,
+// enum, required, properties, additionalProperties, items, string/array length
+// bounds, numeric bounds and pattern.
+func validateSchema(schema map[string]any, v any, at string) error {
+	if t, ok := schema["type"]; ok && !matchesSchemaType(t, v) {
+		return fmt.Errorf("%s: expected type %v", at, t)
+	}
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			if fmt.Sprint(e) == fmt.Sprint(v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value %v not in enum", at, v)
+		}
+	}
+
+	switch val := v.(type) {
+	case map[string]any:
+		if required, ok := schema["required"].([]any); ok {
+			for _, r := range required {
+				if _, ok := val[fmt.Sprint(r)]; !ok {
+					return fmt.Errorf("%s: missing required property %q", at, r)
+				}
+			}
+		}
+		props, _ := schema["properties"].(map[string]any)
+		for k, child := range val {
+			if sub, ok := props[k].(map[string]any); ok {
+				if err := validateSchema(sub, child, at+"."+k); err != nil {
+					return err
+				}
+			} else if extra, ok := schema["additionalProperties"].(bool); ok && !extra {
+				return fmt.Errorf("%s: unexpected property %q", at, k)
+			}
+		}
+	case []any:
+		if err := checkBounds(schema, "minItems", "maxItems", float64(len(val)), at); err != nil {
+			return err
+		}
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range val {
+				if err := validateSchema(items, item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		if err := checkBounds(schema, "minLength", "maxLength", float64(len([]rune(val))), at); err != nil {
+			return err
+		}
+		if p, ok := schema["pattern"].(string); ok {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return fmt.Errorf("%s: invalid schema pattern %q: %w", at, p, err)
+			}
+			if !re.MatchString(val) {
+				return fmt.Errorf("%s: %q does not match pattern %q", at, val, p)
+			}
+		}
+	case float64:
+		if err := checkBounds(schema, "minimum", "maximum", val, at); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func matchesSchemaType(t any, v any) bool {
+	if types, ok := t.([]any); ok {
+		for _, t := range types {
+			if matchesSchemaType(t, v) {
+				return true
+			}
+		}
+		return false
+	}
+	switch t {
+	case "object":
+		_, ok := v.(map[string]any)
+		return ok
+	case "array":
+		_, ok := v.([]any)
+		return ok
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	case "integer":
+		f, ok := v.(float64)
+		return ok && f == float64(int64(f))
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "null":
+		return v == nil
+	}
+	return true
+}
+
+func checkBounds(schema map[string]any, minKey, maxKey string, n float64, at string) error {
+	if min, ok := schema[minKey].(float64); ok && n < min {
+		return fmt.Errorf("%s: %s is %v", at, minKey, min)
+	}
+	if max, ok := schema[maxKey].(float64); ok && n > max {
+		return fmt.Errorf("%s: %s is %v", at, maxKey, max)
+	}
+	return nil
+}
+
+// replaceWithBadGateway swaps an origin response for a 502 with a short
+// plain-text explanation.
+func replaceWithBadGateway(resp *http.Response, msg string) {
+	body := msg + "\n"
+	resp.StatusCode = http.StatusBadGateway
+	resp.Status = fmt.Sprintf("%d %s", http.StatusBadGateway, http.StatusText(http.StatusBadGateway))
+	resp.Header = http.Header{}
+	resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp.Header.Set("Content-Length", fmt.Sprint(len(body)))
+	resp.ContentLength = int64(len(body))
+	resp.Body = io.NopCloser(strings.NewReader(body))
+}
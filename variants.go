@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// acceptBucketTypes are the media types behind the bucket shorthands accepted
+// in --accept-variants; any other bucket is taken as a media type itself.
+var acceptBucketTypes = map[string][]string{
+	"json": {"application/json", "application/*+json"},
+	"xml":  {"application/xml", "text/xml", "application/*+xml"},
+	"html": {"text/html", "application/xhtml+xml"},
+	"text": {"text/plain"},
+}
+
+// acceptVariant is a representation a route can be cached in.
+type acceptVariant struct {
+	name  string
+	types []string // the first one is sent to the origin
+}
+
+// acceptVariants keys the entries of a route by the variant the client's
+// Accept header selects, so routes whose origin honors content negotiation
+// are cached per representation.
+type acceptVariants struct {
+	pattern  pathPattern
+	variants []acceptVariant // the first one is the default
+}
+
+var acceptVariantRules []acceptVariants
+
+// parseAcceptVariants parses PATTERN=BUCKET,..., e.g. "/api/*=json,xml".
+func parseAcceptVariants(spec string) (acceptVariants, error) {
+	pattern, list, ok := strings.Cut(spec, "=")
+	if !ok || list == "" {
+		return acceptVariants{}, fmt.Errorf("invalid accept variants %q (want PATTERN=BUCKET,...)", spec)
+	}
+	p, err := parsePathPattern(pattern)
+	if err != nil {
+		return acceptVariants{}, err
+	}
+	rule := acceptVariants{pattern: p}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		types, ok := acceptBucketTypes[name]
+		if !ok {
+			if !strings.Contains(name, "/") {
+				return acceptVariants{}, fmt.Errorf("accept variants %q: %q is neither a known bucket nor a media type", spec, name)
+			}
+			types = []string{name}
+		}
+		rule.variants = append(rule.variants, acceptVariant{name: name, types: types})
+	}
+	return rule, nil
+}
+
+func acceptVariantsFor(urlPath string) *acceptVariants {
+	for i := range acceptVariantRules {
+		if acceptVariantRules[i].pattern.match(urlPath) {
+			return &acceptVariantRules[i]
+		}
+	}
+	return nil
+}
+
+// mediaRangeMatches reports whether an Accept media range covers typ, which
+// may itself contain a "*+suffix" wildcard subtype.
+func mediaRangeMatches(rng, typ string) bool {
+	if rng == "*/*" || rng == typ {
+		return true
+	}
+	rMain, rSub, _ := strings.Cut(rng, "/")
+	tMain, tSub, _ := strings.Cut(typ, "/")
+	if rMain != tMain {
+		return false
+	}
+	if rSub == "*" {
+		return true
+	}
+	if suffix, ok := strings.CutPrefix(tSub, "*"); ok {
+		return strings.HasSuffix(rSub, suffix)
+	}
+	return false
+}
+
+// selectVariant picks the variant with the highest quality in accept; ties go
+// to the earlier variant, and requests without Accept get the default.
+func (a *acceptVariants) selectVariant(accept string) acceptVariant {
+	best, bestQ := a.variants[0], 0.0
+	if strings.TrimSpace(accept) == "" {
+		return best
+	}
+	for _, v := range a.variants {
+		q := 0.0
+		for _, part := range strings.Split(accept, ",") {
+			rng, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+			pq := 1.0
+			if s, ok := params["q"]; ok {
+				if pq, err = strconv.ParseFloat(s, 64); err != nil {
+					continue
+				}
+			}
+			for _, typ := range v.types {
+				if mediaRangeMatches(rng, typ) {
+					q = max(q, pq)
+				}
+			}
+		}
+		if q > bestQ {
+			best, bestQ = v, q
+		}
+	}
+	return best
+}
+
+// normalizeAccept replaces the Accept header of a request to a route with
+// variants by the selected variant's media type, so the origin returns exactly
+// the representation it is cached under.
+func normalizeAccept(r *http.Request) {
+	if a := acceptVariantsFor(r.URL.Path); a != nil {
+		r.Header.Set("Accept", a.selectVariant(r.Header.Get("Accept")).types[0])
+	}
+}
+
+// acceptKeySuffix keys requests to routes with variants by the selected one.
+func acceptKeySuffix(r *http.Request) string {
+	a := acceptVariantsFor(r.URL.Path)
+	if a == nil {
+		return ""
+	}
+	return "#accept=" + a.selectVariant(r.Header.Get("Accept")).name
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// varyIndex records, per cache key, the request headers the origin's last
+// response varied on. Entries for the key are then stored per variant, with
+// a digest of those header values appended as "#vary=". A key is dropped
+// from the index once none of its variants is cached. Guarded by
+// cacheMutex.
+var varyIndex = map[string]*varyInfo{}
+
+type varyInfo struct {
+	names    []string
+	variants int // cached
+}
+
+// parseVary returns the canonical, sorted header names of a Vary response
+// header; star reports "Vary: *", which no request can be matched against.
+func parseVary(h http.Header) (names []string, star bool) {
+	for _, line := range h.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			name = strings.TrimSpace(name)
+			switch {
+			case name == "*":
+				return nil, true
+			case name != "" && !slices.Contains(names, http.CanonicalHeaderKey(name)):
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	slices.Sort(names)
+	return names, false
+}
+
+// varyKeySuffix digests the request's values for the varying headers, with
+// whitespace around list separators removed so equivalent requests match.
+func varyKeySuffix(names []string, h http.Header) string {
+	sum := sha256.New()
+	for _, name := range names {
+		var parts []string
+		for _, v := range h.Values(name) {
+			for _, part := range strings.Split(v, ",") {
+				parts = append(parts, strings.Join(strings.Fields(part), " "))
+			}
+		}
+		sum.Write([]byte(name + ":" + strings.Join(parts, ",") + "\n"))
+	}
+	return "#vary=" + hex.EncodeToString(sum.Sum(nil)[:8])
+}
+
+// variantKey selects the variant of key a request maps to when responses for
+// key are known to vary.
+func variantKey(key string, r *http.Request) string {
+	cacheMutex.Lock()
+	info, ok := varyIndex[key]
+	cacheMutex.Unlock()
+	if !ok {
+		return key
+	}
+	return key + varyKeySuffix(info.names, r.Header)
+}
+
+// storageKey returns the key a response is stored under: the variant of the
+// request's base key for the client's request headers when the response
+// carries Vary. ok is false for "Vary: *" responses, which must not be
+// stored.
+func storageKey(key string, clientHeader http.Header, resp *http.Response) (string, bool) {
+	base, _, _ := strings.Cut(key, "#vary=")
+	names, star := parseVary(resp.Header)
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	if star {
+		return "", false
+	}
+	if len(names) == 0 {
+		delete(varyIndex, base)
+		return base, true
+	}
+	if info, ok := varyIndex[base]; ok {
+		info.names = names
+	} else {
+		varyIndex[base] = &varyInfo{names: names}
+	}
+	return base + varyKeySuffix(names, clientHeader), true
+}
+
+// variantAddedLocked and variantRemovedLocked count the cached variants of
+// each indexed key. Callers must hold cacheMutex.
+func variantAddedLocked(key string) {
+	if base, _, ok := strings.Cut(key, "#vary="); ok {
+		if info, ok := varyIndex[base]; ok {
+			info.variants++
+		}
+	}
+}
+
+func variantRemovedLocked(key string) {
+	if base, _, ok := strings.Cut(key, "#vary="); ok {
+		if info, ok := varyIndex[base]; ok {
+			if info.variants--; info.variants <= 0 {
+				delete(varyIndex, base)
+			}
+		}
+	}
+}
+
+// purgeVaryIndexLocked drops the index entries of the keys a purge matches,
+// including those whose variant was never stored. Callers must hold
+// cacheMutex.
+func purgeVaryIndexLocked(m purgeMatcher) {
+	for base := range varyIndex {
+		if m.match(base) {
+			delete(varyIndex, base)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"testing"
+)
+
+// Storing a Vary response again under the same variant, as refreshes and
+// revalidations do, must keep the URL's Vary index so the next request hits.
+func TestVaryReplacedVariantHits(t *testing.T) {
+	srv := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		io.WriteString(w, "hello "+r.Header.Get("Accept-Language"))
+	}))
+	get := func() string {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/x", nil)
+		req.Header.Set("Accept-Language", "en")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.Header.Get("X-Cache")
+	}
+	if got := get(); got != "MISS" {
+		t.Fatalf("first request X-Cache = %q, want MISS", got)
+	}
+
+	key := variantKey("GET:/x?", &http.Request{Header: http.Header{"Accept-Language": {"en"}}})
+	stored, ok := lookupEntry(key)
+	if !ok {
+		t.Fatalf("no entry under %q", key)
+	}
+	replaced := *stored
+	cacheMutex.Lock()
+	addEntryLocked(key, &replaced)
+	cacheMutex.Unlock()
+
+	if got := get(); got != "HIT" {
+		t.Errorf("X-Cache after replacing the variant = %q, want HIT", got)
+	}
+}
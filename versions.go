@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// keepVersions is how many superseded versions of each entry are retained.
+var keepVersions int
+
+// entryVersion is a response that was once served for a key.
+type entryVersion struct {
+	*CachedResponse
+	retired time.Time // when it was replaced or invalidated
+}
+
+// entryVersions holds the superseded versions of each key, oldest first. They
+// outlive purges so operators can see what was served before an incident, but
+// are dropped when the key is evicted for space and are not counted against
+// pool budgets. Guarded by cacheMutex.
+var entryVersions = map[string][]entryVersion{}
+
+// retireVersionLocked records c as a superseded version of key. Callers must
+// hold cacheMutex.
+func retireVersionLocked(key string, c *CachedResponse) {
+	if keepVersions == 0 {
+		return
+	}
+	versions := append(entryVersions[key], entryVersion{c, time.Now()})
+	if len(versions) > keepVersions {
+		versions = versions[len(versions)-keepVersions:]
+	}
+	entryVersions[key] = versions
+}
+
+// versionAsOf returns the version of key that was live at t, whether it is
+// the current entry or a superseded one.
+func versionAsOf(key string, t time.Time) (*CachedResponse, bool) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	versions := entryVersions[key]
+	if c, ok := cache[key]; ok {
+		versions = append(versions[:len(versions):len(versions)], entryVersion{CachedResponse: c})
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := versions[i]
+		if v.Timestamp.After(t) {
+			continue
+		}
+		if !v.retired.IsZero() && !v.retired.After(t) {
+			return nil, false // nothing was cached at t
+		}
+		return v.CachedResponse, true
+	}
+	return nil, false
+}
+
+// latestVersion returns the most recently superseded version of key, which can
+// be served stale when its origin cannot be asked for a fresh copy. A no-cache
+// version never is.
+func latestVersion(key string) (*CachedResponse, bool) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	versions := entryVersions[key]
+	if len(versions) == 0 {
+		return nil, false
+	}
+	c := versions[len(versions)-1].CachedResponse
+	if revalidateOnReuse(c) {
+		return nil, false
+	}
+	return c, true
+}
+
+// parseAsOf accepts an RFC 3339 timestamp or Unix seconds.
+func parseAsOf(s string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid X-Cache-As-Of %q (want RFC 3339 or Unix seconds)", s)
+	}
+	return t, nil
+}
+
+// serveAsOf answers a time-travel request with the version of key that was
+// live at the requested time. The origin is never contacted.
+func serveAsOf(w http.ResponseWriter, r *http.Request, key, asOf string) {
+	t, err := parseAsOf(asOf)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c, ok := versionAsOf(key, t)
+	if !ok {
+		log.Printf("[Versions] No version of cacheKey '%s' as of %s", key, t.Format(time.RFC3339))
+		http.Error(w, "No cached version as of "+t.Format(time.RFC3339), http.StatusNotFound)
+		return
+	}
+	log.Printf("[Versions] Serving cacheKey '%s' as of %s (stored %s)", key, t.Format(time.RFC3339), c.Timestamp.Format(time.RFC3339))
+	w.Header().Set("X-Cache-Stored-At", c.Timestamp.UTC().Format(time.RFC3339))
+	writeCached(w, r, key, c, "HIT")
+}
+
+// versionInfo describes one retained version of an entry.
+type versionInfo struct {
+	Version int `json:"version"`
+	entryInfo
+	Current bool       `json:"current,omitempty"`
+	Retired *time.Time `json:"retired,omitempty"`
+}
+
+// versionsLocked lists the superseded versions of key followed by the current
+// entry, if any. Callers must hold cacheMutex.
+func versionsLocked(key string) []versionInfo {
+	var list []versionInfo
+	for i, v := range entryVersions[key] {
+		retired := v.retired
+		list = append(list, versionInfo{Version: i + 1, entryInfo: newEntryInfo(key, v.CachedResponse), Retired: &retired})
+	}
+	if c, ok := cache[key]; ok {
+		list = append(list, versionInfo{Version: len(list) + 1, entryInfo: newEntryInfo(key, c), Current: true})
+	}
+	return list
+}
+
+// versionsHandler lists the retained versions of the entry named by the key
+// query parameter, oldest first.
+func versionsHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	cacheMutex.Lock()
+	list := versionsLocked(key)
+	cacheMutex.Unlock()
+	if len(list) == 0 {
+		http.Error(w, "no such entry", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// rollbackHandler re-activates a superseded version of an entry, by default
+// the most recent one. The restored copy is stored like a fresh response, so
+// it survives earlier purges, and the entry it replaces is retained in turn.
+func rollbackHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	key := q.Get("key")
+
+	cacheMutex.Lock()
+	versions := entryVersions[key]
+	n := len(versions)
+	if s := q.Get("version"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 1 || n > len(versions) {
+			cacheMutex.Unlock()
+			http.Error(w, "no such version", http.StatusNotFound)
+			return
+		}
+	}
+	if n == 0 {
+		cacheMutex.Unlock()
+		http.Error(w, "no previous version", http.StatusNotFound)
+		return
+	}
+	restored := *versions[n-1].CachedResponse
+	cacheMutex.Unlock()
+
+	stored := restored.Timestamp
+	restored.Timestamp = time.Now()
+	storeEntry(key, &restored)
+	log.Printf("[Versions] Rolled back cacheKey '%s' to version %d (stored %s)", key, n, stored.Format(time.RFC3339))
+	writeJSON(w, http.StatusOK, newEntryInfo(key, &restored))
+}
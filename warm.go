@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// warmConfig controls the warm-up crawler. Seeds are fetched through the
+// proxy; HTML pages among them are scanned for same-origin links, which are
+// fetched in turn up to depth levels away.
+type warmConfig struct {
+	seeds       []string
+	depth       int
+	concurrency int
+	robots      bool
+}
+
+var warming = warmConfig{concurrency: 4}
+
+// htmlLinkPattern finds href and src attribute values. It is deliberately
+// loose: a missed link only means one page less warmed.
+var htmlLinkPattern = regexp.MustCompile(`(?i)\b(?:href|src)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+
+type warmResult struct {
+	Fetched int     `json:"fetched"`
+	Cached  int     `json:"cached"`
+	Skipped int     `json:"skipped_by_robots"`
+	Depth   int     `json:"depth"`
+	Seconds float64 `json:"seconds"`
+}
+
+// crawl warms the cache breadth-first from cfg.seeds.
+func crawl(h http.Handler, cfg warmConfig) warmResult {
+	start := time.Now()
+	var result warmResult
+	var mu sync.Mutex
+	visited := map[string]bool{}
+	rules := map[string]*robotsRules{}
+
+	var level []*url.URL
+	for _, seed := range cfg.seeds {
+		if u, err := url.Parse(seed); err == nil {
+			level = append(level, u)
+		}
+	}
+	for depth := 0; len(level) > 0 && depth <= cfg.depth; depth++ {
+		var next []*url.URL
+		sem := make(chan struct{}, max(cfg.concurrency, 1))
+		var wg sync.WaitGroup
+		for _, u := range level {
+			u.Fragment = ""
+			id := u.Host + u.RequestURI()
+			if visited[id] {
+				continue
+			}
+			visited[id] = true
+			if cfg.robots {
+				r, ok := rules[u.Host]
+				if !ok {
+					r = fetchRobots(h, u)
+					rules[u.Host] = r
+				}
+				if !r.allowed(u.Path) {
+					result.Skipped++
+					continue
+				}
+			}
+
+			wg.Add(1)
+			sem <- struct{}{}
+			go func() {
+				defer func() { <-sem; wg.Done() }()
+				c := warmFetch(h, u)
+				mu.Lock()
+				defer mu.Unlock()
+				result.Fetched++
+				if c == nil {
+					return
+				}
+				result.Cached++
+				if depth < cfg.depth {
+					next = append(next, htmlLinks(u, c)...)
+				}
+			}()
+		}
+		wg.Wait()
+		result.Depth = depth
+		level = next
+	}
+	result.Seconds = time.Since(start).Seconds()
+	return result
+}
+
+// warmFetch sends a GET for u through the proxy and returns the entry it left
+// in the cache, if any.
+func warmFetch(h http.Handler, u *url.URL) *CachedResponse {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, u.RequestURI(), nil)
+	if err != nil {
+		return nil
+	}
+	req.Host = u.Host
+	req.RemoteAddr = "127.0.0.1:0"
+	req.Header.Set("Accept", "text/html,*/*;q=0.8")
+	backgroundFetch(h, req)
+	c, _ := lookupEntry(variantKey(generateCacheKey(req), req))
+	return c
+}
+
+// htmlLinks extracts the same-origin links of a cached HTML page.
+func htmlLinks(page *url.URL, c *CachedResponse) []*url.URL {
+	mediaType, _, _ := mime.ParseMediaType(c.Headers.Get("Content-Type"))
+	body, ok := identityBody(c.Headers, c.Response)
+	if mediaType != "text/html" || !ok {
+		return nil
+	}
+	var links []*url.URL
+	for _, m := range htmlLinkPattern.FindAllSubmatch(body, -1) {
+		ref := string(m[1]) + string(m[2])
+		target, err := page.Parse(strings.TrimSpace(ref))
+		if err != nil || (target.Scheme != "" && target.Scheme != "http" && target.Scheme != "https") {
+			continue
+		}
+		if target.Host != page.Host {
+			continue
+		}
+		links = append(links, target)
+	}
+	return links
+}
+
+// robotsRules holds the Allow and Disallow prefixes that apply to us from a
+// robots.txt file.
+type robotsRules struct {
+	allow, disallow []string
+}
+
+// fetchRobots loads robots.txt for u's host through the proxy and keeps the
+// group for "caching-proxy", or "*" when there is none.
+func fetchRobots(h http.Handler, u *url.URL) *robotsRules {
+	c := warmFetch(h, &url.URL{Host: u.Host, Path: "/robots.txt"})
+	if c == nil || c.StatusCode != http.StatusOK {
+		return &robotsRules{}
+	}
+	groups := map[string]*robotsRules{}
+	var agents []string
+	inRules := false
+	scanner := bufio.NewScanner(bytes.NewReader(c.Response))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		field, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		field, value = strings.ToLower(strings.TrimSpace(field)), strings.TrimSpace(value)
+		switch field {
+		case "user-agent":
+			if inRules {
+				agents, inRules = nil, false
+			}
+			agents = append(agents, strings.ToLower(value))
+		case "allow", "disallow":
+			inRules = true
+			for _, agent := range agents {
+				g := groups[agent]
+				if g == nil {
+					g = &robotsRules{}
+					groups[agent] = g
+				}
+				if field == "allow" {
+					g.allow = append(g.allow, value)
+				} else if value != "" {
+					g.disallow = append(g.disallow, value)
+				}
+			}
+		}
+	}
+	if g := groups[viaPseudonym]; g != nil {
+		return g
+	}
+	if g := groups["*"]; g != nil {
+		return g
+	}
+	return &robotsRules{}
+}
+
+// allowed applies the longest matching rule, Allow winning ties.
+func (r *robotsRules) allowed(path string) bool {
+	longest := func(prefixes []string) int {
+		n := -1
+		for _, p := range prefixes {
+			if strings.HasPrefix(path, p) && len(p) > n {
+				n = len(p)
+			}
+		}
+		return n
+	}
+	return longest(r.allow) >= longest(r.disallow)
+}
+
+// runWarmup crawls the configured seeds once at startup.
+func runWarmup(h http.Handler, cfg warmConfig) {
+	log.Printf("[Warm] Crawling %d seed URLs to depth %d with %d workers", len(cfg.seeds), cfg.depth, cfg.concurrency)
+	res := crawl(h, cfg)
+	log.Printf("[Warm] Fetched %d URLs, %d now cached, %d skipped by robots.txt, in %.1fs", res.Fetched, res.Cached, res.Skipped, res.Seconds)
+}
+
+// warmHandler runs a crawl on demand. The body may override the seeds, depth,
+// concurrency and robots setting of the startup configuration.
+func warmHandler(proxyHandler http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body := struct {
+			URLs        []string `json:"urls"`
+			Depth       *int     `json:"depth"`
+			Concurrency *int     `json:"concurrency"`
+			Robots      *bool    `json:"robots"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		cfg := warming
+		if len(body.URLs) > 0 {
+			cfg.seeds = body.URLs
+		}
+		if body.Depth != nil {
+			cfg.depth = *body.Depth
+		}
+		if body.Concurrency != nil {
+			cfg.concurrency = *body.Concurrency
+		}
+		if body.Robots != nil {
+			cfg.robots = *body.Robots
+		}
+		if len(cfg.seeds) == 0 {
+			http.Error(w, "no URLs to warm", http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, crawl(proxyHandler, cfg))
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// storeQueueSize bounds the writes a shared store keeps queued; storeBatchSize
+// is how many of them it applies at a time.
+var storeQueueSize = 1024
+
+const storeBatchSize = 64
+
+// writeQueue is the write-behind queue of a persistent store. Writes are
+// queued without waiting and applied in order by one goroutine, in batches.
+// A write replaces any still queued write of the same key. Once max keys are
+// waiting, further writes are dropped and counted rather than holding up the
+// request that made them, unless max is 0.
+type writeQueue[T any] struct {
+	max   int
+	apply func([]T)
+	// applying is held while batches are applied, so a flush never
+	// overlaps the queue's own goroutine and writes stay in order.
+	applying sync.Mutex
+
+	mu      sync.Mutex
+	pending map[string]T
+	order   []string
+	wake    chan struct{}
+	dropped atomic.Int64
+}
+
+// newWriteQueue starts a queue that hands batches of writes to apply.
+func newWriteQueue[T any](max int, apply func([]T)) *writeQueue[T] {
+	q := &writeQueue[T]{max: max, apply: apply, pending: map[string]T{}, wake: make(chan struct{}, 1)}
+	go q.run()
+	return q
+}
+
+// add queues op under key and reports whether it fit.
+func (q *writeQueue[T]) add(key string, op T) bool {
+	q.mu.Lock()
+	if _, ok := q.pending[key]; !ok {
+		if q.max > 0 && len(q.pending) >= q.max {
+			q.mu.Unlock()
+			q.dropped.Add(1)
+			return false
+		}
+		q.order = append(q.order, key)
+	}
+	q.pending[key] = op
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// depth returns how many writes are waiting.
+func (q *writeQueue[T]) depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+func (q *writeQueue[T]) run() {
+	for range q.wake {
+		q.flush()
+	}
+}
+
+// flush applies the queued writes and returns once they, and any batch the
+// queue's goroutine was applying, are done.
+func (q *writeQueue[T]) flush() {
+	q.applying.Lock()
+	defer q.applying.Unlock()
+	for batch := q.next(); len(batch) > 0; batch = q.next() {
+		q.apply(batch)
+	}
+}
+
+// next takes up to storeBatchSize of the oldest queued writes.
+func (q *writeQueue[T]) next() []T {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var batch []T
+	for len(q.order) > 0 && len(batch) < storeBatchSize {
+		key := q.order[0]
+		q.order = q.order[1:]
+		batch = append(batch, q.pending[key])
+		delete(q.pending, key)
+	}
+	return batch
+}